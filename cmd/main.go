@@ -1,27 +1,23 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"flag"
+	"log"
 	"mylsmtree/pkg"
 	"mylsmtree/pkg/config"
 	"os"
 )
 
 func main() {
-	defer func() {
-		r := recover()
-		if r != nil {
-			fmt.Println(r)
-			inputReader := bufio.NewReader(os.Stdin)
-			_, _ = inputReader.ReadString('\n')
-		}
-	}()
-	pkg.StartServer(config.Config{
-		DataDir:       `/Users/xudong/GolandProjects/mylsmtree/data`,
-		Level0Size:    100,
-		PartSize:      4,
-		Threshold:     3000,
-		CheckInterval: 3,
-	})
-}
\ No newline at end of file
+	opts, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = pkg.StartServer(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,183 +1,578 @@
 package pkg
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/raft"
+	"io/ioutil"
 	"log"
 	"mylsmtree/pkg/config"
-	"mylsmtree/pkg/lsm"
+	"mylsmtree/pkg/kv"
 	"mylsmtree/pkg/myraft"
 	"mylsmtree/pkg/sort_tree"
 	"mylsmtree/pkg/wal"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"sync/atomic"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
 type AppConfig struct{}
 
-func Check() {
-	con := config.GetConfig()
-	ticker := time.Tick(time.Duration(con.CheckInterval) * time.Second)
-	for _ = range ticker {
-		log.Println("Performing background checks...")
-		// 检查内存
-		checkMemory()
-		// 检查压缩数据库文件
-		database.TableTree.Check()
+// backgroundLoop 后台线程，定时或被唤醒时执行落盘、压缩和 value log 回收，数据库关闭时退出。
+// 后台任务失败后数据库进入只读模式，不再执行后台任务，直到 Resume 成功
+func (d *DB) backgroundLoop() {
+	defer d.bgDone.Done()
+	ticker := time.NewTicker(time.Duration(d.con.CheckInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.bgCh:
+		case <-d.closeCh:
+			return
+		}
+		if d.BackgroundError() != nil {
+			continue
+		}
+		d.setBackgroundError(d.check())
 	}
 }
 
-func checkMemory() {
-	con := config.GetConfig()
-	count := database.MemoryTree.GetCount()
-	if count < con.Threshold {
-		return
+// check 执行一次后台检查，返回第一个失败的任务的错误
+func (d *DB) check() error {
+	log.Println("Performing background checks...")
+	// 检查内存
+	err := d.checkMemory()
+	// 将只读内存表落盘
+	if err == nil {
+		err = d.flushImmutables()
+	}
+	// 检查压缩数据库文件
+	if err == nil {
+		err = d.compactFamilies()
+	}
+	// 回收 value log
+	if err == nil {
+		err = d.valueLogGC()
+	}
+	// 更新统计信息，唤醒被阻塞的写入
+	d.updateStallMetrics()
+	d.wakeStalledWrites()
+	return err
+}
+
+// wakeStalledWrites 唤醒被阻塞的写入，让它们重新检查是否需要限流
+func (d *DB) wakeStalledWrites() {
+	d.stallCond.L.Lock()
+	d.stallCond.Broadcast()
+	d.stallCond.L.Unlock()
+}
+
+func (d *DB) checkMemory() error {
+	if !d.memoryTreeFull() {
+		return nil
+	}
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	return d.switchMemoryTree()
+}
+
+// memoryTreeFull 是否有列族的内存表达到了列族的 Threshold
+func (d *DB) memoryTreeFull() bool {
+	for _, cf := range d.getFamilies() {
+		if cf.MemoryTree.GetCount() >= cf.con.Threshold {
+			return true
+		}
 	}
+	return false
+}
+
+// switchMemoryTree 将所有列族的当前内存表一起转为只读内存表，由后台线程落盘，调用方需要持有 writeLock。
+// 所有列族共用一个 wal，切换时一起切换，归档文件在所有列族都落盘后删除
+func (d *DB) switchMemoryTree() error {
+	return d.rotateMemoryTree(false)
+}
+
+// rotateMemoryTree 切换 wal 和内存表，所有内存表都为空时 force 为 false 则不切换，调用方需要持有 writeLock。
+// 先切换 wal，切换失败时内存表保持不变
+func (d *DB) rotateMemoryTree(force bool) error {
 	// 交互内存
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	empty := true
+	for _, cf := range d.families {
+		if cf.MemoryTree.GetCount() > 0 {
+			empty = false
+		}
+	}
+	if empty && !force {
+		return nil
+	}
 	log.Println("Compressing memory")
-	tmpTree := database.MemoryTree.Swap()
+	walPath, err := d.Wal.Rotate()
+	if walPath == "" && err != nil {
+		return err
+	}
+	// 归档成功但没能创建新的 wal.log 时，内存表中的数据已经在归档文件中，仍然切换
+	trees := make(map[string]*sort_tree.Tree)
+	for name, cf := range d.families {
+		if cf.MemoryTree.GetCount() > 0 {
+			trees[name] = cf.MemoryTree.Swap()
+		}
+	}
+	d.Immutables = append(d.Immutables, &Immutable{
+		Trees:     trees,
+		WalPath:   walPath,
+		RaftIndex: d.appliedIndex,
+	})
+	return err
+}
+
+// flushImmutables 将只读内存表按从旧到新的顺序存储到 SsTable 中，
+// 失败时只读内存表和 wal 归档保留，下次落盘时重新写入（已经写入的列族会多一个内容相同的 SSTable）
+func (d *DB) flushImmutables() error {
+	d.flushLock.Lock()
+	defer d.flushLock.Unlock()
+	for {
+		immutables := d.getImmutables()
+		if len(immutables) == 0 {
+			return nil
+		}
+		immutable := immutables[0]
+		for name, tree := range immutable.Trees {
+			cf, ok := d.getFamily(name)
+			if !ok {
+				log.Println("Skip flushing dropped column family", name)
+				continue
+			}
+			if err := cf.TableTree.CreateNewTable(tree.GetValues(), tree.GetRangeTombstones()); err != nil {
+				return err
+			}
+		}
+		// 删除 wal 归档前记录已经落盘的 raft 日志编号，重启后回放的 raft 日志不会重复写入
+		if immutable.RaftIndex > 0 {
+			if err := writeAppliedIndex(d.dir, immutable.RaftIndex); err != nil {
+				return err
+			}
+		}
 
-	// 将内存表存储到 SsTable 中
-	database.TableTree.CreateNewTable(tmpTree.GetValues())
-	database.Wal.Reset()
+		d.lock.Lock()
+		d.Immutables = d.Immutables[1:]
+		d.lock.Unlock()
+		if immutable.WalPath != "" {
+			if err := d.Wal.Remove(immutable.WalPath); err != nil {
+				return err
+			}
+		}
+	}
 }
 
-// 初始化 Database，从磁盘文件中还原 SSTable、WalF、内存表等
-func initDatabase(dir string) {
-	database = &Database{
-		MemoryTree: &sort_tree.Tree{},
-		Wal:        &wal.Wal{},
-		TableTree:  &lsm.TableTree{},
+// newDB 创建还没有加载数据的数据库
+func newDB(options Options) *DB {
+	return &DB{
+		dir:              options.DataDir,
+		con:              options.Config,
+		mergeOperator:    options.MergeOperator,
+		prefixExtractor:  options.PrefixExtractor,
+		compactionFilter: options.CompactionFilter,
+		families:         make(map[string]*ColumnFamily),
+		familyLock:       &sync.Mutex{},
+		Wal:              &wal.Wal{Sync: options.WALSync},
+		lock:             &sync.RWMutex{},
+		writeLock:        &sync.Mutex{},
+		flushLock:        &sync.Mutex{},
+		bgCh:             make(chan struct{}, 1),
+		stallCond:        sync.NewCond(&sync.Mutex{}),
+		snapshots:        make(map[uint64]int),
+		snapshotLock:     &sync.Mutex{},
+		scanCursors:      make(map[uint64]*scanCursor),
+		scanCursorLock:   &sync.Mutex{},
+		watchers:         make(map[*Watcher]struct{}),
+		watchLock:        &sync.Mutex{},
+		bgErrLock:        &sync.Mutex{},
+		closeCh:          make(chan struct{}),
+		bgDone:           &sync.WaitGroup{},
 	}
+}
+
+// load 从磁盘文件中还原 SSTable、WalF、内存表等
+func (d *DB) load() error {
+	dir := d.dir
 	// 从磁盘文件中恢复数据
 	// 如果目录不存在，则为空数据库
 	if _, err := os.Stat(dir); err != nil {
 		log.Printf("The %s directory does not exist. The directory is being created\r\n", dir)
-		err := os.Mkdir(dir, 0666)
-		if err != nil {
-			log.Println("Failed to create the database directory")
-			panic(err)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return kv.IOError("mkdir", dir, err)
 		}
 	}
 	// 从数据目录中，加载 WalF、database 文件
 	// 非空数据库，则开始恢复数据，加载 WalF 和 SSTable 文件
-	memoryTree := database.Wal.Init(dir)
+	memoryTrees, err := d.Wal.Init(dir)
+	if err != nil {
+		return err
+	}
 
-	database.MemoryTree = memoryTree
+	// 上次退出时还没有落盘的只读内存表
+	appliedIndex := readAppliedIndex(dir)
+	for _, walPath := range d.Wal.Archives() {
+		trees, raftIndex, err := d.Wal.Load(walPath)
+		if err != nil {
+			return err
+		}
+		if raftIndex > appliedIndex {
+			appliedIndex = raftIndex
+		}
+		d.Immutables = append(d.Immutables, &Immutable{
+			Trees:     trees,
+			WalPath:   walPath,
+			RaftIndex: appliedIndex,
+		})
+	}
+	if raftIndex := d.Wal.GetRaftIndex(); raftIndex > appliedIndex {
+		appliedIndex = raftIndex
+	}
+	if index, ok := readIndexFile(dir, restoreMarkerFile); ok {
+		log.Println("Raft snapshot", index, "was not fully restored, it will be restored again")
+		appliedIndex = 0
+	}
+	d.appliedIndex = appliedIndex
 	log.Println("Loading database...")
-	database.TableTree.Init(dir)
-}
-
-var (
-	httpAddr    string
-	raftAddr    string
-	raftId      string
-	raftCluster string
-	raftDir     string
-)
-
-var (
-	isLeader int64
-)
+	d.ColumnFamily, err = d.openColumnFamily(wal.DefaultFamily, dir, config.FamilyConfig{}, memoryTrees.Get(wal.DefaultFamily))
+	if err != nil {
+		return err
+	}
+	d.families[wal.DefaultFamily] = d.ColumnFamily
+	familyOptions, err := loadFamilyOptions(dir)
+	if err != nil {
+		return err
+	}
+	for name, options := range familyOptions {
+		if d.families[name], err = d.openColumnFamily(name, familyPath(dir, name), options, memoryTrees.Get(name)); err != nil {
+			return err
+		}
+	}
+	for name := range memoryTrees {
+		if _, ok := d.families[name]; !ok {
+			log.Println("Skip wal records of dropped column family", name)
+		}
+	}
 
-func init() {
-	flag.StringVar(&httpAddr, "http_addr", "127.0.0.1:7001", "http listen addr")
-	flag.StringVar(&raftAddr, "raft_addr", "127.0.0.1:7000", "raft listen addr")
-	flag.StringVar(&raftId, "raft_id", "1", "raft id")
-	flag.StringVar(&raftCluster, "raft_cluster", "1/127.0.0.1:7000", "cluster info")
+	// 从 wal 和 SSTable 中恢复序列号
+	var lastSeq uint64
+	for _, cf := range d.families {
+		if seq := cf.TableTree.GetMaxSeq(); seq > lastSeq {
+			lastSeq = seq
+		}
+		if seq := cf.MemoryTree.GetMaxSeq(); seq > lastSeq {
+			lastSeq = seq
+		}
+	}
+	for _, immutable := range d.Immutables {
+		for _, tree := range immutable.Trees {
+			if seq := tree.GetMaxSeq(); seq > lastSeq {
+				lastSeq = seq
+			}
+		}
+	}
+	d.lastSeq = lastSeq
+	d.publishSeq(lastSeq)
+	return nil
 }
 
-// Start 启动
-func StartServer(con config.Config) {
+// StartServer 用 opts 打开数据库并启动 raft 节点和 http 服务，直到收到 SIGINT 或 SIGTERM 或 http 服务出错。
+// 退出时依次停止接受请求并等待进行中的请求完成、按设置转移 leader、关闭 raft 节点，
+// 再停止后台线程、将内存表落盘（或只同步 wal）并关闭所有文件。
+// 设置不合法、打开数据库或启动失败时返回错误。opts 通常由 config.Load 从配置文件、环境变量和命令行参数加载
+func StartServer(opts config.Options) (err error) {
 	if database != nil {
-		return
+		return nil
 	}
-	// 将配置保存到内存中
-	log.Println("Loading a Configuration File")
+	if err = opts.Validate(); err != nil {
+		return err
+	}
+	log.Print("Options:\n", opts)
+	con := opts.Config()
 	config.Init(con)
 	// 初始化数据库
 	log.Println("Initializing the database")
-	initDatabase(con.DataDir)
-
-	// 数据库启动前进行一次数据压缩
-	log.Println("Performing background checks...")
-	// 检查内存
-	checkMemory()
-	// 检查压缩数据库文件
-	database.TableTree.Check()
-	// 启动后台线程
-	go Check()
-
-	flag.Parse()
-	if httpAddr == "" || raftAddr == "" || raftId == "" || raftCluster == "" {
-		fmt.Println("config error")
-		os.Exit(1)
-		return
+	db, err := Open(con.DataDir, &Options{
+		Config:           con,
+		MergeOperator:    mergeOperator,
+		PrefixExtractor:  prefixExtractor,
+		CompactionFilter: compactionFilter,
+	})
+	if err != nil {
+		return err
 	}
+	database = db
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			log.Println("failure to close the database", closeErr)
+			if err == nil {
+				err = closeErr
+			}
+		}
+		database = nil
+		log.Println("Database closed")
+	}()
 
-	raftDir := "node/raft_" + raftId
-	os.MkdirAll(raftDir, 0700)
+	raftDir := opts.RaftDir()
+	if err = os.MkdirAll(raftDir, 0700); err != nil {
+		return err
+	}
 
 	// 初始化raft
-	myRaft, fm, err := myraft.NewMyRaft(raftAddr, raftId, raftDir)
+	myRaft, fm, err := myraft.NewMyRaft(opts.Raft.Addr, opts.Raft.ID, raftDir, raftEngine{db: db})
 	if err != nil {
-		fmt.Println("NewMyRaft error ", err)
-		os.Exit(1)
-		return
+		return fmt.Errorf("NewMyRaft error: %w", err)
 	}
 
 	// 启动raft
-	myraft.Bootstrap(myRaft, raftId, raftAddr, raftCluster)
+	myraft.Bootstrap(myRaft, opts.Raft.ID, opts.Raft.Addr, opts.Raft.Cluster)
+	db.raft = myRaft
+
+	// 启动http server
+	httpServer := HttpServer{
+		ctx:          myRaft,
+		fsm:          fm,
+		db:           db,
+		maxBodyBytes: opts.HTTP.MaxBodyBytes,
+		httpAddrs:    opts.HTTPAddrs(),
+	}
 
-	// 监听leader变化（使用此方法无法保证强一致性读，仅做leader变化过程观察）
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set", httpServer.Set)
+	mux.HandleFunc("/get", httpServer.Get)
+	mux.HandleFunc("/batch", httpServer.Batch)
+	mux.HandleFunc("/merge", httpServer.Merge)
+	mux.HandleFunc("/cas", httpServer.CompareAndSwap)
+	mux.HandleFunc("/put_if_absent", httpServer.PutIfAbsent)
+	mux.HandleFunc("/delete_if_equals", httpServer.DeleteIfEquals)
+	mux.HandleFunc("/scan", httpServer.Scan)
+	mux.HandleFunc("/metrics", httpServer.Metrics)
+	mux.HandleFunc("/admin/compact", httpServer.CompactRange)
+	mux.HandleFunc("/admin/cf/create", httpServer.CreateColumnFamily)
+	mux.HandleFunc("/admin/cf/drop", httpServer.DropColumnFamily)
+	mux.HandleFunc("/admin/cf/list", httpServer.ListColumnFamilies)
+	mux.HandleFunc("/admin/resume", httpServer.Resume)
+	mux.HandleFunc("/admin/remove_server", httpServer.RemoveServer)
+	mux.HandleFunc(restPrefix, httpServer.KV)
+	mux.HandleFunc("/v1/batch", httpServer.RestBatch)
+	mux.HandleFunc("/v1/scan", httpServer.RestScan)
+	server := &http.Server{
+		Addr:         opts.HTTP.Addr,
+		Handler:      mux,
+		ReadTimeout:  opts.HTTP.ReadTimeout,
+		WriteTimeout: opts.HTTP.WriteTimeout,
+	}
+	serveErr := make(chan error, 2)
 	go func() {
-		for leader := range myRaft.LeaderCh() {
-			if leader {
-				atomic.StoreInt64(&isLeader, 1)
-			} else {
-				atomic.StoreInt64(&isLeader, 0)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	// 配置了地址时同时启动 grpc server，和 http server 共用数据库和 raft 节点
+	var grpcServer *GrpcServer
+	var rpcServer *grpc.Server
+	if opts.GRPC.Addr != "" {
+		listener, listenErr := net.Listen("tcp", opts.GRPC.Addr)
+		if listenErr != nil {
+			_ = server.Close()
+			_ = myRaft.Shutdown().Error()
+			return fmt.Errorf("grpc listen error: %w", listenErr)
+		}
+		grpcServer = newGrpcServer(myRaft, db, opts.Raft.ID, opts.GRPCAddrs())
+		rpcServer = grpcServer.register()
+		go func() {
+			serveErr <- rpcServer.Serve(listener)
+		}()
+		log.Println("grpc server listening on", opts.GRPC.Addr)
+	}
+
+	// 收到 SIGINT 或 SIGTERM 后退出，退出过程中再收到信号时直接结束进程
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err = <-serveErr:
+		log.Println("server stopped", err)
+		_ = server.Close()
+		if rpcServer != nil {
+			rpcServer.Stop()
+		}
+	case <-signals.Done():
+		stop()
+		log.Println("Shutting down")
+		// grpc server 和 http server 同时排空
+		grpcStopped := make(chan struct{})
+		go func() {
+			if grpcServer != nil {
+				grpcServer.stop(rpcServer, opts.Shutdown.Timeout)
 			}
+			close(grpcStopped)
+		}()
+		err = shutdownServer(server, opts.Shutdown)
+		<-grpcStopped
+	}
+
+	// 关闭raft，之后不再有日志写入数据库，再由 defer 关闭数据库
+	if opts.Shutdown.TransferLeadership && db.isLeader() {
+		log.Println("Transferring raft leadership")
+		if transferErr := myRaft.LeadershipTransfer().Error(); transferErr != nil {
+			log.Println("failure to transfer raft leadership", transferErr)
 		}
-	}()
+	}
+	if opts.Shutdown.Leave {
+		log.Println("Leaving the raft cluster")
+		if leaveErr := leaveCluster(myRaft, opts.Raft.ID, opts.HTTPAddrs(), opts.Shutdown.Timeout); leaveErr != nil {
+			log.Println("failure to leave the raft cluster", leaveErr)
+		}
+	}
+	if shutdownErr := myRaft.Shutdown().Error(); shutdownErr != nil {
+		log.Println("failure to shut down raft", shutdownErr)
+	}
+	return err
+}
 
-	// 启动http server
-	httpServer := HttpServer{
-		ctx: myRaft,
-		fsm: fm,
+// leaveCluster 把节点 id 从 raft 集群中移除。leader 直接提交配置变更，之后不再是 leader；
+// follower 通过 /admin/remove_server 请 leader 移除自己，leader 的 http 地址来自 httpAddrs。
+// 集群中只剩这一个节点时不移除，timeout 为 0 表示不限制等待时间
+func leaveCluster(r *raft.Raft, id string, httpAddrs map[string]string, timeout time.Duration) error {
+	future := r.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	servers := future.Configuration().Servers
+	if len(servers) == 1 && string(servers[0].ID) == id {
+		return errors.New("the only server of the cluster can not leave")
+	}
+	if r.State() == raft.Leader {
+		return r.RemoveServer(raft.ServerID(id), 0, timeout).Error()
 	}
 
-	http.HandleFunc("/set", httpServer.Set)
-	http.HandleFunc("/get", httpServer.Get)
-	http.ListenAndServe(httpAddr, nil)
+	_, leaderID := r.LeaderWithID()
+	if leaderID == "" {
+		return errors.New("no leader")
+	}
+	addr := httpAddrs[string(leaderID)]
+	if addr == "" {
+		return fmt.Errorf("http addr of leader %s is not configured in raft.cluster", leaderID)
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	target := fmt.Sprintf("http://%s/admin/remove_server?id=%s", addr, url.QueryEscape(id))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader %s: %s %s", leaderID, response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
 
-	// 关闭raft
-	shutdownFuture := myRaft.Shutdown()
-	if err := shutdownFuture.Error(); err != nil {
-		fmt.Printf("shutdown raft error:%v \n", err)
+// RemoveServer 从 raft 集群中移除节点 id，只能发给 leader，退出的 follower 通过它离开集群
+func (h HttpServer) RemoveServer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeRestError(w, http.StatusBadRequest, "id is required")
+		return
 	}
-	// 退出http server
-	fmt.Println("shutdown kv http server")
+	if err := h.ctx.RemoveServer(raft.ServerID(id), 0, 0).Error(); err != nil {
+		h.writeRaftErr(w, err)
+		return
+	}
+	writeRestJSON(w, http.StatusOK, struct{}{})
+}
 
+// shutdownServer 停止接受新的请求，等待进行中的请求完成，超过 opts.Timeout 时断开剩下的连接，
+// 断开连接会取消请求的 context，正在进行的遍历和压缩随之停止
+func shutdownServer(server *http.Server, opts config.ShutdownOptions) error {
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	err := server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		log.Println("Closing http connections after", opts.Timeout)
+		return server.Close()
+	}
+	return err
 }
 
 
 type HttpServer struct {
 	ctx *raft.Raft
 	fsm *myraft.Fsm
+	// 接口读写的数据库
+	db *DB
+	// /v1 接口请求体的最大字节数，0 表示不限制
+	maxBodyBytes int64
+	// 节点的 raft id 到 http 地址，不是 leader 时告诉客户端 leader 的 http 地址
+	httpAddrs map[string]string
 }
 
 func (h HttpServer) Set(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt64(&isLeader) == 0 {
+	if !h.db.isLeader() {
 		fmt.Fprintf(w, "not leader")
 		return
 	}
+	cf, ok := h.requestFamily(w, r)
+	if !ok {
+		return
+	}
 	vars := r.URL.Query()
 	key := vars.Get("key")
 	value := vars.Get("value")
-	flag := Set(key, value)
+	ttl, err := parseTTL(vars.Get("ttl"))
+	if err != nil {
+		http.Error(w, "invalid ttl", http.StatusBadRequest)
+		return
+	}
+	batch := NewWriteBatch()
+	if raw, _ := strconv.ParseBool(vars.Get("raw")); raw {
+		// 值原样保存，POST 时使用请求体，可以写入二进制的值
+		data := []byte(value)
+		if r.Method == http.MethodPost {
+			if data, err = ioutil.ReadAll(r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		batch.PutBytesCF(cf, []byte(key), data)
+	} else {
+		batch.PutCF(cf, key, value)
+	}
+	if batch.Len() > 0 {
+		batch.ops[0].ExpiresAt = expiresAt(ttl)
+	}
+	// 客户端断开连接时不再等待限流
+	flag := h.db.WriteContext(r.Context(), batch) == nil
 	if flag {
 		fmt.Fprintf(w, "success")
 	}else {
@@ -186,10 +581,46 @@ func (h HttpServer) Set(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// parseTTL 解析 ttl 参数，可以是秒数，也可以是 10m、1h30m 这样的时长，为空表示不过期
+func parseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	var ttl time.Duration
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		ttl = time.Duration(seconds) * time.Second
+	} else if ttl, err = time.ParseDuration(value); err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+	return ttl, nil
+}
+
 func (h HttpServer) Get(w http.ResponseWriter, r *http.Request) {
+	cf, ok := h.requestFamily(w, r)
+	if !ok {
+		return
+	}
 	vars := r.URL.Query()
 	key := vars.Get("key")
-	val, flag := Get(key)
+	if raw, _ := strconv.ParseBool(vars.Get("raw")); raw {
+		// 原样返回值的字节
+		data, err := cf.GetContext(r.Context(), []byte(key))
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+		return
+	}
+	val, flag := cf.GetJSON(key)
 	if flag {
 		fmt.Fprintf(w, fmt.Sprintf("result is %v", val))
 	}else {
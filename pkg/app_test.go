@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"mylsmtree/pkg/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// reopenTestDB 关闭 db 后重新打开同一个目录
+func reopenTestDB(t *testing.T, dir string, opts *Options, db *DB) *DB {
+	t.Helper()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func TestCloseFlushesMemtable(t *testing.T) {
+	for _, skipFlush := range []bool{false, true} {
+		dir := t.TempDir()
+		opts := DefaultOptions()
+		opts.SkipFlushOnClose = skipFlush
+		db, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Put([]byte("k"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		db = reopenTestDB(t, dir, opts, db)
+		// 落盘后数据在 SSTable 中，只同步 wal 时数据在下次打开时从 wal 回放
+		tables, err := filepath.Glob(filepath.Join(dir, "*.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(tables) > 0) == skipFlush {
+			t.Fatalf("skip flush %v: %d SSTables after close", skipFlush, len(tables))
+		}
+		if value, err := db.Get([]byte("k")); err != nil || string(value) != "v" {
+			t.Fatalf("skip flush %v: got %q, %v", skipFlush, value, err)
+		}
+	}
+}
+
+func TestShutdownServerDrainsRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// 请求一直进行，直到超时后连接被断开
+		<-r.Context().Done()
+	})}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	go func() {
+		_, _ = http.Get("http://" + listener.Addr().String())
+	}()
+	<-started
+
+	begin := time.Now()
+	if err = shutdownServer(server, config.ShutdownOptions{Timeout: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+	if _, err = http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Fatal("server accepted a request after shutdown")
+	}
+}
+
+// configurationIDs 节点 r 看到的 raft 集群成员
+func configurationIDs(t *testing.T, r *raft.Raft) []string {
+	t.Helper()
+	future := r.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, server := range future.Configuration().Servers {
+		ids = append(ids, string(server.ID))
+	}
+	return ids
+}
+
+func TestLeaveClusterLeader(t *testing.T) {
+	nodes := newTestCluster(t, 3, nil)
+	if err := leaveCluster(nodes[0].raft, "node0", nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "follower to see the leader leave", func() bool {
+		return strings.Join(configurationIDs(t, nodes[1].raft), ",") == "node1,node2"
+	})
+}
+
+func TestLeaveClusterFollower(t *testing.T) {
+	nodes := newTestCluster(t, 3, nil)
+	leader := httptest.NewServer(http.HandlerFunc(HttpServer{ctx: nodes[0].raft, db: nodes[0].db}.RemoveServer))
+	defer leader.Close()
+	httpAddrs := map[string]string{"node0": strings.TrimPrefix(leader.URL, "http://")}
+
+	if err := leaveCluster(nodes[2].raft, "node2", httpAddrs, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ids := strings.Join(configurationIDs(t, nodes[0].raft), ","); ids != "node0,node1" {
+		t.Fatalf("leader configuration = %s", ids)
+	}
+
+	// 没有配置 leader 的 http 地址时无法离开
+	if err := leaveCluster(nodes[1].raft, "node1", nil, time.Second); err == nil {
+		t.Fatal("left the cluster without the leader's http addr")
+	}
+}
+
+func TestLeaveClusterOnlyServer(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	if err := leaveCluster(nodes[0].raft, "node0", nil, time.Second); err == nil {
+		t.Fatal("the only server left the cluster")
+	}
+	if ids := configurationIDs(t, nodes[0].raft); len(ids) != 1 {
+		t.Fatalf("configuration = %v", ids)
+	}
+}
+
+func TestRemoveServerHandler(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	cases := []struct {
+		name   string
+		node   *testNode
+		method string
+		target string
+		status int
+	}{
+		{"method", nodes[0], http.MethodGet, "/admin/remove_server?id=node1", http.StatusMethodNotAllowed},
+		{"missing id", nodes[0], http.MethodPost, "/admin/remove_server", http.StatusBadRequest},
+		{"not leader", nodes[1], http.MethodPost, "/admin/remove_server?id=node1", http.StatusServiceUnavailable},
+		{"success", nodes[0], http.MethodPost, "/admin/remove_server?id=node1", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		HttpServer{ctx: c.node.raft, db: c.node.db}.RemoveServer(w, httptest.NewRequest(c.method, c.target, nil))
+		if w.Code != c.status {
+			t.Errorf("%s: got %d %s, want %d", c.name, w.Code, w.Body.String(), c.status)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"io/ioutil"
+	"log"
+	"mylsmtree/pkg/kv"
+	"mylsmtree/pkg/wal"
+	"net/http"
+	"time"
+)
+
+// 批量写入中的操作类型
+const (
+	BatchPut         = "put"
+	BatchDelete      = "delete"
+	BatchDeleteRange = "delete_range"
+	BatchMerge       = "merge"
+)
+
+// BatchOp 批量写入中的一个操作，DeleteRange 删除 [Start, End) 范围内的 key，
+// Start 或 End 为空表示不限制，Merge 的 Value 是合并操作数。
+// JSON 中不是合法 UTF-8 的 key、范围边界和不是 JSON 的值用 key_base64、start_base64、end_base64、value_base64 表示
+type BatchOp struct {
+	Op string `json:"op"`
+	// 操作所在的列族，为空表示默认列族
+	CF    string          `json:"cf,omitempty"`
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Start string          `json:"start,omitempty"`
+	End   string          `json:"end,omitempty"`
+	// put 的过期时间，Unix 纳秒时间戳，为 0 表示使用列族的默认过期时间，
+	// 写入 wal 或提交 raft 日志前换成具体的时间，之后为 0 表示不过期
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// 写入的版本，为 0 时使用应用的 raft 日志编号。只在从 raft 快照恢复时使用，保留快照中的版本，不编码到 JSON
+	version uint64
+}
+
+// plainBatchOp 和 BatchOp 相同，但没有自定义的 JSON 编码
+type plainBatchOp BatchOp
+
+// batchOpJSON BatchOp 的 JSON 形式
+type batchOpJSON struct {
+	plainBatchOp
+	KeyBase64   []byte  `json:"key_base64,omitempty"`
+	StartBase64 []byte  `json:"start_base64,omitempty"`
+	EndBase64   []byte  `json:"end_base64,omitempty"`
+	ValueBase64 *[]byte `json:"value_base64,omitempty"`
+}
+
+// MarshalJSON 二进制的 key 和值编码为 base64
+func (op BatchOp) MarshalJSON() ([]byte, error) {
+	record := batchOpJSON{plainBatchOp: plainBatchOp(op)}
+	record.Key, record.KeyBase64 = kv.SplitBinary(op.Key)
+	record.Start, record.StartBase64 = kv.SplitBinary(op.Start)
+	record.End, record.EndBase64 = kv.SplitBinary(op.End)
+	// 值在 JSON 中会被压缩并转义，编码后和原来的字节不同时用 base64 保存
+	if encoded, err := json.Marshal(op.Value); op.Value != nil && (err != nil || !bytes.Equal(encoded, op.Value)) {
+		value := []byte(op.Value)
+		record.Value = nil
+		record.ValueBase64 = &value
+	}
+	return json.Marshal(record)
+}
+
+// UnmarshalJSON 解码 JSON 形式的操作
+func (op *BatchOp) UnmarshalJSON(data []byte) error {
+	var record batchOpJSON
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	*op = BatchOp(record.plainBatchOp)
+	op.Key = kv.JoinBinary(record.Key, record.KeyBase64)
+	op.Start = kv.JoinBinary(record.Start, record.StartBase64)
+	op.End = kv.JoinBinary(record.End, record.EndBase64)
+	if record.ValueBase64 != nil {
+		op.Value = *record.ValueBase64
+		if op.Value == nil {
+			op.Value = []byte{}
+		}
+	}
+	return nil
+}
+
+// WriteBatch 多个 key 的写入，作为一条 wal 记录写入并原子地应用到内存表，
+// 读取要么看到全部操作，要么一个都看不到
+type WriteBatch struct {
+	ops []BatchOp
+	err error
+}
+
+// NewWriteBatch 创建空的批量写入
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		ops: make([]BatchOp, 0),
+	}
+}
+
+// Put 写入 key，值的编码失败时 Write 返回错误
+func (batch *WriteBatch) Put(key string, value interface{}) {
+	data, err := kv.Convert(value)
+	if err != nil {
+		if batch.err == nil {
+			batch.err = err
+		}
+		return
+	}
+	batch.ops = append(batch.ops, BatchOp{Op: BatchPut, Key: key, Value: data})
+}
+
+// PutBytes 写入 key，值原样保存，不经过编码
+func (batch *WriteBatch) PutBytes(key, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	batch.ops = append(batch.ops, BatchOp{Op: BatchPut, Key: string(key), Value: value})
+}
+
+// MergeBytes 写入 key 的合并操作数，操作数原样交给合并操作
+func (batch *WriteBatch) MergeBytes(key, operand []byte) {
+	n := batch.Len()
+	batch.PutBytes(key, operand)
+	batch.ops[n].Op = BatchMerge
+}
+
+// PutWithTTL 写入 key，经过 ttl 后过期
+func (batch *WriteBatch) PutWithTTL(key string, value interface{}, ttl time.Duration) {
+	n := batch.Len()
+	batch.Put(key, value)
+	if batch.Len() > n {
+		batch.ops[n].ExpiresAt = expiresAt(ttl)
+	}
+}
+
+// Delete 删除 key
+func (batch *WriteBatch) Delete(key string) {
+	batch.ops = append(batch.ops, BatchOp{Op: BatchDelete, Key: key})
+}
+
+// Merge 写入 key 的合并操作数，操作数的编码失败时 Write 返回错误
+func (batch *WriteBatch) Merge(key string, operand interface{}) {
+	n := batch.Len()
+	batch.Put(key, operand)
+	if batch.Len() > n {
+		batch.ops[n].Op = BatchMerge
+	}
+}
+
+// DeleteRange 删除 [start, end) 范围内的 key，start 或 end 为空表示不限制
+func (batch *WriteBatch) DeleteRange(start, end string) {
+	batch.ops = append(batch.ops, BatchOp{Op: BatchDeleteRange, Start: start, End: end})
+}
+
+// PutCF 在列族 cf 中写入 key
+func (batch *WriteBatch) PutCF(cf *ColumnFamily, key string, value interface{}) {
+	batch.withFamily(cf, func() { batch.Put(key, value) })
+}
+
+// PutBytesCF 在列族 cf 中写入 key，值原样保存
+func (batch *WriteBatch) PutBytesCF(cf *ColumnFamily, key, value []byte) {
+	batch.withFamily(cf, func() { batch.PutBytes(key, value) })
+}
+
+// DeleteCF 删除列族 cf 中的 key
+func (batch *WriteBatch) DeleteCF(cf *ColumnFamily, key string) {
+	batch.withFamily(cf, func() { batch.Delete(key) })
+}
+
+// MergeCF 在列族 cf 中写入 key 的合并操作数
+func (batch *WriteBatch) MergeCF(cf *ColumnFamily, key string, operand interface{}) {
+	batch.withFamily(cf, func() { batch.Merge(key, operand) })
+}
+
+// DeleteRangeCF 删除列族 cf 中 [start, end) 范围内的 key
+func (batch *WriteBatch) DeleteRangeCF(cf *ColumnFamily, start, end string) {
+	batch.withFamily(cf, func() { batch.DeleteRange(start, end) })
+}
+
+// withFamily 把 add 添加的操作放到列族 cf 中
+func (batch *WriteBatch) withFamily(cf *ColumnFamily, add func()) {
+	n := batch.Len()
+	add()
+	if cf.name == wal.DefaultFamily {
+		return
+	}
+	for i := n; i < batch.Len(); i++ {
+		batch.ops[i].CF = cf.name
+	}
+}
+
+// Len 批量写入中的操作数量
+func (batch *WriteBatch) Len() int {
+	return len(batch.ops)
+}
+
+// Ops 批量写入中的所有操作
+func (batch *WriteBatch) Ops() []BatchOp {
+	return batch.ops
+}
+
+// Marshal 将批量写入编码为 JSON 数组，用于写入 raft 日志
+func (batch *WriteBatch) Marshal() ([]byte, error) {
+	if batch.err != nil {
+		return nil, batch.err
+	}
+	return json.Marshal(batch.ops)
+}
+
+// UnmarshalWriteBatch 解码 JSON 数组形式的批量写入，并检查每个操作是否合法
+func UnmarshalWriteBatch(data []byte) (*WriteBatch, error) {
+	ops := make([]BatchOp, 0)
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case BatchPut, BatchMerge:
+			if op.Value == nil {
+				return nil, fmt.Errorf("op %d: %s without value", i, op.Op)
+			}
+		case BatchDelete:
+		case BatchDeleteRange:
+		default:
+			return nil, fmt.Errorf("op %d: unknown op %q", i, op.Op)
+		}
+	}
+	return &WriteBatch{ops: ops}, nil
+}
+
+// Write 原子地写入批量写入
+func Write(batch *WriteBatch) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.Write(batch)
+}
+
+// WriteContext 和 Write 相同，ctx 被取消或超时时不再等待限流并返回 ctx.Err()
+func WriteContext(ctx context.Context, batch *WriteBatch) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.WriteContext(ctx, batch)
+}
+
+// Write 原子地写入批量写入
+func (d *DB) Write(batch *WriteBatch) error {
+	return d.WriteContext(context.Background(), batch)
+}
+
+// WriteContext 原子地写入批量写入，集群模式下通过 raft 提交，写入被限流阻塞时 ctx 被取消或超时会放弃写入并返回 ctx.Err()，
+// 开始写入 wal 之后不再检查 ctx
+func (d *DB) WriteContext(ctx context.Context, batch *WriteBatch) error {
+	if d.raft != nil {
+		// 集群模式下通过 raft 复制到所有节点，只能在 leader 上写入
+		return d.proposeBatch(ctx, batch)
+	}
+	return d.writeBatch(ctx, d.withDefaultTTL(batch), 0)
+}
+
+// writeBatch 写入批量写入，raftIndex 为对应的 raft 日志编号，不经过 raft 时为 0，
+// 编号不大于已经写入的 raft 日志编号时跳过
+func (d *DB) writeBatch(ctx context.Context, batch *WriteBatch, raftIndex uint64) error {
+	return d.writeBatchIf(ctx, batch, raftIndex, nil)
+}
+
+// writeBatchIf 和 writeBatch 相同，但写入前先在 writeLock 内调用 check，
+// check 返回错误时不写入并返回这个错误，check 可以为 nil。
+// 应用 raft 日志时传入 context.Background()，已经提交的日志不能被取消，也不会被限流阻塞，
+// 限流由提交日志的节点在提交前处理。只有日志被写入或者确定不能写入时才更新已经应用的编号，
+// 读写失败时编号不变，数据库恢复后可以重新应用
+func (d *DB) writeBatchIf(ctx context.Context, batch *WriteBatch, raftIndex uint64, check func() error) error {
+	if batch.err != nil {
+		return batch.err
+	}
+	log.Print("Write batch ", len(batch.ops))
+	if raftIndex == 0 {
+		if err := d.makeRoomForWrite(ctx); err != nil {
+			return err
+		}
+	}
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	if err := d.writeError(); err != nil {
+		return err
+	}
+	if raftIndex > 0 && raftIndex <= d.appliedIndex {
+		log.Println("Skip applied raft log", raftIndex)
+		return nil
+	}
+	families, err := d.batchFamilies(batch)
+	if err == nil && raftIndex == 0 {
+		// raft 日志中的合并操作数由提交日志的节点检查，应用时不依赖本节点的合并操作，所有节点的结果相同
+		err = d.checkMergeOperator(batch)
+	}
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err != nil {
+		if raftIndex > 0 && !errors.Is(err, ErrIO) && !errors.Is(err, ErrCorruption) {
+			// 条件不成立、列族不存在等结果在每个节点上相同，日志已经应用完成
+			d.appliedIndex = raftIndex
+		}
+		return err
+	}
+
+	// 按操作顺序分配序列号，DeleteRange 只遮盖同一个批量写入中在它之前的写入
+	batches := make(map[string]*wal.FamilyBatch)
+	empty := true
+	watching := d.watching()
+	var events []WatchEvent
+	for _, op := range batch.ops {
+		cf := families[familyName(op.CF)]
+		familyBatch, ok := batches[cf.name]
+		if !ok {
+			familyBatch = &wal.FamilyBatch{Values: make([]kv.Value, 0)}
+			batches[cf.name] = familyBatch
+		}
+		version := raftIndex
+		if op.version != 0 {
+			version = op.version
+		}
+		switch op.Op {
+		case BatchPut:
+			familyBatch.Values = append(familyBatch.Values, kv.Value{
+				Key:       op.Key,
+				Value:     op.Value,
+				Seq:       d.nextSeq(),
+				ExpiresAt: op.ExpiresAt,
+				Version:   version,
+			})
+		case BatchDelete:
+			familyBatch.Values = append(familyBatch.Values, kv.Value{
+				Key:     op.Key,
+				Deleted: true,
+				Seq:     d.nextSeq(),
+				Version: version,
+			})
+		case BatchMerge:
+			familyBatch.Values = append(familyBatch.Values, kv.Value{
+				Key:     op.Key,
+				Value:   op.Value,
+				Seq:     d.nextSeq(),
+				Merge:   true,
+				Version: version,
+			})
+		case BatchDeleteRange:
+			if op.End != "" && op.Start >= op.End {
+				continue
+			}
+			familyBatch.RangeTombstones = append(familyBatch.RangeTombstones, kv.RangeTombstone{
+				Start: op.Start,
+				End:   op.End,
+				Seq:   d.nextSeq(),
+			})
+		}
+		empty = false
+		if watching {
+			events = append(events, WatchEvent{
+				Type:   op.Op,
+				Family: cf.name,
+				Key:    op.Key,
+				Value:  op.Value,
+				Start:  op.Start,
+				End:    op.End,
+				Seq:    d.lastSeq,
+			})
+		}
+	}
+	if empty {
+		if raftIndex > 0 {
+			d.appliedIndex = raftIndex
+		}
+		return nil
+	}
+
+	// wal 写入失败时内存表不变，wal 末尾可能留下写了一半的记录，数据库进入只读模式，Resume 时切换 wal
+	if err = d.Wal.WriteBatch(raftIndex, batches); err != nil {
+		d.setBackgroundError(err)
+		return err
+	}
+	if raftIndex > 0 {
+		d.appliedIndex = raftIndex
+	}
+	for name, familyBatch := range batches {
+		cf := families[name]
+		for _, value := range familyBatch.Values {
+			cf.MemoryTree.SetValue(value)
+		}
+		for _, tombstone := range familyBatch.RangeTombstones {
+			cf.MemoryTree.AddRangeTombstone(tombstone)
+		}
+	}
+	// 全部写入内存表后才发布序列号，读取不会看到写了一半的批量写入
+	d.publishSeq(d.lastSeq)
+	d.notifyWatchers(events)
+	d.maybeSwitchMemoryTree()
+	return nil
+}
+
+// batchFamilies 获取批量写入用到的所有列族，列族名到列族，有列族不存在时返回 ErrFamilyNotFound，
+// 调用方需要持有 writeLock，保证写入期间列族不会被删除
+func (d *DB) batchFamilies(batch *WriteBatch) (map[string]*ColumnFamily, error) {
+	families := make(map[string]*ColumnFamily)
+	for _, op := range batch.ops {
+		name := familyName(op.CF)
+		if _, ok := families[name]; ok {
+			continue
+		}
+		cf, ok := d.getFamily(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrFamilyNotFound, name)
+		}
+		families[name] = cf
+	}
+	return families, nil
+}
+
+// raft 日志提交的超时时间
+const raftApplyTimeout = 10 * time.Second
+
+// raftApply 通过 raft 提交一条日志并等待应用，返回应用日志的结果。
+// 提交的超时时间取 ctx 的截止时间，没有截止时间时为 raftApplyTimeout；
+// ctx 被取消时立即返回 ctx.Err()，但已经提交的日志仍然可能被应用
+func raftApply(ctx context.Context, r *raft.Raft, cmd []byte) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	timeout := raftApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	future := r.Apply(cmd, timeout)
+	done := make(chan error, 1)
+	go func() {
+		done <- future.Error()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		return future.Response(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// propose 通过 raft 提交一条日志，后台落盘、压缩跟不上时先在本节点限流，
+// 等待时间取 ctx 的截止时间；本节点只读时不提交，返回 ErrReadOnly
+func (d *DB) propose(ctx context.Context, cmd []byte) (interface{}, error) {
+	if err := d.makeRoomForWrite(ctx); err != nil {
+		return nil, err
+	}
+	if err := d.writeError(); err != nil {
+		return nil, err
+	}
+	return raftApply(ctx, d.raft, cmd)
+}
+
+// proposeBatch 通过 raft 提交批量写入，返回 leader 应用日志时的结果。
+// 有合并操作数时在提交前检查本节点设置了合并操作
+func (d *DB) proposeBatch(ctx context.Context, batch *WriteBatch) error {
+	if err := d.checkMergeOperator(batch); err != nil {
+		return err
+	}
+	data, err := d.withDefaultTTL(batch).Marshal()
+	if err != nil {
+		return err
+	}
+	response, err := d.propose(ctx, append([]byte("batch,"), data...))
+	if err != nil {
+		return err
+	}
+	if err, ok := response.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Batch 批量写入接口，请求体为 JSON 数组，例如
+// [{"op":"put","key":"a","value":1},{"op":"delete","key":"b"},{"op":"delete_range","start":"c","end":"d"},
+// {"op":"merge","key":"e","value":1},{"op":"put","cf":"users","key":"f","value":1}]，
+// 作为一条 raft 日志复制到集群中的所有节点
+func (h HttpServer) Batch(w http.ResponseWriter, r *http.Request) {
+	if !h.db.isLeader() {
+		http.Error(w, "not leader", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch, err := UnmarshalWriteBatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = h.db.proposeBatch(r.Context(), batch); err != nil {
+		log.Println("batch apply failure", err)
+		writeTextError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "success")
+}
+
+// writeTextError 返回纯文本的接口写入失败时按错误类型返回状态码，不是 leader 时返回 503
+func writeTextError(w http.ResponseWriter, err error) {
+	status := restStatus(err)
+	if notLeader(err) {
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteBatchAtomic(t *testing.T) {
+	db := openTestDB(t, nil)
+	batch := NewWriteBatch()
+	batch.Put("a", 1)
+	batch.Put("b", 2)
+	batch.DeleteRange("b", "c")
+	batch.Put("c", 3)
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := db.GetJSON("a"); !ok || value != float64(1) {
+		t.Fatalf("a = %v, %v", value, ok)
+	}
+	// 同一个批量写入中后面的操作覆盖前面的
+	if _, ok := db.GetJSON("b"); ok {
+		t.Fatal("b should be deleted by the range deletion")
+	}
+	if value, ok := db.GetJSON("c"); !ok || value != float64(3) {
+		t.Fatalf("c = %v, %v", value, ok)
+	}
+}
+
+func TestWriteBatchUnknownFamilyWritesNothing(t *testing.T) {
+	db := openTestDB(t, nil)
+	batch := NewWriteBatch()
+	batch.Put("a", 1)
+	batch.ops = append(batch.ops, BatchOp{Op: BatchPut, CF: "missing", Key: "b", Value: []byte("1")})
+	if err := db.Write(batch); err == nil {
+		t.Fatal("write to a missing column family succeeded")
+	}
+	if _, ok := db.GetJSON("a"); ok {
+		t.Fatal("part of a failed batch was written")
+	}
+}
+
+func TestWriteBatchMarshalRoundTrip(t *testing.T) {
+	batch := NewWriteBatch()
+	batch.Put("a", map[string]interface{}{"x": 1})
+	batch.PutBytes([]byte{0xff, 0x00}, []byte{1, 2})
+	batch.Delete("b")
+	batch.DeleteRange("c", "d")
+	data, err := batch.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalWriteBatch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Len() != batch.Len() {
+		t.Fatalf("got %d ops, want %d", decoded.Len(), batch.Len())
+	}
+	for i, op := range decoded.Ops() {
+		want := batch.Ops()[i]
+		if op.Op != want.Op || op.Key != want.Key || string(op.Value) != string(want.Value) ||
+			op.Start != want.Start || op.End != want.End {
+			t.Errorf("op %d: got %+v, want %+v", i, op, want)
+		}
+	}
+}
+
+func TestBatchHandlerStatus(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	leader := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	follower := HttpServer{ctx: nodes[1].raft, db: nodes[1].db}
+	tests := []struct {
+		name   string
+		server HttpServer
+		method string
+		body   string
+		status int
+	}{
+		{"success", leader, http.MethodPost, `[{"op":"put","key":"a","value":1}]`, http.StatusOK},
+		{"invalid body", leader, http.MethodPost, `{`, http.StatusBadRequest},
+		{"method", leader, http.MethodGet, ``, http.StatusMethodNotAllowed},
+		{"missing family", leader, http.MethodPost, `[{"op":"put","cf":"missing","key":"a","value":1}]`, http.StatusNotFound},
+		{"not leader", follower, http.MethodPost, `[{"op":"put","key":"a","value":1}]`, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.server.Batch(w, httptest.NewRequest(test.method, "/batch", strings.NewReader(test.body)))
+			if w.Code != test.status {
+				t.Fatalf("got %d %q, want %d", w.Code, w.Body.String(), test.status)
+			}
+		})
+	}
+}
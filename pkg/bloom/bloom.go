@@ -0,0 +1,67 @@
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Filter 布隆过滤器，MayContain 返回 false 时 key 一定不存在
+type Filter struct {
+	Bits []byte
+	K    int
+}
+
+// New 按预计的 key 数量和每个 key 占用的位数创建过滤器
+func New(n int, bitsPerKey int) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	bits := n * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	// 哈希函数个数取 bitsPerKey * ln2 时误判率最低
+	k := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return &Filter{
+		Bits: make([]byte, (bits+7)/8),
+		K:    k,
+	}
+}
+
+// hash 用一次 64 位哈希拆出两个哈希值，第 i 个哈希为 h1 + i*h2
+func hash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (f *Filter) Add(key string) {
+	bits := uint32(len(f.Bits) * 8)
+	h1, h2 := hash(key)
+	for i := 0; i < f.K; i++ {
+		pos := (h1 + uint32(i)*h2) % bits
+		f.Bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+func (f *Filter) MayContain(key string) bool {
+	bits := uint32(len(f.Bits) * 8)
+	if bits == 0 {
+		return true
+	}
+	h1, h2 := hash(key)
+	for i := 0; i < f.K; i++ {
+		pos := (h1 + uint32(i)*h2) % bits
+		if f.Bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,384 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mylsmtree/pkg/kv"
+	"mylsmtree/pkg/wal"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// 条件写入的类型
+const (
+	CondCompareAndSwap = "cas"
+	CondPutIfAbsent    = "put_if_absent"
+	CondDeleteIfEquals = "delete_if_equals"
+)
+
+// errConditionFailed 条件不成立，不写入
+var errConditionFailed = errors.New("condition failed")
+
+// condRecord 写入 raft 日志的条件写入
+type condRecord struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	// key 所在的列族，为空表示默认列族
+	CF       string          `json:"cf,omitempty"`
+	Expected json.RawMessage `json:"expected,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	// 写入的过期时间，没有指定时由提交日志的节点按列族的默认过期时间计算，为 0 表示不过期
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// 提交日志的节点的时间，Unix 纳秒时间戳，应用日志时按它判断 key 是否过期，为 0 时使用本节点的时间
+	Time int64 `json:"time,omitempty"`
+	// Expected 和 Value 是任意字节，按字节比较，不按 JSON 解码
+	Raw bool `json:"raw,omitempty"`
+}
+
+// plainCondRecord 和 condRecord 相同，但没有自定义的 JSON 编码
+type plainCondRecord condRecord
+
+// condRecordJSON condRecord 的 JSON 形式，不是合法 UTF-8 的 key 保存在 BinaryKey 中，
+// Raw 为 true 时 Expected 和 Value 保存在 ExpectedBase64 和 ValueBase64 中
+type condRecordJSON struct {
+	plainCondRecord
+	BinaryKey      []byte  `json:"binary_key,omitempty"`
+	ExpectedBase64 *[]byte `json:"expected_base64,omitempty"`
+	ValueBase64    *[]byte `json:"value_base64,omitempty"`
+}
+
+func (record condRecord) MarshalJSON() ([]byte, error) {
+	encoded := condRecordJSON{plainCondRecord: plainCondRecord(record)}
+	encoded.Key, encoded.BinaryKey = kv.SplitBinary(record.Key)
+	if record.Raw {
+		encoded.Expected, encoded.Value = nil, nil
+		encoded.ExpectedBase64 = rawField(record.Expected)
+		encoded.ValueBase64 = rawField(record.Value)
+	}
+	return json.Marshal(encoded)
+}
+
+// rawField 任意字节的值编码为 base64，nil 表示没有这个字段，空值也会被编码
+func rawField(value []byte) *[]byte {
+	if value == nil {
+		return nil
+	}
+	return &value
+}
+
+func (record *condRecord) UnmarshalJSON(data []byte) error {
+	var encoded condRecordJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	*record = condRecord(encoded.plainCondRecord)
+	record.Key = kv.JoinBinary(encoded.Key, encoded.BinaryKey)
+	if encoded.ExpectedBase64 != nil {
+		record.Expected = append([]byte{}, *encoded.ExpectedBase64...)
+	}
+	if encoded.ValueBase64 != nil {
+		record.Value = append([]byte{}, *encoded.ValueBase64...)
+	}
+	return nil
+}
+
+// matches key 的当前值 current 是否等于 Expected，Raw 为 true 时按字节比较，否则按解码后的 JSON 比较
+func (record condRecord) matches(current []byte) bool {
+	if record.Raw {
+		return bytes.Equal(current, record.Expected)
+	}
+	value, _ := getInstance(current)
+	expected, _ := getInstance(record.Expected)
+	return reflect.DeepEqual(value, expected)
+}
+
+// CondResult 条件写入的结果，Value 和 Exists 为执行后 key 的当前值
+type CondResult struct {
+	Succeeded bool        `json:"succeeded"`
+	Value     interface{} `json:"value"`
+	Exists    bool        `json:"exists"`
+	// 条件写入的 Raw 为 true 时，执行后 key 的当前值的原始字节，这时 Value 为 nil
+	raw []byte
+}
+
+// setValue 记录执行后 key 的当前值，raw 为 true 时保存原始字节，否则按 JSON 解码
+func (result *CondResult) setValue(data []byte, exists, raw bool) {
+	result.Value, result.raw, result.Exists = nil, nil, exists
+	if !exists {
+		return
+	}
+	if raw {
+		result.raw = data
+		return
+	}
+	result.Value, _ = getInstance(data)
+}
+
+// CompareAndSwap 当 key 的值等于 expected 时写入 value，key 不存在时不写入
+func CompareAndSwap(key string, expected, value interface{}) (CondResult, error) {
+	db, err := current()
+	if err != nil {
+		return CondResult{}, err
+	}
+	return db.CompareAndSwap(key, expected, value)
+}
+
+// PutIfAbsent 当 key 不存在时写入 value
+func PutIfAbsent(key string, value interface{}) (CondResult, error) {
+	db, err := current()
+	if err != nil {
+		return CondResult{}, err
+	}
+	return db.PutIfAbsent(key, value)
+}
+
+// DeleteIfEquals 当 key 的值等于 expected 时删除 key
+func DeleteIfEquals(key string, expected interface{}) (CondResult, error) {
+	db, err := current()
+	if err != nil {
+		return CondResult{}, err
+	}
+	return db.DeleteIfEquals(key, expected)
+}
+
+// CompareAndSwapContext 和 CompareAndSwap 相同，ctx 被取消或超时时返回 ctx.Err()
+func CompareAndSwapContext(ctx context.Context, key string, expected, value interface{}) (CondResult, error) {
+	db, err := current()
+	if err != nil {
+		return CondResult{}, err
+	}
+	return db.CompareAndSwapContext(ctx, key, expected, value)
+}
+
+// PutIfAbsentContext 和 PutIfAbsent 相同，ctx 被取消或超时时返回 ctx.Err()
+func PutIfAbsentContext(ctx context.Context, key string, value interface{}) (CondResult, error) {
+	db, err := current()
+	if err != nil {
+		return CondResult{}, err
+	}
+	return db.PutIfAbsentContext(ctx, key, value)
+}
+
+// DeleteIfEqualsContext 和 DeleteIfEquals 相同，ctx 被取消或超时时返回 ctx.Err()
+func DeleteIfEqualsContext(ctx context.Context, key string, expected interface{}) (CondResult, error) {
+	db, err := current()
+	if err != nil {
+		return CondResult{}, err
+	}
+	return db.DeleteIfEqualsContext(ctx, key, expected)
+}
+
+// CompareAndSwap 当 key 的值等于 expected 时写入 value，key 不存在时不写入
+func (d *DB) CompareAndSwap(key string, expected, value interface{}) (CondResult, error) {
+	return d.CompareAndSwapContext(context.Background(), key, expected, value)
+}
+
+// PutIfAbsent 当 key 不存在时写入 value
+func (d *DB) PutIfAbsent(key string, value interface{}) (CondResult, error) {
+	return d.PutIfAbsentContext(context.Background(), key, value)
+}
+
+// DeleteIfEquals 当 key 的值等于 expected 时删除 key
+func (d *DB) DeleteIfEquals(key string, expected interface{}) (CondResult, error) {
+	return d.DeleteIfEqualsContext(context.Background(), key, expected)
+}
+
+// CompareAndSwapContext 和 CompareAndSwap 相同，集群模式下 raft 提交的超时时间取 ctx 的截止时间
+func (d *DB) CompareAndSwapContext(ctx context.Context, key string, expected, value interface{}) (CondResult, error) {
+	return d.ColumnFamily.conditionalWrite(ctx, CondCompareAndSwap, key, expected, value)
+}
+
+// PutIfAbsentContext 和 PutIfAbsent 相同，集群模式下 raft 提交的超时时间取 ctx 的截止时间
+func (d *DB) PutIfAbsentContext(ctx context.Context, key string, value interface{}) (CondResult, error) {
+	return d.ColumnFamily.conditionalWrite(ctx, CondPutIfAbsent, key, nil, value)
+}
+
+// DeleteIfEqualsContext 和 DeleteIfEquals 相同，集群模式下 raft 提交的超时时间取 ctx 的截止时间
+func (d *DB) DeleteIfEqualsContext(ctx context.Context, key string, expected interface{}) (CondResult, error) {
+	return d.ColumnFamily.conditionalWrite(ctx, CondDeleteIfEquals, key, expected, nil)
+}
+
+// CompareAndSwap 当列族中 key 的值等于 expected 时写入 value，key 不存在时不写入
+func (cf *ColumnFamily) CompareAndSwap(key string, expected, value interface{}) (CondResult, error) {
+	return cf.conditionalWrite(context.Background(), CondCompareAndSwap, key, expected, value)
+}
+
+// PutIfAbsent 当列族中 key 不存在时写入 value，写入的 key 使用列族的默认过期时间
+func (cf *ColumnFamily) PutIfAbsent(key string, value interface{}) (CondResult, error) {
+	return cf.conditionalWrite(context.Background(), CondPutIfAbsent, key, nil, value)
+}
+
+// DeleteIfEquals 当列族中 key 的值等于 expected 时删除 key
+func (cf *ColumnFamily) DeleteIfEquals(key string, expected interface{}) (CondResult, error) {
+	return cf.conditionalWrite(context.Background(), CondDeleteIfEquals, key, expected, nil)
+}
+
+// condFamily 条件写入记录中列族 cf 的名字，默认列族为空
+func condFamily(cf *ColumnFamily) string {
+	if cf.name == wal.DefaultFamily {
+		return ""
+	}
+	return cf.name
+}
+
+// conditionalWrite 编码列族中的条件写入，集群模式下作为一条 raft 日志提交，由每个节点在应用日志时判断条件
+func (cf *ColumnFamily) conditionalWrite(ctx context.Context, op, key string, expected, value interface{}) (CondResult, error) {
+	d := cf.db
+	record := condRecord{Op: op, Key: key, CF: condFamily(cf)}
+	var err error
+	if op != CondPutIfAbsent {
+		if record.Expected, err = kv.Convert(expected); err != nil {
+			return CondResult{}, err
+		}
+	}
+	if op != CondDeleteIfEquals {
+		if record.Value, err = kv.Convert(value); err != nil {
+			return CondResult{}, err
+		}
+	}
+	if d.raft == nil {
+		return d.applyCondition(ctx, d.prepareCondition(record), 0)
+	}
+	return d.proposeCondition(ctx, record)
+}
+
+// prepareCondition 在提交日志的节点上记录当前时间，没有指定过期时间时填上列族的默认过期时间
+func (d *DB) prepareCondition(record condRecord) condRecord {
+	now := time.Now()
+	if record.Time == 0 {
+		record.Time = now.UnixNano()
+	}
+	if cf, ok := d.getFamily(familyName(record.CF)); ok && record.Op != CondDeleteIfEquals &&
+		record.ExpiresAt == 0 && cf.con.TTL > 0 {
+		record.ExpiresAt = now.Add(cf.con.TTL).UnixNano()
+	}
+	return record
+}
+
+// recordTime 把日志中记录的提交节点的时间转换为 time.Time，为 0 时返回本节点的当前时间
+func recordTime(t int64) time.Time {
+	if t == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, t)
+}
+
+// proposeCondition 通过 raft 提交条件写入，返回 leader 应用日志时的结果
+func (d *DB) proposeCondition(ctx context.Context, record condRecord) (CondResult, error) {
+	data, err := json.Marshal(d.prepareCondition(record))
+	if err != nil {
+		return CondResult{}, err
+	}
+	response, err := d.propose(ctx, append([]byte("cond,"), data...))
+	if err != nil {
+		return CondResult{}, err
+	}
+	switch response := response.(type) {
+	case CondResult:
+		return response, nil
+	case error:
+		return CondResult{}, response
+	}
+	return CondResult{}, errors.New("unexpected raft response")
+}
+
+// applyCondition 在 writeLock 内判断条件并写入，raftIndex 为对应的 raft 日志编号
+func (d *DB) applyCondition(ctx context.Context, record condRecord, raftIndex uint64) (CondResult, error) {
+	batch := NewWriteBatch()
+	switch record.Op {
+	case CondCompareAndSwap, CondPutIfAbsent:
+		batch.ops = append(batch.ops, BatchOp{Op: BatchPut, CF: record.CF, Key: record.Key, Value: record.Value, ExpiresAt: record.ExpiresAt})
+	case CondDeleteIfEquals:
+		batch.ops = append(batch.ops, BatchOp{Op: BatchDelete, CF: record.CF, Key: record.Key})
+	default:
+		return CondResult{}, fmt.Errorf("unknown condition %q", record.Op)
+	}
+
+	now := recordTime(record.Time)
+	var result CondResult
+	err := d.writeBatchIf(ctx, batch, raftIndex, func() error {
+		// 列族不存在时 writeBatchIf 在调用前返回 ErrFamilyNotFound
+		cf, _ := d.getFamily(familyName(record.CF))
+		current, exists, err := cf.latestValue(record.Key, now)
+		if err != nil {
+			return err
+		}
+		result.setValue(current, exists, record.Raw)
+		switch record.Op {
+		case CondPutIfAbsent:
+			result.Succeeded = !exists
+		default:
+			result.Succeeded = exists && record.matches(current)
+		}
+		if !result.Succeeded {
+			return errConditionFailed
+		}
+		if record.Op == CondDeleteIfEquals {
+			result.setValue(nil, false, record.Raw)
+		} else {
+			result.setValue(record.Value, true, record.Raw)
+		}
+		return nil
+	})
+	if err != nil && err != errConditionFailed {
+		return CondResult{}, err
+	}
+	return result, nil
+}
+
+// latestValue 获取列族中 key 最新的值的原始字节，按 now 判断是否过期，调用方需要持有 writeLock
+func (cf *ColumnFamily) latestValue(key string, now time.Time) ([]byte, bool, error) {
+	cf.ValueLog.Acquire()
+	defer cf.ValueLog.Release()
+	value, result, err := cf.lookupAt(key, cf.db.getVisibleSeq(), now)
+	if err != nil || result != kv.Success {
+		return nil, false, err
+	}
+	data, err := cf.resolveValue(value)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// condition 条件写入接口的公共部分，通过 raft 提交并以 JSON 返回结果，不是 leader 或提交失败时按错误返回状态码
+func (h HttpServer) condition(w http.ResponseWriter, r *http.Request, record condRecord) {
+	if !h.checkLeader(w) {
+		return
+	}
+	result, err := h.db.proposeCondition(r.Context(), record)
+	if err != nil {
+		log.Println("condition apply failure", err)
+		h.writeRaftErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// CompareAndSwap 接口，参数为 key、expected 和 value，值按字符串处理
+func (h HttpServer) CompareAndSwap(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	expected, _ := kv.Convert(vars.Get("expected"))
+	value, _ := kv.Convert(vars.Get("value"))
+	h.condition(w, r, condRecord{Op: CondCompareAndSwap, Key: vars.Get("key"), Expected: expected, Value: value})
+}
+
+// PutIfAbsent 接口，参数为 key 和 value，值按字符串处理
+func (h HttpServer) PutIfAbsent(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	value, _ := kv.Convert(vars.Get("value"))
+	h.condition(w, r, condRecord{Op: CondPutIfAbsent, Key: vars.Get("key"), Value: value})
+}
+
+// DeleteIfEquals 接口，参数为 key 和 expected，值按字符串处理
+func (h HttpServer) DeleteIfEquals(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	expected, _ := kv.Convert(vars.Get("expected"))
+	h.condition(w, r, condRecord{Op: CondDeleteIfEquals, Key: vars.Get("key"), Expected: expected})
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	db := openTestDB(t, nil)
+	result, err := db.PutIfAbsent("k", 1)
+	if err != nil || !result.Succeeded {
+		t.Fatalf("put if absent: %+v, %v", result, err)
+	}
+	result, err = db.PutIfAbsent("k", 2)
+	if err != nil || result.Succeeded || result.Value != float64(1) {
+		t.Fatalf("put if absent on existing key: %+v, %v", result, err)
+	}
+	result, err = db.CompareAndSwap("k", 2, 3)
+	if err != nil || result.Succeeded {
+		t.Fatalf("cas with wrong expected value: %+v, %v", result, err)
+	}
+	result, err = db.CompareAndSwap("k", 1, 3)
+	if err != nil || !result.Succeeded || result.Value != float64(3) {
+		t.Fatalf("cas: %+v, %v", result, err)
+	}
+	result, err = db.CompareAndSwap("missing", nil, 1)
+	if err != nil || result.Succeeded {
+		t.Fatalf("cas on missing key: %+v, %v", result, err)
+	}
+	result, err = db.DeleteIfEquals("k", 3)
+	if err != nil || !result.Succeeded || result.Exists {
+		t.Fatalf("delete if equals: %+v, %v", result, err)
+	}
+	if _, ok := db.GetJSON("k"); ok {
+		t.Fatal("key was not deleted")
+	}
+}
+
+// 应用条件写入时按记录中提交日志的节点的时间判断过期，而不是本节点的时间
+func TestConditionExpiryUsesRecordTime(t *testing.T) {
+	db := openTestDB(t, nil)
+	expires := time.Now().Add(-time.Minute)
+	batch := NewWriteBatch()
+	batch.Put("k", 1)
+	batch.ops[0].ExpiresAt = expires.UnixNano()
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	before := condRecord{Op: CondPutIfAbsent, Key: "k", Value: []byte("2"), Time: expires.Add(-time.Second).UnixNano()}
+	result, err := db.applyCondition(context.Background(), before, 0)
+	if err != nil || result.Succeeded || !result.Exists {
+		t.Fatalf("key should be live at the record time: %+v, %v", result, err)
+	}
+	after := before
+	after.Time = expires.Add(time.Second).UnixNano()
+	result, err = db.applyCondition(context.Background(), after, 0)
+	if err != nil || !result.Succeeded {
+		t.Fatalf("key should be expired at the record time: %+v, %v", result, err)
+	}
+}
+
+func TestRaftConditionSameOnReplicas(t *testing.T) {
+	nodes := newTestCluster(t, 3, nil)
+	batch := NewWriteBatch()
+	batch.PutWithTTL("k", 1, 50*time.Millisecond)
+	if err := nodes[0].db.proposeBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	record := condRecord{Op: CondCompareAndSwap, Key: "k", Expected: []byte("1"), Value: []byte("2")}
+	result, err := nodes[0].db.proposeCondition(context.Background(), record)
+	if err != nil || !result.Succeeded {
+		t.Fatalf("cas: %+v, %v", result, err)
+	}
+	// key 在节点上都已经过期后才应用，仍然按提交时的时间判断
+	time.Sleep(60 * time.Millisecond)
+	waitApplied(t, nodes)
+	for i, node := range nodes {
+		if value, ok := node.db.GetJSON("k"); !ok || value != float64(2) {
+			t.Errorf("node %d: k = %v, %v", i, value, ok)
+		}
+	}
+}
+
+// lastCondRecord leader 最后一条 raft 日志中的条件写入
+func lastCondRecord(t *testing.T, node *testNode) condRecord {
+	t.Helper()
+	var entry raft.Log
+	if err := node.logs.GetLog(node.raft.LastIndex(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	var record condRecord
+	if !bytes.HasPrefix(entry.Data, []byte("cond,")) || json.Unmarshal(entry.Data[len("cond,"):], &record) != nil {
+		t.Fatalf("last raft log is not a condition: %q", entry.Data)
+	}
+	return record
+}
+
+// 旧的条件写入接口同样在提交前记录 leader 的时间，节点应用日志时不使用自己的时间
+func TestConditionHandlerRecordsTime(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	h := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	start := time.Now().UnixNano()
+	w := httptest.NewRecorder()
+	h.PutIfAbsent(w, httptest.NewRequest(http.MethodPost, "/put_if_absent?key=k&value=v", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"succeeded":true`) {
+		t.Fatalf("put if absent: %d %s", w.Code, w.Body.String())
+	}
+	if record := lastCondRecord(t, nodes[0]); record.Time < start || record.Time > time.Now().UnixNano() {
+		t.Fatalf("record time %d, want the time of the request", record.Time)
+	}
+}
+
+func TestRawCondRecordRoundTrip(t *testing.T) {
+	record := condRecord{Op: CondCompareAndSwap, Key: "k", Expected: []byte{0xff, '{'}, Value: []byte{}, Raw: true}
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded condRecord
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Raw || !bytes.Equal(decoded.Expected, record.Expected) || decoded.Value == nil || len(decoded.Value) != 0 {
+		t.Fatalf("decoded %+v from %s", decoded, data)
+	}
+}
+
+func TestConditionHandlerStatus(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	_, leader := nodes[0].raft.LeaderWithID()
+	follower := HttpServer{ctx: nodes[1].raft, db: nodes[1].db, httpAddrs: map[string]string{string(leader): "10.0.0.1:7001"}}
+	w := httptest.NewRecorder()
+	follower.CompareAndSwap(w, httptest.NewRequest(http.MethodPost, "/cas?key=k&expected=a&value=b", nil))
+	var response restError
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("cas on follower: %d %s", w.Code, w.Body.String())
+	}
+	if response.LeaderAddr != "10.0.0.1:7001" {
+		t.Fatalf("not leader response = %+v", response)
+	}
+
+	// 提交失败时按错误返回状态码
+	h := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	w = httptest.NewRecorder()
+	h.DeleteIfEquals(w, httptest.NewRequest(http.MethodPost, "/delete_if_equals?key=k&expected=a", nil).WithContext(ctx))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expired request: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Codec 值的编码方式，字节接口之上可选的一层，PutValue 和 GetValue 用它在 Go 的值和字节之间转换
+type Codec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+type jsonCodec struct{}
+
+// JSONCodec JSON 编码，Set、GetJSON 等接口使用的编码。解码到 interface{} 时数字为 json.Number，不会损失精度
+var JSONCodec Codec = jsonCodec{}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// PutValue 用 codec 编码 value 后写入 key
+func PutValue(codec Codec, key []byte, value interface{}) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.PutValue(codec, key, value)
+}
+
+// GetValue 读取 key 并用 codec 解码到 value 中，key 不存在时返回 ErrNotFound
+func GetValue(codec Codec, key []byte, value interface{}) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.GetValue(codec, key, value)
+}
+
+// PutValue 用 codec 编码 value 后写入 key
+func (d *DB) PutValue(codec Codec, key []byte, value interface{}) error {
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return d.Put(key, data)
+}
+
+// GetValue 读取 key 并用 codec 解码到 value 中，key 不存在时返回 ErrNotFound
+func (d *DB) GetValue(codec Codec, key []byte, value interface{}) error {
+	data, err := d.Get(key)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, value)
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// binaryPairs 二进制的 key 和值，包含 0x00 和不是合法 UTF-8 的字节，大的值会被分离到 value log
+var binaryPairs = map[string][]byte{
+	"\x00bin\xff":   {0x00, 0xff, 0xfe, '"', '\\'},
+	"k\x00\x01":     bytes.Repeat([]byte{0x00, 0x80}, 100),
+	"plain":         []byte("not json"),
+	"\xc3\x28\x00z": {},
+}
+
+func checkBinaryPairs(t *testing.T, db *DB, stage string) {
+	t.Helper()
+	for key, want := range binaryPairs {
+		if value, err := db.Get([]byte(key)); err != nil || !bytes.Equal(value, want) {
+			t.Fatalf("%s: %q = %q, %v, want %q", stage, key, value, err, want)
+		}
+	}
+}
+
+func TestRawBytesRoundTrip(t *testing.T) {
+	for _, skipFlush := range []bool{false, true} {
+		dir := t.TempDir()
+		opts := valueLogOptions()
+		opts.SkipFlushOnClose = skipFlush
+		db, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range binaryPairs {
+			if err = db.Put([]byte(key), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 值原样保存在内存表、wal、SSTable 和 value log 中
+		checkBinaryPairs(t, db, "memtable")
+		db = reopenTestDB(t, dir, opts, db)
+		checkBinaryPairs(t, db, "reopen")
+		flushTestDB(t, db)
+		checkBinaryPairs(t, db, "flushed")
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	db := openTestDB(t, nil)
+	type record struct {
+		Name string
+		ID   int64
+	}
+	in := record{Name: "a", ID: 1<<62 + 1}
+	if err := db.PutValue(JSONCodec, []byte("r"), in); err != nil {
+		t.Fatal(err)
+	}
+	var out record
+	if err := db.GetValue(JSONCodec, []byte("r"), &out); err != nil || out != in {
+		t.Fatalf("GetValue = %+v, %v, want %+v", out, err, in)
+	}
+	// 解码到 interface{} 时大整数不会变成 float64
+	var decoded interface{}
+	if err := db.GetValue(JSONCodec, []byte("r"), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if id := decoded.(map[string]interface{})["ID"]; id != json.Number("4611686018427387905") {
+		t.Fatalf("ID decoded as %#v", id)
+	}
+	if err := db.GetValue(JSONCodec, []byte("missing"), &decoded); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing key: got %v, want ErrNotFound", err)
+	}
+
+	// Set 写入的值和 JSON 编码的字节相同
+	if err := db.Set("s", []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("s")); err != nil || string(value) != "[1,2]" {
+		t.Fatalf("s = %q, %v", value, err)
+	}
+}
@@ -0,0 +1,641 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mylsmtree/pkg/config"
+	"mylsmtree/pkg/kv"
+	"mylsmtree/pkg/lsm"
+	"mylsmtree/pkg/sort_tree"
+	"mylsmtree/pkg/vlog"
+	"mylsmtree/pkg/wal"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 列族的数据目录，每个列族在其中有一个以列族名命名的子目录，默认列族直接使用数据目录
+	familiesDir = "cf"
+	// 列族目录中保存列族设置的文件，删除列族时先删除它
+	familyOptionsFile = "OPTIONS"
+)
+
+var (
+	// ErrFamilyExists 列族已经存在
+	ErrFamilyExists = errors.New("column family already exists")
+	// ErrFamilyNotFound 列族不存在或已经被删除
+	ErrFamilyNotFound = errors.New("column family not found")
+	// ErrInvalidFamilyName 列族名为空、过长、包含字母数字和 _ - . 以外的字符，或者是默认列族的名字
+	ErrInvalidFamilyName = errors.New("invalid column family name")
+	// ErrInvalidFamilyOptions 列族的设置中有未知的压缩算法或压缩策略
+	ErrInvalidFamilyOptions = errors.New("invalid column family options")
+)
+
+// 列族名只能使用的字符，列族名同时也是目录名
+var familyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-][A-Za-z0-9_\-.]{0,63}$`)
+
+// ColumnFamily 列族，有自己的内存表、SSTable 和 value log，以及独立的设置，
+// 所有列族共用一个 wal，一个批量写入可以原子地写入多个列族
+type ColumnFamily struct {
+	// 列族所在的数据库
+	db   *DB
+	name string
+	// SSTable 和 value log 所在的目录
+	dir string
+	// 创建列族时指定的设置
+	options config.FamilyConfig
+	// 合并了列族设置后的配置
+	con        config.Config
+	MemoryTree *sort_tree.Tree
+	TableTree  *lsm.TableTree
+	ValueLog   *vlog.ValueLog
+	// 列族被删除后为 1，通过 atomic 访问
+	dropped int32
+	// 串行化后台压缩、value log 回收和删除列族时删除文件
+	bgLock *sync.Mutex
+}
+
+// familyRecord raft 日志中创建或删除列族的记录
+type familyRecord struct {
+	Op      string
+	Name    string
+	Options config.FamilyConfig `json:",omitempty"`
+}
+
+// 列族记录的操作类型
+const (
+	familyCreate = "create"
+	familyDrop   = "drop"
+)
+
+// openColumnFamily 打开 dir 中的列族，memoryTree 是从 wal 中回放出的内存表
+func (d *DB) openColumnFamily(name, dir string, options config.FamilyConfig, memoryTree *sort_tree.Tree) (*ColumnFamily, error) {
+	con := d.con.WithFamily(options)
+	cf := &ColumnFamily{
+		db:         d,
+		name:       name,
+		dir:        dir,
+		options:    options,
+		con:        con,
+		MemoryTree: memoryTree,
+		TableTree:  &lsm.TableTree{},
+		ValueLog:   &vlog.ValueLog{},
+		bgLock:     &sync.Mutex{},
+	}
+	log.Println("Loading column family", name)
+	if err := cf.TableTree.Init(dir, con); err != nil {
+		return nil, err
+	}
+	cf.TableTree.SetCompactionFilter(d.compactionFilter)
+	cf.TableTree.SetPrefixExtractor(d.prefixExtractor)
+	cf.TableTree.SetMergeOperator(d.mergeOperator)
+	cf.TableTree.SetSnapshots(d.getSnapshots)
+	if err := cf.ValueLog.Init(dir, con.ValueLogFileSize); err != nil {
+		cf.TableTree.Close()
+		return nil, err
+	}
+	cf.TableTree.SetValueLog(cf.ValueLog, con.ValueThreshold)
+	return cf, nil
+}
+
+// close 关闭列族的 SSTable 和 value log，返回遇到的第一个错误
+func (cf *ColumnFamily) close() error {
+	cf.bgLock.Lock()
+	defer cf.bgLock.Unlock()
+	err := cf.TableTree.Close()
+	if vlogErr := cf.ValueLog.Close(); err == nil {
+		err = vlogErr
+	}
+	return err
+}
+
+// familyPath 列族的目录
+func familyPath(dataDir, name string) string {
+	return path.Join(dataDir, familiesDir, name)
+}
+
+// loadFamilyOptions 读取数据目录中所有列族的设置，列族名到设置。
+// 没有设置文件的目录是删除到一半的列族，直接删除
+func loadFamilyOptions(dataDir string) (map[string]config.FamilyConfig, error) {
+	families := make(map[string]config.FamilyConfig)
+	entries, err := ioutil.ReadDir(path.Join(dataDir, familiesDir))
+	if os.IsNotExist(err) {
+		return families, nil
+	}
+	if err != nil {
+		return nil, kv.IOError("read dir", path.Join(dataDir, familiesDir), err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := familyPath(dataDir, entry.Name())
+		data, err := ioutil.ReadFile(path.Join(dir, familyOptionsFile))
+		if os.IsNotExist(err) {
+			log.Println("Removing dropped column family", entry.Name())
+			if err = os.RemoveAll(dir); err != nil {
+				return nil, kv.IOError("remove", dir, err)
+			}
+			continue
+		}
+		optionsPath := path.Join(dir, familyOptionsFile)
+		if err != nil {
+			return nil, kv.IOError("read", optionsPath, err)
+		}
+		var options config.FamilyConfig
+		if err = json.Unmarshal(data, &options); err != nil {
+			return nil, kv.CorruptionError("load column family options", optionsPath, err)
+		}
+		families[entry.Name()] = options
+	}
+	return families, nil
+}
+
+// writeFamilyOptions 保存列族的设置，先写临时文件再重命名
+func writeFamilyOptions(dir string, options config.FamilyConfig) error {
+	data, _ := json.Marshal(options)
+	tmpPath := path.Join(dir, familyOptionsFile+".tmp")
+	err := ioutil.WriteFile(tmpPath, data, 0666)
+	if err != nil {
+		return kv.IOError("write", tmpPath, err)
+	}
+	return kv.IOError("rename", tmpPath, os.Rename(tmpPath, path.Join(dir, familyOptionsFile)))
+}
+
+// familyName 批量写入中的列族名，为空表示默认列族
+func familyName(name string) string {
+	if name == "" {
+		return wal.DefaultFamily
+	}
+	return name
+}
+
+// CreateColumnFamily 创建列族，options 中为 0 的字段使用全局配置中的值
+func CreateColumnFamily(name string, options config.FamilyConfig) (*ColumnFamily, error) {
+	db, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return db.CreateColumnFamily(name, options)
+}
+
+// CreateColumnFamily 创建列族，options 中为 0 的字段使用打开数据库时的配置中的值
+func (d *DB) CreateColumnFamily(name string, options config.FamilyConfig) (*ColumnFamily, error) {
+	return d.createColumnFamily(name, options, 0)
+}
+
+// createColumnFamily 创建列族，raftIndex 为对应的 raft 日志编号，不经过 raft 时为 0，
+// 编号不大于已经写入的 raft 日志编号时跳过
+func (d *DB) createColumnFamily(name string, options config.FamilyConfig, raftIndex uint64) (*ColumnFamily, error) {
+	if name == wal.DefaultFamily || !familyNamePattern.MatchString(name) {
+		return nil, ErrInvalidFamilyName
+	}
+	if err := options.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFamilyOptions, err)
+	}
+	d.familyLock.Lock()
+	defer d.familyLock.Unlock()
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	if err := d.writeError(); err != nil {
+		return nil, err
+	}
+	if raftIndex > 0 && raftIndex <= d.appliedIndex {
+		log.Println("Skip applied raft log", raftIndex)
+		cf, _ := d.getFamily(name)
+		return cf, nil
+	}
+	if _, ok := d.getFamily(name); ok {
+		return nil, d.writeFamilyRaftIndex(raftIndex, ErrFamilyExists)
+	}
+
+	log.Println("Create column family", name)
+	dir := familyPath(d.dir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, kv.IOError("mkdir", dir, err)
+	}
+	// 没有设置文件的目录在重启时会被删除，失败时不需要清理
+	if err := writeFamilyOptions(dir, options); err != nil {
+		return nil, err
+	}
+	memoryTree := &sort_tree.Tree{}
+	memoryTree.Init()
+	cf, err := d.openColumnFamily(name, dir, options, memoryTree)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	d.families[name] = cf
+	d.lock.Unlock()
+	return cf, d.writeFamilyRaftIndex(raftIndex, nil)
+}
+
+// DropColumnFamily 删除列族和其中的所有数据，默认列族不能删除
+func DropColumnFamily(name string) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.DropColumnFamily(name)
+}
+
+// DropColumnFamily 删除列族和其中的所有数据，默认列族不能删除
+func (d *DB) DropColumnFamily(name string) error {
+	return d.dropColumnFamily(name, 0)
+}
+
+// dropColumnFamily 删除列族，raftIndex 和 createColumnFamily 相同
+func (d *DB) dropColumnFamily(name string, raftIndex uint64) error {
+	if name == wal.DefaultFamily {
+		return ErrInvalidFamilyName
+	}
+	d.familyLock.Lock()
+	defer d.familyLock.Unlock()
+	d.writeLock.Lock()
+
+	if err := d.writeError(); err != nil {
+		d.writeLock.Unlock()
+		return err
+	}
+	if raftIndex > 0 && raftIndex <= d.appliedIndex {
+		log.Println("Skip applied raft log", raftIndex)
+		d.writeLock.Unlock()
+		return nil
+	}
+	cf, ok := d.getFamily(name)
+	if !ok {
+		err := d.writeFamilyRaftIndex(raftIndex, ErrFamilyNotFound)
+		d.writeLock.Unlock()
+		return err
+	}
+
+	log.Println("Drop column family", name)
+	// 先删除设置文件，之后重启时不会再加载这个列族
+	optionsPath := path.Join(cf.dir, familyOptionsFile)
+	if err := os.Remove(optionsPath); err != nil {
+		d.writeLock.Unlock()
+		return kv.IOError("remove", optionsPath, err)
+	}
+	// 切换 wal，列族已经写入的记录都进入归档文件，落盘时跳过，
+	// 之后创建的同名列族不会回放到这些记录。设置文件已经删除，切换失败时也要删除列族
+	err := d.switchMemoryTree()
+	d.setBackgroundError(err)
+	d.lock.Lock()
+	delete(d.families, name)
+	d.lock.Unlock()
+	atomic.StoreInt32(&cf.dropped, 1)
+	if err == nil {
+		err = d.writeFamilyRaftIndex(raftIndex, nil)
+	}
+	d.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = d.flushImmutables(); err != nil {
+		d.setBackgroundError(err)
+		return err
+	}
+	// 等待列族的后台任务结束并关闭 SSTable 和 value log 的文件，然后立即删除目录
+	if err = cf.close(); err != nil {
+		log.Println("close dropped column family", cf.name, err)
+	}
+	return kv.IOError("remove", cf.dir, os.RemoveAll(cf.dir))
+}
+
+// writeFamilyRaftIndex 记录创建、删除列族的 raft 日志编号，写入一条空的批量写入，
+// 重启后从 wal 中恢复编号，不会重复执行，调用方需要持有 writeLock。
+// 写入成功时返回 result，失败时数据库进入只读模式并返回写入的错误
+func (d *DB) writeFamilyRaftIndex(raftIndex uint64, result error) error {
+	if raftIndex == 0 {
+		return result
+	}
+	d.appliedIndex = raftIndex
+	if err := d.Wal.WriteBatch(raftIndex, nil); err != nil {
+		d.setBackgroundError(err)
+		return err
+	}
+	return result
+}
+
+// applyFamily 执行 raft 日志中创建或删除列族的记录
+func (d *DB) applyFamily(record familyRecord, index uint64) error {
+	switch record.Op {
+	case familyCreate:
+		_, err := d.createColumnFamily(record.Name, record.Options, index)
+		return err
+	case familyDrop:
+		return d.dropColumnFamily(record.Name, index)
+	}
+	return fmt.Errorf("unknown column family op %q", record.Op)
+}
+
+// GetColumnFamily 获取列族，wal.DefaultFamily 为默认列族
+func GetColumnFamily(name string) (*ColumnFamily, bool) {
+	db, err := current()
+	if err != nil {
+		return nil, false
+	}
+	return db.GetColumnFamily(name)
+}
+
+// GetColumnFamily 获取列族，wal.DefaultFamily 为默认列族
+func (d *DB) GetColumnFamily(name string) (*ColumnFamily, bool) {
+	return d.getFamily(name)
+}
+
+// DefaultColumnFamily 获取默认列族
+func DefaultColumnFamily() *ColumnFamily {
+	db, err := current()
+	if err != nil {
+		return nil
+	}
+	return db.DefaultColumnFamily()
+}
+
+// DefaultColumnFamily 获取默认列族
+func (d *DB) DefaultColumnFamily() *ColumnFamily {
+	return d.ColumnFamily
+}
+
+// ListColumnFamilies 获取所有列族的名字，包括默认列族，按名字排列
+func ListColumnFamilies() []string {
+	db, err := current()
+	if err != nil {
+		return nil
+	}
+	return db.ListColumnFamilies()
+}
+
+// ListColumnFamilies 获取所有列族的名字，包括默认列族，按名字排列
+func (d *DB) ListColumnFamilies() []string {
+	families := d.getFamilies()
+	names := make([]string, len(families))
+	for i, cf := range families {
+		names[i] = cf.name
+	}
+	return names
+}
+
+// Name 列族名
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Options 创建列族时指定的设置
+func (cf *ColumnFamily) Options() config.FamilyConfig {
+	return cf.options
+}
+
+// isDropped 列族是否已经被删除
+func (cf *ColumnFamily) isDropped() bool {
+	return atomic.LoadInt32(&cf.dropped) == 1
+}
+
+// withDefaultTTL 给没有指定过期时间的 put 填上所在列族的默认过期时间，在写入 wal 或提交 raft 日志之前调用，
+// 过期时间只在写入的节点上计算一次，应用 raft 日志和回放 wal 时不会重新计算。
+// 需要修改时返回副本，不修改 batch
+func (d *DB) withDefaultTTL(batch *WriteBatch) *WriteBatch {
+	now := time.Now()
+	var ops []BatchOp
+	for i, op := range batch.ops {
+		if op.Op != BatchPut || op.ExpiresAt != 0 {
+			continue
+		}
+		cf, ok := d.getFamily(familyName(op.CF))
+		if !ok || cf.con.TTL <= 0 {
+			continue
+		}
+		if ops == nil {
+			ops = append([]BatchOp(nil), batch.ops...)
+		}
+		ops[i].ExpiresAt = now.Add(cf.con.TTL).UnixNano()
+	}
+	if ops == nil {
+		return batch
+	}
+	return &WriteBatch{ops: ops, err: batch.err}
+}
+
+// Get 获取列族中 key 的值，key 不存在时返回 ErrNotFound
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.GetContext(context.Background(), key)
+}
+
+// GetContext 和 Get 相同，ctx 已经被取消或超时时不读取并返回 ctx.Err()
+func (cf *ColumnFamily) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	log.Printf("Get %q from %s", key, cf.name)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cf.isDropped() {
+		return nil, ErrFamilyNotFound
+	}
+	return cf.get(string(key), cf.db.getVisibleSeq())
+}
+
+// GetJSON 获取列族中 JSON 编码的值并解码
+func (cf *ColumnFamily) GetJSON(key string) (interface{}, bool) {
+	log.Print("Get ", key, " from ", cf.name)
+	if cf.isDropped() {
+		var nilV interface{}
+		return nilV, false
+	}
+	return cf.getAt(key, cf.db.getVisibleSeq())
+}
+
+// Put 在列族中写入 key，值原样保存
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	return cf.PutWithTTL(key, value, 0)
+}
+
+// PutContext 和 Put 相同，写入被限流阻塞时 ctx 被取消或超时会放弃写入并返回 ctx.Err()
+func (cf *ColumnFamily) PutContext(ctx context.Context, key, value []byte) error {
+	batch := NewWriteBatch()
+	batch.PutBytesCF(cf, key, value)
+	return cf.db.WriteContext(ctx, batch)
+}
+
+// PutWithTTL 在列族中写入 key，经过 ttl 后过期，ttl 不大于 0 时使用列族的默认过期时间
+func (cf *ColumnFamily) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.PutBytesCF(cf, key, value)
+	batch.ops[0].ExpiresAt = expiresAt(ttl)
+	return cf.db.Write(batch)
+}
+
+// Set 在列族中插入元素，值编码为 JSON
+func (cf *ColumnFamily) Set(key string, value interface{}) error {
+	return cf.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL 在列族中插入元素，值编码为 JSON，经过 ttl 后过期，ttl 不大于 0 时使用列族的默认过期时间
+func (cf *ColumnFamily) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.PutCF(cf, key, value)
+	if batch.Len() > 0 {
+		batch.ops[0].ExpiresAt = expiresAt(ttl)
+	}
+	return cf.db.Write(batch)
+}
+
+// Delete 删除列族中的 key
+func (cf *ColumnFamily) Delete(key string) error {
+	batch := NewWriteBatch()
+	batch.DeleteCF(cf, key)
+	return cf.db.Write(batch)
+}
+
+// DeleteRange 删除列族中 [start, end) 范围内的所有 key，end 为空表示不限制
+func (cf *ColumnFamily) DeleteRange(start, end string) error {
+	batch := NewWriteBatch()
+	batch.DeleteRangeCF(cf, start, end)
+	return cf.db.Write(batch)
+}
+
+// Merge 在列族中写入合并操作数
+func (cf *ColumnFamily) Merge(key string, operand interface{}) error {
+	batch := NewWriteBatch()
+	batch.MergeCF(cf, key, operand)
+	return cf.db.Write(batch)
+}
+
+// NewIterator 创建遍历列族的迭代器
+func (cf *ColumnFamily) NewIterator() *Iterator {
+	return newIterator(cf, "", cf.db.getVisibleSeq())
+}
+
+// NewPrefixIterator 创建只遍历列族中以 prefix 开头的 key 的迭代器
+func (cf *ColumnFamily) NewPrefixIterator(prefix string) *Iterator {
+	return newIterator(cf, prefix, cf.db.getVisibleSeq())
+}
+
+// Scan 按 key 升序返回列族中 [start, end) 范围内的记录
+func (cf *ColumnFamily) Scan(start, end string, limit int) []KeyValue {
+	return scan(cf.NewIterator(), start, end, limit)
+}
+
+// ScanContext 和 Scan 相同，遍历中 ctx 被取消或超时时停止并返回 ctx.Err()，读取失败时返回错误
+func (cf *ColumnFamily) ScanContext(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result, err := scanContext(ctx, cf.NewIterator(), start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ScanPrefix 按 key 升序返回列族中以 prefix 开头的记录
+func (cf *ColumnFamily) ScanPrefix(prefix string, limit int) []KeyValue {
+	return scanPrefix(cf.NewPrefixIterator(prefix), limit)
+}
+
+// compactFamilies 检查所有列族是否需要压缩，返回第一个失败的压缩的错误
+func (d *DB) compactFamilies() error {
+	for _, cf := range d.getFamilies() {
+		cf.bgLock.Lock()
+		var err error
+		if !cf.isDropped() {
+			err = cf.TableTree.Check()
+		}
+		cf.bgLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestFamily 获取请求参数 cf 指定的列族，为空时是默认列族，列族不存在时返回 404
+func (h HttpServer) requestFamily(w http.ResponseWriter, r *http.Request) (*ColumnFamily, bool) {
+	name := r.URL.Query().Get("cf")
+	if name == "" {
+		return h.db.ColumnFamily, true
+	}
+	cf, ok := h.db.getFamily(name)
+	if !ok {
+		http.Error(w, ErrFamilyNotFound.Error(), http.StatusNotFound)
+	}
+	return cf, ok
+}
+
+// familyInfo 列族管理接口返回的列族信息
+type familyInfo struct {
+	Name    string              `json:"name"`
+	Options config.FamilyConfig `json:"options"`
+}
+
+// ListColumnFamilies 列出所有列族和它们的设置
+func (h HttpServer) ListColumnFamilies(w http.ResponseWriter, r *http.Request) {
+	families := h.db.getFamilies()
+	result := make([]familyInfo, len(families))
+	for i, cf := range families {
+		result[i] = familyInfo{Name: cf.name, Options: cf.options}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// CreateColumnFamily 创建列族，参数为 name，请求体可以是 JSON 形式的列族设置，例如
+// {"Threshold":1000,"TTL":3600000000000,"Compression":"flate","CompactionStyle":"tiered"}，TTL 的单位是纳秒
+func (h HttpServer) CreateColumnFamily(w http.ResponseWriter, r *http.Request) {
+	record := familyRecord{Op: familyCreate, Name: r.URL.Query().Get("name")}
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > 0 {
+			if err = json.Unmarshal(body, &record.Options); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	h.applyFamily(w, r, record)
+}
+
+// DropColumnFamily 删除列族，参数为 name
+func (h HttpServer) DropColumnFamily(w http.ResponseWriter, r *http.Request) {
+	h.applyFamily(w, r, familyRecord{Op: familyDrop, Name: r.URL.Query().Get("name")})
+}
+
+// applyFamily 通过 raft 在所有节点上创建或删除列族，不是 leader 时返回 503 和 leader 的地址，失败时按错误返回状态码
+func (h HttpServer) applyFamily(w http.ResponseWriter, r *http.Request, record familyRecord) {
+	if !h.checkLeader(w) {
+		return
+	}
+	if record.Name == wal.DefaultFamily || !familyNamePattern.MatchString(record.Name) {
+		writeRestErr(w, ErrInvalidFamilyName)
+		return
+	}
+	if err := record.Options.Validate(); err != nil {
+		writeRestErr(w, fmt.Errorf("%w: %v", ErrInvalidFamilyOptions, err))
+		return
+	}
+	data, _ := json.Marshal(record)
+	response, err := h.db.propose(r.Context(), append([]byte("cf,"), data...))
+	if err == nil {
+		err, _ = response.(error)
+	}
+	if err != nil {
+		log.Println("column family apply failure", err)
+		h.writeRaftErr(w, err)
+		return
+	}
+	fmt.Fprintf(w, "success")
+}
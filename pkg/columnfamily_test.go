@@ -0,0 +1,306 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mylsmtree/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// familyTableBytes 列族所有 SSTable 文件的总字节数
+func familyTableBytes(t *testing.T, db *DB, name string) int64 {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(familyPath(db.dir, name), "*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	return total
+}
+
+// compressibleValue 重复内容很多的值
+func compressibleValue(i int) string {
+	return fmt.Sprint(i, strings.Repeat("abcdefgh", 50))
+}
+
+func TestFamilyCompression(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := db.CreateColumnFamily("plain", config.FamilyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := db.CreateColumnFamily("compressed", config.FamilyConfig{Compression: config.CompressionFlate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint("key", i)
+		if err = plain.Set(key, compressibleValue(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err = compressed.Set(key, compressibleValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestDB(t, db)
+
+	plainBytes, compressedBytes := familyTableBytes(t, db, "plain"), familyTableBytes(t, db, "compressed")
+	if compressedBytes == 0 || compressedBytes*2 > plainBytes {
+		t.Fatalf("compressed family uses %d bytes, plain family %d", compressedBytes, plainBytes)
+	}
+	check := func(cf *ColumnFamily) {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			if value, ok := cf.GetJSON(fmt.Sprint("key", i)); !ok || value != compressibleValue(i) {
+				t.Fatalf("%s: key%d = %v, %v", cf.Name(), i, value, ok)
+			}
+		}
+		it := cf.NewIterator()
+		defer it.Close()
+		n := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			n++
+		}
+		if n != 50 {
+			t.Fatalf("%s: iterated %d keys, want 50", cf.Name(), n)
+		}
+	}
+	check(compressed)
+
+	// 压缩后写入下一层的记录同样被压缩
+	if err = compressed.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	check(compressed)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 压缩算法保存在列族的设置中，重启后仍然生效
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	compressed, ok := db.getFamily("compressed")
+	if !ok {
+		t.Fatal("compressed family was not reopened")
+	}
+	if compressed.con.Compression != config.CompressionFlate {
+		t.Fatalf("compression after reopen = %q", compressed.con.Compression)
+	}
+	check(compressed)
+}
+
+func TestFamilyCompressionChanged(t *testing.T) {
+	// 不压缩时写入的 SSTable 在开启压缩后仍然可以读取，和新的文件一起压缩
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		db.Set(fmt.Sprint("key", i), compressibleValue(i))
+	}
+	flushTestDB(t, db)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.Compression = config.CompressionFlate
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 20; i < 40; i++ {
+		db.Set(fmt.Sprint("key", i), compressibleValue(i))
+	}
+	flushTestDB(t, db)
+	if err = db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		if value, ok := db.GetJSON(fmt.Sprint("key", i)); !ok || value != compressibleValue(i) {
+			t.Fatalf("key%d = %v, %v", i, value, ok)
+		}
+	}
+}
+
+func TestFamilyCompactionStyle(t *testing.T) {
+	db := openTestDB(t, nil)
+	leveled, err := db.CreateColumnFamily("leveled", config.FamilyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiered, err := db.CreateColumnFamily("tiered", config.FamilyConfig{CompactionStyle: config.CompactionTiered})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(round int) {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprint("key", round, "-", i)
+			if err := leveled.Set(key, i); err != nil {
+				t.Fatal(err)
+			}
+			if err := tiered.Set(key, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushTestDB(t, db)
+		if err := db.compactFamilies(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 每个 SSTable 都超过 level 0 的容量，按层压缩时马上合并到下一层，
+	// 按文件数压缩时一直留在 level 0，直到文件数超过 PartSize
+	partSize := db.con.PartSize
+	for round := 0; round < partSize; round++ {
+		write(round)
+	}
+	if n := leveled.TableTree.GetLevelCount(0); n != 0 {
+		t.Fatalf("leveled family has %d tables in level 0, want 0", n)
+	}
+	if n := tiered.TableTree.GetLevelCount(0); n != partSize {
+		t.Fatalf("tiered family has %d tables in level 0, want %d", n, partSize)
+	}
+	if pending := tiered.TableTree.GetPendingCompactionBytes(); pending != 0 {
+		t.Fatalf("tiered family has %d pending compaction bytes, want 0", pending)
+	}
+
+	write(partSize)
+	if n := tiered.TableTree.GetLevelCount(0); n != 0 {
+		t.Fatalf("tiered family has %d tables in level 0 after exceeding PartSize, want 0", n)
+	}
+	for round := 0; round <= partSize; round++ {
+		key := fmt.Sprint("key", round, "-", 0)
+		if value, ok := tiered.GetJSON(key); !ok || value != float64(0) {
+			t.Fatalf("%s = %v, %v", key, value, ok)
+		}
+	}
+}
+
+func TestInvalidFamilyOptions(t *testing.T) {
+	db := openTestDB(t, nil)
+	if _, err := db.CreateColumnFamily("a", config.FamilyConfig{Compression: "zip"}); !errors.Is(err, ErrInvalidFamilyOptions) {
+		t.Fatalf("unknown compression: got %v, want ErrInvalidFamilyOptions", err)
+	}
+	if _, err := db.CreateColumnFamily("a", config.FamilyConfig{CompactionStyle: "fifo"}); !errors.Is(err, ErrInvalidFamilyOptions) {
+		t.Fatalf("unknown compaction style: got %v, want ErrInvalidFamilyOptions", err)
+	}
+	if _, ok := db.getFamily("a"); ok {
+		t.Fatal("family with invalid options was created")
+	}
+
+	opts := DefaultOptions()
+	opts.CompactionStyle = "fifo"
+	if _, err := Open(t.TempDir(), opts); err == nil {
+		t.Fatal("opened a database with an unknown compaction style")
+	}
+}
+
+func TestFamilyHandlerStatus(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	h := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	request := func(h HttpServer, handler func(HttpServer, http.ResponseWriter, *http.Request), target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(h, w, httptest.NewRequest(http.MethodPost, target, nil))
+		return w
+	}
+	cases := []struct {
+		handler func(HttpServer, http.ResponseWriter, *http.Request)
+		target  string
+		status  int
+	}{
+		{HttpServer.CreateColumnFamily, "/admin/cf/create?name=users", http.StatusOK},
+		{HttpServer.CreateColumnFamily, "/admin/cf/create?name=users", http.StatusConflict},
+		{HttpServer.CreateColumnFamily, "/admin/cf/create?name=bad/name", http.StatusBadRequest},
+		{HttpServer.DropColumnFamily, "/admin/cf/drop?name=missing", http.StatusNotFound},
+		{HttpServer.DropColumnFamily, "/admin/cf/drop?name=users", http.StatusOK},
+	}
+	for _, c := range cases {
+		if w := request(h, c.handler, c.target); w.Code != c.status {
+			t.Fatalf("%s: %d %s, want %d", c.target, w.Code, w.Body.String(), c.status)
+		}
+	}
+
+	// follower 返回 503 和 leader 的 http 地址
+	_, leader := nodes[0].raft.LeaderWithID()
+	follower := HttpServer{ctx: nodes[1].raft, db: nodes[1].db, httpAddrs: map[string]string{string(leader): "10.0.0.1:7001"}}
+	w := request(follower, HttpServer.CreateColumnFamily, "/admin/cf/create?name=logs")
+	var response restError
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("create on follower: %d %s", w.Code, w.Body.String())
+	}
+	if response.LeaderAddr != "10.0.0.1:7001" {
+		t.Fatalf("not leader response = %+v", response)
+	}
+}
+
+// openFiles 进程打开的 dir 下的文件，不能列出时跳过测试
+func openFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot list open files:", err)
+	}
+	var files []string
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, dir) {
+			files = append(files, target)
+		}
+	}
+	return files
+}
+
+func TestDropFamilyClosesFiles(t *testing.T) {
+	db := openTestDB(t, nil)
+	users, err := db.CreateColumnFamily("users", config.FamilyConfig{ValueThreshold: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = users.Put([]byte(fmt.Sprint("k", i)), []byte(compressibleValue(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestDB(t, db)
+	dir, err := filepath.Abs(familyPath(db.dir, "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(openFiles(t, dir)) == 0 {
+		t.Fatal("no open SSTable or value log files before the drop")
+	}
+
+	if err = db.DropColumnFamily("users"); err != nil {
+		t.Fatal(err)
+	}
+	if files := openFiles(t, dir); len(files) != 0 {
+		t.Fatalf("files still open after the drop: %v", files)
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("family directory after the drop: %v", err)
+	}
+}
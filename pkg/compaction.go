@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mylsmtree/pkg/lsm"
+	"net/http"
+)
+
+// CompactRange 手动压缩 [start, end] 范围内的数据，start 或 end 为空表示不限制。
+// 先将内存表落盘，再从 L0 开始把和范围重叠的层逐层压缩到最底层，
+// 压缩过程中会清理已经没有旧数据需要遮盖的删除标记，progress 可以为 nil
+func CompactRange(start, end string, progress func(lsm.CompactionProgress)) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.CompactRange(start, end, progress)
+}
+
+// CompactRangeContext 和 CompactRange 相同，ctx 被取消或超时时在下一层开始前停止并返回 ctx.Err()
+func CompactRangeContext(ctx context.Context, start, end string, progress func(lsm.CompactionProgress)) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.CompactRangeContext(ctx, start, end, progress)
+}
+
+// CompactRange 手动压缩列族中 [start, end] 范围内的数据，落盘或压缩失败时数据库进入只读模式
+func (cf *ColumnFamily) CompactRange(start, end string, progress func(lsm.CompactionProgress)) error {
+	return cf.CompactRangeContext(context.Background(), start, end, progress)
+}
+
+// CompactRangeContext 和 CompactRange 相同，ctx 被取消或超时时停止压缩并返回 ctx.Err()，
+// 已经压缩完的层保持压缩后的状态，取消不会让数据库进入只读模式
+func (cf *ColumnFamily) CompactRangeContext(ctx context.Context, start, end string, progress func(lsm.CompactionProgress)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("Manual compaction %s [%s, %s]\r\n", cf.name, start, end)
+	cf.db.writeLock.Lock()
+	err := cf.db.writeError()
+	if err == nil {
+		err = cf.db.switchMemoryTree()
+	}
+	cf.db.writeLock.Unlock()
+	if err == nil {
+		err = cf.db.flushImmutables()
+	}
+
+	if err == nil {
+		cf.bgLock.Lock()
+		if !cf.isDropped() {
+			err = cf.TableTree.CompactRange(ctx, start, end, progress)
+		}
+		cf.bgLock.Unlock()
+	}
+	if err != nil && !errors.Is(err, ErrClosed) && !errors.Is(err, ErrReadOnly) && ctx.Err() == nil {
+		cf.db.setBackgroundError(err)
+	}
+	cf.db.updateStallMetrics()
+	return err
+}
+
+// CompactRange 管理接口，参数 cf 指定列族，逐行输出每一层的压缩进度，客户端断开连接时停止压缩
+func (h HttpServer) CompactRange(w http.ResponseWriter, r *http.Request) {
+	cf, ok := h.requestFamily(w, r)
+	if !ok {
+		return
+	}
+	vars := r.URL.Query()
+	start := vars.Get("start")
+	end := vars.Get("end")
+	flusher, _ := w.(http.Flusher)
+	err := cf.CompactRangeContext(r.Context(), start, end, func(p lsm.CompactionProgress) {
+		if p.Compacted {
+			fmt.Fprintf(w, "[%d/%d] compacted level %d into level %d\n", p.Done, p.Total, p.Level, p.TargetLevel)
+		} else {
+			fmt.Fprintf(w, "[%d/%d] skipped level %d\n", p.Done, p.Total, p.Level)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(w, "failure: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "success")
+}
+
+// StartServer 打开数据库时使用的压缩过滤器，在数据库初始化前设置时暂存在这里
+var compactionFilter lsm.CompactionFilter
+
+// SetCompactionFilter 设置压缩过滤器，可以在 StartServer 之前调用，传入 nil 表示不过滤
+func SetCompactionFilter(filter lsm.CompactionFilter) {
+	compactionFilter = filter
+	if database != nil {
+		database.SetCompactionFilter(filter)
+	}
+}
+
+// SetCompactionFilter 设置数据库的压缩过滤器，应用到所有列族
+func (d *DB) SetCompactionFilter(filter lsm.CompactionFilter) {
+	d.compactionFilter = filter
+	for _, cf := range d.getFamilies() {
+		cf.TableTree.SetCompactionFilter(filter)
+	}
+}
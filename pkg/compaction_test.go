@@ -0,0 +1,259 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mylsmtree/pkg/lsm"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tableFiles 列族目录中的 SSTable 文件数
+func tableFiles(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestCompactionDropsTombstonesAtBottom(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprint("k", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestDB(t, db)
+	for i := 0; i < 10; i++ {
+		if err := db.Delete(fmt.Sprint("k", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestDB(t, db)
+	if files := tableFiles(t, db.dir); files != 2 {
+		t.Fatalf("%d SSTables before compaction, want 2", files)
+	}
+
+	// 压缩到最底层后没有更旧的数据需要遮盖，删除标记和被删除的数据都被清理
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if files := tableFiles(t, db.dir); files != 0 {
+		t.Fatalf("%d SSTables after compacting only deleted keys", files)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get([]byte(fmt.Sprint("k", i))); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("k%d: got %v, want ErrNotFound", i, err)
+		}
+	}
+}
+
+func TestCompactionKeepsLiveKeysWithTombstones(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = db.Put([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestDB(t, db)
+	for i := 0; i < 10; i += 2 {
+		if err = db.Delete(fmt.Sprint("k", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后从 SSTable 读取，被删除的 key 不会重新出现
+	db = reopenTestDB(t, dir, nil, db)
+	for i := 0; i < 10; i++ {
+		value, err := db.Get([]byte(fmt.Sprint("k", i)))
+		if i%2 == 0 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("deleted k%d: got %q, %v", i, value, err)
+			}
+		} else if err != nil || string(value) != fmt.Sprint("v", i) {
+			t.Fatalf("k%d = %q, %v", i, value, err)
+		}
+	}
+}
+
+// twoLevel0Tables 写入两个 L0 的 SSTable，key 为 k0 到 k9
+func twoLevel0Tables(t *testing.T, db *DB) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 4 || i == 9 {
+			flushTestDB(t, db)
+		}
+	}
+	if files := db.getLevel0Files(); files != 2 {
+		t.Fatalf("%d level 0 files, want 2", files)
+	}
+}
+
+func TestCompactRangeProgress(t *testing.T) {
+	db := openTestDB(t, nil)
+	twoLevel0Tables(t, db)
+
+	// 范围和所有 SSTable 都不重叠时跳过
+	var progress []lsm.CompactionProgress
+	if err := db.CompactRange("x", "z", func(p lsm.CompactionProgress) {
+		progress = append(progress, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 1 || progress[0].Compacted || db.getLevel0Files() != 2 {
+		t.Fatalf("progress = %+v, %d level 0 files", progress, db.getLevel0Files())
+	}
+
+	progress = nil
+	if err := db.CompactRange("k3", "k6", func(p lsm.CompactionProgress) {
+		progress = append(progress, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := lsm.CompactionProgress{Level: 0, TargetLevel: 1, Compacted: true, Done: 1, Total: 1}
+	if len(progress) != 1 || progress[0] != want {
+		t.Fatalf("progress = %+v, want [%+v]", progress, want)
+	}
+	if files := db.getLevel0Files(); files != 0 {
+		t.Fatalf("%d level 0 files after compaction", files)
+	}
+	for i := 0; i < 10; i++ {
+		if value, err := db.Get([]byte(fmt.Sprint("k", i))); err != nil || string(value) != fmt.Sprint("v", i) {
+			t.Fatalf("k%d = %q, %v", i, value, err)
+		}
+	}
+}
+
+func TestCompactRangeCanceled(t *testing.T) {
+	db := openTestDB(t, nil)
+	twoLevel0Tables(t, db)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.CompactRangeContext(ctx, "", "", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	// 取消不是后台错误，数据库仍然可以写入
+	if err := db.BackgroundError(); err != nil {
+		t.Fatal(err)
+	}
+	if files := db.getLevel0Files(); files != 2 {
+		t.Fatalf("%d level 0 files after a canceled compaction, want 2", files)
+	}
+}
+
+func TestCompactRangeHandler(t *testing.T) {
+	db := openTestDB(t, nil)
+	twoLevel0Tables(t, db)
+	h := HttpServer{db: db}
+
+	w := httptest.NewRecorder()
+	h.CompactRange(w, httptest.NewRequest(http.MethodPost, "/admin/compact?cf=missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("missing family: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.CompactRange(w, httptest.NewRequest(http.MethodPost, "/admin/compact?start=k0&end=k9", nil))
+	if body := w.Body.String(); !strings.Contains(body, "[1/1] compacted level 0 into level 1") || !strings.HasSuffix(body, "success") {
+		t.Fatalf("response = %q", body)
+	}
+}
+
+// testFilter 删除 tmp/ 开头的 key，把 upper/ 开头的 key 的值转为大写
+var testFilter = lsm.CompactionFilterFunc(func(level int, key string, value []byte) (lsm.CompactionDecision, []byte) {
+	switch {
+	case strings.HasPrefix(key, "tmp/"):
+		return lsm.Remove, nil
+	case strings.HasPrefix(key, "upper/"):
+		return lsm.ChangeValue, bytes.ToUpper(value)
+	}
+	return lsm.Keep, nil
+})
+
+func TestCompactionFilter(t *testing.T) {
+	db := openTestDB(t, nil)
+	for key, value := range map[string]string{"tmp/a": "1", "upper/a": "abc", "keep": "xyz"} {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestDB(t, db)
+	db.SetCompactionFilter(testFilter)
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("tmp/a")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("tmp/a: got %v, want ErrNotFound", err)
+	}
+	for key, want := range map[string]string{"upper/a": "ABC", "keep": "xyz"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("%s = %q, %v, want %q", key, value, err, want)
+		}
+	}
+}
+
+func TestCompactionFilterRemoveHidesOlderVersions(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.Put([]byte("tmp/a"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	flushTestDB(t, db)
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	// 新版本在 L0，旧版本在更深的层，过滤器删除新版本时旧版本不能重新可见
+	if err := db.Put([]byte("tmp/a"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	flushTestDB(t, db)
+	db.SetCompactionFilter(testFilter)
+	var compacted int
+	if err := db.CompactRange("", "", func(p lsm.CompactionProgress) {
+		if p.Compacted && p.Level == 0 {
+			compacted++
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if compacted != 1 {
+		t.Fatal("level 0 was not compacted")
+	}
+	if value, err := db.Get([]byte("tmp/a")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("tmp/a = %q, %v, want ErrNotFound", value, err)
+	}
+}
+
+func TestCompactionFilterSkipsSnapshotVersions(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.Put([]byte("upper/a"), []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+	flushTestDB(t, db)
+	db.SetCompactionFilter(testFilter)
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	// 快照能看到的版本不经过过滤器
+	if value, err := snapshot.Get([]byte("upper/a")); err != nil || string(value) != "abc" {
+		t.Fatalf("snapshot read = %q, %v", value, err)
+	}
+}
@@ -1,6 +1,27 @@
 package config
 
-import "sync"
+import (
+	"fmt"
+	"time"
+)
+
+// SSTable 中记录的压缩算法
+const (
+	// CompressionNone 不压缩
+	CompressionNone = "none"
+	// CompressionFlate 每条记录用 DEFLATE 压缩
+	CompressionFlate = "flate"
+)
+
+// 压缩策略，决定一层的 SSTable 什么时候合并到下一层
+const (
+	// CompactionLeveled 一层的文件数超过 PartSize 或者大小超过这一层的容量时合并，
+	// 读取时需要查找的 SSTable 较少
+	CompactionLeveled = "leveled"
+	// CompactionTiered 只在一层的文件数超过 PartSize 时合并，不限制每层的大小，
+	// 数据被重写的次数较少，适合写多读少的数据
+	CompactionTiered = "tiered"
+)
 
 type Config struct {
 	DataDir string
@@ -8,18 +29,115 @@ type Config struct {
 	PartSize int
 	Threshold int
 	CheckInterval int
+	// 某一层中删除标记占比超过该值时触发压缩，0 表示不按删除标记触发
+	TombstoneRatio float64
+	// 写入限流，达到 Slowdown 阈值时每次写入延迟 SlowdownDelay 毫秒，
+	// 达到 Stop 阈值时阻塞写入直到后台落盘、压缩跟上，0 表示不限制
+	L0SlowdownTrigger int
+	L0StopTrigger int
+	PendingCompactionSlowdownBytes int64
+	PendingCompactionStopBytes int64
+	ImmutableSlowdownTrigger int
+	ImmutableStopTrigger int
+	SlowdownDelay int
+	// 大于等于 ValueThreshold 字节的值在落盘时写入 value log，SSTable 中只保存指针，0 表示不分离
+	ValueThreshold int
+	// 单个 value log 文件的最大字节数，0 表示不限制
+	ValueLogFileSize int64
+	// value log 文件中失效数据占比超过该值时回收，0 表示不回收
+	ValueLogGCRatio float64
+	// 没有指定过期时间的写入的默认过期时间，0 表示不过期
+	TTL time.Duration
+	// 每次写入 wal 后调用 fsync
+	WALSync bool
+	// SSTable 中记录的压缩算法，空表示 CompressionNone
+	Compression string
+	// 压缩策略，空表示 CompactionLeveled
+	CompactionStyle string
+	// 关闭时不将内存表落盘，只同步 wal，下次打开时回放 wal，关闭更快
+	SkipFlushOnClose bool
+}
+
+// FamilyConfig 列族的设置，为 0 或空的字段使用 Config 中的值
+type FamilyConfig struct {
+	Level0Size      int           `json:",omitempty"`
+	PartSize        int           `json:",omitempty"`
+	Threshold       int           `json:",omitempty"`
+	TombstoneRatio  float64       `json:",omitempty"`
+	ValueThreshold  int           `json:",omitempty"`
+	TTL             time.Duration `json:",omitempty"`
+	Compression     string        `json:",omitempty"`
+	CompactionStyle string        `json:",omitempty"`
+}
+
+// Validate 检查列族的设置，为空的压缩算法和压缩策略使用 Config 中的值
+func (family FamilyConfig) Validate() error {
+	if family.Compression != "" {
+		if err := CheckCompression(family.Compression); err != nil {
+			return err
+		}
+	}
+	if family.CompactionStyle != "" {
+		return CheckCompactionStyle(family.CompactionStyle)
+	}
+	return nil
 }
 
-var once *sync.Once = &sync.Once{}
+// CheckCompression 检查压缩算法的名字，空表示不压缩
+func CheckCompression(name string) error {
+	switch name {
+	case "", CompressionNone, CompressionFlate:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", name)
+}
+
+// CheckCompactionStyle 检查压缩策略的名字，空表示 CompactionLeveled
+func CheckCompactionStyle(name string) error {
+	switch name {
+	case "", CompactionLeveled, CompactionTiered:
+		return nil
+	}
+	return fmt.Errorf("unknown compaction style %q", name)
+}
+
+// WithFamily 用列族的设置覆盖配置中对应的值
+func (con Config) WithFamily(family FamilyConfig) Config {
+	if family.Level0Size > 0 {
+		con.Level0Size = family.Level0Size
+	}
+	if family.PartSize > 0 {
+		con.PartSize = family.PartSize
+	}
+	if family.Threshold > 0 {
+		con.Threshold = family.Threshold
+	}
+	if family.TombstoneRatio > 0 {
+		con.TombstoneRatio = family.TombstoneRatio
+	}
+	if family.ValueThreshold > 0 {
+		con.ValueThreshold = family.ValueThreshold
+	}
+	if family.TTL > 0 {
+		con.TTL = family.TTL
+	}
+	if family.Compression != "" {
+		con.Compression = family.Compression
+	}
+	if family.CompactionStyle != "" {
+		con.CompactionStyle = family.CompactionStyle
+	}
+	return con
+}
 
 var config Config
 
+// Init 保存 StartServer 使用的配置，数据库通过 Open 打开时使用自己的配置，不读取这里
 func Init(con Config) {
-	once.Do(func() {
-		config = con
-	})
+	config = con
 }
 
+// GetConfig 获取 StartServer 使用的配置
 func GetConfig() Config {
 	return config
-}
\ No newline at end of file
+}
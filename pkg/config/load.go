@@ -0,0 +1,245 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix 环境变量的前缀，例如 MYLSMTREE_RAFT_ADDR 对应 raft.addr，MYLSMTREE_CONFIG 为配置文件路径
+const EnvPrefix = "MYLSMTREE_"
+
+// setting Options 中的一项设置
+type setting struct {
+	// 配置文件中的名字，例如 raft.addr
+	name  string
+	usage string
+	field reflect.Value
+}
+
+// flagName 命令行参数名，例如 raft_addr
+func (s setting) flagName() string {
+	return strings.Replace(s.name, ".", "_", 1)
+}
+
+// envName 环境变量名，例如 MYLSMTREE_RAFT_ADDR
+func (s setting) envName() string {
+	return EnvPrefix + strings.ToUpper(s.flagName())
+}
+
+// set 把字符串形式的值写入设置
+func (s setting) set(value string) error {
+	field := s.field
+	var err error
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(value); err == nil {
+			field.SetBool(b)
+		}
+	case reflect.Int, reflect.Int64:
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil {
+				field.SetInt(int64(d))
+			}
+			break
+		}
+		var i int64
+		if i, err = strconv.ParseInt(value, 10, 64); err == nil {
+			field.SetInt(i)
+		}
+	case reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(value, 64); err == nil {
+			field.SetFloat(f)
+		}
+	default:
+		err = fmt.Errorf("unsupported type %s", field.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s, want %s", value, s.name, s.kind())
+	}
+	return nil
+}
+
+// kind 设置的值的形式，用于错误信息
+func (s setting) kind() string {
+	switch {
+	case s.field.Type() == reflect.TypeOf(time.Duration(0)):
+		return "a duration like 10s"
+	case s.field.Kind() == reflect.Bool:
+		return "true or false"
+	case s.field.Kind() == reflect.Float64:
+		return "a number"
+	default:
+		return "an integer"
+	}
+}
+
+// String 设置当前的值，和 set 接受的形式相同
+func (s setting) String() string {
+	return fmt.Sprint(s.field.Interface())
+}
+
+// settings 按字段顺序列出 o 中的所有设置，修改返回的设置会修改 o
+func (o *Options) settings() []setting {
+	var result []setting
+	sections := reflect.ValueOf(o).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("json")
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			result = append(result, setting{
+				name:  sectionName + "." + field.Tag.Get("json"),
+				usage: field.Tag.Get("usage"),
+				field: section.Field(j),
+			})
+		}
+	}
+	return result
+}
+
+// Load 加载服务的设置并校验，后面的来源覆盖前面的：DefaultOptions、
+// -config 参数或 MYLSMTREE_CONFIG 指定的配置文件、MYLSMTREE_ 开头的环境变量、命令行参数。
+// 每项设置对应一个命令行参数，例如 raft.addr 对应 -raft_addr，
+// args 不包含程序名，参数为 -h 时打印用法并返回 flag.ErrHelp
+func Load(args []string) (Options, error) {
+	options := DefaultOptions()
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "config file, .yaml, .yml, .toml or .json")
+	// 命令行参数最后生效，先记下来
+	flags := make(map[string]string)
+	for _, s := range options.settings() {
+		fs.Var(&flagValue{setting: s, flags: flags}, s.flagName(), s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return options, err
+	}
+	if fs.NArg() > 0 {
+		return options, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *configPath != "" {
+		if err := options.LoadFile(*configPath); err != nil {
+			return options, err
+		}
+	}
+	for _, s := range options.settings() {
+		if value, ok := os.LookupEnv(s.envName()); ok {
+			if err := s.set(value); err != nil {
+				return options, fmt.Errorf("%s: %w", s.envName(), err)
+			}
+		}
+	}
+	for _, s := range options.settings() {
+		if value, ok := flags[s.flagName()]; ok {
+			if err := s.set(value); err != nil {
+				return options, err
+			}
+		}
+	}
+	return options, options.Validate()
+}
+
+// flagValue 命令行参数，解析时只记下参数的值，文件和环境变量加载完后再写入
+type flagValue struct {
+	setting
+	flags map[string]string
+}
+
+func (v *flagValue) Set(value string) error {
+	// 先检查值的格式，让参数错误和用法一起输出
+	probe := v.setting
+	probe.field = reflect.New(probe.field.Type()).Elem()
+	if err := probe.set(value); err != nil {
+		return fmt.Errorf("want %s", probe.kind())
+	}
+	v.flags[v.flagName()] = value
+	return nil
+}
+
+// String 默认值，为零值时返回空字符串，用法中不输出默认值
+func (v *flagValue) String() string {
+	if !v.field.IsValid() || v.field.IsZero() {
+		return ""
+	}
+	return v.setting.String()
+}
+
+// IsBoolFlag bool 类型的设置可以写成 -wal_sync
+func (v *flagValue) IsBoolFlag() bool {
+	return v.field.IsValid() && v.field.Kind() == reflect.Bool
+}
+
+// LoadFile 从配置文件加载设置，覆盖 o 中已有的值，按扩展名选择 YAML、TOML 或 JSON 格式。
+// 文件按分组组织，例如 YAML 中的 raft: {addr: 127.0.0.1:7000}，时长写成 10s 这样的字符串
+func (o *Options) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	default:
+		return fmt.Errorf("%s: unknown config file format, want .yaml, .yml, .toml or .json", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	settings := make(map[string]setting)
+	for _, s := range o.settings() {
+		settings[s.name] = s
+	}
+	for sectionName, section := range values {
+		fields, ok := section.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %s must be a table of options", path, sectionName)
+		}
+		for name, value := range fields {
+			s, ok := settings[sectionName+"."+name]
+			if !ok {
+				return fmt.Errorf("%s: unknown option %s.%s", path, sectionName, name)
+			}
+			if value == nil {
+				return fmt.Errorf("%s: missing value for %s", path, s.name)
+			}
+			if err = s.set(fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// String 每行一项设置，按分组顺序列出，用于启动时输出到日志
+func (o Options) String() string {
+	var b strings.Builder
+	for _, s := range o.settings() {
+		fmt.Fprintf(&b, "%s = %s\n", s.name, s.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig 在临时目录中写入配置文件，返回文件路径
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setenv 设置环境变量，测试结束后恢复
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(name, old)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	})
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+engine:
+  data_dir: /var/lib/lsm
+  check_interval: 5s
+  value_log_gc_ratio: 0.25
+wal:
+  sync: true
+raft:
+  id: "2"
+  cluster: 2/127.0.0.1:7000
+`,
+		"config.toml": `
+[engine]
+data_dir = "/var/lib/lsm"
+check_interval = "5s"
+value_log_gc_ratio = 0.25
+[wal]
+sync = true
+[raft]
+id = "2"
+cluster = "2/127.0.0.1:7000"
+`,
+		"config.json": `{
+  "engine": {"data_dir": "/var/lib/lsm", "check_interval": "5s", "value_log_gc_ratio": 0.25},
+  "wal": {"sync": true},
+  "raft": {"id": "2", "cluster": "2/127.0.0.1:7000"}
+}`,
+	}
+	for name, content := range files {
+		options := DefaultOptions()
+		if err := options.LoadFile(writeConfig(t, name, content)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		e := options.Engine
+		if e.DataDir != "/var/lib/lsm" || e.CheckInterval != 5*time.Second || e.ValueLogGCRatio != 0.25 ||
+			!options.WAL.Sync || options.Raft.ID != "2" || options.Raft.Cluster != "2/127.0.0.1:7000" {
+			t.Fatalf("%s: loaded %+v", name, options)
+		}
+		// 文件中没有的设置保持默认值
+		if e.MemtableThreshold != DefaultOptions().Engine.MemtableThreshold {
+			t.Fatalf("%s: memtable_threshold = %d", name, e.MemtableThreshold)
+		}
+		if err := options.Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown.yaml":  "engine:\n  no_such_option: 1\n",
+		"section.yaml":  "engine: 1\n",
+		"value.yaml":    "engine:\n  memtable_threshold: many\n",
+		"duration.json": `{"engine": {"check_interval": "soon"}}`,
+		"config.ini":    "[engine]\n",
+	} {
+		options := DefaultOptions()
+		if err := options.LoadFile(writeConfig(t, name, content)); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "engine:\n  data_dir: from-file\n  memtable_threshold: 10\n  ttl: 1m\n")
+	setenv(t, EnvPrefix+"CONFIG", path)
+	setenv(t, EnvPrefix+"ENGINE_MEMTABLE_THRESHOLD", "20")
+	setenv(t, EnvPrefix+"ENGINE_TTL", "2m")
+
+	options, err := Load([]string{"-engine_ttl", "3m", "-wal_sync"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := options.Engine
+	if e.DataDir != "from-file" || e.MemtableThreshold != 20 || e.TTL != 3*time.Minute || !options.WAL.Sync {
+		t.Fatalf("loaded %+v", options)
+	}
+
+	if _, err = Load([]string{"-engine_memtable_threshold", "many"}); err == nil {
+		t.Fatal("invalid flag value loaded without an error")
+	}
+	setenv(t, EnvPrefix+"ENGINE_TTL", "soon")
+	if _, err = Load(nil); err == nil || !strings.Contains(err.Error(), EnvPrefix+"ENGINE_TTL") {
+		t.Fatalf("invalid environment variable: got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultOptions().Validate(); err != nil {
+		t.Fatalf("default options: %v", err)
+	}
+	options := DefaultOptions()
+	options.Engine.MemtableThreshold = 0
+	options.Engine.ValueLogGCRatio = 2
+	options.Compaction.L0SlowdownTrigger = 10
+	options.Compaction.L0StopTrigger = 5
+	options.HTTP.Addr = options.Raft.Addr
+	err := options.Validate()
+	if err == nil {
+		t.Fatal("invalid options passed validation")
+	}
+	// 错误中列出所有不合法的设置
+	for _, name := range []string{"engine.memtable_threshold", "engine.value_log_gc_ratio", "compaction.l0_stop_trigger", "http.addr"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not mention %s", err, name)
+		}
+	}
+}
+
+func TestOptionsString(t *testing.T) {
+	out := DefaultOptions().String()
+	for _, line := range []string{"engine.data_dir = data\n", "raft.addr = 127.0.0.1:7000\n", "shutdown.timeout = 30s\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("options dump does not contain %q:\n%s", line, out)
+		}
+	}
+}
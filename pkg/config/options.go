@@ -0,0 +1,283 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Options 服务的全部设置，按用途分组。可以从 YAML、TOML 或 JSON 文件加载，
+// 再用环境变量和命令行参数覆盖，见 Load。json 标签是配置文件中的名字，usage 标签是命令行参数的说明
+type Options struct {
+	Engine     EngineOptions     `json:"engine"`
+	WAL        WALOptions        `json:"wal"`
+	Compaction CompactionOptions `json:"compaction"`
+	Raft       RaftOptions       `json:"raft"`
+	HTTP       HTTPOptions       `json:"http"`
+	GRPC       GRPCOptions       `json:"grpc"`
+	Shutdown   ShutdownOptions   `json:"shutdown"`
+}
+
+// EngineOptions 存储引擎的设置，数字为 0 的限制表示不开启
+type EngineOptions struct {
+	DataDir                  string        `json:"data_dir" usage:"data directory"`
+	MemtableThreshold        int           `json:"memtable_threshold" usage:"number of records that fills a memtable"`
+	CheckInterval            time.Duration `json:"check_interval" usage:"interval of the background flush and compaction check"`
+	ImmutableSlowdownTrigger int           `json:"immutable_slowdown_trigger" usage:"immutable memtables that slow down writes, 0 disables"`
+	ImmutableStopTrigger     int           `json:"immutable_stop_trigger" usage:"immutable memtables that stop writes, 0 disables"`
+	SlowdownDelay            time.Duration `json:"slowdown_delay" usage:"delay of a slowed down write"`
+	ValueThreshold           int           `json:"value_threshold" usage:"values of at least this many bytes go to the value log, 0 disables"`
+	ValueLogFileSize         int64         `json:"value_log_file_size" usage:"max bytes of a value log file, 0 is unlimited"`
+	ValueLogGCRatio          float64       `json:"value_log_gc_ratio" usage:"garbage ratio that triggers value log GC, 0 disables"`
+	TTL                      time.Duration `json:"ttl" usage:"default time to live of written keys, 0 never expires"`
+	Compression              string        `json:"compression" usage:"compression of SSTable records, none or flate"`
+}
+
+// WALOptions wal 的设置
+type WALOptions struct {
+	Sync bool `json:"sync" usage:"fsync the WAL after every write"`
+}
+
+// CompactionOptions 压缩和写入限流的设置
+type CompactionOptions struct {
+	Style                          string  `json:"style" usage:"compaction style, leveled or tiered"`
+	Level0Size                     int     `json:"level0_size" usage:"max bytes of level 0, each level is 10 times larger"`
+	MaxLevelFiles                  int     `json:"max_level_files" usage:"max SSTables of a level"`
+	TombstoneRatio                 float64 `json:"tombstone_ratio" usage:"tombstone ratio that triggers a compaction, 0 disables"`
+	L0SlowdownTrigger              int     `json:"l0_slowdown_trigger" usage:"level 0 files that slow down writes, 0 disables"`
+	L0StopTrigger                  int     `json:"l0_stop_trigger" usage:"level 0 files that stop writes, 0 disables"`
+	PendingCompactionSlowdownBytes int64   `json:"pending_compaction_slowdown_bytes" usage:"pending compaction bytes that slow down writes, 0 disables"`
+	PendingCompactionStopBytes     int64   `json:"pending_compaction_stop_bytes" usage:"pending compaction bytes that stop writes, 0 disables"`
+}
+
+// RaftOptions raft 节点的设置
+type RaftOptions struct {
+	ID      string `json:"id" usage:"raft id"`
+	Addr    string `json:"addr" usage:"raft listen addr"`
+	Cluster string `json:"cluster" usage:"cluster info, comma separated id/addr, id/addr/http_addr or id/addr/http_addr/grpc_addr"`
+	Dir     string `json:"dir" usage:"raft data directory, empty is node/raft_<id>"`
+}
+
+// HTTPOptions http 服务的设置
+type HTTPOptions struct {
+	Addr         string        `json:"addr" usage:"http listen addr"`
+	ReadTimeout  time.Duration `json:"read_timeout" usage:"max duration of reading a request, 0 is unlimited"`
+	WriteTimeout time.Duration `json:"write_timeout" usage:"max duration of writing a response, 0 is unlimited"`
+	MaxBodyBytes int64         `json:"max_body_bytes" usage:"max bytes of a /v1 request body, 0 is unlimited"`
+}
+
+// GRPCOptions gRPC 服务的设置
+type GRPCOptions struct {
+	Addr string `json:"addr" usage:"grpc listen addr, empty disables the grpc server"`
+}
+
+// ShutdownOptions 收到 SIGINT 或 SIGTERM 后退出的设置
+type ShutdownOptions struct {
+	Timeout            time.Duration `json:"timeout" usage:"max duration of draining http requests, 0 waits for all of them"`
+	TransferLeadership bool          `json:"transfer_leadership" usage:"transfer raft leadership to another node before leaving"`
+	Leave              bool          `json:"leave" usage:"remove this node from the raft cluster before leaving, a follower asks the leader at its http addr in raft.cluster"`
+	SkipFlush          bool          `json:"skip_flush" usage:"only sync the WAL instead of flushing memtables, they are replayed on the next start"`
+}
+
+// DefaultOptions 默认设置
+func DefaultOptions() Options {
+	return Options{
+		Engine: EngineOptions{
+			DataDir:                  "data",
+			MemtableThreshold:        3000,
+			CheckInterval:            3 * time.Second,
+			ImmutableSlowdownTrigger: 3,
+			ImmutableStopTrigger:     5,
+			SlowdownDelay:            time.Millisecond,
+			ValueThreshold:           4096,
+			ValueLogFileSize:         64 << 20,
+			ValueLogGCRatio:          0.5,
+		},
+		Compaction: CompactionOptions{
+			Level0Size:        100,
+			MaxLevelFiles:     4,
+			TombstoneRatio:    0.5,
+			L0SlowdownTrigger: 8,
+			L0StopTrigger:     12,
+		},
+		Raft: RaftOptions{
+			ID:      "1",
+			Addr:    "127.0.0.1:7000",
+			Cluster: "1/127.0.0.1:7000/127.0.0.1:7001",
+		},
+		HTTP: HTTPOptions{
+			Addr:         "127.0.0.1:7001",
+			MaxBodyBytes: 4 << 20,
+		},
+		Shutdown: ShutdownOptions{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Config 转换为存储引擎使用的配置
+func (o Options) Config() Config {
+	return Config{
+		DataDir:                        o.Engine.DataDir,
+		Level0Size:                     o.Compaction.Level0Size,
+		PartSize:                       o.Compaction.MaxLevelFiles,
+		Threshold:                      o.Engine.MemtableThreshold,
+		CheckInterval:                  int(o.Engine.CheckInterval / time.Second),
+		TombstoneRatio:                 o.Compaction.TombstoneRatio,
+		L0SlowdownTrigger:              o.Compaction.L0SlowdownTrigger,
+		L0StopTrigger:                  o.Compaction.L0StopTrigger,
+		PendingCompactionSlowdownBytes: o.Compaction.PendingCompactionSlowdownBytes,
+		PendingCompactionStopBytes:     o.Compaction.PendingCompactionStopBytes,
+		ImmutableSlowdownTrigger:       o.Engine.ImmutableSlowdownTrigger,
+		ImmutableStopTrigger:           o.Engine.ImmutableStopTrigger,
+		SlowdownDelay:                  int(o.Engine.SlowdownDelay / time.Millisecond),
+		ValueThreshold:                 o.Engine.ValueThreshold,
+		ValueLogFileSize:               o.Engine.ValueLogFileSize,
+		ValueLogGCRatio:                o.Engine.ValueLogGCRatio,
+		TTL:                            o.Engine.TTL,
+		Compression:                    o.Engine.Compression,
+		CompactionStyle:                o.Compaction.Style,
+		WALSync:                        o.WAL.Sync,
+		SkipFlushOnClose:               o.Shutdown.SkipFlush,
+	}
+}
+
+// HTTPAddrs raft.cluster 中给出了 http 地址的节点，raft id 到 http 地址
+func (o Options) HTTPAddrs() map[string]string {
+	return o.peerAddrs(2)
+}
+
+// GRPCAddrs raft.cluster 中给出了 gRPC 地址的节点，raft id 到 gRPC 地址
+func (o Options) GRPCAddrs() map[string]string {
+	return o.peerAddrs(3)
+}
+
+// peerAddrs raft.cluster 中每个节点的第 i 个地址，没有给出的节点不在结果中
+func (o Options) peerAddrs(i int) map[string]string {
+	addrs := make(map[string]string)
+	for _, peer := range strings.Split(o.Raft.Cluster, ",") {
+		if parts := strings.Split(peer, "/"); len(parts) > i && len(parts) <= 4 && parts[i] != "" {
+			addrs[parts[0]] = parts[i]
+		}
+	}
+	return addrs
+}
+
+// RaftDir raft 的数据目录，没有设置时为 node/raft_<id>
+func (o Options) RaftDir() string {
+	if o.Raft.Dir != "" {
+		return o.Raft.Dir
+	}
+	return "node/raft_" + o.Raft.ID
+}
+
+// Validate 检查设置是否合法，返回的错误中列出所有不合法的设置
+func (o Options) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	checkTriggers := func(slowdownName string, slowdown int64, stopName string, stop int64) {
+		check(slowdown >= 0, "%s must not be negative", slowdownName)
+		check(stop >= 0, "%s must not be negative", stopName)
+		check(slowdown == 0 || stop == 0 || stop >= slowdown, "%s must not be less than %s", stopName, slowdownName)
+	}
+
+	e := o.Engine
+	check(e.DataDir != "", "engine.data_dir is required")
+	check(e.MemtableThreshold > 0, "engine.memtable_threshold must be positive")
+	check(e.CheckInterval >= time.Second, "engine.check_interval must be at least 1s")
+	checkTriggers("engine.immutable_slowdown_trigger", int64(e.ImmutableSlowdownTrigger), "engine.immutable_stop_trigger", int64(e.ImmutableStopTrigger))
+	check(e.SlowdownDelay >= 0, "engine.slowdown_delay must not be negative")
+	check(e.ValueThreshold >= 0, "engine.value_threshold must not be negative")
+	check(e.ValueLogFileSize >= 0, "engine.value_log_file_size must not be negative")
+	check(e.ValueLogGCRatio >= 0 && e.ValueLogGCRatio <= 1, "engine.value_log_gc_ratio must be between 0 and 1")
+	check(e.TTL >= 0, "engine.ttl must not be negative")
+	if err := CheckCompression(e.Compression); err != nil {
+		problems = append(problems, "engine.compression: "+err.Error())
+	}
+
+	c := o.Compaction
+	if err := CheckCompactionStyle(c.Style); err != nil {
+		problems = append(problems, "compaction.style: "+err.Error())
+	}
+	check(c.Level0Size > 0, "compaction.level0_size must be positive")
+	check(c.MaxLevelFiles > 0, "compaction.max_level_files must be positive")
+	check(c.TombstoneRatio >= 0 && c.TombstoneRatio <= 1, "compaction.tombstone_ratio must be between 0 and 1")
+	checkTriggers("compaction.l0_slowdown_trigger", int64(c.L0SlowdownTrigger), "compaction.l0_stop_trigger", int64(c.L0StopTrigger))
+	checkTriggers("compaction.pending_compaction_slowdown_bytes", c.PendingCompactionSlowdownBytes,
+		"compaction.pending_compaction_stop_bytes", c.PendingCompactionStopBytes)
+
+	r := o.Raft
+	check(r.ID != "", "raft.id is required")
+	if err := checkAddr(r.Addr); err != nil {
+		problems = append(problems, "raft.addr "+err.Error())
+	}
+	if r.Cluster == "" {
+		problems = append(problems, "raft.cluster is required")
+	} else {
+		found := false
+		for _, peer := range strings.Split(r.Cluster, ",") {
+			parts := strings.Split(peer, "/")
+			if len(parts) < 2 || len(parts) > 4 || parts[0] == "" {
+				problems = append(problems, fmt.Sprintf("raft.cluster: invalid peer %q, want id/addr, id/addr/http_addr or id/addr/http_addr/grpc_addr", peer))
+				continue
+			}
+			if err := checkAddr(parts[1]); err != nil {
+				problems = append(problems, fmt.Sprintf("raft.cluster: peer %s addr %v", parts[0], err))
+			}
+			// 只给出 gRPC 地址时 http 地址可以为空
+			if len(parts) >= 3 && (parts[2] != "" || len(parts) == 3) {
+				if err := checkAddr(parts[2]); err != nil {
+					problems = append(problems, fmt.Sprintf("raft.cluster: peer %s http addr %v", parts[0], err))
+				}
+			}
+			if len(parts) == 4 {
+				if err := checkAddr(parts[3]); err != nil {
+					problems = append(problems, fmt.Sprintf("raft.cluster: peer %s grpc addr %v", parts[0], err))
+				}
+			}
+			if parts[0] == r.ID {
+				found = true
+			}
+		}
+		check(found || r.ID == "", "raft.cluster does not contain raft.id %q", r.ID)
+	}
+
+	h := o.HTTP
+	if err := checkAddr(h.Addr); err != nil {
+		problems = append(problems, "http.addr "+err.Error())
+	}
+	check(h.Addr == "" || h.Addr != r.Addr, "http.addr must differ from raft.addr")
+	check(h.ReadTimeout >= 0, "http.read_timeout must not be negative")
+	check(h.WriteTimeout >= 0, "http.write_timeout must not be negative")
+	check(h.MaxBodyBytes >= 0, "http.max_body_bytes must not be negative")
+
+	if g := o.GRPC; g.Addr != "" {
+		if err := checkAddr(g.Addr); err != nil {
+			problems = append(problems, "grpc.addr "+err.Error())
+		}
+		check(g.Addr != r.Addr && g.Addr != h.Addr, "grpc.addr must differ from raft.addr and http.addr")
+	}
+
+	check(o.Shutdown.Timeout >= 0, "shutdown.timeout must not be negative")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid options: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkAddr 检查 host:port 形式的地址
+func checkAddr(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("is required")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%q is not host:port", addr)
+	}
+	return nil
+}
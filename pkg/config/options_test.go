@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTTPAddrs(t *testing.T) {
+	o := DefaultOptions()
+	o.Raft.ID = "1"
+	o.Raft.Cluster = "1/127.0.0.1:7000/127.0.0.1:7001,2/127.0.0.1:8000,3/127.0.0.1:9000/127.0.0.1:9001"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	addrs := o.HTTPAddrs()
+	if len(addrs) != 2 || addrs["1"] != "127.0.0.1:7001" || addrs["3"] != "127.0.0.1:9001" {
+		t.Fatalf("HTTPAddrs() = %v", addrs)
+	}
+}
+
+func TestGRPCAddrs(t *testing.T) {
+	o := DefaultOptions()
+	o.Raft.ID = "1"
+	o.Raft.Cluster = "1/127.0.0.1:7000/127.0.0.1:7001/127.0.0.1:7002,2/127.0.0.1:8000//127.0.0.1:8002,3/127.0.0.1:9000/127.0.0.1:9001"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	addrs := o.GRPCAddrs()
+	if len(addrs) != 2 || addrs["1"] != "127.0.0.1:7002" || addrs["2"] != "127.0.0.1:8002" {
+		t.Fatalf("GRPCAddrs() = %v", addrs)
+	}
+	// 只给出 gRPC 地址的节点没有 http 地址
+	if http := o.HTTPAddrs(); len(http) != 2 || http["2"] != "" {
+		t.Fatalf("HTTPAddrs() = %v", http)
+	}
+}
+
+func TestValidateClusterPeers(t *testing.T) {
+	for _, cluster := range []string{
+		"1",
+		"1/127.0.0.1:7000/127.0.0.1:7001/not-an-addr",
+		"1/127.0.0.1:7000/127.0.0.1:7001/127.0.0.1:7002/extra",
+		"1/127.0.0.1:7000/",
+		"/127.0.0.1:7000",
+		"1/127.0.0.1:7000/not-an-addr",
+	} {
+		o := DefaultOptions()
+		o.Raft.ID = "1"
+		o.Raft.Cluster = cluster
+		err := o.Validate()
+		if err == nil || !strings.Contains(err.Error(), "raft.cluster") {
+			t.Errorf("cluster %q: got %v, want a raft.cluster error", cluster, err)
+		}
+	}
+}
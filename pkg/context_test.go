@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanceledContext(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.GetContext(ctx, []byte("k")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("get: got %v, want context.Canceled", err)
+	}
+	if err := db.PutContext(ctx, []byte("k"), []byte("v2")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("put: got %v, want context.Canceled", err)
+	}
+	if value, err := db.Get([]byte("k")); err != nil || string(value) != "v" {
+		t.Fatalf("k = %q, %v after a canceled put", value, err)
+	}
+}
+
+func TestPutContextDeadlineWhileStopped(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ImmutableStopTrigger = 1
+	db := openTestDB(t, opts)
+	release := holdImmutable(t, db)
+	defer release()
+
+	// 写入被阻塞时到达截止时间就放弃写入
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := db.PutContext(ctx, []byte("k"), []byte("v")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("put returned after %v", elapsed)
+	}
+	if _, err := db.Get([]byte("k")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("k: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestRaftWriteContext(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	db := nodes[0].db
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.PutContext(ctx, []byte("k"), []byte("v")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled: got %v, want context.Canceled", err)
+	}
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if err := db.PutContext(expired, []byte("k"), []byte("v")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expired: got %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := db.Get([]byte("k")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("k: got %v, want ErrNotFound", err)
+	}
+
+	// 截止时间足够时正常提交
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PutContext(ctx, []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("k")); err != nil || string(value) != "v" {
+		t.Fatalf("k = %q, %v", value, err)
+	}
+}
+
+func TestRestPutDeadline(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ImmutableStopTrigger = 1
+	nodes := newTestCluster(t, 1, opts)
+	h := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	release := holdImmutable(t, nodes[0].db)
+	defer release()
+
+	// 请求的 context 到达截止时间时返回 504
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/v1/kv/k", strings.NewReader(`1`)).WithContext(ctx)
+	h.KV(w, r)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("put: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -1,21 +1,176 @@
 package pkg
 
 import (
+	"github.com/hashicorp/raft"
+	"mylsmtree/pkg/config"
 	"mylsmtree/pkg/lsm"
 	"mylsmtree/pkg/sort_tree"
 	"mylsmtree/pkg/wal"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
-type Database struct {
-	// 内存表
-	MemoryTree *sort_tree.Tree
-	// SSTable 列表
-	TableTree *lsm.TableTree
-	// WalF 文件句柄
+// DB 数据库，通过 Open 打开，使用完需要调用 Close。
+// 同一个进程中可以打开多个不同目录的数据库，关闭后可以重新打开
+type DB struct {
+	// 读取时可见的最大序列号，写入 wal 和内存表之后才发布，通过 atomic 访问
+	visibleSeq uint64
+	// 写入限流和后台压缩的统计信息，通过 atomic 访问
+	slowdownCount          int64
+	slowdownDuration       int64
+	stopCount              int64
+	stopDuration           int64
+	pendingCompactionBytes int64
+	// 数据库关闭后为 1，通过 atomic 访问
+	closed int32
+	// 数据目录
+	dir string
+	// 打开数据库时的配置
+	con config.Config
+	// 集群模式下的 raft 节点，事务、条件写入通过它提交，单机使用时为 nil
+	raft *raft.Raft
+	// 合并操作、前缀提取规则和压缩过滤器，应用到所有列族，可以为 nil
+	mergeOperator    lsm.MergeOperator
+	prefixExtractor  lsm.PrefixExtractor
+	compactionFilter lsm.CompactionFilter
+	// 最后分配的序列号，由 writeLock 保护
+	lastSeq uint64
+	// 已经写入的最大 raft 日志编号，由 writeLock 保护
+	appliedIndex uint64
+	// 默认列族，不指定列族的读写都在默认列族上
+	*ColumnFamily
+	// 所有列族，包括默认列族，列族名到列族，由 lock 保护，增删时还需要持有 writeLock
+	families map[string]*ColumnFamily
+	// 串行化列族的创建和删除
+	familyLock *sync.Mutex
+	// 等待落盘的只读内存表，从旧到新排列
+	Immutables []*Immutable
+	// WalF 文件句柄，所有列族共用
 	Wal *wal.Wal
+	// 保护内存表切换、Immutables 和 families
+	lock *sync.RWMutex
+	// 串行化写入，保证 wal 和内存表的顺序一致
+	writeLock *sync.Mutex
+	// 保证只读内存表只被落盘一次
+	flushLock *sync.Mutex
+	// 唤醒后台线程立即执行落盘和压缩
+	bgCh chan struct{}
+	// 写入被阻塞时在 stallCond 上等待后台线程
+	stallCond *sync.Cond
+	// 仍在使用的快照，序列号到引用次数
+	snapshots    map[uint64]int
+	snapshotLock *sync.Mutex
+	// 分页遍历在服务端保留的游标，游标编号到游标
+	scanCursors    map[uint64]*scanCursor
+	nextCursorId   uint64
+	scanCursorLock *sync.Mutex
+	// 变更订阅者，由 watchLock 保护
+	watchers  map[*Watcher]struct{}
+	watchLock *sync.Mutex
+	// 导致数据库只读的后台错误，为 nil 时可以写入
+	bgErr     error
+	bgErrLock *sync.Mutex
+	// 关闭时通知后台线程退出
+	closeCh chan struct{}
+	// 等待后台线程退出
+	bgDone *sync.WaitGroup
 }
 
-// 数据库，全局唯一实例
-var database *Database
+// Immutable 所有列族在同一时刻切换出来的只读内存表，和它们对应的 wal 归档文件在全部落盘后一起删除
+type Immutable struct {
+	// 列族名到只读内存表，切换时没有数据的列族不在其中
+	Trees   map[string]*sort_tree.Tree
+	WalPath string
+	// 切换时已经写入的最大 raft 日志编号，落盘后记录到 raft 编号文件中
+	RaftIndex uint64
+}
+
+// StartServer 打开的数据库，包级别的函数和 http 接口都使用它
+var database *DB
+
+// current 返回 StartServer 打开的数据库，没有打开时返回 ErrClosed，包级别的函数通过它访问数据库
+func current() (*DB, error) {
+	if db := database; db != nil {
+		return db, nil
+	}
+	return nil, ErrClosed
+}
+
+// getImmutables 获取只读内存表的快照
+func (d *DB) getImmutables() []*Immutable {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.Immutables
+}
 
+// getFamily 获取列族
+func (d *DB) getFamily(name string) (*ColumnFamily, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	cf, ok := d.families[name]
+	return cf, ok
+}
+
+// getFamilies 获取所有列族，按列族名排列
+func (d *DB) getFamilies() []*ColumnFamily {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	families := make([]*ColumnFamily, 0, len(d.families))
+	for _, cf := range d.families {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	return families
+}
 
+// scheduleBackground 唤醒后台线程，不会阻塞
+func (d *DB) scheduleBackground() {
+	select {
+	case d.bgCh <- struct{}{}:
+	default:
+	}
+}
+
+// nextSeq 为一次写入分配序列号，调用方需要持有 writeLock
+func (d *DB) nextSeq() uint64 {
+	d.lastSeq++
+	return d.lastSeq
+}
+
+// publishSeq 发布序列号，之后的读取可以看到序列号不大于 seq 的写入
+func (d *DB) publishSeq(seq uint64) {
+	atomic.StoreUint64(&d.visibleSeq, seq)
+}
+
+// getVisibleSeq 获取当前读取可见的最大序列号
+func (d *DB) getVisibleSeq() uint64 {
+	return atomic.LoadUint64(&d.visibleSeq)
+}
+
+// getSnapshots 获取仍在使用的快照的序列号，按升序排列
+func (d *DB) getSnapshots() []uint64 {
+	d.snapshotLock.Lock()
+	defer d.snapshotLock.Unlock()
+
+	seqs := make([]uint64, 0, len(d.snapshots))
+	for seq := range d.snapshots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs
+}
+
+// isClosed 数据库是否已经关闭
+func (d *DB) isClosed() bool {
+	return atomic.LoadInt32(&d.closed) == 1
+}
+
+// isLeader 节点是否是 raft leader，写入只能由 leader 提交，没有启动 raft 时返回 false
+func (d *DB) isLeader() bool {
+	return d.raft != nil && d.raft.State() == raft.Leader
+}
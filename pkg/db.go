@@ -1,82 +1,310 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"mylsmtree/pkg/kv"
+	"mylsmtree/pkg/lsm"
+	"time"
 )
 
-// Get 获取一个元素
+// ErrNotFound key 不存在、已经被删除或已经过期
+var ErrNotFound = errors.New("key not found")
+
+// Get 获取 key 的值，key 和值都可以是任意字节，key 不存在时返回 ErrNotFound
+func Get(key []byte) ([]byte, error) {
+	db, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return db.Get(key)
+}
+
+// GetContext 和 Get 相同，ctx 已经被取消或超时时不读取并返回 ctx.Err()
+func GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	db, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetContext(ctx, key)
+}
+
+// GetJSON 获取 JSON 编码的值并解码
 // 需要支持集群模式
-func Get(key string) (interface{}, bool) {
-	log.Print("Get ", key)
+func GetJSON(key string) (interface{}, bool) {
+	db, err := current()
+	if err != nil {
+		var nilV interface{}
+		return nilV, false
+	}
+	return db.GetJSON(key)
+}
+
+// get 获取 key 在序列号 seq 时的值
+func (cf *ColumnFamily) get(key string, seq uint64) ([]byte, error) {
+	if cf.db.isClosed() {
+		return nil, ErrClosed
+	}
+	cf.ValueLog.Acquire()
+	defer cf.ValueLog.Release()
+
+	value, result, err := cf.lookup(key, seq)
+	if err != nil {
+		return nil, err
+	}
+	if result != kv.Success {
+		return nil, ErrNotFound
+	}
+	return cf.resolveValue(value)
+}
+
+// getAt 获取 key 在序列号 seq 时 JSON 编码的值并解码
+func (cf *ColumnFamily) getAt(key string, seq uint64) (interface{}, bool) {
+	var nilV interface{}
+	data, err := cf.get(key, seq)
+	if err != nil {
+		if err != ErrNotFound {
+			log.Println(err)
+		}
+		return nilV, false
+	}
+	return getInstance(data)
+}
+
+// lookup 返回 key 在序列号 seq 时可见的最新记录，已经过期的记录作为删除标记返回，
+// 值被分离到 value log 时只返回指针，合并操作数会和更旧的版本合并为完整的值。
+// 调用方需要持有 value log。读取 SSTable 或 value log 失败时返回错误
+func (cf *ColumnFamily) lookup(key string, seq uint64) (kv.Value, kv.SearchResult, error) {
+	return cf.lookupAt(key, seq, time.Now())
+}
+
+// lookupAt 和 lookup 相同，但按 now 判断记录是否过期。
+// 应用 raft 日志时 now 取提交日志的节点的时间，每个节点的判断结果相同
+func (cf *ColumnFamily) lookupAt(key string, seq uint64, now time.Time) (kv.Value, kv.SearchResult, error) {
+	value, result, err := cf.search(key, seq)
+	if err != nil {
+		return kv.Value{}, kv.None, err
+	}
+	if result == kv.Success && value.Merge {
+		merged, err := cf.mergeOperands(key, value)
+		if errors.Is(err, ErrIO) || errors.Is(err, ErrCorruption) {
+			return kv.Value{}, kv.None, err
+		}
+		if err != nil {
+			log.Println("failure to merge", key, err)
+			return kv.Value{}, kv.None, nil
+		}
+		value = merged
+	}
+	if result == kv.Success && value.Expired(now) {
+		return value, kv.Deleted, nil
+	}
+	return value, result, nil
+}
+
+// mergeOperands 从最新的操作数 newest 开始向旧版本查找，直到值、删除标记或没有更旧的版本，
+// 把找到的操作数合并到它上面
+func (cf *ColumnFamily) mergeOperands(key string, newest kv.Value) (kv.Value, error) {
+	operands := []kv.Value{newest}
+	base := kv.Value{Key: key, Deleted: true}
+	for value := newest; value.Seq > 0; {
+		var result kv.SearchResult
+		var err error
+		value, result, err = cf.search(key, value.Seq-1)
+		if err != nil {
+			return kv.Value{}, err
+		}
+		if result == kv.None {
+			break
+		}
+		if result == kv.Deleted || !value.Merge {
+			base = value
+			break
+		}
+		operands = append(operands, value)
+	}
+	return lsm.ApplyMerge(cf.db.mergeOperator, base, operands, cf.resolveValue)
+}
+
+// search 依次查找内存表、只读内存表和 SSTable，返回 key 在序列号 seq 时可见的最新记录
+func (cf *ColumnFamily) search(key string, seq uint64) (kv.Value, kv.SearchResult, error) {
 	// 先查内存表
-	value, result := database.MemoryTree.Search(key)
+	cf.db.lock.RLock()
+	value, result := cf.MemoryTree.Search(key, seq)
+	immutables := cf.db.Immutables
+	cf.db.lock.RUnlock()
 
-	if result == kv.Success {
-		return getInstance(value.Value)
+	if result != kv.None {
+		return value, result, nil
 	}
 
-	// 查 SsTable 文件
-	if database.TableTree != nil {
-		value, result := database.TableTree.Search(key)
-		if result == kv.Success {
-			return getInstance(value.Value)
+	// 再查等待落盘的只读内存表，从新到旧
+	for i := len(immutables) - 1; i >= 0; i-- {
+		tree, ok := immutables[i].Trees[cf.name]
+		if !ok {
+			continue
+		}
+		value, result := tree.Search(key, seq)
+		if result != kv.None {
+			return value, result, nil
 		}
 	}
-	var nilV interface{}
-	return nilV, false
+
+	// 查 SsTable 文件
+	if cf.TableTree != nil {
+		return cf.TableTree.Search(key, seq)
+	}
+	return kv.Value{}, kv.None, nil
 }
 
-// Set 插入元素
+// Put 写入 key，key 和值都可以是任意字节，值原样保存，不经过编码
+func Put(key, value []byte) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.Put(key, value)
+}
+
+// PutContext 和 Put 相同，写入被限流阻塞时 ctx 被取消或超时会放弃写入并返回 ctx.Err()
+func PutContext(ctx context.Context, key, value []byte) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.PutContext(ctx, key, value)
+}
+
+// PutWithTTL 写入 key，经过 ttl 后过期，ttl 不大于 0 时使用配置中的默认过期时间
+func PutWithTTL(key, value []byte, ttl time.Duration) error {
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.PutWithTTL(key, value, ttl)
+}
+
+// Set 插入元素，值编码为 JSON
 // 只需要支持集群模式
 func Set(key string, value interface{}) bool {
-	log.Print("Insert ", key, ",")
-	data, err := kv.Convert(value)
+	return SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL 插入元素，经过 ttl 后过期，过期后读取不到，并在压缩时被清理，
+// ttl 不大于 0 时使用配置中的默认过期时间
+func SetWithTTL(key string, value interface{}, ttl time.Duration) bool {
+	db, err := current()
+	if err == nil {
+		err = db.SetWithTTL(key, value, ttl)
+	}
 	if err != nil {
 		log.Println(err)
 		return false
 	}
-
-	_, _ = database.MemoryTree.Set(key, data)
-
-	// 写入 wal.log
-	database.Wal.Write(kv.Value{
-		Key:     key,
-		Value:   data,
-		Deleted: false,
-	})
 	return true
 }
 
+// expiresAt 从现在开始经过 ttl 后的过期时间，ttl 不大于 0 时返回 0，表示不过期
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
 // DeleteAndGet 删除元素并尝试获取旧的值，
 // 返回的 bool 表示是否有旧值，不表示是否删除成功
 func DeleteAndGet(key string) (interface{}, bool) {
+	db, err := current()
+	if err != nil {
+		var nilV interface{}
+		return nilV, false
+	}
+	return db.DeleteAndGet(key)
+}
+
+// DeleteAndGet 删除默认列族中的元素并尝试获取旧的值
+func (d *DB) DeleteAndGet(key string) (interface{}, bool) {
 	log.Print("Delete ", key)
-	value, success := database.MemoryTree.Delete(key)
+	var nilV interface{}
+	if d.raft != nil {
+		// 集群模式下删除通过 raft 复制到所有节点，读取旧值和删除不是原子的
+		value, ok := d.GetJSON(key)
+		if !ok {
+			return nilV, false
+		}
+		if err := d.Delete(key); err != nil {
+			log.Println(err)
+			return nilV, false
+		}
+		return value, true
+	}
+	_ = d.makeRoomForWrite(context.Background())
+	d.ValueLog.Acquire()
+	defer d.ValueLog.Release()
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	if err := d.writeError(); err != nil {
+		log.Println(err)
+		return nilV, false
+	}
+
+	value, result, err := d.lookup(key, d.getVisibleSeq())
+	if err != nil {
+		log.Println(err)
+		return nilV, false
+	}
+	if result != kv.Success {
+		return nilV, false
+	}
 
-	if success {
-		// 写入 wal.log
-		database.Wal.Write(kv.Value{
-			Key:     key,
-			Value:   nil,
-			Deleted: true,
-		})
-		return getInstance(value.Value)
+	// 写入 wal.log
+	record := kv.Value{
+		Key:     key,
+		Value:   nil,
+		Deleted: true,
+		Seq:     d.nextSeq(),
 	}
-	var nilV interface{}
-	return nilV, false
+	if err = d.Wal.Write(record); err != nil {
+		d.setBackgroundError(err)
+		log.Println(err)
+		return nilV, false
+	}
+	d.MemoryTree.SetValue(record)
+	d.publishSeq(record.Seq)
+	d.maybeSwitchMemoryTree()
+	data, err := d.resolveValue(value)
+	if err != nil {
+		log.Println(err)
+	}
+	return getInstance(data)
 }
 
 // Delete 删除元素
 func Delete(key string) {
 	log.Print("Delete ", key)
-	database.MemoryTree.Delete(key)
-	database.Wal.Write(kv.Value{
-		Key:     key,
-		Value:   nil,
-		Deleted: true,
-	})
+	db, err := current()
+	if err == nil {
+		err = db.Delete(key)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// DeleteRange 删除 [start, end) 范围内的所有 key，end 为空表示不限制。
+// 只写入一个范围删除标记，被遮盖的数据在压缩时清理
+func DeleteRange(start, end string) {
+	log.Printf("Delete range [%s, %s)\r\n", start, end)
+	db, err := current()
+	if err == nil {
+		err = db.DeleteRange(start, end)
+	}
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 // 将字节数组转为类型对象
@@ -88,4 +316,3 @@ func getInstance(data []byte) (interface{}, bool) {
 	}
 	return value, true
 }
-
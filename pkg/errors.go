@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mylsmtree/pkg/kv"
+	"net/http"
+)
+
+var (
+	// ErrIO 读写数据文件失败，可以用 errors.Is 判断
+	ErrIO = kv.ErrIO
+	// ErrCorruption 数据文件内容损坏，可以用 errors.Is 判断
+	ErrCorruption = kv.ErrCorruption
+	// ErrReadOnly 后台落盘、压缩或写入 wal 失败后数据库进入只读模式，调用 Resume 恢复写入
+	ErrReadOnly = errors.New("database is in read-only mode")
+)
+
+// readOnlyError 只读模式下写入返回的错误，errors.Is 可以同时判断 ErrReadOnly 和导致只读的原因
+type readOnlyError struct {
+	cause error
+}
+
+func (e *readOnlyError) Error() string {
+	return ErrReadOnly.Error() + ": " + e.cause.Error()
+}
+
+func (e *readOnlyError) Unwrap() error {
+	return e.cause
+}
+
+func (e *readOnlyError) Is(target error) bool {
+	return target == ErrReadOnly
+}
+
+// BackgroundError 导致数据库进入只读模式的错误，没有时返回 nil
+func (d *DB) BackgroundError() error {
+	d.bgErrLock.Lock()
+	defer d.bgErrLock.Unlock()
+	return d.bgErr
+}
+
+// setBackgroundError 记录后台任务或写入 wal 的错误，之后的写入返回 ErrReadOnly，只保留第一个错误
+func (d *DB) setBackgroundError(err error) {
+	if err == nil {
+		return
+	}
+	d.bgErrLock.Lock()
+	if d.bgErr == nil {
+		log.Println("Database is read-only after background error:", err)
+		d.bgErr = err
+	}
+	d.bgErrLock.Unlock()
+	// 唤醒被限流阻塞的写入，它们会发现数据库已经只读
+	d.wakeStalledWrites()
+}
+
+// writeError 写入前检查数据库是否可以写入，关闭后返回 ErrClosed，只读模式下返回 ErrReadOnly
+func (d *DB) writeError() error {
+	if d.isClosed() {
+		return ErrClosed
+	}
+	if err := d.BackgroundError(); err != nil {
+		return &readOnlyError{cause: err}
+	}
+	return nil
+}
+
+// waitWritable 阻塞到数据库可以写入，只读时等待 Resume 恢复，数据库关闭时返回 ErrClosed
+func (d *DB) waitWritable() error {
+	d.stallCond.L.Lock()
+	defer d.stallCond.L.Unlock()
+	for {
+		err := d.writeError()
+		if err == nil || errors.Is(err, ErrClosed) {
+			return err
+		}
+		d.stallCond.Wait()
+	}
+}
+
+// Resume 排除导致只读的故障（例如磁盘空间不足）后恢复写入：重新切换 wal 并落盘所有内存表，
+// 再进行一次压缩，全部成功后清除后台错误，失败时保持只读并返回错误。没有后台错误时什么也不做
+func (d *DB) Resume() error {
+	if d.isClosed() {
+		return ErrClosed
+	}
+	if d.BackgroundError() == nil {
+		return nil
+	}
+	log.Println("Resuming database", d.dir)
+	d.writeLock.Lock()
+	// wal 末尾可能留下写了一半的记录，总是切换 wal，之后的写入从新文件开始
+	err := d.rotateMemoryTree(true)
+	d.writeLock.Unlock()
+	if err == nil {
+		err = d.flushImmutables()
+	}
+	if err == nil {
+		err = d.compactFamilies()
+	}
+	if err != nil {
+		log.Println("failure to resume the database", err)
+		return err
+	}
+
+	d.bgErrLock.Lock()
+	d.bgErr = nil
+	d.bgErrLock.Unlock()
+	d.updateStallMetrics()
+	d.wakeStalledWrites()
+	log.Println("Database resumed", d.dir)
+	return nil
+}
+
+// Resume 管理接口，恢复只读模式下的数据库，只在当前节点上执行
+func (h HttpServer) Resume(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.Resume(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "success")
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyAndResume(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.setBackgroundError(errors.New("disk full"))
+	if err := db.Put([]byte("k"), []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("put: got %v, want ErrReadOnly", err)
+	}
+	if err := db.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("put after resume: %v", err)
+	}
+}
+
+func TestRaftReadOnlyFollowerAppliesAfterResume(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	follower := nodes[1].db
+	follower.setBackgroundError(errors.New("disk full"))
+	if err := nodes[0].db.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	// 只读的 follower 不能跳过已经提交的日志
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := follower.GetJSON("a"); ok {
+		t.Fatal("read-only follower applied the write")
+	}
+	if follower.raftApplied(nodes[0].raft.LastIndex()) {
+		t.Fatal("read-only follower counted the entry as applied")
+	}
+	if err := follower.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "follower to apply after resume", func() bool {
+		_, ok := follower.GetJSON("a")
+		return ok
+	})
+}
+
+func TestRaftReadOnlyLeaderRejectsProposals(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	nodes[0].db.setBackgroundError(errors.New("disk full"))
+	if err := nodes[0].db.Set("a", 1); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("got %v, want ErrReadOnly", err)
+	}
+	if err := nodes[0].db.Resume(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStallOnProposerNotOnApply(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PendingCompactionStopBytes = 1
+	nodes := newTestCluster(t, 2, opts)
+	for _, node := range nodes {
+		// 挡住后台落盘，后台线程不会重新计算待压缩数据量
+		node.db.flushLock.Lock()
+		defer node.db.flushLock.Unlock()
+		atomic.StoreInt64(&node.db.pendingCompactionBytes, 1<<30)
+	}
+	// 提交日志的节点按请求的 ctx 限流
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := nodes[0].db.WriteContext(ctx, batchOf("a", 1)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	// 应用 raft 日志时不限流
+	done := make(chan error, 1)
+	go func() {
+		done <- nodes[1].db.writeBatch(context.Background(), batchOf("b", 1), 100)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("applying a raft log was blocked by the write stall")
+	}
+}
+
+// batchOf 只写入一个 key 的批量写入
+func batchOf(key string, value interface{}) *WriteBatch {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return batch
+}
@@ -0,0 +1,320 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mylsmtree/pkg/config"
+	"mylsmtree/pkg/kv"
+	"mylsmtree/pkg/wal"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// 记录已经落盘的 raft 日志编号的文件
+	appliedIndexFile = "raft.index"
+	// 正在恢复的 raft 快照的日志编号，恢复完成后删除
+	restoreMarkerFile = "raft.restore"
+	// 从 raft 快照恢复时每个批量写入的记录数
+	restoreBatchSize = 1000
+)
+
+// raftEngine 将 raft 日志应用到数据库
+type raftEngine struct {
+	db *DB
+}
+
+// apply 执行一条 raft 日志。raft 把返回的日志都当作已经应用，之后不会再交给状态机，
+// 所以日志没有被写入时（例如数据库只读）不能返回，进入只读模式并阻塞 raft 的应用流程，
+// 等 Resume 恢复后重新执行。数据库关闭时返回错误，重启后从已经落盘的编号之后回放
+func (e raftEngine) apply(index uint64, fn func() interface{}) interface{} {
+	for {
+		response := fn()
+		if e.db.raftApplied(index) || e.db.isClosed() {
+			return response
+		}
+		err, _ := response.(error)
+		if err == nil {
+			err = fmt.Errorf("raft log %d not applied", index)
+		}
+		log.Println("failure to apply raft log", index, err, ", waiting for resume")
+		e.db.setBackgroundError(err)
+		if err = e.db.waitWritable(); err != nil {
+			return err
+		}
+	}
+}
+
+// raftApplied 编号为 index 的 raft 日志是否已经应用
+func (d *DB) raftApplied(index uint64) bool {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	return index <= d.appliedIndex
+}
+
+// applyError 执行一条只返回错误的 raft 日志
+func (e raftEngine) applyError(index uint64, fn func() error) error {
+	err, _ := e.apply(index, func() interface{} {
+		return fn()
+	}).(error)
+	return err
+}
+
+// ApplyBatch 写入 raft 日志中的批量写入
+func (e raftEngine) ApplyBatch(index uint64, data []byte) error {
+	batch, err := UnmarshalWriteBatch(data)
+	if err != nil {
+		log.Println("invalid batch in raft log", index, err)
+		return err
+	}
+	return e.applyError(index, func() error {
+		return e.db.writeBatch(context.Background(), batch, index)
+	})
+}
+
+// ApplyTxn 写入 raft 日志中的事务
+func (e raftEngine) ApplyTxn(index uint64, data []byte) error {
+	var record txnRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		log.Println("invalid transaction in raft log", index, err)
+		return err
+	}
+	return e.applyError(index, func() error {
+		return e.db.commitTxn(context.Background(), record.Reads, &WriteBatch{ops: record.Ops}, index, recordTime(record.Time))
+	})
+}
+
+// ApplyCondition 写入 raft 日志中的条件写入，返回 CondResult 或错误
+func (e raftEngine) ApplyCondition(index uint64, data []byte) interface{} {
+	var record condRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		log.Println("invalid condition in raft log", index, err)
+		return err
+	}
+	return e.apply(index, func() interface{} {
+		result, err := e.db.applyCondition(context.Background(), record, index)
+		if err != nil {
+			return err
+		}
+		return result
+	})
+}
+
+// ApplyFamily 执行 raft 日志中创建或删除列族的记录
+func (e raftEngine) ApplyFamily(index uint64, data []byte) error {
+	var record familyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		log.Println("invalid column family record in raft log", index, err)
+		return err
+	}
+	return e.applyError(index, func() error {
+		return e.db.applyFamily(record, index)
+	})
+}
+
+// snapshotHeader raft 快照的第一条记录
+type snapshotHeader struct {
+	// 快照包含的最大 raft 日志编号
+	Index uint64
+	// 除默认列族外的所有列族，列族名到列族的设置
+	Families map[string]config.FamilyConfig `json:",omitempty"`
+}
+
+// snapshotEntry raft 快照中的一条记录
+type snapshotEntry struct {
+	// 记录所在的列族，为空表示默认列族
+	CF  string `json:",omitempty"`
+	Key string
+	// 不是合法 UTF-8 的 key 保存在 BinaryKey 中
+	BinaryKey []byte `json:",omitempty"`
+	Value     []byte
+	ExpiresAt int64 `json:",omitempty"`
+	// 写入这个版本的 raft 日志编号，恢复后保持不变，事务在每个节点上的冲突检查结果相同
+	Version uint64 `json:",omitempty"`
+}
+
+// fsmSnapshot 基于数据库快照的 raft 快照，持久化期间不阻塞写入
+type fsmSnapshot struct {
+	snapshot *Snapshot
+	index    uint64
+	// 创建快照时的所有列族
+	families []*ColumnFamily
+}
+
+// Snapshot 创建 raft 快照，raft 保证调用期间不会执行 Apply
+func (e raftEngine) Snapshot() (raft.FSMSnapshot, error) {
+	e.db.writeLock.Lock()
+	index := e.db.appliedIndex
+	families := e.db.getFamilies()
+	e.db.writeLock.Unlock()
+	return &fsmSnapshot{
+		snapshot: e.db.GetSnapshot(),
+		index:    index,
+		families: families,
+	}, nil
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := s.persist(sink)
+	if err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) persist(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	header := snapshotHeader{Index: s.index, Families: make(map[string]config.FamilyConfig)}
+	for _, cf := range s.families {
+		if cf.name != wal.DefaultFamily {
+			header.Families[cf.name] = cf.options
+		}
+	}
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+	for _, cf := range s.families {
+		if err := s.persistFamily(encoder, cf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persistFamily 写入快照中列族 cf 的所有记录
+func (s *fsmSnapshot) persistFamily(encoder *json.Encoder, cf *ColumnFamily) error {
+	it := s.snapshot.NewIteratorCF(cf)
+	defer it.Close()
+	name := ""
+	if cf.name != wal.DefaultFamily {
+		name = cf.name
+	}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		value, err := it.ValueBytes()
+		if err != nil {
+			return err
+		}
+		entry := snapshotEntry{CF: name, Value: value, ExpiresAt: it.value.ExpiresAt, Version: it.value.Version}
+		entry.Key, entry.BinaryKey = kv.SplitBinary(it.Key())
+		if err = encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (s *fsmSnapshot) Release() {
+	ReleaseSnapshot(s.snapshot)
+}
+
+// Restore 用 raft 快照替换数据库中的数据，快照不比已经写入的数据新时跳过
+func (e raftEngine) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	decoder := json.NewDecoder(rc)
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return err
+	}
+	e.db.writeLock.Lock()
+	appliedIndex := e.db.appliedIndex
+	e.db.writeLock.Unlock()
+	if header.Index <= appliedIndex {
+		log.Printf("Skip raft snapshot %d, applied %d\r\n", header.Index, appliedIndex)
+		return nil
+	}
+
+	log.Println("Restoring raft snapshot", header.Index)
+	// 恢复分成多个批量写入，不是原子的，中途失败或进程退出时数据库中只有部分数据。
+	// 开始前写入标记，只有最后一个批量写入记录快照的日志编号，之前失败时已经应用的编号不变，
+	// raft 重试或重启时再次恢复同一个快照会从清空数据开始重新写入；
+	// 重启时发现标记，说明上次恢复没有完成，已经应用的编号从 0 开始，保证快照一定被重新恢复
+	if err := writeIndexFile(e.db.dir, restoreMarkerFile, header.Index); err != nil {
+		return err
+	}
+	// 让列族和快照中的一致，再清空所有列族
+	for _, name := range e.db.ListColumnFamilies() {
+		if _, ok := header.Families[name]; !ok && name != wal.DefaultFamily {
+			if err := e.db.DropColumnFamily(name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, options := range header.Families {
+		if _, ok := e.db.getFamily(name); !ok {
+			if _, err := e.db.CreateColumnFamily(name, options); err != nil {
+				return err
+			}
+		}
+	}
+	batch := NewWriteBatch()
+	for _, cf := range e.db.getFamilies() {
+		batch.DeleteRangeCF(cf, "", "")
+	}
+	for {
+		var entry snapshotEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		batch.ops = append(batch.ops, BatchOp{Op: BatchPut, CF: entry.CF, Key: kv.JoinBinary(entry.Key, entry.BinaryKey), Value: entry.Value, ExpiresAt: entry.ExpiresAt, version: entry.Version})
+		if batch.Len() >= restoreBatchSize {
+			if err = e.db.writeBatch(context.Background(), batch, 0); err != nil {
+				return err
+			}
+			batch = NewWriteBatch()
+		}
+	}
+	// 最后一个批量写入记录快照的 raft 日志编号
+	if err := e.db.writeBatch(context.Background(), batch, header.Index); err != nil {
+		return err
+	}
+	markerPath := path.Join(e.db.dir, restoreMarkerFile)
+	return kv.IOError("remove", markerPath, os.Remove(markerPath))
+}
+
+// readAppliedIndex 读取已经落盘的 raft 日志编号
+func readAppliedIndex(dir string) uint64 {
+	index, _ := readIndexFile(dir, appliedIndexFile)
+	return index
+}
+
+// writeAppliedIndex 记录已经落盘的 raft 日志编号
+func writeAppliedIndex(dir string, index uint64) error {
+	return writeIndexFile(dir, appliedIndexFile, index)
+}
+
+// readIndexFile 读取记录 raft 日志编号的文件，文件不存在或内容不合法时返回 false
+func readIndexFile(dir, name string) (uint64, bool) {
+	data, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return 0, false
+	}
+	index, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		log.Println("invalid raft index file", name, err)
+		return 0, false
+	}
+	return index, true
+}
+
+// writeIndexFile 写入记录 raft 日志编号的文件，先写临时文件再重命名，避免写了一半的文件
+func writeIndexFile(dir, name string, index uint64) error {
+	tmpPath := path.Join(dir, name+".tmp")
+	err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatUint(index, 10)), 0666)
+	if err != nil {
+		return kv.IOError("write", tmpPath, err)
+	}
+	return kv.IOError("rename", tmpPath, os.Rename(tmpPath, path.Join(dir, name)))
+}
@@ -0,0 +1,263 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mylsmtree/pkg/config"
+	"mylsmtree/pkg/myraft"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testNode 测试集群中的一个节点
+type testNode struct {
+	db   *DB
+	raft *raft.Raft
+	fsm  *myraft.Fsm
+	// 节点的 raft 日志
+	logs *raft.InmemStore
+}
+
+// newTestCluster 启动 n 个使用内存传输和内存日志的 raft 节点，每个节点用 opts 打开自己的数据库，
+// 返回时第一个节点是 leader，测试结束时关闭所有节点
+func newTestCluster(t *testing.T, n int, opts *Options) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, n)
+	transports := make([]*raft.InmemTransport, n)
+	var configuration raft.Configuration
+	for i := range nodes {
+		addr, transport := raft.NewInmemTransport("")
+		transports[i] = transport
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			ID:      raft.ServerID(fmt.Sprint("node", i)),
+			Address: addr,
+		})
+	}
+	for i := range transports {
+		for j := range transports {
+			if i != j {
+				transports[i].Connect(transports[j].LocalAddr(), transports[j])
+			}
+		}
+	}
+	for i := range nodes {
+		db := openTestDB(t, opts)
+		conf := raft.DefaultConfig()
+		conf.LocalID = configuration.Servers[i].ID
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.LogLevel = "ERROR"
+		if i > 0 {
+			// 只让第一个节点发起选举，保证它成为 leader
+			conf.HeartbeatTimeout = time.Hour
+			conf.ElectionTimeout = time.Hour
+			conf.LeaderLeaseTimeout = time.Hour
+		}
+		fsm := myraft.NewFsm(raftEngine{db: db})
+		store := raft.NewInmemStore()
+		r, err := raft.NewRaft(conf, fsm, store, store, raft.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.raft = r
+		nodes[i] = &testNode{db: db, raft: r, fsm: fsm, logs: store}
+	}
+	// 先关闭 raft 再关闭数据库，Cleanup 按注册的相反顺序执行
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			_ = node.raft.Shutdown().Error()
+		}
+	})
+	if err := nodes[0].raft.BootstrapCluster(configuration).Error(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "leader election", func() bool {
+		return nodes[0].db.isLeader()
+	})
+	return nodes
+}
+
+// waitFor 等待 cond 成立，超时时测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitApplied 等待所有节点应用 leader 已经提交的日志
+func waitApplied(t *testing.T, nodes []*testNode) {
+	t.Helper()
+	if err := nodes[0].raft.Barrier(5 * time.Second).Error(); err != nil {
+		t.Fatal(err)
+	}
+	index := nodes[0].raft.AppliedIndex()
+	for _, node := range nodes[1:] {
+		node := node
+		waitFor(t, "followers to apply", func() bool {
+			return node.raft.AppliedIndex() >= index
+		})
+	}
+}
+
+func TestRaftBatchReplicates(t *testing.T) {
+	nodes := newTestCluster(t, 3, nil)
+	batch := NewWriteBatch()
+	batch.Put("a", 1)
+	batch.Put("b", 2)
+	batch.Delete("a")
+	if err := nodes[0].db.proposeBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, nodes)
+	for i, node := range nodes {
+		if _, ok := node.db.GetJSON("a"); ok {
+			t.Errorf("node %d: deleted key a is visible", i)
+		}
+		if value, ok := node.db.GetJSON("b"); !ok || value != float64(2) {
+			t.Errorf("node %d: b = %v, %v", i, value, ok)
+		}
+	}
+}
+
+func TestRaftBatchNotLeader(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	batch := NewWriteBatch()
+	batch.Put("a", 1)
+	err := nodes[1].db.proposeBatch(context.Background(), batch)
+	if !notLeader(err) {
+		t.Fatalf("got %v, want a not-leader error", err)
+	}
+}
+
+// bufferSink 把 raft 快照写到内存中
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Close() error  { return nil }
+func (s *bufferSink) Cancel() error { return nil }
+
+// persistSnapshot 把数据库的 raft 快照写到内存中
+func persistSnapshot(t *testing.T, db *DB) []byte {
+	t.Helper()
+	snapshot, err := raftEngine{db: db}.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+	sink := &bufferSink{}
+	if err = snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	return sink.Bytes()
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	source := openTestDB(t, nil)
+	users, err := source.CreateColumnFamily("users", config.FamilyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := NewWriteBatch()
+	batch.Put("a", 1)
+	batch.PutBytes([]byte{0xff}, []byte{1})
+	batch.PutCF(users, "u", "x")
+	if err = source.writeBatch(context.Background(), batch, 7); err != nil {
+		t.Fatal(err)
+	}
+	data := persistSnapshot(t, source)
+
+	target := openTestDB(t, nil)
+	target.Set("stale", 1)
+	if err = (raftEngine{db: target}).Restore(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := target.GetJSON("stale"); ok {
+		t.Fatal("data from before the snapshot survived the restore")
+	}
+	if value, ok := target.GetJSON("a"); !ok || value != float64(1) {
+		t.Fatalf("a = %v, %v", value, ok)
+	}
+	if value, err := target.Get([]byte{0xff}); err != nil || !bytes.Equal(value, []byte{1}) {
+		t.Fatalf("binary key = %v, %v", value, err)
+	}
+	cf, ok := target.GetColumnFamily("users")
+	if !ok {
+		t.Fatal("column family was not restored")
+	}
+	if value, ok := cf.GetJSON("u"); !ok || value != "x" {
+		t.Fatalf("u = %v, %v", value, ok)
+	}
+	if target.appliedIndex != 7 {
+		t.Fatalf("applied index %d, want 7", target.appliedIndex)
+	}
+	if _, err = os.Stat(filepath.Join(target.dir, restoreMarkerFile)); !os.IsNotExist(err) {
+		t.Fatalf("restore marker left behind: %v", err)
+	}
+}
+
+func TestSnapshotRestoreInterrupted(t *testing.T) {
+	source := openTestDB(t, nil)
+	batch := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		batch.Put(fmt.Sprint("key", i), i)
+	}
+	if err := source.writeBatch(context.Background(), batch, 5); err != nil {
+		t.Fatal(err)
+	}
+	data := persistSnapshot(t, source)
+
+	dir := t.TempDir()
+	target, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 快照只传了一半
+	err = raftEngine{db: target}.Restore(ioutil.NopCloser(bytes.NewReader(data[:len(data)/2])))
+	if err == nil {
+		t.Fatal("restoring a truncated snapshot succeeded")
+	}
+	if target.appliedIndex != 0 {
+		t.Fatalf("applied index %d after a failed restore", target.appliedIndex)
+	}
+	if index, ok := readIndexFile(dir, restoreMarkerFile); !ok || index != 5 {
+		t.Fatalf("restore marker = %d, %v", index, ok)
+	}
+	// 重启后重新恢复同一个快照
+	if err = target.Close(); err != nil {
+		t.Fatal(err)
+	}
+	target, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if target.appliedIndex != 0 {
+		t.Fatalf("applied index %d after reopening an interrupted restore", target.appliedIndex)
+	}
+	if err = (raftEngine{db: target}).Restore(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if value, ok := target.GetJSON(fmt.Sprint("key", i)); !ok || value != float64(i) {
+			t.Fatalf("key%d = %v, %v", i, value, ok)
+		}
+	}
+	if _, ok := readIndexFile(dir, restoreMarkerFile); ok {
+		t.Fatal("restore marker left behind")
+	}
+}
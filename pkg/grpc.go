@@ -0,0 +1,417 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mylsmtree/pkg/kvpb"
+	"mylsmtree/pkg/lsm"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcServer gRPC 接口，实现 kv.proto 中的 KV 和 Cluster 服务，和 HttpServer 使用同一个数据库和 raft 节点。
+// 写入通过 raft 提交，读取和订阅在本节点上执行
+type GrpcServer struct {
+	kvpb.UnimplementedKVServer
+	kvpb.UnimplementedClusterServer
+	raft *raft.Raft
+	db   *DB
+	// 本节点的 raft id
+	id string
+	// raft id 到 gRPC 地址，不是 leader 时告诉客户端 leader 的地址
+	grpcAddrs map[string]string
+	// 关闭时结束所有 Watch
+	done chan struct{}
+}
+
+// 写入操作的类型和 kvpb.OpType 的对应关系
+var (
+	opTypes = map[kvpb.OpType]string{
+		kvpb.OpType_PUT:          BatchPut,
+		kvpb.OpType_DELETE:       BatchDelete,
+		kvpb.OpType_DELETE_RANGE: BatchDeleteRange,
+		kvpb.OpType_MERGE:        BatchMerge,
+	}
+	opTypeValues = map[string]kvpb.OpType{
+		BatchPut:         kvpb.OpType_PUT,
+		BatchDelete:      kvpb.OpType_DELETE,
+		BatchDeleteRange: kvpb.OpType_DELETE_RANGE,
+		BatchMerge:       kvpb.OpType_MERGE,
+	}
+)
+
+func newGrpcServer(r *raft.Raft, db *DB, id string, grpcAddrs map[string]string) *GrpcServer {
+	return &GrpcServer{raft: r, db: db, id: id, grpcAddrs: grpcAddrs, done: make(chan struct{})}
+}
+
+// register 创建 grpc.Server 并注册服务
+func (g *GrpcServer) register() *grpc.Server {
+	server := grpc.NewServer()
+	kvpb.RegisterKVServer(server, g)
+	kvpb.RegisterClusterServer(server, g)
+	return server
+}
+
+// stop 结束所有 Watch，然后等待进行中的调用完成，超过 timeout 时直接断开连接
+func (g *GrpcServer) stop(server *grpc.Server, timeout time.Duration) {
+	close(g.done)
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	if timeout <= 0 {
+		<-stopped
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		log.Println("Closing grpc connections after", timeout)
+		server.Stop()
+	}
+}
+
+func (g *GrpcServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+	cf, ok := g.db.getFamily(familyName(req.Cf))
+	if !ok {
+		return nil, grpcError(ErrFamilyNotFound)
+	}
+	value, err := cf.GetContext(ctx, req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.GetResponse{Value: value}, nil
+}
+
+func (g *GrpcServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	op := &kvpb.Op{Type: kvpb.OpType_PUT, Cf: req.Cf, Key: req.Key, Value: req.Value, TtlMs: req.TtlMs}
+	if err := g.write(ctx, []*kvpb.Op{op}); err != nil {
+		return nil, err
+	}
+	return &kvpb.PutResponse{}, nil
+}
+
+func (g *GrpcServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	op := &kvpb.Op{Type: kvpb.OpType_DELETE, Cf: req.Cf, Key: req.Key}
+	if err := g.write(ctx, []*kvpb.Op{op}); err != nil {
+		return nil, err
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+func (g *GrpcServer) Batch(ctx context.Context, req *kvpb.BatchRequest) (*kvpb.BatchResponse, error) {
+	if err := g.write(ctx, req.Ops); err != nil {
+		return nil, err
+	}
+	return &kvpb.BatchResponse{}, nil
+}
+
+// write 把操作转换为批量写入，通过 raft 提交
+func (g *GrpcServer) write(ctx context.Context, ops []*kvpb.Op) error {
+	if err := g.checkLeader(ctx); err != nil {
+		return err
+	}
+	batch := NewWriteBatch()
+	for i, op := range ops {
+		name, ok := opTypes[op.Type]
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "op %d: unknown type %d", i, op.Type)
+		}
+		if name != BatchDeleteRange && len(op.Key) == 0 {
+			return status.Errorf(codes.InvalidArgument, "op %d: missing key", i)
+		}
+		if op.TtlMs < 0 {
+			return status.Errorf(codes.InvalidArgument, "op %d: negative ttl", i)
+		}
+		batchOp := BatchOp{Op: name, CF: op.Cf, Key: string(op.Key), Start: string(op.Start), End: string(op.End)}
+		switch name {
+		case BatchPut:
+			batchOp.Value = nonNil(op.Value)
+			batchOp.ExpiresAt = expiresAt(time.Duration(op.TtlMs) * time.Millisecond)
+		case BatchMerge:
+			batchOp.Value = nonNil(op.Value)
+		}
+		batch.ops = append(batch.ops, batchOp)
+	}
+	if err := g.db.proposeBatch(ctx, batch); err != nil {
+		log.Println("batch apply failure", err)
+		return g.raftError(ctx, err)
+	}
+	return nil
+}
+
+// nonNil 空值也是一个值，编码到 raft 日志时不能被省略
+func nonNil(value []byte) []byte {
+	if value == nil {
+		return []byte{}
+	}
+	return value
+}
+
+func (g *GrpcServer) CompareAndSwap(ctx context.Context, req *kvpb.CompareAndSwapRequest) (*kvpb.CompareAndSwapResponse, error) {
+	if err := g.checkLeader(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+	if req.TtlMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "negative ttl")
+	}
+	cf, ok := g.db.getFamily(familyName(req.Cf))
+	if !ok {
+		return nil, grpcError(ErrFamilyNotFound)
+	}
+	// 和 Put 一样，值是任意字节，按字节比较
+	record := condRecord{
+		Op:        CondCompareAndSwap,
+		Key:       string(req.Key),
+		CF:        condFamily(cf),
+		ExpiresAt: expiresAt(time.Duration(req.TtlMs) * time.Millisecond),
+		Raw:       true,
+	}
+	switch {
+	case req.IfAbsent && req.Delete:
+		return nil, status.Error(codes.InvalidArgument, "if_absent and delete are exclusive")
+	case req.IfAbsent:
+		record.Op = CondPutIfAbsent
+	case req.Delete:
+		record.Op = CondDeleteIfEquals
+	}
+	if record.Op != CondPutIfAbsent {
+		record.Expected = nonNil(req.Expected)
+	}
+	if record.Op != CondDeleteIfEquals {
+		record.Value = nonNil(req.Value)
+	}
+
+	result, err := g.db.proposeCondition(ctx, record)
+	if err != nil {
+		log.Println("condition apply failure", err)
+		return nil, g.raftError(ctx, err)
+	}
+	return &kvpb.CompareAndSwapResponse{Succeeded: result.Succeeded, Exists: result.Exists, Value: result.raw}, nil
+}
+
+// Scan 在一个迭代器上遍历，所有记录来自调用开始时的快照
+func (g *GrpcServer) Scan(req *kvpb.ScanRequest, stream kvpb.KV_ScanServer) error {
+	if req.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "negative limit")
+	}
+	cf, ok := g.db.getFamily(familyName(req.Cf))
+	if !ok {
+		return grpcError(ErrFamilyNotFound)
+	}
+	options := ScanOptions{
+		Family:  req.Cf,
+		Start:   string(req.Start),
+		End:     string(req.End),
+		Prefix:  string(req.Prefix),
+		Reverse: req.Reverse,
+	}
+	it := newScanCursor(cf, options).it
+	defer it.Close()
+
+	ctx := stream.Context()
+	var count int64
+	for it.Valid() && options.inScanRange(it.Key()) {
+		if err := ctx.Err(); err != nil {
+			return grpcError(err)
+		}
+		value, err := it.ValueBytes()
+		if err != nil {
+			return grpcError(err)
+		}
+		if err = stream.Send(&kvpb.KeyValue{Key: []byte(it.Key()), Value: value}); err != nil {
+			return err
+		}
+		count++
+		if req.Limit > 0 && count >= req.Limit {
+			break
+		}
+		if options.Reverse {
+			it.Prev()
+		} else {
+			it.Next()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+// Watch 按写入顺序发送本节点应用的变更，直到客户端取消、处理太慢或服务关闭
+func (g *GrpcServer) Watch(req *kvpb.WatchRequest, stream kvpb.KV_WatchServer) error {
+	ctx := stream.Context()
+	watcher, err := g.db.Watch(ctx, WatchOptions{Family: req.Cf, Prefix: string(req.Prefix)})
+	if err != nil {
+		return grpcError(err)
+	}
+	defer watcher.Close()
+	// 发送响应头，客户端收到后就知道订阅已经开始
+	if err = stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return grpcError(watcher.Err())
+			}
+			err = stream.Send(&kvpb.WatchEvent{
+				Type:  opTypeValues[event.Type],
+				Cf:    event.Family,
+				Key:   []byte(event.Key),
+				Value: event.Value,
+				Start: []byte(event.Start),
+				End:   []byte(event.End),
+				Seq:   event.Seq,
+			})
+			if err != nil {
+				return err
+			}
+		case <-g.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+func (g *GrpcServer) Status(ctx context.Context, req *kvpb.StatusRequest) (*kvpb.StatusResponse, error) {
+	addr, id := g.raft.LeaderWithID()
+	response := &kvpb.StatusResponse{
+		Id:           g.id,
+		State:        g.raft.State().String(),
+		LeaderId:     string(id),
+		LeaderAddr:   string(addr),
+		LastIndex:    g.raft.LastIndex(),
+		AppliedIndex: g.raft.AppliedIndex(),
+	}
+	future := g.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, grpcError(err)
+	}
+	for _, server := range future.Configuration().Servers {
+		response.Servers = append(response.Servers, &kvpb.Server{
+			Id:       string(server.ID),
+			Addr:     string(server.Address),
+			Suffrage: server.Suffrage.String(),
+		})
+	}
+	return response, nil
+}
+
+func (g *GrpcServer) AddVoter(ctx context.Context, req *kvpb.AddVoterRequest) (*kvpb.AddVoterResponse, error) {
+	if req.Id == "" || req.Addr == "" {
+		return nil, status.Error(codes.InvalidArgument, "id and addr are required")
+	}
+	if err := g.checkLeader(ctx); err != nil {
+		return nil, err
+	}
+	log.Println("Adding raft voter", req.Id, req.Addr)
+	future := g.raft.AddVoter(raft.ServerID(req.Id), raft.ServerAddress(req.Addr), 0, raftTimeout(ctx))
+	if err := future.Error(); err != nil {
+		return nil, g.raftError(ctx, err)
+	}
+	return &kvpb.AddVoterResponse{}, nil
+}
+
+func (g *GrpcServer) RemoveServer(ctx context.Context, req *kvpb.RemoveServerRequest) (*kvpb.RemoveServerResponse, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	if err := g.checkLeader(ctx); err != nil {
+		return nil, err
+	}
+	log.Println("Removing raft server", req.Id)
+	future := g.raft.RemoveServer(raft.ServerID(req.Id), 0, raftTimeout(ctx))
+	if err := future.Error(); err != nil {
+		return nil, g.raftError(ctx, err)
+	}
+	return &kvpb.RemoveServerResponse{}, nil
+}
+
+func (g *GrpcServer) TransferLeadership(ctx context.Context, req *kvpb.TransferLeadershipRequest) (*kvpb.TransferLeadershipResponse, error) {
+	if (req.Id == "") != (req.Addr == "") {
+		return nil, status.Error(codes.InvalidArgument, "id and addr must be given together")
+	}
+	if err := g.checkLeader(ctx); err != nil {
+		return nil, err
+	}
+	var future raft.Future
+	if req.Id == "" {
+		log.Println("Transferring raft leadership")
+		future = g.raft.LeadershipTransfer()
+	} else {
+		log.Println("Transferring raft leadership to", req.Id)
+		future = g.raft.LeadershipTransferToServer(raft.ServerID(req.Id), raft.ServerAddress(req.Addr))
+	}
+	if err := future.Error(); err != nil {
+		return nil, g.raftError(ctx, err)
+	}
+	return &kvpb.TransferLeadershipResponse{}, nil
+}
+
+// raftTimeout 修改集群成员的超时时间，ctx 没有截止时间时为 0，表示一直等待
+func raftTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return 0
+}
+
+// checkLeader 写入只能发给 leader，不是 leader 时返回 UNAVAILABLE 并在 trailer 中给出 leader 的 gRPC 地址
+func (g *GrpcServer) checkLeader(ctx context.Context) error {
+	if g.db.isLeader() {
+		return nil
+	}
+	return g.notLeader(ctx)
+}
+
+// notLeader 返回 UNAVAILABLE，trailer 中的 leader-addr 是 leader 的 gRPC 地址，没有配置时为空
+func (g *GrpcServer) notLeader(ctx context.Context) error {
+	_, id := g.raft.LeaderWithID()
+	_ = grpc.SetTrailer(ctx, metadata.Pairs("leader-id", string(id), "leader-addr", g.grpcAddrs[string(id)]))
+	return status.Error(codes.Unavailable, "not leader")
+}
+
+// raftError raft 提交失败的错误，提交过程中失去 leader 时同样给出 leader 的地址
+func (g *GrpcServer) raftError(ctx context.Context, err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+		return g.notLeader(ctx)
+	}
+	return grpcError(err)
+}
+
+// grpcError 错误对应的 gRPC 状态，和 restStatus 的分类一致
+func grpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrFamilyNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ErrReadOnly), errors.Is(err, ErrClosed), errors.Is(err, raft.ErrRaftShutdown):
+		code = codes.Unavailable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, raft.ErrEnqueueTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, lsm.ErrNoMergeOperator), errors.Is(err, ErrInvalidFamilyName):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrWatchOverflow):
+		code = codes.ResourceExhausted
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,310 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mylsmtree/pkg/config"
+	"mylsmtree/pkg/kvpb"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startTestGrpc 在内存连接上启动节点的 gRPC 服务，返回连接到它的客户端
+func startTestGrpc(t *testing.T, node *testNode) *grpc.ClientConn {
+	t.Helper()
+	return serveTestGrpc(t, newGrpcServer(node.raft, node.db, "", nil))
+}
+
+// serveTestGrpc 在内存连接上启动 gRPC 服务 g，返回连接到它的客户端
+func serveTestGrpc(t *testing.T, g *GrpcServer) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := g.register()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务要在 raft 关闭前停止，Cleanup 按注册的相反顺序执行
+	t.Cleanup(func() {
+		_ = conn.Close()
+		g.stop(server, time.Second)
+	})
+	return conn
+}
+
+func TestGrpcPutGet(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	client := kvpb.NewKVClient(startTestGrpc(t, nodes[0]))
+	ctx := context.Background()
+
+	// 值是任意字节，原样保存
+	value := []byte{0xff, 0x00, 'x'}
+	if _, err := client.Put(ctx, &kvpb.PutRequest{Key: []byte("k"), Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("k")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Value, value) {
+		t.Fatalf("get = %q, want %q", got.Value, value)
+	}
+	if _, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: []byte("k")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(ctx, &kvpb.GetRequest{Key: []byte("k")}); status.Code(err) != codes.NotFound {
+		t.Fatalf("get deleted key: got %v, want NOT_FOUND", err)
+	}
+	if _, err = client.Get(ctx, &kvpb.GetRequest{Cf: "missing", Key: []byte("k")}); status.Code(err) != codes.NotFound {
+		t.Fatalf("get from missing family: got %v, want NOT_FOUND", err)
+	}
+}
+
+func TestGrpcCompareAndSwapRawBytes(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	client := kvpb.NewKVClient(startTestGrpc(t, nodes[0]))
+	ctx := context.Background()
+	key := []byte("k")
+
+	// 不是 JSON 的值也可以比较和写入
+	if _, err := client.Put(ctx, &kvpb.PutRequest{Key: key, Value: []byte("v1 not json")}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Key: key, Expected: []byte("v0"), Value: []byte("v2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Succeeded || !response.Exists || string(response.Value) != "v1 not json" {
+		t.Fatalf("mismatched swap = %+v", response)
+	}
+	response, err = client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Key: key, Expected: []byte("v1 not json"), Value: []byte{0xff}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Succeeded || !bytes.Equal(response.Value, []byte{0xff}) {
+		t.Fatalf("swap = %+v", response)
+	}
+	if got, err := nodes[0].db.Get(key); err != nil || !bytes.Equal(got, []byte{0xff}) {
+		t.Fatalf("stored value = %q, %v", got, err)
+	}
+
+	// JSON 的值按字节比较，空白不同时不相等
+	if _, err = client.Put(ctx, &kvpb.PutRequest{Key: key, Value: []byte(`{"a": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	response, err = client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Key: key, Expected: []byte(`{"a":1}`), Value: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Succeeded {
+		t.Fatal("swap succeeded although the bytes differ")
+	}
+
+	response, err = client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Key: key, Expected: []byte(`{"a": 1}`), Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Succeeded || response.Exists {
+		t.Fatalf("delete if equals = %+v", response)
+	}
+	response, err = client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Key: key, Value: []byte{}, IfAbsent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Succeeded || !response.Exists || len(response.Value) != 0 {
+		t.Fatalf("put if absent = %+v", response)
+	}
+	if got, err := nodes[0].db.Get(key); err != nil || len(got) != 0 {
+		t.Fatalf("stored empty value = %q, %v", got, err)
+	}
+}
+
+func TestGrpcCompareAndSwapReplicated(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	client := kvpb.NewKVClient(startTestGrpc(t, nodes[0]))
+	ctx := context.Background()
+	if _, err := client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Key: []byte("k"), Value: []byte{1, 2}, IfAbsent: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "follower to apply the swap", func() bool {
+		got, err := nodes[1].db.Get([]byte("k"))
+		return err == nil && bytes.Equal(got, []byte{1, 2})
+	})
+}
+
+func TestGrpcScan(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	client := kvpb.NewKVClient(startTestGrpc(t, nodes[0]))
+	ctx := context.Background()
+	ops := make([]*kvpb.Op, 0)
+	for _, key := range []string{"a", "b1", "b2", "b3", "c"} {
+		ops = append(ops, &kvpb.Op{Type: kvpb.OpType_PUT, Key: []byte(key), Value: []byte(key)})
+	}
+	if _, err := client.Batch(ctx, &kvpb.BatchRequest{Ops: ops}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.Scan(ctx, &kvpb.ScanRequest{Prefix: []byte("b"), Reverse: true, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for {
+		kv, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(kv.Key, kv.Value) {
+			t.Fatalf("%s = %s", kv.Key, kv.Value)
+		}
+		keys = append(keys, string(kv.Key))
+	}
+	if len(keys) != 2 || keys[0] != "b3" || keys[1] != "b2" {
+		t.Fatalf("scan = %v, want [b3 b2]", keys)
+	}
+}
+
+func TestGrpcNotLeader(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	_, id := nodes[0].raft.LeaderWithID()
+	grpcAddrs := map[string]string{string(id): "10.0.0.1:7002"}
+	client := kvpb.NewKVClient(serveTestGrpc(t, newGrpcServer(nodes[1].raft, nodes[1].db, "node1", grpcAddrs)))
+	var trailer metadata.MD
+	_, err := client.Put(context.Background(), &kvpb.PutRequest{Key: []byte("k"), Value: []byte("v")}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("put on follower: got %v, want UNAVAILABLE", err)
+	}
+	if got := trailer.Get("leader-id"); len(got) != 1 || got[0] != string(id) {
+		t.Fatalf("leader-id = %v, want %s", got, id)
+	}
+	// leader-addr 是客户端可以连接的 gRPC 地址，而不是 raft 地址
+	if got := trailer.Get("leader-addr"); len(got) != 1 || got[0] != "10.0.0.1:7002" {
+		t.Fatalf("leader-addr = %v, want 10.0.0.1:7002", got)
+	}
+
+	// 没有配置 leader 的 gRPC 地址时为空
+	client = kvpb.NewKVClient(startTestGrpc(t, nodes[1]))
+	trailer = nil
+	_, err = client.Put(context.Background(), &kvpb.PutRequest{Key: []byte("k"), Value: []byte("v")}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("put on follower: got %v, want UNAVAILABLE", err)
+	}
+	if got := trailer.Get("leader-addr"); len(got) != 1 || got[0] != "" {
+		t.Fatalf("leader-addr = %v without a configured grpc address", got)
+	}
+}
+
+func TestGrpcStatus(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	client := kvpb.NewClusterClient(startTestGrpc(t, nodes[0]))
+	response, err := client.Status(context.Background(), &kvpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.State != "Leader" || len(response.Servers) != 2 {
+		t.Fatalf("status = %+v", response)
+	}
+}
+
+func TestGrpcCompareAndSwapFamily(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	users, err := nodes[0].db.CreateColumnFamily("users", config.FamilyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := kvpb.NewKVClient(startTestGrpc(t, nodes[0]))
+	ctx := context.Background()
+	key := []byte("k")
+	response, err := client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Cf: "users", Key: key, Value: []byte("v"), IfAbsent: true, TtlMs: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Succeeded {
+		t.Fatalf("put if absent = %+v", response)
+	}
+	if got, err := users.Get(key); err != nil || string(got) != "v" {
+		t.Fatalf("users k = %q, %v", got, err)
+	}
+	if _, err = nodes[0].db.Get(key); err == nil {
+		t.Fatal("swap in a family changed the default family")
+	}
+
+	// 过期后 key 不存在，可以再次写入
+	time.Sleep(100 * time.Millisecond)
+	response, err = client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Cf: "users", Key: key, Value: []byte("w"), IfAbsent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Succeeded {
+		t.Fatalf("put if absent after expiry = %+v", response)
+	}
+
+	_, err = client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Cf: "missing", Key: key, Value: []byte("v"), IfAbsent: true})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("swap in missing family: got %v, want NOT_FOUND", err)
+	}
+	_, err = client.CompareAndSwap(ctx, &kvpb.CompareAndSwapRequest{Key: key, Value: []byte("v"), IfAbsent: true, TtlMs: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("negative ttl: got %v, want INVALID_ARGUMENT", err)
+	}
+}
+
+func TestGrpcWatch(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	// 在 follower 上订阅，收到 leader 写入后复制过来的变更
+	client := kvpb.NewKVClient(startTestGrpc(t, nodes[1]))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	missing, err := client.Watch(ctx, &kvpb.WatchRequest{Cf: "missing"})
+	if err == nil {
+		_, err = missing.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("watch missing family: got %v, want NOT_FOUND", err)
+	}
+
+	stream, err := client.Watch(ctx, &kvpb.WatchRequest{Prefix: []byte("w/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 收到响应头后订阅已经开始
+	if _, err = stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	if err = nodes[0].db.Put([]byte("x"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = nodes[0].db.Put([]byte("w/a"), []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != kvpb.OpType_PUT || string(event.Key) != "w/a" || !bytes.Equal(event.Value, []byte{0xff}) || event.Seq == 0 {
+		t.Fatalf("event = %v", event)
+	}
+	cancel()
+	if _, err = stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Fatalf("after cancel: got %v, want CANCELED", err)
+	}
+}
@@ -0,0 +1,368 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"mylsmtree/pkg/iterator"
+	"mylsmtree/pkg/kv"
+	"mylsmtree/pkg/lsm"
+	"strings"
+	"time"
+)
+
+// Iterator 按 key 有序遍历数据库，合并内存表、只读内存表和所有层的 SSTable，
+// 已删除或已过期的 key 和被新值覆盖的旧值不会出现。
+// 遍历的是创建时的数据，不受之后写入的影响，使用完需要调用 Close
+type Iterator struct {
+	// 遍历的列族
+	cf   *ColumnFamily
+	iter iterator.Iterator
+	// 只能看到序列号不大于 seq 的版本
+	seq     uint64
+	forward bool
+	valid   bool
+	key     string
+	value   kv.Value
+	err     error
+	closed  bool
+	// 不为空时只遍历以 prefix 开头的 key
+	prefix string
+	// 创建时所有可见的范围删除标记
+	tombstones []kv.RangeTombstone
+}
+
+// NewIterator 创建遍历整个数据库的迭代器，需要先调用 Seek、SeekToFirst 或 SeekToLast 定位
+func NewIterator() *Iterator {
+	db, err := current()
+	if err != nil {
+		return closedIterator(nil)
+	}
+	return db.NewIterator()
+}
+
+// closedIterator 数据库没有打开或已经关闭时返回的没有数据的迭代器，Err 返回 ErrClosed
+func closedIterator(cf *ColumnFamily) *Iterator {
+	return &Iterator{cf: cf, iter: iterator.NewMergingIterator(), err: ErrClosed, closed: true}
+}
+
+// newIterator 创建遍历列族 cf、只能看到序列号不大于 seq 的版本的迭代器
+func newIterator(cf *ColumnFamily, prefix string, seq uint64) *Iterator {
+	if cf.db.isClosed() {
+		return closedIterator(cf)
+	}
+	cf.ValueLog.Acquire()
+
+	cf.db.lock.RLock()
+	children := []iterator.Iterator{cf.MemoryTree.NewIterator()}
+	tombstones := cf.MemoryTree.GetRangeTombstones()
+	for i := len(cf.db.Immutables) - 1; i >= 0; i-- {
+		tree, ok := cf.db.Immutables[i].Trees[cf.name]
+		if !ok {
+			continue
+		}
+		children = append(children, tree.NewIterator())
+		tombstones = append(tombstones, tree.GetRangeTombstones()...)
+	}
+	tableIterators, tableTombstones := cf.TableTree.NewPrefixIterators(prefix)
+	children = append(children, tableIterators...)
+	tombstones = append(tombstones, tableTombstones...)
+	cf.db.lock.RUnlock()
+
+	visible := make([]kv.RangeTombstone, 0, len(tombstones))
+	for _, tombstone := range tombstones {
+		if tombstone.Seq <= seq {
+			visible = append(visible, tombstone)
+		}
+	}
+	return &Iterator{
+		cf:         cf,
+		iter:       iterator.NewMergingIterator(children...),
+		seq:        seq,
+		forward:    true,
+		prefix:     prefix,
+		tombstones: visible,
+	}
+}
+
+// isLive 版本是否能被读到，删除标记、已经过期和被范围删除标记遮盖的版本都读不到
+func (it *Iterator) isLive(value kv.Value) bool {
+	if value.Deleted || value.Expired(time.Now()) {
+		return false
+	}
+	return kv.MaxCoveringSeq(it.tombstones, value.Key, it.seq) <= value.Seq
+}
+
+// resolve 从 key 从新到旧的可见版本中得到迭代器返回的记录，最新的版本是合并操作数时和更旧的版本合并，
+// ok 为 false 表示 key 读不到
+func (it *Iterator) resolve(versions []kv.Value) (value kv.Value, ok bool) {
+	value = versions[0]
+	if value.Merge {
+		coveredSeq := kv.MaxCoveringSeq(it.tombstones, value.Key, it.seq)
+		if value.Seq < coveredSeq {
+			return kv.Value{}, false
+		}
+		operands, base, complete := lsm.SplitMerge(versions, coveredSeq)
+		if !complete {
+			base = kv.Value{Key: value.Key, Deleted: true}
+		}
+		merged, err := lsm.ApplyMerge(it.cf.db.mergeOperator, base, operands, it.cf.resolveValue)
+		if err != nil {
+			it.err = err
+			return kv.Value{}, false
+		}
+		value = merged
+	}
+	return value, it.isLive(value)
+}
+
+// inRange key 是否在迭代器的前缀范围内
+func (it *Iterator) inRange(key string) bool {
+	return strings.HasPrefix(key, it.prefix)
+}
+
+// findNextUserEntry 正向遍历时，同一个 key 的版本按序列号从新到旧出现，
+// 跳过迭代器创建之后写入的版本，取出第一个可见的版本后跳过这个 key 的其它旧版本，停在下一个 key 上
+func (it *Iterator) findNextUserEntry() {
+	it.forward = true
+	for it.iter.Valid() {
+		key, seq, _ := kv.ParseInternalKey(it.iter.Key())
+		if !it.inRange(key) {
+			break
+		}
+		if seq > it.seq {
+			it.iter.Next()
+			continue
+		}
+		// 最新的版本是合并操作数时，还要取出更旧的版本，直到值或删除标记
+		versions := []kv.Value{it.iter.Value()}
+		collecting := versions[0].Merge
+		for it.iter.Next(); it.iter.Valid() && kv.UserKey(it.iter.Key()) == key; it.iter.Next() {
+			if collecting {
+				older := it.iter.Value()
+				versions = append(versions, older)
+				collecting = older.Merge
+			}
+		}
+		if value, ok := it.resolve(versions); ok {
+			it.key = key
+			it.value = value
+			it.valid = true
+			return
+		}
+	}
+	it.valid = false
+}
+
+// findPrevUserEntry 反向遍历时，同一个 key 的版本从旧到新出现，最后一个可见的版本才是最新的，
+// 取出后停在上一个 key 上
+func (it *Iterator) findPrevUserEntry() {
+	it.forward = false
+	for it.iter.Valid() {
+		key := kv.UserKey(it.iter.Key())
+		// 可见的版本，从旧到新
+		versions := make([]kv.Value, 0, 1)
+		for it.iter.Valid() {
+			currentKey, seq, _ := kv.ParseInternalKey(it.iter.Key())
+			if currentKey != key {
+				break
+			}
+			if seq <= it.seq {
+				versions = append(versions, it.iter.Value())
+			}
+			it.iter.Prev()
+		}
+		if !it.inRange(key) {
+			break
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+			versions[i], versions[j] = versions[j], versions[i]
+		}
+		if value, ok := it.resolve(versions); ok {
+			it.key = key
+			it.value = value
+			it.valid = true
+			return
+		}
+	}
+	it.valid = false
+}
+
+// Valid 是否定位在一个有效的 key 上
+func (it *Iterator) Valid() bool {
+	return !it.closed && it.valid && it.Err() == nil
+}
+
+// SeekToFirst 定位到第一个 key
+func (it *Iterator) SeekToFirst() {
+	if it.prefix != "" {
+		it.iter.Seek(kv.InternalKey(it.prefix, kv.MaxSeq))
+	} else {
+		it.iter.SeekToFirst()
+	}
+	it.findNextUserEntry()
+}
+
+// SeekToLast 定位到最后一个 key
+func (it *Iterator) SeekToLast() {
+	successor, ok := prefixSuccessor(it.prefix)
+	if !ok {
+		it.iter.SeekToLast()
+	} else {
+		// 定位到前缀之后的第一个 key，再退回一个
+		it.iter.Seek(kv.InternalKey(successor, kv.MaxSeq))
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else {
+			it.iter.SeekToLast()
+		}
+	}
+	it.findPrevUserEntry()
+}
+
+// Seek 定位到第一个大于等于 key 的位置
+func (it *Iterator) Seek(key string) {
+	if key < it.prefix {
+		key = it.prefix
+	}
+	it.iter.Seek(kv.InternalKey(key, kv.MaxSeq))
+	it.findNextUserEntry()
+}
+
+// Next 移动到下一个 key
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	if !it.forward {
+		// 反向时子迭代器停在当前 key 之前，先跳过当前 key 的所有版本
+		it.iter.Seek(kv.InternalKey(it.key, kv.MaxSeq))
+		for it.iter.Valid() && kv.UserKey(it.iter.Key()) == it.key {
+			it.iter.Next()
+		}
+	}
+	it.findNextUserEntry()
+}
+
+// Prev 移动到上一个 key
+func (it *Iterator) Prev() {
+	if !it.valid {
+		return
+	}
+	if it.forward {
+		// 正向时子迭代器停在当前 key 之后，先退回到当前 key 之前
+		it.iter.Seek(kv.InternalKey(it.key, kv.MaxSeq))
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else {
+			it.iter.SeekToLast()
+		}
+	}
+	it.findPrevUserEntry()
+}
+
+// Key 当前位置的 key
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value 当前位置 JSON 编码的值解码后的结果
+func (it *Iterator) Value() interface{} {
+	data, err := it.cf.resolveValue(it.value)
+	if err != nil {
+		it.err = err
+		return nil
+	}
+	value, _ := getInstance(data)
+	return value
+}
+
+// ValueBytes 当前位置的值的原始字节
+func (it *Iterator) ValueBytes() ([]byte, error) {
+	return it.cf.resolveValue(it.value)
+}
+
+// Err 遍历过程中遇到的错误
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.closed {
+		return errors.New("iterator is closed")
+	}
+	return it.iter.Err()
+}
+
+// Close 释放迭代器持有的 SSTable 和 value log
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.valid = false
+	err := it.iter.Close()
+	it.cf.ValueLog.Release()
+	return err
+}
+
+// KeyValue Scan 返回的一条记录
+type KeyValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// Scan 按 key 升序返回 [start, end) 范围内的记录，
+// start 或 end 为空表示不限制，limit 小于等于 0 表示不限制数量
+func Scan(start, end string, limit int) []KeyValue {
+	db, err := current()
+	if err != nil {
+		return nil
+	}
+	return db.Scan(start, end, limit)
+}
+
+// ScanContext 和 Scan 相同，遍历中 ctx 被取消或超时时停止并返回 ctx.Err()
+func ScanContext(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	db, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return db.ScanContext(ctx, start, end, limit)
+}
+
+// scan 用 it 遍历 [start, end) 范围内的记录，遍历完关闭 it
+func scan(it *Iterator, start, end string, limit int) []KeyValue {
+	result, _ := scanContext(context.Background(), it, start, end, limit)
+	return result
+}
+
+// scanContext 和 scan 相同，每读一条记录检查一次 ctx，
+// ctx 被取消或迭代器出错时返回已经读到的记录和错误
+func scanContext(ctx context.Context, it *Iterator, start, end string, limit int) ([]KeyValue, error) {
+	defer it.Close()
+
+	result := make([]KeyValue, 0)
+	if start == "" {
+		it.SeekToFirst()
+	} else {
+		it.Seek(start)
+	}
+	for ; it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if end != "" && it.Key() >= end {
+			break
+		}
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, KeyValue{
+			Key:   it.Key(),
+			Value: it.Value(),
+		})
+	}
+	return result, it.Err()
+}
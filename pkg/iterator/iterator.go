@@ -0,0 +1,85 @@
+package iterator
+
+import (
+	"mylsmtree/pkg/kv"
+	"sort"
+)
+
+// Iterator 按内部 key 有序遍历内存表或 SSTable 中的记录，包含删除标记和同一个 key 的所有版本，
+// 定位到末尾之外时 Valid 返回 false
+type Iterator interface {
+	Valid() bool
+	SeekToFirst()
+	SeekToLast()
+	// Seek 定位到第一个大于等于内部 key 的位置
+	Seek(key string)
+	Next()
+	Prev()
+	// Key 当前位置的内部 key
+	Key() string
+	Value() kv.Value
+	Err() error
+	Close() error
+}
+
+// sliceIterator 遍历已经按内部 key 排好序的记录
+type sliceIterator struct {
+	keys   []string
+	values []kv.Value
+	index  int
+}
+
+// NewSliceIterator 创建遍历有序记录的迭代器，values 需要按内部 key 升序排列
+func NewSliceIterator(values []kv.Value) Iterator {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = kv.InternalKey(value.Key, value.Seq)
+	}
+	return &sliceIterator{
+		keys:   keys,
+		values: values,
+		index:  len(values),
+	}
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.index >= 0 && it.index < len(it.values)
+}
+
+func (it *sliceIterator) SeekToFirst() {
+	it.index = 0
+}
+
+func (it *sliceIterator) SeekToLast() {
+	it.index = len(it.values) - 1
+}
+
+func (it *sliceIterator) Seek(key string) {
+	it.index = sort.SearchStrings(it.keys, key)
+}
+
+func (it *sliceIterator) Next() {
+	it.index++
+}
+
+func (it *sliceIterator) Prev() {
+	it.index--
+}
+
+func (it *sliceIterator) Key() string {
+	return it.keys[it.index]
+}
+
+func (it *sliceIterator) Value() kv.Value {
+	return it.values[it.index]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	it.keys = nil
+	it.values = nil
+	return nil
+}
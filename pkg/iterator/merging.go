@@ -0,0 +1,145 @@
+package iterator
+
+import "mylsmtree/pkg/kv"
+
+// mergingIterator 将多个有序的迭代器合并为一个，
+// 相同的 key 按子迭代器的顺序排列，调用方把较新的数据源放在前面，
+// 遍历时同一个 key 最先出现的就是最新的记录
+type mergingIterator struct {
+	children []Iterator
+	current  int
+	forward  bool
+}
+
+// NewMergingIterator 合并多个迭代器，children 按从新到旧排列
+func NewMergingIterator(children ...Iterator) Iterator {
+	return &mergingIterator{
+		children: children,
+		current:  -1,
+		forward:  true,
+	}
+}
+
+// before 判断子迭代器 i 当前的位置是否排在子迭代器 j 之前
+func (m *mergingIterator) before(i, j int) bool {
+	ki, kj := m.children[i].Key(), m.children[j].Key()
+	if ki != kj {
+		return ki < kj
+	}
+	return i < j
+}
+
+func (m *mergingIterator) findSmallest() {
+	m.current = -1
+	for i, child := range m.children {
+		if child.Valid() && (m.current == -1 || m.before(i, m.current)) {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = -1
+	for i, child := range m.children {
+		if child.Valid() && (m.current == -1 || m.before(m.current, i)) {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.current != -1
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+	m.forward = true
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+	m.forward = false
+	m.findLargest()
+}
+
+func (m *mergingIterator) Seek(key string) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+	m.forward = true
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Next() {
+	if !m.forward {
+		// 反向切换为正向，其它子迭代器都要移动到当前位置之后
+		key := m.Key()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+			child.Seek(key)
+			if child.Valid() && child.Key() == key && i < m.current {
+				child.Next()
+			}
+		}
+		m.forward = true
+	}
+	m.children[m.current].Next()
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Prev() {
+	if m.forward {
+		// 正向切换为反向，其它子迭代器都要移动到当前位置之前
+		key := m.Key()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+			child.Seek(key)
+			if !child.Valid() {
+				child.SeekToLast()
+			} else if child.Key() != key || i > m.current {
+				child.Prev()
+			}
+		}
+		m.forward = false
+	}
+	m.children[m.current].Prev()
+	m.findLargest()
+}
+
+func (m *mergingIterator) Key() string {
+	return m.children[m.current].Key()
+}
+
+func (m *mergingIterator) Value() kv.Value {
+	return m.children[m.current].Value()
+}
+
+func (m *mergingIterator) Err() error {
+	for _, child := range m.children {
+		if err := child.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergingIterator) Close() error {
+	var err error
+	for _, child := range m.children {
+		if e := child.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	m.children = nil
+	m.current = -1
+	return err
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// iteratorDB 数据分布在 SSTable、只读内存表和内存表中：
+// a、b、c 在 SSTable 中，b 在只读内存表中被覆盖，c 在内存表中被删除，d 只在内存表中
+func iteratorDB(t *testing.T) *DB {
+	t.Helper()
+	db := openTestDB(t, nil)
+	set := func(key string, value interface{}) {
+		if err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("a", 1)
+	set("b", 1)
+	set("c", 1)
+	flushTestDB(t, db)
+	set("b", 2)
+	db.writeLock.Lock()
+	err := db.switchMemoryTree()
+	db.writeLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	set("d", 3)
+	return db
+}
+
+// collect 从当前位置开始遍历，forward 为 false 时反向遍历，返回 key=value 形式的记录
+func collect(it *Iterator, forward bool) string {
+	var entries []string
+	for it.Valid() {
+		entries = append(entries, fmt.Sprint(it.Key(), "=", it.Value()))
+		if forward {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+func TestIteratorMergesAllSources(t *testing.T) {
+	db := iteratorDB(t)
+	it := db.NewIterator()
+	defer it.Close()
+
+	it.SeekToFirst()
+	if got := collect(it, true); got != "a=1,b=2,d=3" {
+		t.Fatalf("forward = %s", got)
+	}
+	it.SeekToLast()
+	if got := collect(it, false); got != "d=3,b=2,a=1" {
+		t.Fatalf("reverse = %s", got)
+	}
+	// 定位到被删除的 c 时跳到下一个 key
+	it.Seek("c")
+	if got := collect(it, true); got != "d=3" {
+		t.Fatalf("seek c = %s", got)
+	}
+	// 正反方向切换
+	it.Seek("b")
+	it.Prev()
+	if !it.Valid() || it.Key() != "a" {
+		t.Fatalf("prev of b = %q, valid %v", it.Key(), it.Valid())
+	}
+	it.Next()
+	if !it.Valid() || it.Key() != "b" {
+		t.Fatalf("next of a = %q, valid %v", it.Key(), it.Valid())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIteratorIgnoresLaterWrites(t *testing.T) {
+	db := iteratorDB(t)
+	it := db.NewIterator()
+	defer it.Close()
+	if err := db.Set("aa", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+	it.SeekToFirst()
+	if got := collect(it, true); got != "a=1,b=2,d=3" {
+		t.Fatalf("iterator saw later writes: %s", got)
+	}
+}
+
+func TestScanRangeAndLimit(t *testing.T) {
+	db := iteratorDB(t)
+	keys := func(result []KeyValue) string {
+		var keys []string
+		for _, kv := range result {
+			keys = append(keys, kv.Key)
+		}
+		return strings.Join(keys, ",")
+	}
+	if got := keys(db.Scan("b", "", 0)); got != "b,d" {
+		t.Fatalf("scan [b, ) = %s", got)
+	}
+	if got := keys(db.Scan("", "d", 0)); got != "a,b" {
+		t.Fatalf("scan [, d) = %s", got)
+	}
+	if got := keys(db.Scan("", "", 2)); got != "a,b" {
+		t.Fatalf("scan with limit 2 = %s", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.ScanContext(ctx, "", "", 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled scan: got %v, want context.Canceled", err)
+	}
+}
+
+func TestIteratorClosedDB(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	it := db.NewIterator()
+	it.SeekToFirst()
+	if it.Valid() || !errors.Is(it.Err(), ErrClosed) {
+		t.Fatalf("iterator of a closed database: valid %v, err %v", it.Valid(), it.Err())
+	}
+}
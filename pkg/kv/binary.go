@@ -0,0 +1,80 @@
+package kv
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// SplitBinary 把 s 拆成 JSON 中可以保存的形式，JSON 字符串中不合法的 UTF-8 会被替换为 U+FFFD，
+// 所以合法的 UTF-8 字符串原样作为 text 返回，否则作为 binary 返回，binary 在 JSON 中是 base64
+func SplitBinary(s string) (text string, binary []byte) {
+	if utf8.ValidString(s) {
+		return s, nil
+	}
+	return "", []byte(s)
+}
+
+// JoinBinary SplitBinary 的逆操作，binary 不为 nil 时使用 binary
+func JoinBinary(text string, binary []byte) string {
+	if binary != nil {
+		return string(binary)
+	}
+	return text
+}
+
+// plainValue 和 Value 相同，但没有自定义的 JSON 编码
+type plainValue Value
+
+// valueJSON Value 的 JSON 形式，key 不是合法的 UTF-8 时保存在 BinaryKey 中
+type valueJSON struct {
+	plainValue
+	BinaryKey []byte `json:",omitempty"`
+}
+
+// MarshalJSON 二进制的 key 编码为 base64
+func (v Value) MarshalJSON() ([]byte, error) {
+	record := valueJSON{plainValue: plainValue(v)}
+	record.Key, record.BinaryKey = SplitBinary(v.Key)
+	return json.Marshal(record)
+}
+
+// UnmarshalJSON 兼容没有 BinaryKey 的旧记录
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var record valueJSON
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	*v = Value(record.plainValue)
+	v.Key = JoinBinary(record.Key, record.BinaryKey)
+	return nil
+}
+
+// plainRangeTombstone 和 RangeTombstone 相同，但没有自定义的 JSON 编码
+type plainRangeTombstone RangeTombstone
+
+// rangeTombstoneJSON RangeTombstone 的 JSON 形式，Start、End 不是合法的 UTF-8 时保存在 BinaryStart、BinaryEnd 中
+type rangeTombstoneJSON struct {
+	plainRangeTombstone
+	BinaryStart []byte `json:",omitempty"`
+	BinaryEnd   []byte `json:",omitempty"`
+}
+
+// MarshalJSON 二进制的范围边界编码为 base64
+func (t RangeTombstone) MarshalJSON() ([]byte, error) {
+	record := rangeTombstoneJSON{plainRangeTombstone: plainRangeTombstone(t)}
+	record.Start, record.BinaryStart = SplitBinary(t.Start)
+	record.End, record.BinaryEnd = SplitBinary(t.End)
+	return json.Marshal(record)
+}
+
+// UnmarshalJSON 兼容没有 BinaryStart、BinaryEnd 的旧记录
+func (t *RangeTombstone) UnmarshalJSON(data []byte) error {
+	var record rangeTombstoneJSON
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	*t = RangeTombstone(record.plainRangeTombstone)
+	t.Start = JoinBinary(record.Start, record.BinaryStart)
+	t.End = JoinBinary(record.End, record.BinaryEnd)
+	return nil
+}
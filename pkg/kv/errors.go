@@ -0,0 +1,52 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrIO 读写文件失败
+	ErrIO = errors.New("io error")
+	// ErrCorruption 文件内容损坏，无法解析
+	ErrCorruption = errors.New("corruption")
+)
+
+// Error 存储引擎读写文件时的错误，errors.Is 可以判断是 ErrIO 还是 ErrCorruption，
+// errors.Unwrap 得到原始的错误
+type Error struct {
+	// ErrIO 或 ErrCorruption
+	Kind error
+	// 出错的操作和文件
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v: %s %s", e.Kind, e.Op, e.Path)
+	}
+	return fmt.Sprintf("%v: %s %s: %v", e.Kind, e.Op, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// IOError 读写文件 path 时的 I/O 错误，err 为 nil 时返回 nil
+func IOError(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: ErrIO, Op: op, Path: path, Err: err}
+}
+
+// CorruptionError 文件 path 的内容损坏，err 可以为 nil
+func CorruptionError(op, path string, err error) error {
+	return &Error{Kind: ErrCorruption, Op: op, Path: path, Err: err}
+}
@@ -0,0 +1,66 @@
+package kv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MaxSeq 最大的序列号，按 MaxSeq 查找时可以看到所有版本
+const MaxSeq uint64 = math.MaxUint64
+
+// 内部 key 中序列号部分的长度
+const seqLen = 16
+
+// InternalKey 将 key 和序列号编码为内部 key，内存表和 SSTable 中的记录按内部 key 排序。
+// 编码为：key 中的 0x00 转义为 0x00 0x02，接着是结束符 0x00 0x01，最后是 ^seq 的 16 位十六进制，
+// 编码后的字符串按字节比较时，先按 key 升序，同一个 key 再按序列号降序，即新版本在前
+func InternalKey(key string, seq uint64) string {
+	var builder strings.Builder
+	builder.Grow(len(key) + 2 + seqLen)
+	for i := 0; i < len(key); i++ {
+		if key[i] == 0x00 {
+			builder.WriteString("\x00\x02")
+		} else {
+			builder.WriteByte(key[i])
+		}
+	}
+	builder.WriteString("\x00\x01")
+	builder.WriteString(fmt.Sprintf("%016x", ^seq))
+	return builder.String()
+}
+
+// ParseInternalKey 解析内部 key，返回 key 和序列号
+func ParseInternalKey(internalKey string) (key string, seq uint64, ok bool) {
+	n := len(internalKey) - seqLen - 2
+	if n < 0 || internalKey[n:n+2] != "\x00\x01" {
+		return "", 0, false
+	}
+	inverted, err := strconv.ParseUint(internalKey[n+2:], 16, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	escaped := internalKey[:n]
+	if strings.IndexByte(escaped, 0x00) < 0 {
+		return escaped, ^inverted, true
+	}
+	var builder strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		builder.WriteByte(escaped[i])
+		if escaped[i] == 0x00 {
+			// 跳过转义用的 0x02
+			i++
+		}
+	}
+	return builder.String(), ^inverted, true
+}
+
+// UserKey 获取内部 key 中的 key，无法解析时原样返回
+func UserKey(internalKey string) string {
+	key, _, ok := ParseInternalKey(internalKey)
+	if !ok {
+		return internalKey
+	}
+	return key
+}
@@ -0,0 +1,34 @@
+package kv
+
+// RangeTombstone 范围删除标记，删除 [Start, End) 中序列号小于 Seq 的所有版本，End 为空表示不限制
+type RangeTombstone struct {
+	Start string
+	End   string `json:",omitempty"`
+	Seq   uint64
+}
+
+// Contains key 是否在删除范围内
+func (t RangeTombstone) Contains(key string) bool {
+	return key >= t.Start && (t.End == "" || key < t.End)
+}
+
+// Covers 序列号为 seq 的 key 是否被删除
+func (t RangeTombstone) Covers(key string, seq uint64) bool {
+	return seq < t.Seq && t.Contains(key)
+}
+
+// Overlaps 删除范围是否和 [start, end] 有重叠，start 或 end 为空表示不限制
+func (t RangeTombstone) Overlaps(start, end string) bool {
+	return (end == "" || t.Start <= end) && (start == "" || t.End == "" || start < t.End)
+}
+
+// MaxCoveringSeq 在序列号 readSeq 时可见的、范围包含 key 的删除标记中最大的序列号，没有时返回 0
+func MaxCoveringSeq(tombstones []RangeTombstone, key string, readSeq uint64) uint64 {
+	var maxSeq uint64
+	for _, t := range tombstones {
+		if t.Seq <= readSeq && t.Seq > maxSeq && t.Contains(key) {
+			maxSeq = t.Seq
+		}
+	}
+	return maxSeq
+}
@@ -1,6 +1,9 @@
 package kv
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 type SearchResult int
 
@@ -15,6 +18,23 @@ type Value struct {
 	Key string
 	Value []byte
 	Deleted bool
+	// 写入时分配的序列号，同一个 key 序列号大的版本更新
+	Seq uint64 `json:",omitempty"`
+	// 值被分离到 value log 时指向它的位置，此时 Value 为空
+	Pointer *ValuePointer `json:",omitempty"`
+	// 过期时间，Unix 纳秒时间戳，为 0 表示不过期
+	ExpiresAt int64 `json:",omitempty"`
+	// 合并操作数，读取和压缩时用 MergeOperator 合并到更旧的版本上
+	Merge bool `json:",omitempty"`
+	// 写入这个版本的 raft 日志编号，每个节点上相同，不通过 raft 写入时为 0
+	Version uint64 `json:",omitempty"`
+}
+
+// ValuePointer value log 中一条记录的位置
+type ValuePointer struct {
+	Fid uint32
+	Offset int64
+	Len int64
 }
 
 func (v *Value) Copy() *Value {
@@ -22,9 +42,19 @@ func (v *Value) Copy() *Value {
 		Key: v.Key,
 		Value: v.Value,
 		Deleted: v.Deleted,
+		Seq: v.Seq,
+		Pointer: v.Pointer,
+		ExpiresAt: v.ExpiresAt,
+		Merge: v.Merge,
+		Version: v.Version,
 	}
 }
 
+// Expired 记录在 now 时是否已经过期，过期的记录和删除标记一样处理
+func (v *Value) Expired(now time.Time) bool {
+	return v.ExpiresAt > 0 && now.UnixNano() >= v.ExpiresAt
+}
+
 func Get(v *Value) (interface{}, error) {
 	var value interface{}
 	err := json.Unmarshal(v.Value, &value)
@@ -0,0 +1,4 @@
+// Package kvpb gRPC 接口的消息和服务，由 kv.proto 生成
+package kvpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kv.proto
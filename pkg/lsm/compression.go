@@ -0,0 +1,52 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"mylsmtree/pkg/config"
+	"mylsmtree/pkg/kv"
+)
+
+// flateRecord 压缩后的记录的第一个字节。没有压缩的记录是 JSON 对象，以 '{' 开头，
+// 所以同一个 SSTable 中可以混合两种记录，修改列族的压缩算法后旧文件仍然可以读取
+const flateRecord = 0x01
+
+// encodeRecord 按压缩算法 compression 编码 SSTable 中的一条记录
+func encodeRecord(value kv.Value, compression string) ([]byte, error) {
+	data, err := kv.Encode(value)
+	if err != nil || compression != config.CompressionFlate {
+		return data, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(flateRecord)
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	// 很短的记录压缩后可能更长，这时保存原始数据
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRecord 解码 SSTable 中的一条记录，记录可以是压缩的，也可以是没有压缩的
+func decodeRecord(data []byte) (kv.Value, error) {
+	if len(data) > 0 && data[0] == flateRecord {
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		decompressed, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return kv.Value{}, err
+		}
+		data = decompressed
+	}
+	return kv.Decode(data)
+}
@@ -0,0 +1,26 @@
+package lsm
+
+// CompactionDecision 压缩过滤器对一条记录的处理结果
+type CompactionDecision int
+
+const (
+	// Keep 保留记录
+	Keep CompactionDecision = iota
+	// Remove 删除记录，记录会被替换为删除标记，到达最底层时再被清理
+	Remove
+	// ChangeValue 用过滤器返回的新值替换记录的值
+	ChangeValue
+)
+
+// CompactionFilter 在压缩合并时对每个 key 的最新有效值调用，
+// 可以用来实现自定义的过期、按租户清理、改写值等逻辑，level 为被压缩的层
+type CompactionFilter interface {
+	Filter(level int, key string, value []byte) (decision CompactionDecision, newValue []byte)
+}
+
+// CompactionFilterFunc 将普通函数转为 CompactionFilter
+type CompactionFilterFunc func(level int, key string, value []byte) (CompactionDecision, []byte)
+
+func (f CompactionFilterFunc) Filter(level int, key string, value []byte) (CompactionDecision, []byte) {
+	return f(level, key, value)
+}
@@ -0,0 +1,141 @@
+package lsm
+
+import (
+	"mylsmtree/pkg/iterator"
+	"mylsmtree/pkg/kv"
+	"sort"
+	"strings"
+)
+
+// tableIterator 按 key 有序遍历 SSTable，值在访问时才从文件中读取
+type tableIterator struct {
+	table *SSTable
+	index int
+	err   error
+}
+
+// NewIterator 创建遍历 SSTable 的迭代器，迭代器持有 SSTable 的引用，使用完需要 Close
+func (table *SSTable) NewIterator() iterator.Iterator {
+	table.Ref()
+	return &tableIterator{
+		table: table,
+		index: len(table.sortIndex),
+	}
+}
+
+func (it *tableIterator) Valid() bool {
+	return it.err == nil && it.index >= 0 && it.index < len(it.table.sortIndex)
+}
+
+func (it *tableIterator) SeekToFirst() {
+	it.index = 0
+}
+
+func (it *tableIterator) SeekToLast() {
+	it.index = len(it.table.sortIndex) - 1
+}
+
+func (it *tableIterator) Seek(key string) {
+	it.index = sort.SearchStrings(it.table.sortIndex, key)
+}
+
+func (it *tableIterator) Next() {
+	it.index++
+}
+
+func (it *tableIterator) Prev() {
+	it.index--
+}
+
+func (it *tableIterator) Key() string {
+	return it.table.sortIndex[it.index]
+}
+
+func (it *tableIterator) Value() kv.Value {
+	internalKey := it.Key()
+	key, seq, _ := kv.ParseInternalKey(internalKey)
+	position := it.table.sparseIndex[internalKey]
+	if position.Deleted {
+		return kv.Value{
+			Key:     key,
+			Deleted: true,
+			Seq:     seq,
+		}
+	}
+	data := make([]byte, position.Len)
+	if _, err := it.table.f.ReadAt(data, it.table.tableMetaInfo.dataStart+position.Start); err != nil {
+		it.err = err
+		return kv.Value{Key: key, Seq: seq}
+	}
+	value, err := decodeRecord(data)
+	if err != nil {
+		it.err = err
+		return kv.Value{Key: key, Seq: seq}
+	}
+	value.Key = key
+	value.Seq = seq
+	return value
+}
+
+func (it *tableIterator) Err() error {
+	return it.err
+}
+
+func (it *tableIterator) Close() error {
+	if it.table != nil {
+		it.table.Unref()
+		it.table = nil
+	}
+	return nil
+}
+
+// NewIterators 为所有 SSTable 创建迭代器，按从新到旧排列，
+// 即 L0 中编号大的在前，然后依次是更深的层，同时返回所有 SSTable 中的范围删除标记
+func (tree *TableTree) NewIterators() ([]iterator.Iterator, []kv.RangeTombstone) {
+	return tree.NewPrefixIterators("")
+}
+
+// NewPrefixIterators 为可能包含以 prefix 开头的 key 的 SSTable 创建迭代器，
+// prefix 能被 PrefixExtractor 提取时，用前缀布隆过滤器跳过不包含该前缀的 SSTable。
+// 被跳过的 SSTable 中的范围删除标记也会返回，它们可能遮盖其它 SSTable 中的版本
+func (tree *TableTree) NewPrefixIterators(prefix string) ([]iterator.Iterator, []kv.RangeTombstone) {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+
+	filterPrefix, useFilter := "", false
+	if prefix != "" && tree.prefixExtractor != nil {
+		filterPrefix, useFilter = tree.prefixExtractor.Extract(prefix)
+	}
+	iterators := make([]iterator.Iterator, 0)
+	tombstones := make([]kv.RangeTombstone, 0)
+	for _, node := range tree.levels {
+		tables := make([]*SSTable, 0)
+		for node != nil {
+			tables = append(tables, node.table)
+			node = node.next
+		}
+		for i := len(tables) - 1; i >= 0; i-- {
+			tombstones = append(tombstones, tables[i].rangeTombstones...)
+			if prefix != "" && !tables[i].mayContainKeyWithPrefix(prefix) {
+				continue
+			}
+			if useFilter && !tables[i].MayContainPrefix(tree.prefixExtractor, filterPrefix) {
+				continue
+			}
+			iterators = append(iterators, tables[i].NewIterator())
+		}
+	}
+	return iterators, tombstones
+}
+
+// mayContainKeyWithPrefix 根据 key 的范围判断 SSTable 中是否可能有以 prefix 开头的 key
+func (table *SSTable) mayContainKeyWithPrefix(prefix string) bool {
+	start, end, ok := table.GetKeyRange()
+	if !ok {
+		return false
+	}
+	if end < prefix {
+		return false
+	}
+	return start <= prefix || strings.HasPrefix(start, prefix)
+}
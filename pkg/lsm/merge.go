@@ -0,0 +1,212 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mylsmtree/pkg/kv"
+	"strconv"
+	"time"
+)
+
+// MergeOperator 合并操作，Merge 写入的操作数不需要先读取旧值，
+// 读取和压缩时再把操作数按写入顺序合并到旧值上。值和操作数都是 JSON 编码
+type MergeOperator interface {
+	// FullMerge 把 operands（从旧到新）依次合并到 existing 上，exists 为 false 表示 key 没有值
+	FullMerge(key string, existing []byte, exists bool, operands [][]byte) ([]byte, error)
+	// PartialMerge 在没有旧值时把相邻的两个操作数合并为一个，left 比 right 旧，
+	// 不能合并时 ok 返回 false，两个操作数都会保留
+	PartialMerge(key string, left, right []byte) (operand []byte, ok bool)
+}
+
+type int64Add struct{}
+
+// Int64AddOperator 整数累加，值和操作数都是整数，没有旧值时从 0 开始
+func Int64AddOperator() MergeOperator {
+	return int64Add{}
+}
+
+func (int64Add) FullMerge(key string, existing []byte, exists bool, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if exists {
+		n, err := parseInt64(existing)
+		if err != nil {
+			return nil, fmt.Errorf("merge %s: existing value is not an integer: %v", key, err)
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := parseInt64(operand)
+		if err != nil {
+			return nil, fmt.Errorf("merge %s: operand is not an integer: %v", key, err)
+		}
+		sum += n
+	}
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+func (int64Add) PartialMerge(key string, left, right []byte) ([]byte, bool) {
+	l, err := parseInt64(left)
+	if err != nil {
+		return nil, false
+	}
+	r, err := parseInt64(right)
+	if err != nil {
+		return nil, false
+	}
+	return []byte(strconv.FormatInt(l+r, 10)), true
+}
+
+// parseInt64 解析 JSON 编码的整数，也接受字符串形式的整数
+func parseInt64(data []byte) (int64, error) {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return strconv.ParseInt(s, 10, 64)
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return 0, err
+	}
+	return n.Int64()
+}
+
+type stringAppend struct {
+	delimiter string
+}
+
+// StringAppendOperator 字符串追加，值和操作数都是字符串，有旧值时用 delimiter 分隔
+func StringAppendOperator(delimiter string) MergeOperator {
+	return stringAppend{delimiter: delimiter}
+}
+
+func (o stringAppend) FullMerge(key string, existing []byte, exists bool, operands [][]byte) ([]byte, error) {
+	var result string
+	if exists {
+		if err := json.Unmarshal(existing, &result); err != nil {
+			return nil, fmt.Errorf("merge %s: existing value is not a string: %v", key, err)
+		}
+	}
+	for i, operand := range operands {
+		var s string
+		if err := json.Unmarshal(operand, &s); err != nil {
+			return nil, fmt.Errorf("merge %s: operand is not a string: %v", key, err)
+		}
+		if exists || i > 0 {
+			result += o.delimiter
+		}
+		result += s
+	}
+	return json.Marshal(result)
+}
+
+func (o stringAppend) PartialMerge(key string, left, right []byte) ([]byte, bool) {
+	var l, r string
+	if json.Unmarshal(left, &l) != nil || json.Unmarshal(right, &r) != nil {
+		return nil, false
+	}
+	data, err := json.Marshal(l + o.delimiter + r)
+	return data, err == nil
+}
+
+type jsonMergePatch struct{}
+
+// JSONMergePatchOperator 按 RFC 7386 把操作数作为 merge patch 应用到旧值上
+func JSONMergePatchOperator() MergeOperator {
+	return jsonMergePatch{}
+}
+
+func (jsonMergePatch) FullMerge(key string, existing []byte, exists bool, operands [][]byte) ([]byte, error) {
+	var target interface{}
+	if exists {
+		if err := json.Unmarshal(existing, &target); err != nil {
+			return nil, fmt.Errorf("merge %s: %v", key, err)
+		}
+	}
+	for _, operand := range operands {
+		var patch interface{}
+		if err := json.Unmarshal(operand, &patch); err != nil {
+			return nil, fmt.Errorf("merge %s: operand is not JSON: %v", key, err)
+		}
+		target = mergePatch(target, patch)
+	}
+	return json.Marshal(target)
+}
+
+// PartialMerge 两个 merge patch 合并后和依次应用的结果不一定相同，例如先删除字段再写入对象，所以不合并
+func (jsonMergePatch) PartialMerge(key string, left, right []byte) ([]byte, bool) {
+	return nil, false
+}
+
+// mergePatch 把 patch 应用到 target 上，patch 不是对象时直接替换 target，值为 null 的字段会被删除
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// ErrNoMergeOperator 读到合并操作数但没有设置 MergeOperator
+var ErrNoMergeOperator = errors.New("no merge operator")
+
+// SplitMerge 把同一个 key 从新到旧的版本分为开头连续的合并操作数和作为合并基础的版本，
+// 遇到值或删除标记时它就是基础；序列号小于 coveredSeq 的版本被范围删除标记遮盖，基础是删除标记。
+// complete 为 false 表示 versions 中只有操作数，没有找到基础
+func SplitMerge(versions []kv.Value, coveredSeq uint64) (operands []kv.Value, base kv.Value, complete bool) {
+	for i, version := range versions {
+		if version.Seq < coveredSeq {
+			return versions[:i], kv.Value{Key: version.Key, Deleted: true, Seq: coveredSeq}, true
+		}
+		if !version.Merge {
+			return versions[:i], version, true
+		}
+	}
+	return versions, kv.Value{}, false
+}
+
+// ApplyMerge 把从新到旧排列的操作数合并到 base 上，base 是删除标记或已经过期时当作没有值，
+// 没有找到基础时传入删除标记。read 读取记录的值（值可能在 value log 中），
+// 返回的记录序列号是最新的操作数的序列号，过期时间沿用 base
+func ApplyMerge(operator MergeOperator, base kv.Value, operands []kv.Value, read func(kv.Value) ([]byte, error)) (kv.Value, error) {
+	if operator == nil {
+		return kv.Value{}, ErrNoMergeOperator
+	}
+	key := operands[0].Key
+	exists := !base.Deleted && !base.Expired(time.Now())
+	var existing []byte
+	if exists {
+		data, err := read(base)
+		if err != nil {
+			return kv.Value{}, err
+		}
+		existing = data
+	}
+	list := make([][]byte, len(operands))
+	for i, operand := range operands {
+		data, err := read(operand)
+		if err != nil {
+			return kv.Value{}, err
+		}
+		list[len(operands)-1-i] = data
+	}
+	data, err := operator.FullMerge(key, existing, exists, list)
+	if err != nil {
+		return kv.Value{}, err
+	}
+	result := kv.Value{Key: key, Value: data, Seq: operands[0].Seq, Version: operands[0].Version}
+	if exists {
+		result.ExpiresAt = base.ExpiresAt
+	}
+	return result, nil
+}
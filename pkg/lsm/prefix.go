@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrefixExtractor 从 key 中提取前缀，SSTable 为提取出的前缀生成布隆过滤器，
+// 前缀查询时可以跳过不包含该前缀的 SSTable
+type PrefixExtractor interface {
+	// Name 写入 SSTable，提取规则变化后旧文件中的过滤器不再使用
+	Name() string
+	// Extract 返回 key 的前缀，ok 为 false 表示 key 不在提取规则的范围内。
+	// 对于任意 p，如果 Extract(p) 成功，所有以 p 开头的 key 都要提取出相同的前缀
+	Extract(key string) (prefix string, ok bool)
+}
+
+type fixedPrefix struct {
+	n int
+}
+
+// FixedPrefix 取 key 的前 n 个字节作为前缀，短于 n 的 key 没有前缀
+func FixedPrefix(n int) PrefixExtractor {
+	return fixedPrefix{n: n}
+}
+
+func (e fixedPrefix) Name() string {
+	return fmt.Sprintf("fixed:%d", e.n)
+}
+
+func (e fixedPrefix) Extract(key string) (string, bool) {
+	if len(key) < e.n {
+		return "", false
+	}
+	return key[:e.n], true
+}
+
+type delimiterPrefix struct {
+	delimiter string
+	n         int
+}
+
+// DelimiterPrefix 取 key 的前 n 段（包含第 n 个分隔符）作为前缀，
+// 例如 DelimiterPrefix("/", 1) 从 tenant/entity/id 中提取 tenant/
+func DelimiterPrefix(delimiter string, n int) PrefixExtractor {
+	return delimiterPrefix{delimiter: delimiter, n: n}
+}
+
+func (e delimiterPrefix) Name() string {
+	return fmt.Sprintf("delimiter:%s:%d", e.delimiter, e.n)
+}
+
+func (e delimiterPrefix) Extract(key string) (string, bool) {
+	end := 0
+	for i := 0; i < e.n; i++ {
+		index := strings.Index(key[end:], e.delimiter)
+		if index < 0 {
+			return "", false
+		}
+		end += index + len(e.delimiter)
+	}
+	return key[:end], true
+}
@@ -1,8 +1,14 @@
 package lsm
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mylsmtree/pkg/bloom"
 	"mylsmtree/pkg/kv"
 	"os"
 	"sort"
@@ -15,6 +21,27 @@ type MetaInfo struct {
 	dataLen int64
 	indexStart int64
 	indexLen int64
+	filterStart int64
+	filterLen int64
+	rangeDelStart int64
+	rangeDelLen int64
+}
+
+// 文件末尾 MetaInfo 占用的字节数
+const metaInfoSize = 8 * 7
+
+// 版本 3 开始 MetaInfo 之前是范围删除标记区域的位置和长度
+const rangeDelInfoSize = 8 * 2
+
+// SSTable 文件格式版本，版本 2 开始索引中的 key 为内部 key，版本 3 开始有范围删除标记区域，
+// 版本 4 开始索引中的 key 用 base64 编码，可以保存二进制的 key
+const tableVersion = 4
+
+// PrefixFilter SSTable 中所有 key（包括删除标记）前缀的布隆过滤器
+type PrefixFilter struct {
+	// 生成过滤器时使用的 PrefixExtractor
+	Extractor string
+	Filter *bloom.Filter
 }
 
 type Position struct {
@@ -29,105 +56,267 @@ type SSTable struct {
 	tableMetaInfo MetaInfo
 	sparseIndex map[string]Position
 	sortIndex []string
+	// 删除标记数量
+	tombstones int
+	// 最大的序列号
+	maxSeq uint64
+	// 前缀布隆过滤器，没有配置 PrefixExtractor 时为 nil
+	prefixFilter *PrefixFilter
+	// 范围删除标记，只遮盖这个 SSTable 和更旧的数据中的版本
+	rangeTombstones []kv.RangeTombstone
+	// 文件大小
+	size int64
+	// 正在使用的迭代器数量，压缩后废弃的文件等到没有迭代器使用时再删除
+	refs int
+	obsolete bool
 	lock sync.Locker
 }
 
-func (table *SSTable) Init(path string) {
+func (table *SSTable) Init(path string) error {
 	table.filePath = path
 	table.lock = &sync.Mutex{}
-	table.loadFileHandle()
+	return table.loadFileHandle()
 }
 
-func (table *SSTable) loadFileHandle() {
+func (table *SSTable) loadFileHandle() error {
 	if table.f == nil {
 		f, err := os.OpenFile(table.filePath, os.O_RDONLY, 0666)
 		if err != nil {
-			panic(err)
+			return kv.IOError("open", table.filePath, err)
 		}
 
 		table.f = f
 	}
-	table.loadMetaInfo()
-	table.loadSparseIndex()
+	err := table.loadMetaInfo()
+	if err == nil {
+		err = table.loadRangeTombstones()
+	}
+	if err == nil {
+		err = table.loadSparseIndex()
+	}
+	if err == nil {
+		err = table.loadPrefixFilter()
+	}
+	if err != nil {
+		_ = table.f.Close()
+		table.f = nil
+	}
+	return err
 }
 
-func (table *SSTable) loadMetaInfo() {
+func (table *SSTable) loadMetaInfo() error {
 	f := table.f
-	_, err := f.Seek(0, 0)
+	info, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return kv.IOError("stat", table.filePath, err)
+	}
+	size := info.Size()
+	table.size = size
+	if size < metaInfoSize {
+		return kv.CorruptionError("load", table.filePath, errors.New("file is too short"))
 	}
-	info, _ := f.Stat()
-	_, err = f.Seek(info.Size()-8*5, 0)
+	var meta [7]int64
+	err = binary.Read(io.NewSectionReader(f, size-metaInfoSize, metaInfoSize), binary.LittleEndian, &meta)
 	if err != nil {
-		panic(err)
+		return kv.IOError("read", table.filePath, err)
+	}
+	table.tableMetaInfo = MetaInfo{
+		version: meta[0],
+		dataStart: meta[1],
+		dataLen: meta[2],
+		indexStart: meta[3],
+		indexLen: meta[4],
+		filterStart: meta[5],
+		filterLen: meta[6],
 	}
-	_ = binary.Read(f, binary.LittleEndian, table.tableMetaInfo.version)
-	_, err = f.Seek(info.Size() - 8*4, 0)
+	metaInfo := table.tableMetaInfo
+	if metaInfo.version < 0 || metaInfo.version > tableVersion {
+		return kv.CorruptionError("load", table.filePath, fmt.Errorf("unknown table version %d", metaInfo.version))
+	}
+	if !validArea(metaInfo.dataStart, metaInfo.dataLen, size) ||
+		!validArea(metaInfo.indexStart, metaInfo.indexLen, size) ||
+		!validArea(metaInfo.filterStart, metaInfo.filterLen, size) {
+		return kv.CorruptionError("load", table.filePath, errors.New("invalid meta info"))
+	}
+	if metaInfo.version < 3 {
+		return nil
+	}
+	if size < metaInfoSize+rangeDelInfoSize {
+		return kv.CorruptionError("load", table.filePath, errors.New("file is too short"))
+	}
+	var rangeDel [2]int64
+	err = binary.Read(io.NewSectionReader(f, size-metaInfoSize-rangeDelInfoSize, rangeDelInfoSize), binary.LittleEndian, &rangeDel)
 	if err != nil {
-		panic(err)
+		return kv.IOError("read", table.filePath, err)
+	}
+	if !validArea(rangeDel[0], rangeDel[1], size) {
+		return kv.CorruptionError("load", table.filePath, errors.New("invalid range tombstone area"))
 	}
+	table.tableMetaInfo.rangeDelStart = rangeDel[0]
+	table.tableMetaInfo.rangeDelLen = rangeDel[1]
+	return nil
+}
 
-	_ = binary.Read(f, binary.LittleEndian, table.tableMetaInfo.dataStart)
+// validArea 判断 [start, start+len) 是否在文件内
+func validArea(start, len, size int64) bool {
+	return start >= 0 && len >= 0 && start+len <= size
+}
 
-	_, err = f.Seek(info.Size() - 8 *3, 0)
-	if err != nil {
-		panic(err)
+// readArea 读取文件中的一块区域
+func (table *SSTable) readArea(start, len int64) ([]byte, error) {
+	bytes := make([]byte, len)
+	if _, err := table.f.ReadAt(bytes, start); err != nil {
+		return nil, kv.IOError("read", table.filePath, err)
 	}
+	return bytes, nil
+}
 
-	_ = binary.Read(f, binary.LittleEndian, table.tableMetaInfo.dataLen)
-
-	_, err = f.Seek(info.Size() - 8*2, 0)
+func (table *SSTable) loadRangeTombstones() error {
+	if table.tableMetaInfo.rangeDelLen == 0 {
+		return nil
+	}
+	bytes, err := table.readArea(table.tableMetaInfo.rangeDelStart, table.tableMetaInfo.rangeDelLen)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	if err := json.Unmarshal(bytes, &table.rangeTombstones); err != nil {
+		return kv.CorruptionError("load range tombstones", table.filePath, err)
+	}
+	return nil
+}
 
-	_ = binary.Read(f, binary.LittleEndian, table.tableMetaInfo.indexStart)
-
-	_, err  = f.Seek(info.Size() - 8, 0)
+func (table *SSTable) loadPrefixFilter() error {
+	if table.tableMetaInfo.filterLen == 0 {
+		return nil
+	}
+	bytes, err := table.readArea(table.tableMetaInfo.filterStart, table.tableMetaInfo.filterLen)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	_ = binary.Read(f, binary.LittleEndian, table.tableMetaInfo.indexLen)
-
+	filter := &PrefixFilter{}
+	if err := json.Unmarshal(bytes, filter); err != nil {
+		return kv.CorruptionError("load prefix filter", table.filePath, err)
+	}
+	table.prefixFilter = filter
+	return nil
 }
 
-func (table *SSTable) loadSparseIndex() {
-	bytes := make([]byte, table.tableMetaInfo.indexLen)
-	if _, err := table.f.Seek(table.tableMetaInfo.indexStart, 0); err != nil {
-		panic(err)
+// MayContainPrefix 判断 SSTable 中是否可能有 extractor 提取出 prefix 的 key，
+// 没有过滤器或者过滤器由其它 PrefixExtractor 生成时返回 true
+func (table *SSTable) MayContainPrefix(extractor PrefixExtractor, prefix string) bool {
+	if table.prefixFilter == nil || extractor == nil || table.prefixFilter.Extractor != extractor.Name() {
+		return true
 	}
-	if _, err := table.f.Read(bytes); err != nil {
-		panic(err)
+	return table.prefixFilter.Filter.MayContain(prefix)
+}
+
+func (table *SSTable) loadSparseIndex() error {
+	bytes, err := table.readArea(table.tableMetaInfo.indexStart, table.tableMetaInfo.indexLen)
+	if err != nil {
+		return err
 	}
 
 	table.sparseIndex = make(map[string]Position)
-	err := json.Unmarshal(bytes, &table.sparseIndex)
-	if err != nil {
-		panic(err)
+	if err = json.Unmarshal(bytes, &table.sparseIndex); err != nil {
+		return kv.CorruptionError("load index", table.filePath, err)
+	}
+	if table.tableMetaInfo.version >= 4 {
+		index := make(map[string]Position, len(table.sparseIndex))
+		for k, position := range table.sparseIndex {
+			key, err := base64.StdEncoding.DecodeString(k)
+			if err != nil {
+				return kv.CorruptionError("load index", table.filePath, err)
+			}
+			index[string(key)] = position
+		}
+		table.sparseIndex = index
+	} else if table.tableMetaInfo.version < 2 {
+		// 旧版本的索引中是 key，转为序列号为 0 的内部 key
+		index := make(map[string]Position, len(table.sparseIndex))
+		for k, position := range table.sparseIndex {
+			index[kv.InternalKey(k, 0)] = position
+		}
+		table.sparseIndex = index
 	}
 
-	_, _ = table.f.Seek(0, 0)
 	keys := make([]string, 0, len(table.sparseIndex))
-	for k := range table.sparseIndex {
+	table.tombstones = 0
+	table.maxSeq = 0
+	for k, position := range table.sparseIndex {
 		keys = append(keys, k)
+		if position.Deleted {
+			table.tombstones++
+		}
+		if _, seq, ok := kv.ParseInternalKey(k); ok && seq > table.maxSeq {
+			table.maxSeq = seq
+		}
+	}
+	for _, tombstone := range table.rangeTombstones {
+		if tombstone.Seq > table.maxSeq {
+			table.maxSeq = tombstone.Seq
+		}
 	}
 	sort.Strings(keys)
 	table.sortIndex = keys
-
+	return nil
 }
 
+// GetDbSize 获取文件大小，SSTable 写入后不再修改，使用加载时的大小
 func (table *SSTable) GetDbSize() int64 {
-	info, err := os.Stat(table.filePath)
-	if err != nil {
-		panic(err)
+	return table.size
+}
+
+
+// GetKeyRange 获取 SSTable 中最小和最大的 key
+func (table *SSTable) GetKeyRange() (start string, end string, ok bool) {
+	if len(table.sortIndex) == 0 {
+		return "", "", false
+	}
+	return kv.UserKey(table.sortIndex[0]), kv.UserKey(table.sortIndex[len(table.sortIndex)-1]), true
+}
+
+// GetMaxSeq 获取 SSTable 中最大的序列号
+func (table *SSTable) GetMaxSeq() uint64 {
+	return table.maxSeq
+}
+
+// Contains 判断 key 是否落在 SSTable 的 key 范围或范围删除标记内
+func (table *SSTable) Contains(key string) bool {
+	return table.Overlaps(key, key)
+}
+
+// Overlaps 判断 SSTable 的 key 范围或范围删除标记是否和 [start, end] 重叠，start 或 end 为空表示不限制
+func (table *SSTable) Overlaps(start, end string) bool {
+	tableStart, tableEnd, ok := table.GetKeyRange()
+	if ok && (start == "" || tableEnd >= start) && (end == "" || tableStart <= end) {
+		return true
+	}
+	for _, tombstone := range table.rangeTombstones {
+		if tombstone.Overlaps(start, end) {
+			return true
+		}
 	}
-	return info.Size()
+	return false
 }
 
+// GetRangeTombstones 获取 SSTable 中的范围删除标记
+func (table *SSTable) GetRangeTombstones() []kv.RangeTombstone {
+	return table.rangeTombstones
+}
+
+// GetTombstoneCount 获取 SSTable 中删除标记的数量
+func (table *SSTable) GetTombstoneCount() int {
+	return table.tombstones
+}
 
-func (table *SSTable) Search(key string) (value kv.Value, result kv.SearchResult) {
+// GetKeyCount 获取 SSTable 中 key 的数量（包含删除标记）
+func (table *SSTable) GetKeyCount() int {
+	return len(table.sortIndex)
+}
+
+// Search 查找 key 在序列号 seq 时可见的版本，即序列号不大于 seq 的最新版本，
+// 读取失败或者数据损坏时返回错误
+func (table *SSTable) Search(key string, seq uint64) (value kv.Value, result kv.SearchResult, err error) {
 	table.lock.Lock()
 	defer table.lock.Unlock()
 
@@ -135,45 +324,95 @@ func (table *SSTable) Search(key string) (value kv.Value, result kv.SearchResult
 		Start:  -1,
 	}
 
-	l := 0
-	r := len(table.sortIndex) - 1
-
-	for l <= r {
-		mid := (l+r)/2
-		if table.sortIndex[mid] == key {
-			position = table.sparseIndex[key]
+	// 同一个 key 的版本按序列号降序排列，第一个大于等于 (key, seq) 的就是可见的版本，
+	// 被范围删除标记遮盖时，更旧的数据中的版本也都被遮盖
+	tombstoneSeq := kv.MaxCoveringSeq(table.rangeTombstones, key, seq)
+	index := sort.SearchStrings(table.sortIndex, kv.InternalKey(key, seq))
+	if index < len(table.sortIndex) {
+		internalKey := table.sortIndex[index]
+		if userKey, versionSeq, _ := kv.ParseInternalKey(internalKey); userKey == key && versionSeq >= tombstoneSeq {
+			position = table.sparseIndex[internalKey]
 			if position.Deleted {
-				return kv.Value{}, kv.Deleted
+				return kv.Value{Key: key, Deleted: true, Seq: versionSeq}, kv.Deleted, nil
 			}
-		}else if table.sortIndex[mid] < key {
-			l = mid + 1
-		}else if table.sortIndex[mid] > key {
-			r = mid - 1
 		}
 	}
 
 	if position.Start == -1 {
-		return kv.Value{}, kv.None
+		if tombstoneSeq > 0 {
+			return kv.Value{Key: key, Deleted: true, Seq: tombstoneSeq}, kv.Deleted, nil
+		}
+		return kv.Value{}, kv.None, nil
 	}
 
-	bytes := make([]byte, position.Len)
-	if _, err := table.f.Seek(position.Start, 0); err != nil {
-		return kv.Value{}, kv.None
+	if table.f == nil {
+		return kv.Value{}, kv.None, kv.IOError("read", table.filePath, os.ErrClosed)
 	}
-
-	if _, err := table.f.Read(bytes); err != nil {
-		return kv.Value{}, kv.None
+	if !validArea(position.Start, position.Len, table.size) {
+		return kv.Value{}, kv.None, kv.CorruptionError("search", table.filePath, errors.New("invalid index position"))
+	}
+	bytes, err := table.readArea(position.Start, position.Len)
+	if err != nil {
+		return kv.Value{}, kv.None, err
 	}
 
-	value, err := kv.Decode(bytes)
+	value, err = decodeRecord(bytes)
 	if err != nil {
-		return kv.Value{}, kv.None
+		return kv.Value{}, kv.None, kv.CorruptionError("decode", table.filePath, err)
 	}
-	return value, kv.Success
+	value.Key = key
+	return value, kv.Success, nil
 }
 
+// Ref 增加引用计数，迭代器在使用 SSTable 期间持有一个引用
+func (table *SSTable) Ref() {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.refs++
+}
 
+// Unref 释放引用，已经废弃的 SSTable 在最后一个引用释放时删除
+func (table *SSTable) Unref() {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.refs--
+	if table.refs == 0 && table.obsolete {
+		if err := table.destroy(); err != nil {
+			log.Println("failed to remove obsolete table:", err)
+		}
+	}
+}
 
+// Obsolete 标记 SSTable 已经被压缩废弃，没有引用时立即删除文件
+func (table *SSTable) Obsolete() error {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.obsolete = true
+	if table.refs == 0 {
+		return table.destroy()
+	}
+	return nil
+}
 
+// Close 关闭文件句柄，不删除文件
+func (table *SSTable) Close() error {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.f == nil {
+		return nil
+	}
+	err := table.f.Close()
+	table.f = nil
+	return kv.IOError("close", table.filePath, err)
+}
 
-
+func (table *SSTable) destroy() error {
+	if table.f != nil {
+		err := table.f.Close()
+		table.f = nil
+		if err != nil {
+			return kv.IOError("close", table.filePath, err)
+		}
+	}
+	return kv.IOError("remove", table.filePath, os.Remove(table.filePath))
+}
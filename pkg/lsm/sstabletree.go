@@ -1,14 +1,20 @@
 package lsm
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"mylsmtree/pkg/bloom"
 	"mylsmtree/pkg/config"
 	"mylsmtree/pkg/kv"
 	"mylsmtree/pkg/sort_tree"
 	"mylsmtree/pkg/utils"
+	"mylsmtree/pkg/vlog"
 	"os"
 	"path"
 	"path/filepath"
@@ -19,17 +25,41 @@ import (
 )
 
 type TableTree struct {
+	// SSTable 文件所在的目录
+	dir string
+	// 配置，列族中的 SSTable 使用合并了列族设置后的配置
+	con config.Config
+	// 每一层的最大字节数
+	levelMaxSize []int
 	levels []*TableNode
+	// 每一层下一个 SSTable 的编号
+	nextIndex []int
 	lock *sync.RWMutex
+	// 保证同一时间只有一个压缩任务
+	compactLock *sync.Mutex
+	// 压缩过滤器，可以为 nil
+	filter CompactionFilter
+	// 大于等于 valueThreshold 字节的值在落盘时写入 value log，vlog 为 nil 时不分离
+	vlog *vlog.ValueLog
+	valueThreshold int
+	// 为 key 的前缀生成布隆过滤器，可以为 nil
+	prefixExtractor PrefixExtractor
+	// 获取仍在使用的快照的序列号，按升序排列，可以为 nil
+	snapshots func() []uint64
+	// 落盘和压缩时合并操作数，可以为 nil
+	merge MergeOperator
 }
 
+// 前缀布隆过滤器中每个前缀占用的位数
+const prefixBloomBitsPerKey = 10
+
 type TableNode struct {
 	index int
 	table *SSTable
 	next *TableNode
 }
 
-func (tree *TableTree) loadDbFile(path string) {
+func (tree *TableTree) loadDbFile(path string) error {
 	log.Println("loading the table tree")
 	start := time.Now()
 	defer func() {
@@ -39,26 +69,34 @@ func (tree *TableTree) loadDbFile(path string) {
 
 	level, index, err := utils.GetLevel(filepath.Base(path))
 	if err != nil {
-		panic(err)
+		return kv.CorruptionError("load", path, err)
+	}
+	if level < 0 || level >= len(tree.levels) {
+		return kv.CorruptionError("load", path, fmt.Errorf("invalid level %d", level))
 	}
 
 	table := &SSTable{}
-	table.Init(path)
+	if err = table.Init(path); err != nil {
+		return err
+	}
 	newNode := &TableNode{
 		index: index,
 		table: table,
 	}
+	if index >= tree.nextIndex[level] {
+		tree.nextIndex[level] = index + 1
+	}
 
 	currentNode := tree.levels[level]
 	if currentNode == nil {
 		tree.levels[level] = newNode
-		return
+		return nil
 	}
 
 	if newNode.index < currentNode.index {
 		newNode.next = currentNode
 		tree.levels[level] = newNode
-		return
+		return nil
 	}
 
 	for currentNode != nil {
@@ -70,10 +108,10 @@ func (tree *TableTree) loadDbFile(path string) {
 			currentNode = currentNode.next
 		}
 	}
-
+	return nil
 }
 
-func (tree *TableTree) insert(table *SSTable, level int) (index int) {
+func (tree *TableTree) insert(table *SSTable, level int, index int) {
 
 	tree.lock.Lock()
 	defer tree.lock.Unlock()
@@ -82,7 +120,7 @@ func (tree *TableTree) insert(table *SSTable, level int) (index int) {
 	newNode := &TableNode{
 		table: table,
 		next: nil,
-		index: 0,
+		index: index,
 	}
 
 	if node == nil {
@@ -90,7 +128,6 @@ func (tree *TableTree) insert(table *SSTable, level int) (index int) {
 	}else {
 		for node != nil {
 			if node.next == nil {
-				newNode.index = node.index + 1
 				node.next = newNode
 				break
 			}else {
@@ -98,13 +135,30 @@ func (tree *TableTree) insert(table *SSTable, level int) (index int) {
 			}
 		}
 	}
-	return newNode.index
 }
 
-func (tree *TableTree) Search(key string) (kv.Value, kv.SearchResult){
+// reserveIndex 分配新 SSTable 的编号，编号只增不减，
+// 避免新文件和还在被迭代器使用、等待删除的旧文件重名
+func (tree *TableTree) reserveIndex(level int) int {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	index := tree.nextIndex[level]
+	tree.nextIndex[level]++
+	return index
+}
+
+// Search 查找 key 在序列号 seq 时可见的版本。
+// 同一个 key 浅层的版本总是比深层的新，同一层中编号大的 SSTable 比编号小的新，
+// 所以按这个顺序找到的第一个可见版本就是序列号最大的版本，读取 SSTable 失败时返回错误
+func (tree *TableTree) Search(key string, seq uint64) (kv.Value, kv.SearchResult, error) {
 	tree.lock.RLock()
 	defer tree.lock.RUnlock()
 
+	prefix, hasPrefix := "", false
+	if tree.prefixExtractor != nil {
+		prefix, hasPrefix = tree.prefixExtractor.Extract(key)
+	}
 	for _, node := range tree.levels {
 		tables := make([]*SSTable, 0)
 		for node != nil {
@@ -112,15 +166,38 @@ func (tree *TableTree) Search(key string) (kv.Value, kv.SearchResult){
 			node = node.next
 		}
 		for i := len(tables) - 1; i >= 0; i-- {
-			value, searchRsult := tables[i].Search(key)
+			// 有范围删除标记的 SSTable 不能跳过，标记可能遮盖更旧的 SSTable 中的版本
+			if hasPrefix && len(tables[i].rangeTombstones) == 0 && !tables[i].MayContainPrefix(tree.prefixExtractor, prefix) {
+				continue
+			}
+			value, searchRsult, err := tables[i].Search(key, seq)
+			if err != nil {
+				return kv.Value{}, kv.None, err
+			}
 			if searchRsult == kv.None {
 				continue
 			}else {
-				return value, searchRsult
+				return value, searchRsult, nil
 			}
 		}
 	}
-	return kv.Value{}, kv.None
+	return kv.Value{}, kv.None, nil
+}
+
+// GetMaxSeq 获取所有 SSTable 中最大的序列号
+func (tree *TableTree) GetMaxSeq() uint64 {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+
+	var maxSeq uint64
+	for _, node := range tree.levels {
+		for ; node != nil; node = node.next {
+			if seq := node.table.GetMaxSeq(); seq > maxSeq {
+				maxSeq = seq
+			}
+		}
+	}
+	return maxSeq
 }
 
 func (tree *TableTree) getMaxIndex(level int) int {
@@ -143,9 +220,7 @@ func (tree *TableTree) getCount(level int) int {
 	return count
 }
 
-var levelMaxSize []int
-
-func (tree *TableTree) Init(dir string) {
+func (tree *TableTree) Init(dir string, con config.Config) error {
 	log.Println("init table tree")
 	start := time.Now()
 	defer func() {
@@ -153,68 +228,77 @@ func (tree *TableTree) Init(dir string) {
 		log.Println("sstable init elapse time", elapse)
 	}()
 
-	con := config.GetConfig()
-	levelMaxSize = make([]int, 10)
+	tree.dir = dir
+	tree.con = con
+	tree.levelMaxSize = make([]int, 10)
 	var i = 0
 	for i < 10 {
 		if i == 0 {
-			levelMaxSize[i] = con.Level0Size
+			tree.levelMaxSize[i] = con.Level0Size
 		} else {
-			levelMaxSize[i] = levelMaxSize[i-1] * 10
+			tree.levelMaxSize[i] = tree.levelMaxSize[i-1] * 10
 		}
 		i++
 	}
 	tree.levels = make([]*TableNode, 10)
+	tree.nextIndex = make([]int, 10)
 	tree.lock = &sync.RWMutex{}
+	tree.compactLock = &sync.Mutex{}
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
-		panic(err)
+		return kv.IOError("read dir", dir, err)
 	}
 	for _, info := range infos {
 		if path.Ext(info.Name()) == ".db" {
-			tree.loadDbFile(path.Join(dir, info.Name()))
+			if err = tree.loadDbFile(path.Join(dir, info.Name())); err != nil {
+				tree.Close()
+				return err
+			}
 		}
 	}
-
+	return nil
 }
 
 
-func WriteDataToFile(filePath string, dataArea []byte, indexArea []byte, meta MetaInfo) {
-	f, err := os.OpenFile(filePath, os.O_CREATE | os.O_RDWR | os.O_APPEND, 0666)
+// WriteDataToFile 写入 SSTable 文件并刷到磁盘，失败时删除写了一半的文件
+func WriteDataToFile(filePath string, dataArea []byte, indexArea []byte, filterArea []byte, rangeDelArea []byte, meta MetaInfo) (err error) {
+	f, err := os.OpenFile(filePath, os.O_CREATE | os.O_RDWR | os.O_EXCL, 0666)
 	if err != nil {
-		log.Println("error create file", err)
-		return
+		return kv.IOError("create", filePath, err)
 	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(filePath)
+		}
+	}()
 
-	_, err = f.Write(dataArea)
-	if err != nil {
-		log.Println("error write file", err)
-		return
+	buf := make([]byte, 0, len(dataArea)+len(indexArea)+len(filterArea)+len(rangeDelArea)+rangeDelInfoSize+metaInfoSize)
+	buf = append(buf, dataArea...)
+	buf = append(buf, indexArea...)
+	buf = append(buf, filterArea...)
+	buf = append(buf, rangeDelArea...)
+	for _, n := range []int64{meta.rangeDelStart, meta.rangeDelLen, meta.version, meta.dataStart, meta.dataLen,
+		meta.indexStart, meta.indexLen, meta.filterStart, meta.filterLen} {
+		buf = appendInt64(buf, n)
 	}
 
-	_, err = f.Write(indexArea)
-	if err != nil {
-		log.Println("err write index file", err)
-		return
+	if _, err = f.Write(buf); err != nil {
+		return kv.IOError("write", filePath, err)
 	}
-
-	_ = binary.Write(f, binary.LittleEndian, &meta.version)
-	_ = binary.Write(f, binary.LittleEndian, &meta.dataStart)
-	_ = binary.Write(f, binary.LittleEndian, &meta.dataLen)
-	_ = binary.Write(f, binary.LittleEndian, &meta.indexStart)
-	_ = binary.Write(f, binary.LittleEndian, &meta.indexLen)
-
-	err = f.Sync()
-	if err != nil {
-		log.Println("error write file", err)
-		return
+	if err = f.Sync(); err != nil {
+		return kv.IOError("sync", filePath, err)
 	}
-
-	err = f.Close()
-	if err != nil {
-		log.Println("error close file", err)
-		return
+	if err = f.Close(); err != nil {
+		return kv.IOError("close", filePath, err)
 	}
+	return nil
+}
+
+func appendInt64(buf []byte, n int64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(n))
+	return append(buf, b[:]...)
 }
 
 // GetLevelSize 获取指定层的 SSTable 总大小
@@ -228,81 +312,569 @@ func (tree *TableTree) GetLevelSize(level int) int64 {
 	return size
 }
 
-func (tree *TableTree) CreateNewTable(values []kv.Value) {
-	tree.CreateTable(values, 0)
+// GetLevelCount 获取指定层的 SSTable 数量
+func (tree *TableTree) GetLevelCount(level int) int {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	return tree.getCount(level)
+}
+
+// GetPendingCompactionBytes 估算各层超出容量、等待压缩的数据量。
+// 分层大小不受限制的压缩策略下，文件数超过 PartSize 的层整层都等待压缩
+func (tree *TableTree) GetPendingCompactionBytes() int64 {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+
+	var pending int64
+	for level := range tree.levels {
+		size := tree.GetLevelSize(level)
+		if tree.con.CompactionStyle == config.CompactionTiered {
+			if tree.getCount(level) > tree.con.PartSize {
+				pending += size
+			}
+			continue
+		}
+		if size > int64(tree.levelMaxSize[level]) {
+			pending += size - int64(tree.levelMaxSize[level])
+		}
+	}
+	return pending
+}
+
+// overCapacity 大小为 size 的层是否超出容量，CompactionTiered 不限制每层的大小
+func (tree *TableTree) overCapacity(level int, size int64) bool {
+	if tree.con.CompactionStyle == config.CompactionTiered {
+		return false
+	}
+	return size > int64(tree.levelMaxSize[level])
+}
+
+// SetPrefixExtractor 设置前缀提取规则，之后生成的 SSTable 会带有前缀布隆过滤器
+func (tree *TableTree) SetPrefixExtractor(extractor PrefixExtractor) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.prefixExtractor = extractor
+}
+
+// GetPrefixExtractor 获取当前的前缀提取规则
+func (tree *TableTree) GetPrefixExtractor() PrefixExtractor {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	return tree.prefixExtractor
+}
+
+// buildPrefixFilter 为有序的内部 key 生成前缀布隆过滤器
+func (tree *TableTree) buildPrefixFilter(keys []string) *PrefixFilter {
+	extractor := tree.GetPrefixExtractor()
+	if extractor == nil {
+		return nil
+	}
+	prefixes := make([]string, 0)
+	for _, key := range keys {
+		prefix, ok := extractor.Extract(kv.UserKey(key))
+		// keys 有序，相同的前缀是连续的
+		if ok && (len(prefixes) == 0 || prefixes[len(prefixes)-1] != prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	filter := bloom.New(len(prefixes), prefixBloomBitsPerKey)
+	for _, prefix := range prefixes {
+		filter.Add(prefix)
+	}
+	return &PrefixFilter{
+		Extractor: extractor.Name(),
+		Filter: filter,
+	}
+}
+
+// SetValueLog 设置 value log，大于等于 threshold 字节的值在内存表落盘时分离出去
+func (tree *TableTree) SetValueLog(vl *vlog.ValueLog, threshold int) {
+	tree.vlog = vl
+	tree.valueThreshold = threshold
+}
+
+// SetSnapshots 设置获取快照的方法，落盘和压缩时保留快照还能看到的旧版本
+func (tree *TableTree) SetSnapshots(snapshots func() []uint64) {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	tree.snapshots = snapshots
+}
+
+func (tree *TableTree) getSnapshots() []uint64 {
+	if tree.snapshots == nil {
+		return nil
+	}
+	return tree.snapshots()
+}
+
+// visibleVersions 从按内部 key 排好序的记录中取出需要保留的版本。
+// 快照把序列号分成若干段，每段中只有最新的版本能被看到：
+// 序列号不大于 snapshots[0] 的是第 0 段，大于 snapshots[i-1] 且不大于 snapshots[i] 的是第 i 段，
+// 大于所有快照的是最后一段，没有快照时每个 key 只保留最新的版本。
+// 最新的版本是合并操作数时，还要保留同一段中更旧的版本，直到第一个值或删除标记
+func visibleVersions(values []kv.Value, snapshots []uint64) []kv.Value {
+	result := make([]kv.Value, 0, len(values))
+	lastStripe := -1
+	for i, value := range values {
+		stripe := stripeOf(snapshots, value.Seq)
+		// 同一个 key 的版本从新到旧排列，同一段中只保留第一个
+		if i > 0 && values[i-1].Key == value.Key && stripe == lastStripe && !result[len(result)-1].Merge {
+			continue
+		}
+		lastStripe = stripe
+		result = append(result, value)
+	}
+	return result
+}
+
+// stripeOf 序列号 seq 所在的快照段
+func stripeOf(snapshots []uint64, seq uint64) int {
+	return sort.Search(len(snapshots), func(j int) bool {
+		return snapshots[j] >= seq
+	})
+}
+
+// SetMergeOperator 设置合并操作，传入 nil 时落盘和压缩保留所有操作数
+func (tree *TableTree) SetMergeOperator(operator MergeOperator) {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	tree.merge = operator
+}
+
+// readValue 读取记录的值，值被分离时从 value log 中读取
+func (tree *TableTree) readValue(value kv.Value) ([]byte, error) {
+	if value.Pointer == nil {
+		return value.Value, nil
+	}
+	return tree.vlog.Read(*value.Pointer)
+}
+
+// foldMerges 合并 visibleVersions 保留下来的操作数：同一个快照段中最新的版本是操作数时，
+// 找到段中的值或删除标记就合并为一条完整的值；没有找到时只能在更深的层中找，
+// 操作数之间能部分合并的合并为一个操作数，否则原样保留
+func (tree *TableTree) foldMerges(values []kv.Value, tombstones []kv.RangeTombstone, snapshots []uint64) ([]kv.Value, error) {
+	if tree.merge == nil {
+		return values, nil
+	}
+	result := make([]kv.Value, 0, len(values))
+	folded, separated := 0, false
+	for i := 0; i < len(values); {
+		// 同一个 key 同一段中的版本
+		end := i + 1
+		for end < len(values) && values[end].Key == values[i].Key &&
+			stripeOf(snapshots, values[end].Seq) == stripeOf(snapshots, values[i].Seq) {
+			end++
+		}
+		group := values[i:end]
+		i = end
+		if !group[0].Merge {
+			result = append(result, group...)
+			continue
+		}
+		coveredSeq := kv.MaxCoveringSeq(tombstones, group[0].Key, group[0].Seq)
+		operands, base, complete := SplitMerge(group, coveredSeq)
+		var merged kv.Value
+		if complete {
+			var err error
+			if merged, err = ApplyMerge(tree.merge, base, operands, tree.readValue); err != nil {
+				log.Println("failure to merge operands, keep them", group[0].Key, err)
+				result = append(result, group...)
+				continue
+			}
+		} else {
+			var ok bool
+			if merged, ok = tree.partialMerge(operands); !ok {
+				result = append(result, group...)
+				continue
+			}
+		}
+		ok, err := tree.separateValue(&merged)
+		if err != nil {
+			return nil, err
+		}
+		separated = separated || ok
+		result = append(result, merged)
+		folded += len(group) - 1
+	}
+	if separated {
+		if err := tree.vlog.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	if folded > 0 {
+		log.Printf("Folded %d merge operands\r\n", folded)
+	}
+	return result, nil
+}
+
+// partialMerge 把从新到旧排列的操作数合并为一个操作数，有操作数不能部分合并时 ok 返回 false
+func (tree *TableTree) partialMerge(operands []kv.Value) (kv.Value, bool) {
+	if len(operands) == 1 {
+		return operands[0], true
+	}
+	last := operands[len(operands)-1]
+	acc, err := tree.readValue(last)
+	if err != nil {
+		log.Println("failure to read the value log, keep the operands", err)
+		return kv.Value{}, false
+	}
+	for i := len(operands) - 2; i >= 0; i-- {
+		data, err := tree.readValue(operands[i])
+		if err != nil {
+			log.Println("failure to read the value log, keep the operands", err)
+			return kv.Value{}, false
+		}
+		var ok bool
+		if acc, ok = tree.merge.PartialMerge(last.Key, acc, data); !ok {
+			return kv.Value{}, false
+		}
+	}
+	return kv.Value{Key: last.Key, Value: acc, Seq: operands[0].Seq, Merge: true, Version: operands[0].Version}, true
+}
+
+// separateValue 值大于等于 valueThreshold 字节时写入 value log，只留下指针
+func (tree *TableTree) separateValue(value *kv.Value) (bool, error) {
+	if tree.vlog == nil || tree.valueThreshold <= 0 || value.Deleted || value.Pointer != nil || len(value.Value) < tree.valueThreshold {
+		return false, nil
+	}
+	ptr, err := tree.vlog.Write(value.Key, value.Value)
+	if err != nil {
+		return false, err
+	}
+	value.Value = nil
+	value.Pointer = &ptr
+	return true, nil
+}
+
+// CreateNewTable 将内存表落盘为 L0 的 SSTable，values 需要按内部 key 升序排列，
+// 被同一个内存表中新版本或范围删除标记覆盖、且没有快照能看到的旧版本不再写入
+func (tree *TableTree) CreateNewTable(values []kv.Value, tombstones []kv.RangeTombstone) error {
+	snapshots := tree.getSnapshots()
+	values = visibleVersions(values, snapshots)
+	values, err := tree.foldMerges(values, tombstones, snapshots)
+	if err != nil {
+		return err
+	}
+	values = dropCoveredVersions(values, tombstones, snapshots)
+	if tree.vlog != nil && tree.valueThreshold > 0 {
+		separated := 0
+		for i := range values {
+			ok, err := tree.separateValue(&values[i])
+			if err != nil {
+				return err
+			}
+			if ok {
+				separated++
+			}
+		}
+		if separated > 0 {
+			// 先保证 value log 落盘，再写引用它的 SSTable
+			if err = tree.vlog.Sync(); err != nil {
+				return err
+			}
+			log.Printf("Separated %d values into the value log\r\n", separated)
+		}
+	}
+	_, err = tree.CreateTable(values, tombstones, 0)
+	return err
+}
+
+// dropCoveredVersions 去掉被范围删除标记遮盖、且没有快照能看到的版本
+func dropCoveredVersions(values []kv.Value, tombstones []kv.RangeTombstone, snapshots []uint64) []kv.Value {
+	if len(tombstones) == 0 {
+		return values
+	}
+	result := make([]kv.Value, 0, len(values))
+	for _, value := range values {
+		covered := false
+		for _, tombstone := range tombstones {
+			if tombstone.Covers(value.Key, value.Seq) && !snapshotBetween(snapshots, value.Seq, tombstone.Seq) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, value)
+		}
+	}
+	return result
 }
 
-func (tree *TableTree) CreateTable(values []kv.Value, level int) *SSTable {
+// snapshotBetween 是否有快照的序列号在 [low, high) 中，即能看到序列号为 low 的版本、但看不到序列号为 high 的删除标记
+func snapshotBetween(snapshots []uint64, low, high uint64) bool {
+	i := sort.Search(len(snapshots), func(j int) bool {
+		return snapshots[j] >= low
+	})
+	return i < len(snapshots) && snapshots[i] < high
+}
+
+func (tree *TableTree) CreateTable(values []kv.Value, tombstones []kv.RangeTombstone, level int) (*SSTable, error) {
 	keys := make([]string, 0, len(values))
 	positions := make(map[string]Position)
 	dataArea := make([]byte, 0)
+	deleted := 0
 	for _, value := range values {
-		data, err := kv.Encode(value)
+		data, err := encodeRecord(value, tree.con.Compression)
 		if err != nil {
-			log.Println("encode failure")
-			continue
+			return nil, err
 		}
-		keys = append(keys, value.Key)
-		positions[value.Key] = Position{
+		internalKey := kv.InternalKey(value.Key, value.Seq)
+		keys = append(keys, internalKey)
+		positions[internalKey] = Position{
 			Start: int64(len(dataArea)),
 			Len: int64(len(data)),
 			Deleted: value.Deleted,
 		}
+		if value.Deleted {
+			deleted++
+		}
 		dataArea = append(dataArea, data...)
 	}
 	sort.Strings(keys)
 
-	indexArea, err := json.Marshal(positions)
+	encodedPositions := make(map[string]Position, len(positions))
+	for k, position := range positions {
+		encodedPositions[base64.StdEncoding.EncodeToString([]byte(k))] = position
+	}
+	indexArea, err := json.Marshal(encodedPositions)
 	if err != nil {
-		log.Println("index generate failure")
-		return nil
+		return nil, err
+	}
+
+	prefixFilter := tree.buildPrefixFilter(keys)
+	filterArea := make([]byte, 0)
+	if prefixFilter != nil {
+		filterArea, err = json.Marshal(prefixFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rangeDelArea := make([]byte, 0)
+	if len(tombstones) > 0 {
+		rangeDelArea, err = json.Marshal(tombstones)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	meta := MetaInfo{
-		version: 0,
+		version: tableVersion,
 		dataStart: 0,
 		dataLen: int64(len(dataArea)),
 		indexStart: int64(len(dataArea)),
 		indexLen: int64(len(indexArea)),
+		filterStart: int64(len(dataArea) + len(indexArea)),
+		filterLen: int64(len(filterArea)),
+		rangeDelStart: int64(len(dataArea) + len(indexArea) + len(filterArea)),
+		rangeDelLen: int64(len(rangeDelArea)),
+	}
+
+	maxSeq := uint64(0)
+	for _, value := range values {
+		if value.Seq > maxSeq {
+			maxSeq = value.Seq
+		}
+	}
+	for _, tombstone := range tombstones {
+		if tombstone.Seq > maxSeq {
+			maxSeq = tombstone.Seq
+		}
 	}
 
 	table := &SSTable{
 		tableMetaInfo: meta,
 		sparseIndex: positions,
 		sortIndex: keys,
+		tombstones: deleted,
+		maxSeq: maxSeq,
+		prefixFilter: prefixFilter,
+		rangeTombstones: tombstones,
 		lock: &sync.RWMutex{},
 	}
 
-	index := tree.insert(table,level)
+	index := tree.reserveIndex(level)
 	log.Println("create a new ss table")
-	con := config.GetConfig()
-	filePath := con.DataDir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + ".db"
+	filePath := tree.dir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + ".db"
 	table.filePath = filePath
 
-	WriteDataToFile(filePath, dataArea, indexArea, meta)
-	f , err := os.OpenFile(table.filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err = WriteDataToFile(filePath, dataArea, indexArea, filterArea, rangeDelArea, meta); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(table.filePath, os.O_RDONLY, 0666)
 	if err != nil {
-		panic(err)
+		_ = os.Remove(table.filePath)
+		return nil, kv.IOError("open", table.filePath, err)
 	}
 	table.f = f
-	return table
+	table.size = int64(len(dataArea)+len(indexArea)+len(filterArea)+len(rangeDelArea)) + rangeDelInfoSize + metaInfoSize
+	// 文件写完并打开后才加入到层中，避免并发的查询和压缩读到未完成的 SSTable
+	tree.insert(table, level, index)
+	return table, nil
+}
+
+// SetCompactionFilter 设置压缩过滤器，传入 nil 表示不过滤
+func (tree *TableTree) SetCompactionFilter(filter CompactionFilter) {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	tree.filter = filter
+}
+
+// Check 压缩超出容量的层，压缩失败时参与压缩的 SSTable 保持不变
+func (tree *TableTree) Check() error {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	return tree.majorCompaction()
+}
+
+// CompactionProgress 手动压缩的进度
+type CompactionProgress struct {
+	// 正在处理的层和输出层
+	Level       int
+	TargetLevel int
+	// 该层是否和压缩范围有重叠，没有重叠的层会被跳过
+	Compacted bool
+	// 已处理的层数和总层数
+	Done  int
+	Total int
+}
+
+// CompactRange 将和 [start, end] 有重叠的层从 L0 开始逐层压缩到最底层，
+// start 或 end 为空表示不限制，progress 可以为 nil，某一层压缩失败时停止并返回错误，
+// ctx 被取消或超时时在下一层开始前停止并返回 ctx.Err()
+func (tree *TableTree) CompactRange(ctx context.Context, start, end string, progress func(CompactionProgress)) error {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+
+	log.Printf("Compacting range [%s, %s]\r\n", start, end)
+	// 找到最深的非空层，压缩会把数据推到它的下一层
+	bottom := -1
+	tree.lock.RLock()
+	for level := range tree.levels {
+		if tree.levels[level] != nil {
+			bottom = level
+		}
+	}
+	tree.lock.RUnlock()
+
+	total := bottom + 1
+	for level := 0; level <= bottom; level++ {
+		// 每压缩完一层检查一次，已经压缩完的层保持压缩后的状态
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		targetLevel := level + 1
+		if targetLevel >= len(tree.levels) {
+			targetLevel = len(tree.levels) - 1
+		}
+		compacted := tree.overlaps(level, start, end)
+		if compacted {
+			if err := tree.majorCompactionLevel(level); err != nil {
+				return err
+			}
+		}
+		if progress != nil {
+			progress(CompactionProgress{
+				Level:       level,
+				TargetLevel: targetLevel,
+				Compacted:   compacted,
+				Done:        level + 1,
+				Total:       total,
+			})
+		}
+	}
+	return nil
 }
 
-func (tree *TableTree) Check() {
-	tree.majorCompaction()
+// overlaps 判断指定层是否有 SSTable 和 [start, end] 重叠
+func (tree *TableTree) overlaps(level int, start, end string) bool {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+
+	for node := tree.levels[level]; node != nil; node = node.next {
+		if node.table.Overlaps(start, end) {
+			return true
+		}
+	}
+	return false
 }
 
-func (tree *TableTree) majorCompaction() {
-	con := config.GetConfig()
+func (tree *TableTree) majorCompaction() error {
+	con := tree.con
 	for levelIndex, _ := range tree.levels {
 		tableSize := int(tree.GetLevelSize(levelIndex))
-		if tree.getCount(levelIndex) > con.PartSize || tableSize > levelMaxSize[levelIndex] {
-			tree.majorCompactionLevel(levelIndex)
+		count := tree.getCount(levelIndex)
+		// L0 文件数达到写入限流阈值时也要压缩，否则写入会一直被阻塞
+		stalled := levelIndex == 0 && ((con.L0SlowdownTrigger > 0 && count >= con.L0SlowdownTrigger) ||
+			(con.L0StopTrigger > 0 && count >= con.L0StopTrigger))
+		if count > con.PartSize || tree.overCapacity(levelIndex, int64(tableSize)) || stalled {
+			if err := tree.majorCompactionLevel(levelIndex); err != nil {
+				return err
+			}
+			continue
+		}
+		// 删除标记过多时，即使层未满也进行压缩，让删除标记下沉并最终被清理
+		if con.TombstoneRatio > 0 && tree.getTombstoneRatio(levelIndex) > con.TombstoneRatio {
+			log.Printf("Layer %d tombstone ratio exceeds %v\r\n", levelIndex, con.TombstoneRatio)
+			if err := tree.majorCompactionLevel(levelIndex); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getTombstoneRatio 获取指定层中删除标记的占比
+func (tree *TableTree) getTombstoneRatio(level int) float64 {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+
+	keys, tombstones := 0, 0
+	for node := tree.levels[level]; node != nil; node = node.next {
+		keys += node.table.GetKeyCount()
+		tombstones += node.table.GetTombstoneCount()
+	}
+	if keys == 0 {
+		return 0
+	}
+	return float64(tombstones) / float64(keys)
+}
+
+// isBottommost 判断 level 及更深的层中是否还有其它 SSTable 覆盖 key，
+// 没有的话压缩输出到 level 时，该 key 的删除标记已经没有需要遮盖的旧数据
+func (tree *TableTree) isBottommost(level int, key string, compacting map[*TableNode]bool) bool {
+	for i := level; i < len(tree.levels); i++ {
+		for node := tree.levels[i]; node != nil; node = node.next {
+			if compacting[node] {
+				continue
+			}
+			if node.table.Contains(key) {
+				return false
+			}
 		}
 	}
+	return true
 }
 
-func (tree *TableTree) majorCompactionLevel(level int) {
+// isBottommostRange 判断 level 及更深的层中是否还有其它 SSTable 和范围删除标记重叠，
+// 没有的话压缩输出到 level 时，范围删除标记已经没有需要遮盖的旧数据
+func (tree *TableTree) isBottommostRange(level int, tombstone kv.RangeTombstone, compacting map[*TableNode]bool) bool {
+	for i := level; i < len(tree.levels); i++ {
+		for node := tree.levels[i]; node != nil; node = node.next {
+			if compacting[node] {
+				continue
+			}
+			if node.table.Overlaps(tombstone.Start, tombstone.End) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// majorCompactionLevel 将一层的 SSTable 合并到下一层，读取或写入失败时返回错误，
+// 这时参与压缩的 SSTable 仍然留在原来的层中
+func (tree *TableTree) majorCompactionLevel(level int) error {
 	log.Println("compresssing layer")
 	start := time.Now()
 	defer func() {
@@ -312,39 +884,53 @@ func (tree *TableTree) majorCompactionLevel(level int) {
 
 	log.Printf("Compressing layer %d.db files\r\n", level)
 
-	tableCache := make([]byte, levelMaxSize[level])
-	currentNode := tree.levels[level]
+	// 按需扩容，深层的 levelMaxSize 可能非常大
+	tableCache := make([]byte, 0)
 
 	memoryTree := &sort_tree.Tree{}
 	memoryTree.Init()
+	tombstones := make([]kv.RangeTombstone, 0)
 
 	tree.lock.Lock()
+	// 记录参与压缩的节点，压缩过程中新生成的 SSTable 只会追加在链表尾部
+	oldNode := tree.levels[level]
+	var lastNode *TableNode
+	compacting := make(map[*TableNode]bool)
+	currentNode := oldNode
 	for currentNode != nil {
+		compacting[currentNode] = true
+		lastNode = currentNode
 		table := currentNode.table
+		tombstones = append(tombstones, table.rangeTombstones...)
 		if int64(len(tableCache)) < table.tableMetaInfo.dataLen {
 			tableCache = make([]byte, table.tableMetaInfo.dataLen)
 		}
 
 		newSlice := tableCache[0:table.tableMetaInfo.dataLen]
 
-		if _, err := table.f.Seek(0, 0); err != nil {
-			log.Println("error open file")
-			panic(err)
-		}
-
-		if _, err := table.f.Read(newSlice); err != nil {
-			panic(err)
+		if _, err := table.f.ReadAt(newSlice, table.tableMetaInfo.dataStart); err != nil {
+			tree.lock.Unlock()
+			return kv.IOError("read", table.filePath, err)
 		}
 
 		for k, position := range table.sparseIndex {
+			key, seq, _ := kv.ParseInternalKey(k)
 			if position.Deleted == false {
-				value, err := kv.Decode(newSlice)
+				if !validArea(position.Start, position.Len, int64(len(newSlice))) {
+					tree.lock.Unlock()
+					return kv.CorruptionError("compact", table.filePath, errors.New("invalid index position"))
+				}
+				value, err := decodeRecord(newSlice[position.Start:(position.Start + position.Len)])
 				if err != nil {
-					log.Fatal(err)
+					tree.lock.Unlock()
+					return kv.CorruptionError("decode", table.filePath, err)
 				}
-				memoryTree.Set(k, value.Value)
+				// 分离到 value log 的值只搬动指针
+				value.Key = key
+				value.Seq = seq
+				memoryTree.SetValue(value)
 			}else {
-				memoryTree.Delete(k)
+				memoryTree.Delete(key, seq)
 			}
 		}
 		currentNode = currentNode.next
@@ -353,43 +939,203 @@ func (tree *TableTree) majorCompactionLevel(level int) {
 
 	tree.lock.Unlock()
 
-	values := memoryTree.GetValues()
+	if oldNode == nil {
+		return nil
+	}
+
 	newLevel := level + 1
-	if newLevel > 10 {
-		newLevel = 10
+	if newLevel >= len(tree.levels) {
+		newLevel = len(tree.levels) - 1
 	}
 
-	tree.CreateTable(values, newLevel)
+	// 按序列号合并，每个 key 只保留最新的版本和快照还能看到的版本
+	snapshots := tree.getSnapshots()
+	merged := visibleVersions(memoryTree.GetValues(), snapshots)
+	merged, err := tree.foldMerges(merged, tombstones, snapshots)
+	if err != nil {
+		return err
+	}
+	// 过期的记录对任何读取都不可见，转为删除标记，和其它删除标记一样在最底层丢弃
+	now := time.Now()
+	expired := 0
+	for i, value := range merged {
+		if !value.Deleted && value.Expired(now) {
+			merged[i] = kv.Value{Key: value.Key, Deleted: true, Seq: value.Seq}
+			expired++
+		}
+	}
+	if expired > 0 {
+		log.Printf("Expired %d values compacting layer %d\r\n", expired, level)
+	}
+	// 被参与压缩的范围删除标记遮盖的版本直接丢弃
+	if len(tombstones) > 0 {
+		before := len(merged)
+		merged = dropCoveredVersions(merged, tombstones, snapshots)
+		log.Printf("Dropped %d values covered by range tombstones compacting layer %d\r\n", before-len(merged), level)
+	}
+	if tree.filter != nil {
+		for i, value := range merged {
+			// 快照能看到的版本不经过过滤器，保证快照读到的数据不变
+			if len(snapshots) > 0 && value.Seq <= snapshots[len(snapshots)-1] {
+				continue
+			}
+			// 合并操作数不是完整的值，不经过过滤器
+			if !value.Deleted && !value.Merge {
+				if merged[i], err = tree.applyFilter(level, value); err != nil {
+					return err
+				}
+			}
+		}
+		if tree.vlog != nil {
+			if err = tree.vlog.Sync(); err != nil {
+				return err
+			}
+		}
+	}
 
-	oldNode := tree.levels[level]
-	if level < 10 {
-		tree.levels[level] = nil
-		tree.clearLevel(oldNode)
+	// 输出层已经是 key 所在的最底层时，删除标记（以及被它遮盖的旧版本）可以直接丢弃，
+	// 但删除标记之后还保留着快照能看到的旧版本时，需要用它遮盖这些旧版本
+	values := make([]kv.Value, 0)
+	dropped := 0
+	tree.lock.RLock()
+	merged, err = tree.foldBottommostMerges(merged, newLevel, compacting, snapshots)
+	if err != nil {
+		tree.lock.RUnlock()
+		return err
+	}
+	for i, value := range merged {
+		oldest := i+1 == len(merged) || merged[i+1].Key != value.Key
+		if value.Deleted && oldest && tree.isBottommost(newLevel, value.Key, compacting) {
+			dropped++
+			continue
+		}
+		values = append(values, value)
+	}
+	// 范围删除标记在最底层、并且没有因为快照保留下来的被它遮盖的版本时才能丢弃
+	keptTombstones := make([]kv.RangeTombstone, 0, len(tombstones))
+	for _, tombstone := range tombstones {
+		if tree.isBottommostRange(newLevel, tombstone, compacting) && !coversAny(tombstone, values) {
+			dropped++
+			continue
+		}
+		keptTombstones = append(keptTombstones, tombstone)
+	}
+	tree.lock.RUnlock()
+	if dropped > 0 {
+		log.Printf("Dropped %d tombstones compacting into layer %d\r\n", dropped, newLevel)
 	}
 
+	if len(values) > 0 || len(keptTombstones) > 0 {
+		if _, err = tree.CreateTable(values, keptTombstones, newLevel); err != nil {
+			return err
+		}
+	}
 
+	tree.lock.Lock()
+	tree.levels[level] = lastNode.next
+	lastNode.next = nil
+	tree.lock.Unlock()
+	return tree.clearLevel(oldNode)
 }
 
-func (tree *TableTree) clearLevel(oldNode *TableNode) {
-	tree.lock.Lock()
-	defer tree.lock.Unlock()
+// foldBottommostMerges 输出层已经是 key 所在的最底层时，最旧的快照段中的操作数下面已经没有旧值，
+// 直接合并为完整的值，调用方需要持有 tree.lock
+func (tree *TableTree) foldBottommostMerges(values []kv.Value, level int, compacting map[*TableNode]bool, snapshots []uint64) ([]kv.Value, error) {
+	if tree.merge == nil {
+		return values, nil
+	}
+	result := make([]kv.Value, 0, len(values))
+	separated := false
+	for i := 0; i < len(values); {
+		end := i + 1
+		for end < len(values) && values[end].Key == values[i].Key {
+			end++
+		}
+		// 最旧的段中的版本
+		start := end - 1
+		for start > i && stripeOf(snapshots, values[start-1].Seq) == stripeOf(snapshots, values[end-1].Seq) {
+			start--
+		}
+		result = append(result, values[i:start]...)
+		// 合并失败时段中还留着值或删除标记，这时不处理
+		_, _, complete := SplitMerge(values[start:end], 0)
+		if !complete && tree.isBottommost(level, values[start].Key, compacting) {
+			base := kv.Value{Key: values[start].Key, Deleted: true}
+			merged, err := ApplyMerge(tree.merge, base, values[start:end], tree.readValue)
+			if err == nil {
+				ok, err := tree.separateValue(&merged)
+				if err != nil {
+					return nil, err
+				}
+				separated = separated || ok
+				result = append(result, merged)
+				i = end
+				continue
+			}
+			log.Println("failure to merge operands, keep them", values[start].Key, err)
+		}
+		result = append(result, values[start:end]...)
+		i = end
+	}
+	if separated {
+		if err := tree.vlog.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
 
-	for oldNode != nil {
-		err := oldNode.table.f.Close()
-		if err != nil {
-			panic(err)
+// coversAny 范围删除标记是否遮盖 values 中的某个版本
+func coversAny(tombstone kv.RangeTombstone, values []kv.Value) bool {
+	for _, value := range values {
+		if tombstone.Covers(value.Key, value.Seq) {
+			return true
 		}
+	}
+	return false
+}
 
-		err = os.Remove(oldNode.table.filePath)
+// applyFilter 调用压缩过滤器，被删除的记录转为删除标记，避免更深层中的旧值重新可见
+func (tree *TableTree) applyFilter(level int, value kv.Value) (kv.Value, error) {
+	data := value.Value
+	if value.Pointer != nil {
+		var err error
+		data, err = tree.vlog.Read(*value.Pointer)
 		if err != nil {
-			panic(err)
+			log.Println("failure to read the value log, skip the compaction filter", err)
+			return value, nil
+		}
+	}
+	decision, newValue := tree.filter.Filter(level, value.Key, data)
+	switch decision {
+	case Remove:
+		value.Value = nil
+		value.Pointer = nil
+		value.Deleted = true
+	case ChangeValue:
+		value.Value = newValue
+		value.Pointer = nil
+		if _, err := tree.separateValue(&value); err != nil {
+			return value, err
 		}
+	}
+	return value, nil
+}
 
-		oldNode.table.f = nil
+// clearLevel 删除压缩前的 SSTable，返回遇到的第一个错误，其余文件仍然会被删除
+func (tree *TableTree) clearLevel(oldNode *TableNode) error {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	var firstErr error
+	for oldNode != nil {
+		if err := oldNode.table.Obsolete(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 		oldNode.table = nil
 		oldNode = oldNode.next
 	}
-
+	return firstErr
 }
 
 
@@ -399,3 +1145,21 @@ func (tree *TableTree) clearLevel(oldNode *TableNode) {
 
 
 
+
+// Close 关闭所有 SSTable 的文件句柄，等待进行中的压缩结束，返回遇到的第一个错误
+func (tree *TableTree) Close() error {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	var firstErr error
+	for _, node := range tree.levels {
+		for ; node != nil; node = node.next {
+			if err := node.table.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
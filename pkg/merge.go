@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"mylsmtree/pkg/lsm"
+	"net/http"
+)
+
+// StartServer 打开数据库时使用的合并操作，在数据库初始化前设置时暂存在这里
+var mergeOperator lsm.MergeOperator
+
+// SetMergeOperator 设置合并操作，可以在 StartServer 之前调用。
+// 所有节点需要设置相同的合并操作，已经写入的操作数在读取和压缩时用它合并
+func SetMergeOperator(operator lsm.MergeOperator) {
+	mergeOperator = operator
+	if database != nil {
+		database.SetMergeOperator(operator)
+	}
+}
+
+// SetMergeOperator 设置数据库的合并操作，应用到所有列族
+func (d *DB) SetMergeOperator(operator lsm.MergeOperator) {
+	d.mergeOperator = operator
+	for _, cf := range d.getFamilies() {
+		cf.TableTree.SetMergeOperator(operator)
+	}
+}
+
+// Merge 写入合并操作数，不读取旧值，读取时用 SetMergeOperator 设置的合并操作合并到旧值上，
+// 例如 Int64AddOperator 下 Merge("counter", 1) 把计数器加一。没有设置合并操作时返回 lsm.ErrNoMergeOperator
+func Merge(key string, operand interface{}) error {
+	log.Print("Merge ", key)
+	db, err := current()
+	if err != nil {
+		return err
+	}
+	return db.Merge(key, operand)
+}
+
+// checkMergeOperator 批量写入中有合并操作数时，需要已经设置合并操作。
+// 只在直接写入和提交 raft 日志前检查，应用 raft 日志时不检查
+func (d *DB) checkMergeOperator(batch *WriteBatch) error {
+	if d.mergeOperator != nil {
+		return nil
+	}
+	for _, op := range batch.ops {
+		if op.Op == BatchMerge {
+			return lsm.ErrNoMergeOperator
+		}
+	}
+	return nil
+}
+
+// Merge 接口，参数为 key、value 和列族 cf，值按字符串处理，整数累加时可以传入字符串形式的整数，
+// JSON 形式的操作数可以通过 /batch 写入
+func (h HttpServer) Merge(w http.ResponseWriter, r *http.Request) {
+	if !h.db.isLeader() {
+		http.Error(w, "not leader", http.StatusServiceUnavailable)
+		return
+	}
+	cf, ok := h.requestFamily(w, r)
+	if !ok {
+		return
+	}
+	vars := r.URL.Query()
+	batch := NewWriteBatch()
+	batch.MergeCF(cf, vars.Get("key"), vars.Get("value"))
+	if err := h.db.proposeBatch(r.Context(), batch); err != nil {
+		log.Println("merge apply failure", err)
+		writeTextError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "success")
+}
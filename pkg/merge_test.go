@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"mylsmtree/pkg/lsm"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMergeCounter(t *testing.T) {
+	db := openTestDB(t, &Options{MergeOperator: lsm.Int64AddOperator()})
+	for i := 0; i < 3; i++ {
+		if err := db.Merge("counter", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, ok := db.GetJSON("counter"); !ok || value != float64(6) {
+		t.Fatalf("counter = %v, %v", value, ok)
+	}
+	// 合并到已有的值上
+	db.Set("counter", 10)
+	if err := db.Merge("counter", -1); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := db.GetJSON("counter"); !ok || value != float64(9) {
+		t.Fatalf("counter = %v, %v", value, ok)
+	}
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.Merge("counter", 1); !errors.Is(err, lsm.ErrNoMergeOperator) {
+		t.Fatalf("got %v, want ErrNoMergeOperator", err)
+	}
+}
+
+// 合并操作只在提交日志的节点上检查，没有设置合并操作的节点也应用同样的日志
+func TestRaftMergeDoesNotDependOnFollowerOperator(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	nodes[0].db.SetMergeOperator(lsm.Int64AddOperator())
+	batch := NewWriteBatch()
+	batch.Put("counter", 1)
+	batch.Merge("counter", 2)
+	if err := nodes[0].db.proposeBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, nodes)
+	if nodes[1].raft.AppliedIndex() != nodes[0].raft.AppliedIndex() {
+		t.Fatal("follower did not apply the merge")
+	}
+	nodes[1].db.SetMergeOperator(lsm.Int64AddOperator())
+	for i, node := range nodes {
+		if value, ok := node.db.GetJSON("counter"); !ok || value != float64(3) {
+			t.Errorf("node %d: counter = %v, %v", i, value, ok)
+		}
+	}
+}
+
+func TestMergeHandlerStatus(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	leader := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	follower := HttpServer{ctx: nodes[1].raft, db: nodes[1].db}
+
+	w := httptest.NewRecorder()
+	leader.Merge(w, httptest.NewRequest(http.MethodGet, "/merge?key=c&value=1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("without merge operator: got %d, want 400", w.Code)
+	}
+	nodes[0].db.SetMergeOperator(lsm.Int64AddOperator())
+	w = httptest.NewRecorder()
+	leader.Merge(w, httptest.NewRequest(http.MethodGet, "/merge?key=c&value=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %q, want 200", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	leader.Merge(w, httptest.NewRequest(http.MethodGet, "/merge?key=c&value=1&cf=missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("missing family: got %d, want 404", w.Code)
+	}
+	w = httptest.NewRecorder()
+	follower.Merge(w, httptest.NewRequest(http.MethodGet, "/merge?key=c&value=1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("follower: got %d, want 503", w.Code)
+	}
+}
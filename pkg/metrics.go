@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics 数据库运行时的统计信息
+type Metrics struct {
+	// 写入被延迟的次数和累计时长
+	SlowdownCount    int64
+	SlowdownDuration time.Duration
+	// 写入被阻塞的次数和累计时长
+	StopCount    int64
+	StopDuration time.Duration
+	// 最近一次后台检查时的状态，L0Files 是所有列族中最多的 L0 文件数，
+	// PendingCompactionBytes 是所有列族的总和
+	L0Files                int
+	ImmutableMemTables     int
+	PendingCompactionBytes int64
+	// 导致数据库只读的后台错误，可以写入时为空
+	BackgroundError string `json:",omitempty"`
+}
+
+// GetMetrics 获取统计信息
+func GetMetrics() Metrics {
+	db, err := current()
+	if err != nil {
+		return Metrics{}
+	}
+	return db.GetMetrics()
+}
+
+// GetMetrics 获取数据库的统计信息
+func (d *DB) GetMetrics() Metrics {
+	var bgErr string
+	if err := d.BackgroundError(); err != nil {
+		bgErr = err.Error()
+	}
+	return Metrics{
+		SlowdownCount:          atomic.LoadInt64(&d.slowdownCount),
+		SlowdownDuration:       time.Duration(atomic.LoadInt64(&d.slowdownDuration)),
+		StopCount:              atomic.LoadInt64(&d.stopCount),
+		StopDuration:           time.Duration(atomic.LoadInt64(&d.stopDuration)),
+		L0Files:                d.getLevel0Files(),
+		ImmutableMemTables:     len(d.getImmutables()),
+		PendingCompactionBytes: atomic.LoadInt64(&d.pendingCompactionBytes),
+		BackgroundError:        bgErr,
+	}
+}
+
+// updateStallMetrics 由后台线程在每次落盘、压缩后调用，
+// 待压缩数据量需要遍历所有 SSTable 文件，不在写入路径上实时计算
+func (d *DB) updateStallMetrics() {
+	var pending int64
+	for _, cf := range d.getFamilies() {
+		pending += cf.TableTree.GetPendingCompactionBytes()
+	}
+	atomic.StoreInt64(&d.pendingCompactionBytes, pending)
+}
+
+func (h HttpServer) Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.db.GetMetrics())
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"errors"
+	"mylsmtree/pkg/kv"
+	"sort"
+	"testing"
+)
+
+func TestInternalKeyOrder(t *testing.T) {
+	// 先按 key 升序，同一个 key 按序列号降序，包含 0x00 的 key 也保持顺序
+	ordered := []string{
+		kv.InternalKey("a", 9),
+		kv.InternalKey("a", 2),
+		kv.InternalKey("a\x00", 5),
+		kv.InternalKey("a\x00b", 1),
+		kv.InternalKey("ab", kv.MaxSeq),
+		kv.InternalKey("ab", 0),
+	}
+	if !sort.StringsAreSorted(ordered) {
+		t.Fatalf("internal keys are not ordered: %q", ordered)
+	}
+	for _, c := range []struct {
+		key string
+		seq uint64
+	}{{"a", 9}, {"a\x00b", 1}, {"\x00\x01", 7}, {"", kv.MaxSeq}} {
+		key, seq, ok := kv.ParseInternalKey(kv.InternalKey(c.key, c.seq))
+		if !ok || key != c.key || seq != c.seq {
+			t.Errorf("ParseInternalKey(InternalKey(%q, %d)) = %q, %d, %v", c.key, c.seq, key, seq, ok)
+		}
+	}
+	if _, _, ok := kv.ParseInternalKey("plain"); ok {
+		t.Error("parsed a key without a sequence number")
+	}
+}
+
+func TestReadAtSeq(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.Put([]byte("k"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	seq1 := db.getVisibleSeq()
+	// 旧版本落盘到 SSTable，新版本在内存表中
+	flushTestDB(t, db)
+	if err := db.Put([]byte("k"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	seq2 := db.getVisibleSeq()
+	if err := db.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	seq3 := db.getVisibleSeq()
+	if !(seq1 < seq2 && seq2 < seq3) {
+		t.Fatalf("sequence numbers %d, %d, %d are not increasing", seq1, seq2, seq3)
+	}
+
+	if _, err := db.get("k", seq1-1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("before the first write: got %v, want ErrNotFound", err)
+	}
+	for seq, want := range map[uint64]string{seq1: "v1", seq2: "v2"} {
+		if value, err := db.get("k", seq); err != nil || string(value) != want {
+			t.Fatalf("read at %d = %q, %v, want %q", seq, value, err, want)
+		}
+	}
+	if _, err := db.get("k", seq3); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("after the delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestSeqRecoveredOnReopen(t *testing.T) {
+	for _, skipFlush := range []bool{false, true} {
+		dir := t.TempDir()
+		opts := DefaultOptions()
+		opts.SkipFlushOnClose = skipFlush
+		db, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range []string{"v1", "v2", "v3"} {
+			if err = db.Put([]byte("k"), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		last := db.getVisibleSeq()
+		db = reopenTestDB(t, dir, opts, db)
+		// 序列号从 SSTable 或 wal 中恢复，新的写入不会和旧版本的序列号重复
+		if seq := db.getVisibleSeq(); seq != last {
+			t.Fatalf("skip flush %v: visible seq %d after reopen, want %d", skipFlush, seq, last)
+		}
+		if err = db.Put([]byte("k"), []byte("v4")); err != nil {
+			t.Fatal(err)
+		}
+		if seq := db.getVisibleSeq(); seq <= last {
+			t.Fatalf("skip flush %v: new write got seq %d, not after %d", skipFlush, seq, last)
+		}
+		if value, err := db.Get([]byte("k")); err != nil || string(value) != "v4" {
+			t.Fatalf("skip flush %v: got %q, %v", skipFlush, value, err)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package myraft
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	"strings"
 	"sync"
@@ -10,35 +9,74 @@ import (
 	"github.com/hashicorp/raft"
 )
 
+// Engine 执行 raft 日志的存储引擎
+type Engine interface {
+	// ApplyBatch 原子地写入一个编码后的批量写入，index 为 raft 日志编号，
+	// 已经写入过的日志（例如重启后回放）需要跳过
+	ApplyBatch(index uint64, data []byte) error
+	// ApplyTxn 检查事务的读集合没有冲突后原子地写入事务，冲突时返回错误
+	ApplyTxn(index uint64, data []byte) error
+	// ApplyCondition 原子地判断条件并写入，返回条件写入的结果或错误
+	ApplyCondition(index uint64, data []byte) interface{}
+	// ApplyFamily 创建或删除列族
+	ApplyFamily(index uint64, data []byte) error
+	// Snapshot 创建存储引擎当前数据的快照
+	Snapshot() (raft.FSMSnapshot, error)
+	// Restore 用快照替换存储引擎中的数据
+	Restore(rc io.ReadCloser) error
+}
+
 type Fsm struct {
 	DataBase database
+	// 存储引擎，为 nil 时只维护 DataBase
+	Engine Engine
 }
 
-func NewFsm() *Fsm {
+func NewFsm(engine Engine) *Fsm {
 	fsm := &Fsm{
 		DataBase: NewDatabase(),
+		Engine:   engine,
 	}
 	return fsm
 }
 
 func (f *Fsm) Apply(l *raft.Log) interface{} {
-	fmt.Println("apply data:", string(l.Data))
-	data := strings.Split(string(l.Data), ",")
+	// 命令格式为 op,参数
+	data := strings.SplitN(string(l.Data), ",", 2)
 	op := data[0]
 	if op == "set" {
-		key := data[1]
-		value := data[2]
+		args := strings.Split(data[1], ",")
+		key := args[0]
+		value := args[1]
 		f.DataBase.Set(key, value)
 	}
+	if op == "batch" && f.Engine != nil {
+		return f.Engine.ApplyBatch(l.Index, []byte(data[1]))
+	}
+	if op == "txn" && f.Engine != nil {
+		return f.Engine.ApplyTxn(l.Index, []byte(data[1]))
+	}
+	if op == "cond" && f.Engine != nil {
+		return f.Engine.ApplyCondition(l.Index, []byte(data[1]))
+	}
+	if op == "cf" && f.Engine != nil {
+		return f.Engine.ApplyFamily(l.Index, []byte(data[1]))
+	}
 
 	return nil
 }
 
 func (f *Fsm) Snapshot() (raft.FSMSnapshot, error) {
+	if f.Engine != nil {
+		return f.Engine.Snapshot()
+	}
 	return &f.DataBase, nil
 }
 
-func (f *Fsm) Restore(io.ReadCloser) error {
+func (f *Fsm) Restore(rc io.ReadCloser) error {
+	if f.Engine != nil {
+		return f.Engine.Restore(rc)
+	}
 	return nil
 }
 
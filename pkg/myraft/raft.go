@@ -11,7 +11,7 @@ import (
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 )
 
-func NewMyRaft(raftAddr, raftId, raftDir string) (*raft.Raft, *Fsm, error) {
+func NewMyRaft(raftAddr, raftId, raftDir string, engine Engine) (*raft.Raft, *Fsm, error) {
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(raftId)
 	// config.HeartbeatTimeout = 1000 * time.Millisecond
@@ -38,7 +38,7 @@ func NewMyRaft(raftAddr, raftId, raftDir string) (*raft.Raft, *Fsm, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	fm := NewFsm()
+	fm := NewFsm(engine)
 	rf, err := raft.NewRaft(config, fm, logStore, stableStore, snapshots, transport)
 	if err != nil {
 		return nil, nil, err
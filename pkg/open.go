@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mylsmtree/pkg/config"
+	"mylsmtree/pkg/lsm"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrClosed 数据库已经关闭
+	ErrClosed = errors.New("database is closed")
+	// ErrAlreadyOpen 数据目录已经被同一个进程中的另一个 DB 打开
+	ErrAlreadyOpen = errors.New("database directory is already open")
+)
+
+// Options 打开数据库的设置，Config.DataDir 会被 Open 的 dir 参数覆盖
+type Options struct {
+	config.Config
+	// 合并操作，可以为 nil，之后也可以通过 DB.SetMergeOperator 设置
+	MergeOperator lsm.MergeOperator
+	// 前缀提取规则，可以为 nil
+	PrefixExtractor lsm.PrefixExtractor
+	// 压缩过滤器，可以为 nil
+	CompactionFilter lsm.CompactionFilter
+}
+
+// DefaultOptions 默认设置，只设置了内存表、SSTable 大小和后台检查间隔，其它功能都不开启
+func DefaultOptions() *Options {
+	return &Options{
+		Config: config.Config{
+			Level0Size:    100,
+			PartSize:      4,
+			Threshold:     3000,
+			CheckInterval: 3,
+		},
+	}
+}
+
+// 当前进程中已经打开的数据目录，绝对路径
+var (
+	openDirs     = make(map[string]bool)
+	openDirsLock = &sync.Mutex{}
+)
+
+// Open 打开 dir 中的数据库，目录不存在时创建，opts 为 nil 时使用 DefaultOptions，
+// opts 中内存表、SSTable 大小和后台检查间隔为 0 时也使用默认值
+func Open(dir string, opts *Options) (db *DB, err error) {
+	options := *DefaultOptions()
+	if opts != nil {
+		options = *opts
+		defaults := DefaultOptions()
+		if options.Level0Size <= 0 {
+			options.Level0Size = defaults.Level0Size
+		}
+		if options.PartSize <= 0 {
+			options.PartSize = defaults.PartSize
+		}
+		if options.Threshold <= 0 {
+			options.Threshold = defaults.Threshold
+		}
+		if options.CheckInterval <= 0 {
+			options.CheckInterval = defaults.CheckInterval
+		}
+	}
+	options.DataDir = dir
+	if err = config.CheckCompression(options.Compression); err != nil {
+		return nil, err
+	}
+	if err = config.CheckCompactionStyle(options.CompactionStyle); err != nil {
+		return nil, err
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	openDirsLock.Lock()
+	if openDirs[absDir] {
+		openDirsLock.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyOpen, dir)
+	}
+	openDirs[absDir] = true
+	openDirsLock.Unlock()
+
+	log.Println("Opening database", dir)
+	db = newDB(options)
+	if err = db.load(); err != nil {
+		db.closeFiles()
+		releaseDir(absDir)
+		return nil, fmt.Errorf("open %s: %w", dir, err)
+	}
+	// 数据库启动前进行一次数据压缩，失败时数据库以只读模式打开，可以读取数据，修复后调用 Resume
+	log.Println("Performing background checks...")
+	// 检查内存
+	err = db.checkMemory()
+	if err == nil {
+		err = db.flushImmutables()
+	}
+	// 检查压缩数据库文件
+	if err == nil {
+		err = db.compactFamilies()
+	}
+	db.setBackgroundError(err)
+	db.updateStallMetrics()
+	// 启动后台线程
+	db.bgDone.Add(1)
+	go db.backgroundLoop()
+	return db, nil
+}
+
+// releaseDir 数据库关闭后，数据目录可以被再次打开
+func releaseDir(absDir string) {
+	openDirsLock.Lock()
+	defer openDirsLock.Unlock()
+	delete(openDirs, absDir)
+}
+
+// Close 停止后台线程，将内存表全部落盘后关闭所有文件，关闭后的读写返回 ErrClosed，重复调用没有影响。
+// 设置了 SkipFlushOnClose 时只同步 wal，内存表在下次打开时从 wal 回放。
+// 落盘失败或者数据库处于只读模式时返回对应的错误，文件仍然会被关闭。
+// 调用前需要关闭所有迭代器，集群模式下需要先关闭 raft 节点
+func (d *DB) Close() error {
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return nil
+	}
+	log.Println("Closing database", d.dir)
+	close(d.closeCh)
+	d.bgDone.Wait()
+	// 唤醒被限流阻塞的写入，它们会发现数据库已经关闭
+	d.wakeStalledWrites()
+	d.closeScanCursors()
+
+	// 等待进行中的写入完成，之后的写入都会返回 ErrClosed。
+	// 只读模式下不再落盘，内存表中的数据仍然在 wal 中，下次打开时回放
+	d.writeLock.Lock()
+	err := d.BackgroundError()
+	if err == nil {
+		if d.con.SkipFlushOnClose {
+			err = d.Wal.SyncLog()
+		} else {
+			err = d.switchMemoryTree()
+		}
+	}
+	d.writeLock.Unlock()
+	if err == nil && !d.con.SkipFlushOnClose {
+		err = d.flushImmutables()
+	}
+	if closeErr := d.closeFiles(); err == nil {
+		err = closeErr
+	}
+
+	if absDir, absErr := filepath.Abs(d.dir); absErr == nil {
+		releaseDir(absDir)
+	}
+	return err
+}
+
+// closeFiles 关闭所有列族和 wal 的文件，返回遇到的第一个错误
+func (d *DB) closeFiles() error {
+	var firstErr error
+	for _, cf := range d.families {
+		if err := cf.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := d.Wal.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+)
+
+// openTestDB 在临时目录中打开数据库，测试结束时关闭
+func openTestDB(t *testing.T, opts *Options) *DB {
+	t.Helper()
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return db
+}
+
+func TestOpenSameDirTwice(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(dir, nil); !errors.Is(err, ErrAlreadyOpen) {
+		t.Fatalf("second open: got %v, want ErrAlreadyOpen", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("reopen after close: %v", err)
+	}
+	defer db.Close()
+}
+
+func TestReopenKeepsData(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	value, err := db.Get([]byte("k"))
+	if err != nil || string(value) != "v" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+}
+
+func TestClosedDB(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("k"), []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("put: got %v, want ErrClosed", err)
+	}
+	if _, err = db.Get([]byte("k")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("get: got %v, want ErrClosed", err)
+	}
+	if err = db.NewIterator().Err(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("iterator: got %v, want ErrClosed", err)
+	}
+}
+
+func TestPackageFunctionsWithoutDatabase(t *testing.T) {
+	if database != nil {
+		t.Skip("database opened by StartServer")
+	}
+	if _, err := Get([]byte("k")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Get: got %v, want ErrClosed", err)
+	}
+	if err := Put([]byte("k"), []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Put: got %v, want ErrClosed", err)
+	}
+	if err := Write(NewWriteBatch()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Write: got %v, want ErrClosed", err)
+	}
+	if _, err := CompareAndSwap("k", 1, 2); !errors.Is(err, ErrClosed) {
+		t.Fatalf("CompareAndSwap: got %v, want ErrClosed", err)
+	}
+	if err := NewIterator().Err(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("NewIterator: got %v, want ErrClosed", err)
+	}
+	if Set("k", "v") {
+		t.Fatal("Set succeeded without a database")
+	}
+	txn := BeginTxn()
+	txn.Put("k", "v")
+	if err := txn.Commit(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Commit: got %v, want ErrClosed", err)
+	}
+	if GetSnapshot() != nil {
+		t.Fatal("GetSnapshot returned a snapshot without a database")
+	}
+}
+
+func TestNotLeaderWithoutRaft(t *testing.T) {
+	db := openTestDB(t, nil)
+	if db.isLeader() {
+		t.Fatal("database without raft reports leadership")
+	}
+}
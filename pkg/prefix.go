@@ -0,0 +1,72 @@
+package pkg
+
+import "mylsmtree/pkg/lsm"
+
+// StartServer 打开数据库时使用的前缀提取规则，在数据库初始化前设置时暂存在这里
+var prefixExtractor lsm.PrefixExtractor
+
+// SetPrefixExtractor 设置前缀提取规则，之后生成的 SSTable 会为提取出的前缀生成布隆过滤器，
+// 可以在 StartServer 之前调用，传入 nil 表示不生成
+func SetPrefixExtractor(extractor lsm.PrefixExtractor) {
+	prefixExtractor = extractor
+	if database != nil {
+		database.SetPrefixExtractor(extractor)
+	}
+}
+
+// SetPrefixExtractor 设置数据库的前缀提取规则，应用到所有列族
+func (d *DB) SetPrefixExtractor(extractor lsm.PrefixExtractor) {
+	d.prefixExtractor = extractor
+	for _, cf := range d.getFamilies() {
+		cf.TableTree.SetPrefixExtractor(extractor)
+	}
+}
+
+// NewPrefixIterator 创建只遍历以 prefix 开头的 key 的迭代器，
+// prefix 能被前缀提取规则提取时，会跳过前缀布隆过滤器中不包含该前缀的 SSTable
+func NewPrefixIterator(prefix string) *Iterator {
+	db, err := current()
+	if err != nil {
+		return closedIterator(nil)
+	}
+	return db.NewPrefixIterator(prefix)
+}
+
+// ScanPrefix 按 key 升序返回以 prefix 开头的记录，limit 小于等于 0 表示不限制数量
+func ScanPrefix(prefix string, limit int) []KeyValue {
+	db, err := current()
+	if err != nil {
+		return nil
+	}
+	return db.ScanPrefix(prefix, limit)
+}
+
+// scanPrefix 用前缀迭代器 it 遍历所有记录，遍历完关闭 it
+func scanPrefix(it *Iterator, limit int) []KeyValue {
+	defer it.Close()
+
+	result := make([]KeyValue, 0)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, KeyValue{
+			Key:   it.Key(),
+			Value: it.Value(),
+		})
+	}
+	return result
+}
+
+// prefixSuccessor 返回大于所有以 prefix 开头的 key 的最小字符串，
+// prefix 为空或全部是 0xff 时不存在，ok 为 false
+func prefixSuccessor(prefix string) (string, bool) {
+	bytes := []byte(prefix)
+	for i := len(bytes) - 1; i >= 0; i-- {
+		if bytes[i] != 0xff {
+			bytes[i]++
+			return string(bytes[:i+1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"mylsmtree/pkg/lsm"
+	"strings"
+	"testing"
+)
+
+func TestPrefixExtractors(t *testing.T) {
+	cases := []struct {
+		extractor lsm.PrefixExtractor
+		key       string
+		prefix    string
+		ok        bool
+	}{
+		{lsm.FixedPrefix(3), "abcdef", "abc", true},
+		{lsm.FixedPrefix(3), "ab", "", false},
+		{lsm.DelimiterPrefix("/", 1), "tenant/entity/id", "tenant/", true},
+		{lsm.DelimiterPrefix("/", 2), "tenant/entity/id", "tenant/entity/", true},
+		{lsm.DelimiterPrefix("/", 2), "tenant/entity", "", false},
+		{lsm.DelimiterPrefix("::", 1), "a::b", "a::", true},
+	}
+	for _, c := range cases {
+		prefix, ok := c.extractor.Extract(c.key)
+		if prefix != c.prefix || ok != c.ok {
+			t.Errorf("%s: Extract(%q) = %q, %v, want %q, %v", c.extractor.Name(), c.key, prefix, ok, c.prefix, c.ok)
+		}
+	}
+	if lsm.FixedPrefix(3).Name() == lsm.FixedPrefix(4).Name() {
+		t.Error("extractors with different lengths have the same name")
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	cases := map[string]string{"a": "b", "ab": "ac", "a\xff": "b", "a\xff\xff": "b"}
+	for prefix, want := range cases {
+		if got, ok := prefixSuccessor(prefix); !ok || got != want {
+			t.Errorf("prefixSuccessor(%q) = %q, %v, want %q", prefix, got, ok, want)
+		}
+	}
+	for _, prefix := range []string{"", "\xff", "\xff\xff"} {
+		if _, ok := prefixSuccessor(prefix); ok {
+			t.Errorf("prefixSuccessor(%q) exists", prefix)
+		}
+	}
+}
+
+// prefixDB 两个租户的数据，一部分在 SSTable 中，一部分在内存表中
+func prefixDB(t *testing.T, dir string, extractor lsm.PrefixExtractor) *DB {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.PrefixExtractor = extractor
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"t1/a", "t2/a", "t1/c"} {
+		if err = db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestDB(t, db)
+	for _, key := range []string{"t1/b", "t2/b", "t10/a"} {
+		if err = db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// prefixKeys 前缀遍历的结果中的 key
+func prefixKeys(result []KeyValue) string {
+	var keys []string
+	for _, kv := range result {
+		if kv.Value != kv.Key {
+			return "wrong value for " + kv.Key
+		}
+		keys = append(keys, kv.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestScanPrefix(t *testing.T) {
+	db := prefixDB(t, t.TempDir(), lsm.DelimiterPrefix("/", 1))
+	defer db.Close()
+	if got := prefixKeys(db.ScanPrefix("t1/", 0)); got != "t1/a,t1/b,t1/c" {
+		t.Fatalf("scan t1/ = %s", got)
+	}
+	if got := prefixKeys(db.ScanPrefix("t1/", 2)); got != "t1/a,t1/b" {
+		t.Fatalf("scan t1/ with limit 2 = %s", got)
+	}
+	// 不能被提取的前缀不使用布隆过滤器，仍然按前缀匹配
+	if got := prefixKeys(db.ScanPrefix("t1", 0)); got != "t1/a,t1/b,t1/c,t10/a" {
+		t.Fatalf("scan t1 = %s", got)
+	}
+	if got := prefixKeys(db.ScanPrefix("t3/", 0)); got != "" {
+		t.Fatalf("scan t3/ = %s", got)
+	}
+
+	it := db.NewPrefixIterator("t2/")
+	defer it.Close()
+	it.SeekToLast()
+	if got := collect(it, false); got != "t2/b=t2/b,t2/a=t2/a" {
+		t.Fatalf("reverse t2/ = %s", got)
+	}
+	it.Seek("a")
+	if !it.Valid() || it.Key() != "t2/a" {
+		t.Fatalf("seek before the prefix = %q, valid %v", it.Key(), it.Valid())
+	}
+}
+
+func TestScanPrefixWithChangedExtractor(t *testing.T) {
+	dir := t.TempDir()
+	db := prefixDB(t, dir, lsm.DelimiterPrefix("/", 1))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 旧 SSTable 的过滤器由其它规则生成，不能用来跳过文件
+	db, err := Open(dir, &Options{Config: DefaultOptions().Config, PrefixExtractor: lsm.FixedPrefix(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := prefixKeys(db.ScanPrefix("t1/", 0)); got != "t1/a,t1/b,t1/c" {
+		t.Fatalf("scan t1/ = %s", got)
+	}
+}
@@ -0,0 +1,134 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+)
+
+// rangeDeleteDB a 到 f 中 a、b、c 在 SSTable 中，d、e、f 在内存表中
+func rangeDeleteDB(t *testing.T, dir string, opts *Options) *DB {
+	t.Helper()
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err = db.Set(key, i); err != nil {
+			t.Fatal(err)
+		}
+		if key == "c" {
+			flushTestDB(t, db)
+		}
+	}
+	return db
+}
+
+// allKeys 遍历数据库中的所有 key
+func allKeys(t *testing.T, db *DB) string {
+	t.Helper()
+	it := db.NewIterator()
+	defer it.Close()
+	var result string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		result += it.Key()
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDeleteRange(t *testing.T) {
+	db := rangeDeleteDB(t, t.TempDir(), nil)
+	defer db.Close()
+	// 范围跨过 SSTable 和内存表，end 不包含在内
+	if err := db.DeleteRange("b", "e"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if _, err := db.Get([]byte(key)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: got %v, want ErrNotFound", key, err)
+		}
+	}
+	if got := allKeys(t, db); got != "aef" {
+		t.Fatalf("keys after deleting [b, e) = %s", got)
+	}
+
+	// 之后的写入不被遮盖
+	if err := db.Set("c", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("c")); err != nil || string(value) != `"new"` {
+		t.Fatalf("c = %q, %v", value, err)
+	}
+
+	// end 为空表示一直删除到最后
+	if err := db.DeleteRange("e", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := allKeys(t, db); got != "ac" {
+		t.Fatalf("keys after deleting [e, ) = %s", got)
+	}
+}
+
+func TestDeleteRangeRecovered(t *testing.T) {
+	for _, skipFlush := range []bool{false, true} {
+		dir := t.TempDir()
+		opts := DefaultOptions()
+		opts.SkipFlushOnClose = skipFlush
+		db := rangeDeleteDB(t, dir, opts)
+		if err := db.DeleteRange("b", "e"); err != nil {
+			t.Fatal(err)
+		}
+		// 范围删除标记从 SSTable 或 wal 中恢复
+		db = reopenTestDB(t, dir, opts, db)
+		if got := allKeys(t, db); got != "aef" {
+			t.Fatalf("skip flush %v: keys after reopen = %s", skipFlush, got)
+		}
+		if _, err := db.Get([]byte("b")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("skip flush %v: b: got %v, want ErrNotFound", skipFlush, err)
+		}
+	}
+}
+
+func TestDeleteRangeCompaction(t *testing.T) {
+	db := rangeDeleteDB(t, t.TempDir(), nil)
+	defer db.Close()
+	if err := db.DeleteRange("", ""); err != nil {
+		t.Fatal(err)
+	}
+	flushTestDB(t, db)
+	// 压缩到最底层后被遮盖的数据和范围删除标记都被清理
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if files := tableFiles(t, db.dir); files != 0 {
+		t.Fatalf("%d SSTables after compacting a deleted range", files)
+	}
+	if got := allKeys(t, db); got != "" {
+		t.Fatalf("keys = %s", got)
+	}
+}
+
+func TestDeleteRangeKeepsSnapshotVersions(t *testing.T) {
+	db := rangeDeleteDB(t, t.TempDir(), nil)
+	defer db.Close()
+	snapshot := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+	if err := db.DeleteRange("b", "e"); err != nil {
+		t.Fatal(err)
+	}
+	flushTestDB(t, db)
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	// 快照能看到的版本在压缩中保留
+	for _, key := range []string{"b", "c", "d"} {
+		if _, err := snapshot.Get([]byte(key)); err != nil {
+			t.Fatalf("snapshot %s: %v", key, err)
+		}
+	}
+	if got := allKeys(t, db); got != "aef" {
+		t.Fatalf("keys = %s", got)
+	}
+}
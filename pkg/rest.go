@@ -0,0 +1,388 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mylsmtree/pkg/lsm"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+// REST 接口，请求体和响应都是 JSON：
+//
+//	GET    /v1/kv/{key}  读取，key 不存在时返回 404
+//	PUT    /v1/kv/{key}  写入，请求体是 JSON 值，参数 ttl；参数 expected 为 JSON 值时比较并交换，
+//	                     if_absent=true 时只在 key 不存在时写入，条件不成立时返回 409
+//	DELETE /v1/kv/{key}  删除，参数 expected 为 JSON 值时只在值相等时删除，条件不成立时返回 409
+//	POST   /v1/batch     批量写入，请求体和 /batch 相同
+//	GET    /v1/scan      分页遍历，参数和 /scan 相同
+//
+// 都可以用参数 cf 指定列族。出错时返回 {"error": "..."}，写入发到不是 leader 的节点时返回 503，
+// 并在 leader_id、leader_addr 中给出 leader 的 raft id 和 http 地址，raft.cluster 中没有 leader 的 http 地址时
+// leader_addr 为空
+const restPrefix = "/v1/kv/"
+
+// restValue GET /v1/kv/{key} 的响应，不是 JSON 的值用 value_base64 表示
+type restValue struct {
+	Key         string          `json:"key"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ValueBase64 []byte          `json:"value_base64,omitempty"`
+}
+
+// restError 出错时的响应
+type restError struct {
+	Error      string `json:"error"`
+	LeaderID   string `json:"leader_id,omitempty"`
+	LeaderAddr string `json:"leader_addr,omitempty"`
+}
+
+// restScan GET /v1/scan 的响应，还有下一页时 next 为下一页的 token
+type restScan struct {
+	Items []KeyValue `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+// KV 处理 /v1/kv/{key}
+func (h HttpServer) KV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, restPrefix)
+	if key == "" {
+		writeRestError(w, http.StatusBadRequest, "missing key")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.restGet(w, r, key)
+	case http.MethodPut:
+		h.restPut(w, r, key)
+	case http.MethodDelete:
+		h.restDelete(w, r, key)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (h HttpServer) restGet(w http.ResponseWriter, r *http.Request, key string) {
+	cf, ok := h.restFamily(w, r)
+	if !ok {
+		return
+	}
+	data, err := cf.GetContext(r.Context(), []byte(key))
+	if err != nil {
+		writeRestErr(w, err)
+		return
+	}
+	result := restValue{Key: key}
+	if json.Valid(data) {
+		result.Value = data
+	} else {
+		result.ValueBase64 = data
+	}
+	writeRestJSON(w, http.StatusOK, result)
+}
+
+func (h HttpServer) restPut(w http.ResponseWriter, r *http.Request, key string) {
+	if !h.checkLeader(w) {
+		return
+	}
+	cf, ok := h.restFamily(w, r)
+	if !ok {
+		return
+	}
+	value, ok := h.readJSONBody(w, r)
+	if !ok {
+		return
+	}
+	vars := r.URL.Query()
+	ttl, err := parseTTL(vars.Get("ttl"))
+	if err != nil {
+		writeRestError(w, http.StatusBadRequest, "invalid ttl")
+		return
+	}
+
+	ifAbsent := false
+	if v := vars.Get("if_absent"); v != "" {
+		if ifAbsent, err = strconv.ParseBool(v); err != nil {
+			writeRestError(w, http.StatusBadRequest, "invalid if_absent")
+			return
+		}
+	}
+	_, hasExpected := vars["expected"]
+	if ifAbsent || hasExpected {
+		if ifAbsent && hasExpected {
+			writeRestError(w, http.StatusBadRequest, "expected and if_absent are exclusive")
+			return
+		}
+		record := condRecord{Op: CondPutIfAbsent, Key: key, CF: condFamily(cf), Value: value, ExpiresAt: expiresAt(ttl)}
+		if hasExpected {
+			record.Op = CondCompareAndSwap
+			if record.Expected, ok = compactJSON(vars.Get("expected")); !ok {
+				writeRestError(w, http.StatusBadRequest, "expected is not JSON")
+				return
+			}
+		}
+		h.restCondition(w, r, record)
+		return
+	}
+
+	batch := NewWriteBatch()
+	batch.PutBytesCF(cf, []byte(key), value)
+	if batch.Len() > 0 {
+		batch.ops[0].ExpiresAt = expiresAt(ttl)
+	}
+	if h.restBatch(w, r, batch) {
+		writeRestJSON(w, http.StatusOK, restValue{Key: key, Value: value})
+	}
+}
+
+func (h HttpServer) restDelete(w http.ResponseWriter, r *http.Request, key string) {
+	if !h.checkLeader(w) {
+		return
+	}
+	cf, ok := h.restFamily(w, r)
+	if !ok {
+		return
+	}
+	vars := r.URL.Query()
+	if _, hasExpected := vars["expected"]; hasExpected {
+		record := condRecord{Op: CondDeleteIfEquals, Key: key, CF: condFamily(cf)}
+		if record.Expected, ok = compactJSON(vars.Get("expected")); !ok {
+			writeRestError(w, http.StatusBadRequest, "expected is not JSON")
+			return
+		}
+		h.restCondition(w, r, record)
+		return
+	}
+
+	batch := NewWriteBatch()
+	batch.DeleteCF(cf, key)
+	if h.restBatch(w, r, batch) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RestBatch 处理 POST /v1/batch，成功时返回写入的操作数
+func (h HttpServer) RestBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !h.checkLeader(w) {
+		return
+	}
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+	batch, err := UnmarshalWriteBatch(body)
+	if err != nil {
+		writeRestError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if h.restBatch(w, r, batch) {
+		writeRestJSON(w, http.StatusOK, map[string]int{"ops": batch.Len()})
+	}
+}
+
+// RestScan 处理 GET /v1/scan
+func (h HttpServer) RestScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+	vars := r.URL.Query()
+	options := ScanOptions{
+		Family: vars.Get("cf"),
+		Start:  vars.Get("start"),
+		End:    vars.Get("end"),
+		Prefix: vars.Get("prefix"),
+	}
+	var err error
+	if reverse := vars.Get("reverse"); reverse != "" {
+		if options.Reverse, err = strconv.ParseBool(reverse); err != nil {
+			writeRestError(w, http.StatusBadRequest, "invalid reverse")
+			return
+		}
+	}
+	limit := 0
+	if value := vars.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeRestError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	ctx := withScanClient(r.Context(), requestClient(r))
+	items, next, err := h.db.ScanPageContext(ctx, options, vars.Get("token"), limit)
+	if err != nil {
+		writeRestErr(w, err)
+		return
+	}
+	if items == nil {
+		items = []KeyValue{}
+	}
+	writeRestJSON(w, http.StatusOK, restScan{Items: items, Next: next})
+}
+
+// restBatch 通过 raft 写入批量写入，失败时写入错误响应并返回 false
+func (h HttpServer) restBatch(w http.ResponseWriter, r *http.Request, batch *WriteBatch) bool {
+	if batch.err != nil {
+		writeRestError(w, http.StatusBadRequest, batch.err.Error())
+		return false
+	}
+	if err := h.db.proposeBatch(r.Context(), batch); err != nil {
+		log.Println("batch apply failure", err)
+		h.writeRaftErr(w, err)
+		return false
+	}
+	return true
+}
+
+// restCondition 通过 raft 执行条件写入，条件不成立时返回 409
+func (h HttpServer) restCondition(w http.ResponseWriter, r *http.Request, record condRecord) {
+	result, err := h.db.proposeCondition(r.Context(), record)
+	if err != nil {
+		log.Println("condition apply failure", err)
+		h.writeRaftErr(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !result.Succeeded {
+		status = http.StatusConflict
+	}
+	writeRestJSON(w, status, result)
+}
+
+// restFamily 参数 cf 指定的列族，不存在时返回 404
+func (h HttpServer) restFamily(w http.ResponseWriter, r *http.Request) (*ColumnFamily, bool) {
+	name := r.URL.Query().Get("cf")
+	if name == "" {
+		return h.db.ColumnFamily, true
+	}
+	cf, ok := h.db.getFamily(name)
+	if !ok {
+		writeRestError(w, http.StatusNotFound, ErrFamilyNotFound.Error())
+	}
+	return cf, ok
+}
+
+// checkLeader 写入只能发给 leader，不是 leader 时返回 503 和 leader 的地址
+func (h HttpServer) checkLeader(w http.ResponseWriter) bool {
+	if h.db.isLeader() {
+		return true
+	}
+	h.writeNotLeader(w)
+	return false
+}
+
+// writeNotLeader 返回 503，给出 leader 的 raft id 和 http 地址，客户端可以直接重试 leader
+func (h HttpServer) writeNotLeader(w http.ResponseWriter) {
+	_, id := h.ctx.LeaderWithID()
+	writeRestJSON(w, http.StatusServiceUnavailable, restError{
+		Error:      "not leader",
+		LeaderID:   string(id),
+		LeaderAddr: h.httpAddrs[string(id)],
+	})
+}
+
+// writeRaftErr 写入 raft 提交失败的响应，提交过程中失去 leader 时同样给出 leader 的地址
+func (h HttpServer) writeRaftErr(w http.ResponseWriter, err error) {
+	if notLeader(err) {
+		h.writeNotLeader(w)
+		return
+	}
+	writeRestErr(w, err)
+}
+
+// notLeader 提交 raft 日志时节点不是 leader 或者正在失去 leader 身份
+func notLeader(err error) bool {
+	return errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, raft.ErrLeadershipTransferInProgress)
+}
+
+// readBody 读取请求体，超过 maxBodyBytes 时返回 413
+func (h HttpServer) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var reader io.Reader = r.Body
+	if h.maxBodyBytes > 0 {
+		reader = io.LimitReader(r.Body, h.maxBodyBytes+1)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		writeRestError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	if h.maxBodyBytes > 0 && int64(len(data)) > h.maxBodyBytes {
+		writeRestError(w, http.StatusRequestEntityTooLarge,
+			"request body is larger than "+strconv.FormatInt(h.maxBodyBytes, 10)+" bytes")
+		return nil, false
+	}
+	return data, true
+}
+
+// readJSONBody 读取 JSON 值形式的请求体，返回压缩后的 JSON
+func (h HttpServer) readJSONBody(w http.ResponseWriter, r *http.Request) (json.RawMessage, bool) {
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return nil, false
+	}
+	value, ok := compactJSON(string(body))
+	if !ok {
+		writeRestError(w, http.StatusBadRequest, "request body is not JSON")
+	}
+	return value, ok
+}
+
+// compactJSON 检查 s 是否是一个 JSON 值，返回去掉空白后的 JSON
+func compactJSON(s string) (json.RawMessage, bool) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil || buf.Len() == 0 {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// restStatus 错误对应的 HTTP 状态码
+func restStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrFamilyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrReadOnly), errors.Is(err, ErrClosed), errors.Is(err, raft.ErrRaftShutdown):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, raft.ErrEnqueueTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, lsm.ErrNoMergeOperator), errors.Is(err, ErrInvalidFamilyName), errors.Is(err, ErrInvalidFamilyOptions),
+		errors.Is(err, ErrInvalidScanToken):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrScanTokenExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrFamilyExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeRestErr(w http.ResponseWriter, err error) {
+	writeRestError(w, restStatus(err), err.Error())
+}
+
+func writeRestError(w http.ResponseWriter, status int, message string) {
+	writeRestJSON(w, status, restError{Error: message})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeRestError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeRestJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
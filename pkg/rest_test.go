@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"encoding/json"
+	"mylsmtree/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restRequest 把请求交给 /v1/kv/ 接口，返回响应
+func restRequest(t *testing.T, h HttpServer, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.KV(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestRestPutGetDelete(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	h := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/k", `{"a": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("put: %d %s", w.Code, w.Body.String())
+	}
+	w := restRequest(t, h, http.MethodGet, "/v1/kv/k", "")
+	var value restValue
+	if err := json.Unmarshal(w.Body.Bytes(), &value); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("get: %d %s", w.Code, w.Body.String())
+	}
+	if string(value.Value) != `{"a":1}` {
+		t.Fatalf("get = %s", value.Value)
+	}
+	if w = restRequest(t, h, http.MethodDelete, "/v1/kv/k", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if w = restRequest(t, h, http.MethodGet, "/v1/kv/k", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get deleted: %d %s", w.Code, w.Body.String())
+	}
+	if w = restRequest(t, h, http.MethodPut, "/v1/kv/k", "not json"); w.Code != http.StatusBadRequest {
+		t.Fatalf("put invalid JSON: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRestConditionalFamily(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	db := nodes[0].db
+	users, err := db.CreateColumnFamily("users", config.FamilyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := HttpServer{ctx: nodes[0].raft, db: db}
+
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/k?cf=users&if_absent=true", "1"); w.Code != http.StatusOK {
+		t.Fatalf("put if absent: %d %s", w.Code, w.Body.String())
+	}
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/k?cf=users&if_absent=true", "2"); w.Code != http.StatusConflict {
+		t.Fatalf("second put if absent: %d %s", w.Code, w.Body.String())
+	}
+	if value, ok := users.GetJSON("k"); !ok || value != float64(1) {
+		t.Fatalf("users k = %v, %v", value, ok)
+	}
+	if _, ok := db.GetJSON("k"); ok {
+		t.Fatal("conditional write to a family changed the default family")
+	}
+
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/k?cf=users&expected=1", "3"); w.Code != http.StatusOK {
+		t.Fatalf("compare and swap: %d %s", w.Code, w.Body.String())
+	}
+	if w := restRequest(t, h, http.MethodDelete, "/v1/kv/k?cf=users&expected=1", ""); w.Code != http.StatusConflict {
+		t.Fatalf("delete with stale expected: %d %s", w.Code, w.Body.String())
+	}
+	if w := restRequest(t, h, http.MethodDelete, "/v1/kv/k?cf=users&expected=3", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete if equals: %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := users.GetJSON("k"); ok {
+		t.Fatal("key was not deleted")
+	}
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/k?cf=missing&if_absent=true", "1"); w.Code != http.StatusNotFound {
+		t.Fatalf("missing family: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRestConditionalTTL(t *testing.T) {
+	nodes := newTestCluster(t, 1, nil)
+	db := nodes[0].db
+	sessions, err := db.CreateColumnFamily("sessions", config.FamilyConfig{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := HttpServer{ctx: nodes[0].raft, db: db}
+
+	// 参数 ttl 指定的过期时间
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/short?if_absent=true&ttl=50ms", "1"); w.Code != http.StatusOK {
+		t.Fatalf("put if absent with ttl: %d %s", w.Code, w.Body.String())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/short?if_absent=true", "2"); w.Code != http.StatusOK {
+		t.Fatalf("put if absent after expiry: %d %s", w.Code, w.Body.String())
+	}
+
+	// 没有指定 ttl 时使用列族的默认过期时间
+	if w := restRequest(t, h, http.MethodPut, "/v1/kv/k?cf=sessions&if_absent=true", "1"); w.Code != http.StatusOK {
+		t.Fatalf("put if absent in sessions: %d %s", w.Code, w.Body.String())
+	}
+	value, _, err := sessions.search("k", db.getVisibleSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires := time.Until(time.Unix(0, value.ExpiresAt)); expires <= 0 || expires > time.Hour {
+		t.Fatalf("expires in %v, want the family ttl", expires)
+	}
+}
+
+func TestRestNotLeaderHTTPAddr(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	_, leader := nodes[0].raft.LeaderWithID()
+	h := HttpServer{ctx: nodes[1].raft, db: nodes[1].db, httpAddrs: map[string]string{string(leader): "10.0.0.1:7001"}}
+	w := restRequest(t, h, http.MethodPut, "/v1/kv/k", "1")
+	var response restError
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("put on follower: %d %s", w.Code, w.Body.String())
+	}
+	if response.LeaderID != string(leader) || response.LeaderAddr != "10.0.0.1:7001" {
+		t.Fatalf("not leader response = %+v", response)
+	}
+
+	// 没有配置 leader 的 http 地址时不返回 raft 地址
+	h.httpAddrs = nil
+	w = restRequest(t, h, http.MethodPut, "/v1/kv/k", "1")
+	response = restError{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.LeaderAddr != "" {
+		t.Fatalf("leader_addr = %q without a configured http address", response.LeaderAddr)
+	}
+}
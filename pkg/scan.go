@@ -0,0 +1,349 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 默认每页返回的记录数
+	defaultScanLimit = 100
+	// 每页最多返回的记录数
+	maxScanLimit = 1000
+	// 游标超过这个时间没有被继续使用就关闭
+	scanCursorTTL = time.Minute
+	// 最多同时保留的游标数，超出时关闭最早过期的游标
+	maxScanCursors = 1024
+	// 每个客户端最多同时保留的游标数，超出时关闭这个客户端最早过期的游标
+	maxScanCursorsPerClient = 16
+)
+
+var (
+	// ErrScanTokenExpired 续页令牌对应的游标已经过期、被关闭或者不存在，需要从头重新遍历
+	ErrScanTokenExpired = errors.New("scan token expired")
+	// ErrInvalidScanToken 续页令牌无法解码
+	ErrInvalidScanToken = errors.New("invalid scan token")
+)
+
+// scanClientKey 在 context 中保存发起分页遍历的客户端
+type scanClientKey struct{}
+
+// withScanClient 记录发起分页遍历的客户端，游标按客户端限制数量
+func withScanClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, scanClientKey{}, client)
+}
+
+// requestClient 请求的客户端地址，不包含端口
+func requestClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ScanOptions 分页遍历的参数，遍历列族 Family 中 [Start, End) 范围内以 Prefix 开头的 key，
+// 空字符串表示不限制，Family 为空表示默认列族，Reverse 为 true 时按 key 降序返回
+type ScanOptions struct {
+	Family  string `json:"f,omitempty"`
+	Start   string `json:"s,omitempty"`
+	End     string `json:"e,omitempty"`
+	Prefix  string `json:"p,omitempty"`
+	Reverse bool   `json:"r,omitempty"`
+}
+
+// scanToken 续页令牌的内容，对客户端不透明
+type scanToken struct {
+	ScanOptions
+	// 保存在服务端的游标编号
+	Cursor uint64 `json:"c"`
+	// 上一页返回的最后一个 key
+	Last string `json:"k"`
+}
+
+// scanCursor 一次分页遍历在服务端保留的迭代器，停在下一页的第一条记录上，
+// 后续的页从同一个迭代器继续读取，所有页看到的都是第一页创建时的数据
+type scanCursor struct {
+	it      *Iterator
+	options ScanOptions
+	last    string
+	// 发起遍历的客户端，为空表示进程内的调用，不按客户端限制
+	client string
+	expire time.Time
+}
+
+// takeScanCursor 取出游标，同一时刻一个游标只能被一个请求使用
+func (d *DB) takeScanCursor(token scanToken) *scanCursor {
+	d.scanCursorLock.Lock()
+	defer d.scanCursorLock.Unlock()
+	d.expireScanCursors(time.Now())
+	cursor, ok := d.scanCursors[token.Cursor]
+	if !ok || cursor.last != token.Last || cursor.options != token.ScanOptions {
+		return nil
+	}
+	delete(d.scanCursors, token.Cursor)
+	return cursor
+}
+
+// putScanCursor 保存游标，返回游标编号
+func (d *DB) putScanCursor(cursor *scanCursor) uint64 {
+	d.scanCursorLock.Lock()
+	defer d.scanCursorLock.Unlock()
+	d.expireScanCursors(time.Now())
+	if cursor.client != "" {
+		for d.countScanCursors(cursor.client) >= maxScanCursorsPerClient {
+			d.closeOldestScanCursor(cursor.client)
+		}
+	}
+	for len(d.scanCursors) >= maxScanCursors {
+		d.closeOldestScanCursor("")
+	}
+	d.nextCursorId++
+	cursor.expire = time.Now().Add(scanCursorTTL)
+	d.scanCursors[d.nextCursorId] = cursor
+	return d.nextCursorId
+}
+
+// countScanCursors 统计客户端保留的游标数，调用方需要持有 scanCursorLock
+func (d *DB) countScanCursors(client string) int {
+	n := 0
+	for _, cursor := range d.scanCursors {
+		if cursor.client == client {
+			n++
+		}
+	}
+	return n
+}
+
+// closeOldestScanCursor 关闭最早过期的游标，client 不为空时只在这个客户端的游标中选，
+// 调用方需要持有 scanCursorLock
+func (d *DB) closeOldestScanCursor(client string) {
+	var oldest uint64
+	for id, c := range d.scanCursors {
+		if client != "" && c.client != client {
+			continue
+		}
+		if oldest == 0 || c.expire.Before(d.scanCursors[oldest].expire) {
+			oldest = id
+		}
+	}
+	if cursor, ok := d.scanCursors[oldest]; ok {
+		_ = cursor.it.Close()
+		delete(d.scanCursors, oldest)
+	}
+}
+
+// expireScanCursors 关闭过期的游标，释放它持有的 SSTable 和 value log
+func (d *DB) expireScanCursors(now time.Time) {
+	for id, cursor := range d.scanCursors {
+		if now.After(cursor.expire) {
+			_ = cursor.it.Close()
+			delete(d.scanCursors, id)
+		}
+	}
+}
+
+// closeScanCursors 关闭数据库时关闭所有游标
+func (d *DB) closeScanCursors() {
+	d.scanCursorLock.Lock()
+	defer d.scanCursorLock.Unlock()
+	for id, cursor := range d.scanCursors {
+		_ = cursor.it.Close()
+		delete(d.scanCursors, id)
+	}
+}
+
+// inScanRange key 是否在 [Start, End) 范围内
+func (options ScanOptions) inScanRange(key string) bool {
+	return (options.Start == "" || key >= options.Start) && (options.End == "" || key < options.End)
+}
+
+// newScanCursor 在列族 cf 上创建游标并定位到第一条记录
+func newScanCursor(cf *ColumnFamily, options ScanOptions) *scanCursor {
+	it := cf.NewPrefixIterator(options.Prefix)
+	switch {
+	case !options.Reverse && options.Start != "":
+		it.Seek(options.Start)
+	case !options.Reverse:
+		it.SeekToFirst()
+	case options.End == "":
+		it.SeekToLast()
+	default:
+		// 定位到第一个大于等于 End 的 key，再退回到小于 End 的 key
+		it.Seek(options.End)
+		if it.Valid() {
+			it.Prev()
+		} else {
+			it.SeekToLast()
+		}
+	}
+	return &scanCursor{
+		it:      it,
+		options: options,
+	}
+}
+
+// ScanPage 读取一页数据，token 为空时从头开始。
+// 返回的 next 不为空表示还有数据，用它读取下一页，所有页看到的都是第一页创建时的数据；
+// next 只能使用一次，超过 scanCursorTTL 没有使用就会过期，过期后返回 ErrScanTokenExpired
+func ScanPage(options ScanOptions, token string, limit int) (result []KeyValue, next string, err error) {
+	db, err := current()
+	if err != nil {
+		return nil, "", err
+	}
+	return db.ScanPage(options, token, limit)
+}
+
+// ScanPageContext 和 ScanPage 相同，读取中 ctx 被取消或超时时停止并返回 ctx.Err()
+func ScanPageContext(ctx context.Context, options ScanOptions, token string, limit int) (result []KeyValue, next string, err error) {
+	db, err := current()
+	if err != nil {
+		return nil, "", err
+	}
+	return db.ScanPageContext(ctx, options, token, limit)
+}
+
+// ScanPage 在数据库中读取一页数据，和包级别的 ScanPage 相同
+func (d *DB) ScanPage(options ScanOptions, token string, limit int) (result []KeyValue, next string, err error) {
+	return d.ScanPageContext(context.Background(), options, token, limit)
+}
+
+// ScanPageContext 在数据库中读取一页数据，ctx 被取消或超时时关闭游标并返回 ctx.Err()，
+// 之后同一个 token 不能再使用。ctx 中记录了客户端时，游标按客户端限制数量
+func (d *DB) ScanPageContext(ctx context.Context, options ScanOptions, token string, limit int) (result []KeyValue, next string, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	var cursor *scanCursor
+	if token != "" {
+		decoded, err := decodeScanToken(token)
+		if err != nil {
+			return nil, "", err
+		}
+		options = decoded.ScanOptions
+		// 游标过期后不能重新创建，新的迭代器看到的数据和之前的页不同
+		if cursor = d.takeScanCursor(decoded); cursor == nil {
+			return nil, "", ErrScanTokenExpired
+		}
+	} else {
+		cf, ok := d.getFamily(familyName(options.Family))
+		if !ok {
+			return nil, "", ErrFamilyNotFound
+		}
+		cursor = newScanCursor(cf, options)
+		cursor.client, _ = ctx.Value(scanClientKey{}).(string)
+	}
+
+	// 读完一页后迭代器多前进一条，停在下一页的第一条记录上，没有更多数据时不返回 next
+	it := cursor.it
+	result = make([]KeyValue, 0)
+	for len(result) < limit && it.Valid() && options.inScanRange(it.Key()) {
+		if err = ctx.Err(); err != nil {
+			_ = it.Close()
+			return nil, "", err
+		}
+		result = append(result, KeyValue{
+			Key:   it.Key(),
+			Value: it.Value(),
+		})
+		if options.Reverse {
+			it.Prev()
+		} else {
+			it.Next()
+		}
+	}
+	if err = it.Err(); err != nil {
+		_ = it.Close()
+		return nil, "", err
+	}
+	if !it.Valid() || !options.inScanRange(it.Key()) {
+		_ = it.Close()
+		return result, "", nil
+	}
+	cursor.last = result[len(result)-1].Key
+	id := d.putScanCursor(cursor)
+	next = encodeScanToken(scanToken{
+		ScanOptions: options,
+		Cursor:      id,
+		Last:        cursor.last,
+	})
+	return result, next, nil
+}
+
+// encodeScanToken 用 gob 编码令牌，key 可以是任意字节，JSON 会替换其中不合法的 UTF-8
+func encodeScanToken(token scanToken) string {
+	var buf bytes.Buffer
+	_ = gob.NewEncoder(&buf).Encode(token)
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+func decodeScanToken(token string) (scanToken, error) {
+	var decoded scanToken
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return decoded, ErrInvalidScanToken
+	}
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		return decoded, ErrInvalidScanToken
+	}
+	return decoded, nil
+}
+
+// Scan 分页遍历接口，参数为 cf、start、end、prefix、limit、reverse 和上一页返回的 token，
+// 返回 JSON 数组，还有下一页时在 X-Next-Token 响应头中返回 token，token 过期时返回 410
+func (h HttpServer) Scan(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	options := ScanOptions{
+		Family: vars.Get("cf"),
+		Start:  vars.Get("start"),
+		End:    vars.Get("end"),
+		Prefix: vars.Get("prefix"),
+	}
+	var err error
+	if reverse := vars.Get("reverse"); reverse != "" {
+		options.Reverse, err = strconv.ParseBool(reverse)
+		if err != nil {
+			http.Error(w, "invalid reverse", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if value := vars.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := withScanClient(r.Context(), requestClient(r))
+	result, next, err := h.db.ScanPageContext(ctx, options, vars.Get("token"), limit)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrScanTokenExpired) {
+			status = http.StatusGone
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if next != "" {
+		w.Header().Set("X-Next-Token", next)
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// scanKeys 按页读取所有数据，返回每页的 key
+func scanKeys(t *testing.T, db *DB, ctx context.Context, options ScanOptions, limit int) [][]string {
+	t.Helper()
+	pages := make([][]string, 0)
+	token := ""
+	for {
+		result, next, err := db.ScanPageContext(ctx, options, token, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := make([]string, 0, len(result))
+		for _, kv := range result {
+			page = append(page, kv.Key)
+		}
+		pages = append(pages, page)
+		if next == "" {
+			return pages
+		}
+		token = next
+	}
+}
+
+func TestScanPages(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 5; i++ {
+		db.Set(fmt.Sprint("key", i), i)
+	}
+	db.Set("other", 1)
+	tests := []struct {
+		name    string
+		options ScanOptions
+		limit   int
+		want    string
+	}{
+		{"forward", ScanOptions{Prefix: "key"}, 2, "[[key0 key1] [key2 key3] [key4]]"},
+		// 最后一页正好 limit 条时不返回 next
+		{"exact", ScanOptions{Prefix: "key", End: "key4"}, 2, "[[key0 key1] [key2 key3]]"},
+		{"reverse", ScanOptions{Prefix: "key", Reverse: true}, 2, "[[key4 key3] [key2 key1] [key0]]"},
+		{"range", ScanOptions{Start: "key1", End: "key3"}, 10, "[[key1 key2]]"},
+		{"empty", ScanOptions{Prefix: "missing"}, 2, "[[]]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := fmt.Sprint(scanKeys(t, db, context.Background(), test.options, test.limit)); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScanPagesSeeFirstPageData(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 4; i++ {
+		db.Set(fmt.Sprint("key", i), i)
+	}
+	result, next, err := db.ScanPage(ScanOptions{}, "", 2)
+	if err != nil || len(result) != 2 || next == "" {
+		t.Fatalf("first page: %v, %q, %v", result, next, err)
+	}
+	db.Set("key2a", 1)
+	db.Delete("key3")
+	result, next, err = db.ScanPage(ScanOptions{}, next, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "" || len(result) != 2 || result[0].Key != "key2" || result[1].Key != "key3" {
+		t.Fatalf("second page: %v, %q", result, next)
+	}
+}
+
+func TestScanTokenExpired(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 4; i++ {
+		db.Set(fmt.Sprint("key", i), i)
+	}
+	_, next, err := db.ScanPage(ScanOptions{}, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = db.ScanPage(ScanOptions{}, next, 1); err != nil {
+		t.Fatal(err)
+	}
+	// 令牌只能使用一次
+	if _, _, err = db.ScanPage(ScanOptions{}, next, 1); !errors.Is(err, ErrScanTokenExpired) {
+		t.Fatalf("reused token: got %v, want ErrScanTokenExpired", err)
+	}
+
+	_, next, err = db.ScanPage(ScanOptions{}, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.scanCursorLock.Lock()
+	for _, cursor := range db.scanCursors {
+		cursor.expire = time.Now().Add(-time.Second)
+	}
+	db.scanCursorLock.Unlock()
+	if _, _, err = db.ScanPage(ScanOptions{}, next, 1); !errors.Is(err, ErrScanTokenExpired) {
+		t.Fatalf("expired token: got %v, want ErrScanTokenExpired", err)
+	}
+	if _, _, err = db.ScanPage(ScanOptions{}, "not a token", 1); !errors.Is(err, ErrInvalidScanToken) {
+		t.Fatalf("invalid token: got %v, want ErrInvalidScanToken", err)
+	}
+}
+
+func TestScanCursorsPerClient(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.Set("a", 1)
+	db.Set("b", 2)
+	first := func(client string) string {
+		_, next, err := db.ScanPageContext(withScanClient(context.Background(), client), ScanOptions{}, "", 1)
+		if err != nil || next == "" {
+			t.Fatalf("first page: %q, %v", next, err)
+		}
+		return next
+	}
+	other := first("10.0.0.2")
+	tokens := make([]string, 0)
+	for i := 0; i <= maxScanCursorsPerClient; i++ {
+		tokens = append(tokens, first("10.0.0.1"))
+	}
+	// 超出数量时关闭这个客户端最早的游标，不影响其它客户端
+	if _, _, err := db.ScanPage(ScanOptions{}, tokens[0], 1); !errors.Is(err, ErrScanTokenExpired) {
+		t.Fatalf("oldest cursor: got %v, want ErrScanTokenExpired", err)
+	}
+	for _, token := range []string{tokens[1], tokens[len(tokens)-1], other} {
+		if _, _, err := db.ScanPage(ScanOptions{}, token, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScanHandlerExpiredToken(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.Set("a", 1)
+	db.Set("b", 2)
+	server := HttpServer{db: db}
+	w := httptest.NewRecorder()
+	server.RestScan(w, httptest.NewRequest(http.MethodGet, "/v1/scan?limit=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first page: %d %s", w.Code, w.Body.String())
+	}
+	db.closeScanCursors()
+	for path, handler := range map[string]http.HandlerFunc{"/v1/scan": server.RestScan, "/scan": server.Scan} {
+		_, next, err := db.ScanPage(ScanOptions{}, "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.closeScanCursors()
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, path+"?token="+next, nil))
+		if w.Code != http.StatusGone {
+			t.Errorf("%s: got %d %s, want 410", path, w.Code, w.Body.String())
+		}
+	}
+}
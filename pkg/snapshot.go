@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Snapshot 数据库在某一时刻的只读视图，之后的写入对快照不可见。
+// 快照存在期间，落盘和压缩会保留快照能看到的旧版本，使用完需要调用 ReleaseSnapshot
+type Snapshot struct {
+	// 快照所在的数据库
+	db       *DB
+	seq      uint64
+	released int32
+}
+
+// GetSnapshot 创建当前时刻的快照
+func GetSnapshot() *Snapshot {
+	db, err := current()
+	if err != nil {
+		return nil
+	}
+	return db.GetSnapshot()
+}
+
+// GetSnapshot 创建数据库当前时刻的快照
+func (d *DB) GetSnapshot() *Snapshot {
+	// 和 value log 回收互斥，回收写入新位置时要么看到这个快照并放弃，要么快照能看到新位置
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.snapshotLock.Lock()
+	defer d.snapshotLock.Unlock()
+
+	seq := d.getVisibleSeq()
+	d.snapshots[seq]++
+	log.Println("Get snapshot", seq)
+	return &Snapshot{db: d, seq: seq}
+}
+
+// ReleaseSnapshot 释放快照，快照能看到的旧版本在之后的压缩中被清理，重复释放没有影响
+func ReleaseSnapshot(snapshot *Snapshot) {
+	if snapshot == nil || !atomic.CompareAndSwapInt32(&snapshot.released, 0, 1) {
+		return
+	}
+	d := snapshot.db
+	d.snapshotLock.Lock()
+	defer d.snapshotLock.Unlock()
+
+	log.Println("Release snapshot", snapshot.seq)
+	d.snapshots[snapshot.seq]--
+	if d.snapshots[snapshot.seq] <= 0 {
+		delete(d.snapshots, snapshot.seq)
+	}
+}
+
+// ReleaseSnapshot 释放数据库的快照，和包级别的 ReleaseSnapshot 相同
+func (d *DB) ReleaseSnapshot(snapshot *Snapshot) {
+	ReleaseSnapshot(snapshot)
+}
+
+// Seq 快照的序列号，快照能看到序列号不大于它的写入
+func (snapshot *Snapshot) Seq() uint64 {
+	return snapshot.seq
+}
+
+// Get 获取快照创建时 key 的值，key 不存在时返回 ErrNotFound
+func (snapshot *Snapshot) Get(key []byte) ([]byte, error) {
+	log.Printf("Get %q at snapshot %d", key, snapshot.seq)
+	return snapshot.db.get(string(key), snapshot.seq)
+}
+
+// GetJSON 获取快照创建时 key 的 JSON 编码的值并解码
+func (snapshot *Snapshot) GetJSON(key string) (interface{}, bool) {
+	log.Print("Get ", key, " at snapshot ", snapshot.seq)
+	return snapshot.db.getAt(key, snapshot.seq)
+}
+
+// NewIterator 创建遍历快照的迭代器
+func (snapshot *Snapshot) NewIterator() *Iterator {
+	return newIterator(snapshot.db.ColumnFamily, "", snapshot.seq)
+}
+
+// NewPrefixIterator 创建遍历快照中以 prefix 开头的 key 的迭代器
+func (snapshot *Snapshot) NewPrefixIterator(prefix string) *Iterator {
+	return newIterator(snapshot.db.ColumnFamily, prefix, snapshot.seq)
+}
+
+// Scan 按 key 升序返回快照中 [start, end) 范围内的记录
+func (snapshot *Snapshot) Scan(start, end string, limit int) []KeyValue {
+	return scan(snapshot.NewIterator(), start, end, limit)
+}
+
+// GetCF 获取快照创建时列族 cf 中 key 的值，key 不存在时返回 ErrNotFound
+func (snapshot *Snapshot) GetCF(cf *ColumnFamily, key []byte) ([]byte, error) {
+	log.Printf("Get %q from %s at snapshot %d", key, cf.name, snapshot.seq)
+	return cf.get(string(key), snapshot.seq)
+}
+
+// NewIteratorCF 创建遍历快照中列族 cf 的迭代器
+func (snapshot *Snapshot) NewIteratorCF(cf *ColumnFamily) *Iterator {
+	return newIterator(cf, "", snapshot.seq)
+}
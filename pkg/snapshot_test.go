@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"errors"
+	"mylsmtree/pkg/config"
+	"testing"
+)
+
+// snapshotDB 在 a=1、b=1 时创建快照，之后把 a 改为 2、删除 b、写入 c=3
+func snapshotDB(t *testing.T) (*DB, *Snapshot) {
+	t.Helper()
+	db := openTestDB(t, nil)
+	set := func(key string, value interface{}) {
+		if err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("a", 1)
+	set("b", 1)
+	snapshot := db.GetSnapshot()
+	set("a", 2)
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	set("c", 3)
+	return db, snapshot
+}
+
+// checkSnapshot 快照中只能看到 a=1、b=1
+func checkSnapshot(t *testing.T, snapshot *Snapshot) {
+	t.Helper()
+	for key, want := range map[string]string{"a": "1", "b": "1"} {
+		if value, err := snapshot.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("snapshot %s = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	if _, err := snapshot.Get([]byte("c")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("snapshot c: got %v, want ErrNotFound", err)
+	}
+	it := snapshot.NewIterator()
+	defer it.Close()
+	it.SeekToFirst()
+	if got := collect(it, true); got != "a=1,b=1" {
+		t.Fatalf("snapshot iterator = %s", got)
+	}
+}
+
+func TestSnapshotReads(t *testing.T) {
+	db, snapshot := snapshotDB(t)
+	defer db.ReleaseSnapshot(snapshot)
+	checkSnapshot(t, snapshot)
+	if got := len(snapshot.Scan("", "", 0)); got != 2 {
+		t.Fatalf("snapshot scan returned %d records, want 2", got)
+	}
+	// 数据库本身看到最新的数据
+	it := db.NewIterator()
+	defer it.Close()
+	it.SeekToFirst()
+	if got := collect(it, true); got != "a=2,c=3" {
+		t.Fatalf("latest = %s", got)
+	}
+}
+
+func TestSnapshotSurvivesFlushAndCompaction(t *testing.T) {
+	db, snapshot := snapshotDB(t)
+	flushTestDB(t, db)
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, snapshot)
+
+	// 释放后旧版本在下一次压缩中被清理
+	seq := snapshot.Seq()
+	db.ReleaseSnapshot(snapshot)
+	db.ReleaseSnapshot(snapshot)
+	if len(db.getSnapshots()) != 0 {
+		t.Fatalf("snapshots after release = %v", db.getSnapshots())
+	}
+	if err := db.Set("d", 4); err != nil {
+		t.Fatal(err)
+	}
+	flushTestDB(t, db)
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.get("a", seq); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("old version of a = %q, %v after the snapshot was released", value, err)
+	}
+	if value, err := db.Get([]byte("a")); err != nil || string(value) != "2" {
+		t.Fatalf("a = %q, %v", value, err)
+	}
+}
+
+func TestSnapshotColumnFamily(t *testing.T) {
+	db := openTestDB(t, nil)
+	users, err := db.CreateColumnFamily("users", config.FamilyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = users.Put([]byte("k"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+	if err = users.Put([]byte("k"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := snapshot.GetCF(users, []byte("k")); err != nil || string(value) != "v1" {
+		t.Fatalf("snapshot users k = %q, %v", value, err)
+	}
+	it := snapshot.NewIteratorCF(users)
+	defer it.Close()
+	it.SeekToFirst()
+	if !it.Valid() || it.Key() != "k" {
+		t.Fatal("snapshot iterator of users is empty")
+	}
+	if value, err := it.ValueBytes(); err != nil || string(value) != "v1" {
+		t.Fatalf("snapshot iterator value = %q, %v", value, err)
+	}
+}
@@ -1,19 +1,27 @@
 package sort_tree
 
 import (
+	"mylsmtree/pkg/iterator"
 	"mylsmtree/pkg/kv"
 	"sync"
 )
 
 type TreeNode struct {
+	// 内部 key，由 KV 的 key 和序列号编码而成
+	Key string
 	KV kv.Value
 	Left *TreeNode
 	Right *TreeNode
 }
 
+// Tree 内存表，同一个 key 的每次写入都是一个新版本，按内部 key 排序
 type Tree struct {
 	root *TreeNode
 	count int
+	// 内存表中最大的序列号
+	maxSeq uint64
+	// 范围删除标记，只遮盖这个内存表和更旧的数据中的版本
+	rangeTombstones []kv.RangeTombstone
 	rwLock *sync.RWMutex
 }
 
@@ -22,10 +30,20 @@ func (tree *Tree) Init() {
 }
 
 func (tree *Tree) GetCount() int {
+	tree.rwLock.RLock()
+	defer tree.rwLock.RUnlock()
 	return tree.count
 }
 
-func (tree *Tree) Search(key string) (kv.Value, kv.SearchResult) {
+// GetMaxSeq 获取内存表中最大的序列号
+func (tree *Tree) GetMaxSeq() uint64 {
+	tree.rwLock.RLock()
+	defer tree.rwLock.RUnlock()
+	return tree.maxSeq
+}
+
+// Search 查找 key 在序列号 seq 时可见的版本，即序列号不大于 seq 的最新版本
+func (tree *Tree) Search(key string, seq uint64) (kv.Value, kv.SearchResult) {
 	tree.rwLock.RLock()
 	defer tree.rwLock.RUnlock()
 
@@ -33,126 +51,117 @@ func (tree *Tree) Search(key string) (kv.Value, kv.SearchResult) {
 		return kv.Value{}, kv.None
 	}
 
+	// 找到第一个大于等于 (key, seq) 的内部 key
+	target := kv.InternalKey(key, seq)
+	var found *TreeNode
 	currentNode := tree.root
 	for currentNode != nil {
-		if key == currentNode.KV.Key {
-			if currentNode.KV.Deleted == false {
-				return currentNode.KV, kv.Success
-			}else {
-				return currentNode.KV, kv.Deleted
-			}
-		}
-		if key < currentNode.KV.Key {
-			currentNode = currentNode.Left;
+		if currentNode.Key >= target {
+			found = currentNode
+			currentNode = currentNode.Left
 		}else{
-			currentNode = currentNode.Right;
+			currentNode = currentNode.Right
 		}
 	}
-	return kv.Value{}, kv.None
+	// 被范围删除标记遮盖时，更旧的数据中的版本也都被遮盖
+	tombstoneSeq := kv.MaxCoveringSeq(tree.rangeTombstones, key, seq)
+	if found == nil || found.KV.Key != key || found.KV.Seq < tombstoneSeq {
+		if tombstoneSeq > 0 {
+			return kv.Value{Key: key, Deleted: true, Seq: tombstoneSeq}, kv.Deleted
+		}
+		return kv.Value{}, kv.None
+	}
+	if found.KV.Deleted {
+		return found.KV, kv.Deleted
+	}
+	return found.KV, kv.Success
+}
+
+func (tree *Tree) Set(key string, value []byte, seq uint64) {
+	tree.SetValue(kv.Value{
+		Key: key,
+		Value: value,
+		Seq: seq,
+	})
+}
+
+func (tree *Tree) Delete(key string, seq uint64) {
+	tree.SetValue(kv.Value{
+		Key: key,
+		Deleted: true,
+		Seq: seq,
+	})
 }
 
-func (tree *Tree) Set(key string, value []byte) (*kv.Value, bool) {
+// SetValue 插入一个版本，例如值已经被分离到 value log 的记录或者删除标记，
+// 序列号相同的版本会被覆盖
+func (tree *Tree) SetValue(value kv.Value) {
 	tree.rwLock.Lock()
 	defer tree.rwLock.Unlock()
 
 	if tree == nil {
-		return &kv.Value{}, false
+		return
 	}
 
-	current := tree.root
-
+	if value.Seq > tree.maxSeq {
+		tree.maxSeq = value.Seq
+	}
+	key := kv.InternalKey(value.Key, value.Seq)
 	newNode := &TreeNode{
-		KV: kv.Value{
-			Key: key,
-			Value: value,
-		},
+		Key: key,
+		KV: value,
 	}
 
+	current := tree.root
 	if current == nil {
 		tree.root = newNode
 		tree.count ++
-		return &kv.Value{}, false
+		return
 	}
 
 	for current != nil {
-		if key == current.KV.Key {
-			oldKV := current.KV.Copy()
-			current.KV.Value = value
-			current.KV.Deleted = false
-			if oldKV.Deleted {
-				return &kv.Value{}, false
-			} else {
-				return oldKV, true
-			}
+		if key == current.Key {
+			current.KV = value
+			return
 		}
-		if key < current.KV.Key {
+		if key < current.Key {
 			if current.Left == nil {
 				current.Left = newNode
 				tree.count ++
-				return &kv.Value{}, false
+				return
 			}
 			current = current.Left
 		}else {
 			if current.Right == nil {
 				current.Right = newNode
 				tree.count ++
-				return &kv.Value{}, false
+				return
 			}
 			current = current.Right
 		}
 	}
-	return &kv.Value{}, false
 }
 
-func (tree *Tree) Delete(key string) (oldValue kv.Value, hasOld bool) {
+// AddRangeTombstone 写入范围删除标记
+func (tree *Tree) AddRangeTombstone(tombstone kv.RangeTombstone) {
 	tree.rwLock.Lock()
 	defer tree.rwLock.Unlock()
 
-	if tree == nil {
-		return kv.Value{}, false
-	}
-
-	newNode := &TreeNode{
-		KV: kv.Value{
-			Key: key,
-			Value: nil,
-			Deleted: true,
-		},
+	if tombstone.Seq > tree.maxSeq {
+		tree.maxSeq = tombstone.Seq
 	}
+	tree.rangeTombstones = append(tree.rangeTombstones, tombstone)
+	tree.count ++
+}
 
-	currentNode := tree.root
-	if currentNode == nil {
-		tree.root = newNode
-		return kv.Value{}, false
-	}
+// GetRangeTombstones 获取内存表中所有的范围删除标记
+func (tree *Tree) GetRangeTombstones() []kv.RangeTombstone {
+	tree.rwLock.RLock()
+	defer tree.rwLock.RUnlock()
 
-	for currentNode != nil {
-		if key == currentNode.KV.Key {
-			if currentNode.KV.Deleted == false {
-				oldKV := currentNode.KV.Copy()
-				currentNode.KV.Value = nil
-				currentNode.KV.Deleted = true
-				tree.count --
-				return *oldKV, true
-			}else {
-				return kv.Value{}, false
-			}
-		}
-		if key < currentNode.KV.Key {
-			if currentNode.Left == nil {
-				currentNode.Left = newNode
-				tree.count++
-			}
-			currentNode = currentNode.Left
-		} else {
-			if currentNode.Right == nil {
-				currentNode.Right = newNode
-				tree.count ++
-			}
-			currentNode = currentNode.Right
-		}
-	}
-	return kv.Value{}, false
+	tombstones := make([]kv.RangeTombstone, len(tree.rangeTombstones))
+	copy(tombstones, tree.rangeTombstones)
+	return tombstones
 }
 
 func (tree *Tree) GetValues() []kv.Value {
@@ -160,7 +169,7 @@ func (tree *Tree) GetValues() []kv.Value {
 	defer tree.rwLock.RUnlock()
 
 	stack := InitStack(tree.count)
-	values := make([]kv.Value, tree.count)
+	values := make([]kv.Value, 0, tree.count)
 
 	currentNode := tree.root
 	for {
@@ -179,6 +188,11 @@ func (tree *Tree) GetValues() []kv.Value {
 	return values
 }
 
+// NewIterator 按内部 key 有序遍历内存表，遍历的是创建时的快照，不受之后写入的影响
+func (tree *Tree) NewIterator() iterator.Iterator {
+	return iterator.NewSliceIterator(tree.GetValues())
+}
+
 func (tree *Tree) Swap() *Tree {
 	tree.rwLock.Lock()
 	defer tree.rwLock.Unlock()
@@ -186,8 +200,12 @@ func (tree *Tree) Swap() *Tree {
 	newTree := &Tree{}
 	newTree.Init()
 	newTree.root = tree.root
+	newTree.count = tree.count
+	newTree.maxSeq = tree.maxSeq
+	newTree.rangeTombstones = tree.rangeTombstones
 	tree.root = nil
 	tree.count = 0
+	tree.rangeTombstones = nil
 	return newTree
 }
 
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+type stallState int
+
+const (
+	stallNone stallState = iota
+	stallSlowdown
+	stallStop
+)
+
+// getStallState 根据 L0 文件数、待压缩数据量、只读内存表数量判断是否需要限流，
+// L0 文件数取所有列族中最多的
+func (d *DB) getStallState() (stallState, string) {
+	con := d.con
+	l0Files := d.getLevel0Files()
+	pending := atomic.LoadInt64(&d.pendingCompactionBytes)
+	immutables := len(d.getImmutables())
+
+	if con.L0StopTrigger > 0 && l0Files >= con.L0StopTrigger {
+		return stallStop, "too many level 0 files"
+	}
+	if con.PendingCompactionStopBytes > 0 && pending >= con.PendingCompactionStopBytes {
+		return stallStop, "too many pending compaction bytes"
+	}
+	if con.ImmutableStopTrigger > 0 && immutables >= con.ImmutableStopTrigger {
+		return stallStop, "too many immutable memtables"
+	}
+	if con.L0SlowdownTrigger > 0 && l0Files >= con.L0SlowdownTrigger {
+		return stallSlowdown, "too many level 0 files"
+	}
+	if con.PendingCompactionSlowdownBytes > 0 && pending >= con.PendingCompactionSlowdownBytes {
+		return stallSlowdown, "too many pending compaction bytes"
+	}
+	if con.ImmutableSlowdownTrigger > 0 && immutables >= con.ImmutableSlowdownTrigger {
+		return stallSlowdown, "too many immutable memtables"
+	}
+	return stallNone, ""
+}
+
+// makeRoomForWrite 写入前检查后台落盘、压缩是否跟得上，
+// 跟不上时延迟或阻塞写入，给后台线程留出时间，数据库关闭或只读时立即返回。
+// 等待期间 ctx 被取消或超时时返回 ctx.Err()
+func (d *DB) makeRoomForWrite(ctx context.Context) error {
+	delayed := false
+	for d.writeError() == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		state, reason := d.getStallState()
+		switch {
+		case state == stallSlowdown && !delayed:
+			// 每次写入最多延迟一次
+			delay := time.Duration(d.con.SlowdownDelay) * time.Millisecond
+			if delay <= 0 {
+				delay = time.Millisecond
+			}
+			d.scheduleBackground()
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+			atomic.AddInt64(&d.slowdownCount, 1)
+			atomic.AddInt64(&d.slowdownDuration, int64(delay))
+			delayed = true
+		case state == stallStop:
+			log.Println("Write stopped:", reason)
+			start := time.Now()
+			stop := d.wakeOnDone(ctx)
+			d.stallCond.L.Lock()
+			for s, _ := d.getStallState(); s == stallStop && d.writeError() == nil && ctx.Err() == nil; s, _ = d.getStallState() {
+				d.scheduleBackground()
+				d.stallCond.Wait()
+			}
+			d.stallCond.L.Unlock()
+			stop()
+			atomic.AddInt64(&d.stopCount, 1)
+			atomic.AddInt64(&d.stopDuration, int64(time.Since(start)))
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// wakeOnDone ctx 被取消时唤醒被阻塞的写入，让等待 ctx 的写入返回，调用返回的函数停止等待
+func (d *DB) wakeOnDone(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.wakeStalledWrites()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// getLevel0Files 所有列族中最多的 L0 文件数
+func (d *DB) getLevel0Files() int {
+	count := 0
+	for _, cf := range d.getFamilies() {
+		if n := cf.TableTree.GetLevelCount(0); n > count {
+			count = n
+		}
+	}
+	return count
+}
+
+// maybeSwitchMemoryTree 有列族的内存表写满时切换为只读内存表，并唤醒后台线程落盘，调用方需要持有 writeLock。
+// 写入已经记录在 wal 中，切换失败时不影响这次写入，数据库进入只读模式
+func (d *DB) maybeSwitchMemoryTree() {
+	if !d.memoryTreeFull() {
+		return
+	}
+	d.setBackgroundError(d.switchMemoryTree())
+	d.scheduleBackground()
+}
@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// holdImmutable 挡住后台落盘并切换出一个只读内存表，调用返回的函数恢复落盘
+func holdImmutable(t *testing.T, db *DB) func() {
+	t.Helper()
+	db.flushLock.Lock()
+	if err := db.Put([]byte("held"), []byte("v")); err != nil {
+		db.flushLock.Unlock()
+		t.Fatal(err)
+	}
+	db.writeLock.Lock()
+	err := db.switchMemoryTree()
+	db.writeLock.Unlock()
+	if err != nil {
+		db.flushLock.Unlock()
+		t.Fatal(err)
+	}
+	return db.flushLock.Unlock
+}
+
+func TestStallSlowdown(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ImmutableSlowdownTrigger = 1
+	opts.SlowdownDelay = 20
+	db := openTestDB(t, opts)
+	release := holdImmutable(t, db)
+	defer release()
+
+	start := time.Now()
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("write took %v, want a delay of at least 20ms", elapsed)
+	}
+	metrics := db.GetMetrics()
+	if metrics.SlowdownCount != 1 || metrics.SlowdownDuration != 20*time.Millisecond || metrics.StopCount != 0 {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+	if metrics.ImmutableMemTables != 1 {
+		t.Fatalf("immutable memtables = %d, want 1", metrics.ImmutableMemTables)
+	}
+}
+
+func TestStallStopUntilFlushed(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ImmutableStopTrigger = 1
+	db := openTestDB(t, opts)
+	release := holdImmutable(t, db)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Put([]byte("k"), []byte("v"))
+	}()
+	select {
+	case err := <-done:
+		release()
+		t.Fatalf("write was not stopped: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 落盘后只读内存表减少，被阻塞的写入继续
+	release()
+	db.scheduleBackground()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still stopped after the memtable was flushed")
+	}
+	metrics := db.GetMetrics()
+	if metrics.StopCount != 1 || metrics.StopDuration < 50*time.Millisecond {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+	if value, err := db.Get([]byte("k")); err != nil || string(value) != "v" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ImmutableSlowdownTrigger = 1
+	db := openTestDB(t, opts)
+	release := holdImmutable(t, db)
+	defer release()
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	HttpServer{db: db}.Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics Metrics
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.SlowdownCount != 1 || metrics.ImmutableMemTables != 1 || metrics.BackgroundError != "" {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+}
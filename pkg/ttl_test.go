@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"context"
+	"mylsmtree/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// expiresAtOf 读取 key 最新版本的过期时间
+func expiresAtOf(t *testing.T, cf *ColumnFamily, key string) int64 {
+	t.Helper()
+	value, _, err := cf.search(key, cf.db.getVisibleSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value.ExpiresAt
+}
+
+func TestSetWithTTLExpires(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.SetWithTTL("short", 1, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("forever", 1)
+	if _, ok := db.GetJSON("short"); !ok {
+		t.Fatal("key expired too early")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := db.GetJSON("short"); ok {
+		t.Fatal("expired key is still visible")
+	}
+	if _, ok := db.GetJSON("forever"); !ok {
+		t.Fatal("key without ttl expired")
+	}
+	if result := db.Scan("", "", 0); len(result) != 1 || result[0].Key != "forever" {
+		t.Fatalf("scan returned %v", result)
+	}
+}
+
+// 默认过期时间在写入时计算一次，回放 wal 不会延长
+func TestDefaultTTLFixedAtWrite(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.TTL = time.Hour
+	opts.SkipFlushOnClose = true
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("k", 1); err != nil {
+		t.Fatal(err)
+	}
+	expires := expiresAtOf(t, db.ColumnFamily, "k")
+	if expires == 0 {
+		t.Fatal("default ttl was not applied")
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := expiresAtOf(t, db.ColumnFamily, "k"); got != expires {
+		t.Fatalf("expiry changed on replay: %d, want %d", got, expires)
+	}
+}
+
+func TestFamilyDefaultTTL(t *testing.T) {
+	db := openTestDB(t, nil)
+	sessions, err := db.CreateColumnFamily("sessions", config.FamilyConfig{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sessions.Set("s", 1); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("k", 1)
+	if expiresAtOf(t, sessions, "s") == 0 {
+		t.Fatal("family ttl was not applied")
+	}
+	if expiresAtOf(t, db.ColumnFamily, "k") != 0 {
+		t.Fatal("family ttl applied to the default family")
+	}
+}
+
+// 集群中默认过期时间由提交日志的节点计算，所有节点相同
+func TestRaftDefaultTTLSameOnReplicas(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TTL = time.Hour
+	nodes := newTestCluster(t, 3, opts)
+	batch := NewWriteBatch()
+	batch.Put("k", 1)
+	if err := nodes[0].db.proposeBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].db.proposeCondition(context.Background(), condRecord{Op: CondPutIfAbsent, Key: "c", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, nodes)
+	for _, key := range []string{"k", "c"} {
+		want := expiresAtOf(t, nodes[0].db.ColumnFamily, key)
+		if want == 0 {
+			t.Fatalf("%s: default ttl was not applied", key)
+		}
+		for i, node := range nodes[1:] {
+			if got := expiresAtOf(t, node.db.ColumnFamily, key); got != want {
+				t.Errorf("%s: node %d expires at %d, leader %d", key, i+1, got, want)
+			}
+		}
+	}
+}
+
+// 旧的条件写入接口同样使用列族的默认过期时间
+func TestConditionHandlerDefaultTTL(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TTL = time.Hour
+	nodes := newTestCluster(t, 2, opts)
+	h := HttpServer{ctx: nodes[0].raft, db: nodes[0].db}
+	w := httptest.NewRecorder()
+	h.PutIfAbsent(w, httptest.NewRequest(http.MethodPost, "/put_if_absent?key=k&value=v", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("put if absent: %d %s", w.Code, w.Body.String())
+	}
+	waitApplied(t, nodes)
+	want := expiresAtOf(t, nodes[0].db.ColumnFamily, "k")
+	if want == 0 {
+		t.Fatal("default ttl was not applied")
+	}
+	if got := expiresAtOf(t, nodes[1].db.ColumnFamily, "k"); got != want {
+		t.Fatalf("follower expires at %d, leader %d", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"mylsmtree/pkg/kv"
+	"time"
+)
+
+var (
+	// ErrTxnConflict 事务读取过的 key 在提交前被其他写入修改
+	ErrTxnConflict = errors.New("transaction conflict")
+	// ErrTxnDone 事务已经提交或放弃
+	ErrTxnDone = errors.New("transaction already committed or discarded")
+)
+
+// Txn 乐观事务，读取事务开始时的快照并记录每个读过的 key 读到的版本，写入先缓存在事务中，
+// 提交时如果读过的 key 的当前版本和读到的不同，提交失败并返回 ErrTxnConflict。
+// 集群模式下提交作为一条 raft 日志复制到所有节点，由每个节点在应用日志时检查冲突，
+// 版本是写入它的 raft 日志编号，每个节点上相同，检查的结果也相同。
+// Txn 不能在多个 goroutine 中同时使用
+type Txn struct {
+	db       *DB
+	snapshot *Snapshot
+	// 读过的 key 和读到的版本，key 不存在时为 0
+	reads map[string]uint64
+	batch *WriteBatch
+	// 事务中每个 key 最后一次写入，用于读到自己的写入
+	writes map[string]BatchOp
+	done   bool
+}
+
+// txnRecord 写入 raft 日志的事务
+type txnRecord struct {
+	Reads map[string]uint64 `json:"reads"`
+	Ops   []BatchOp         `json:"ops"`
+	// 提交日志的节点的时间，Unix 纳秒时间戳，应用日志时按它判断读过的 key 是否过期
+	Time int64 `json:"time,omitempty"`
+}
+
+// txnRecordJSON txnRecord 的 JSON 形式，不是合法 UTF-8 的 key 用 base64 编码后放在 BinaryReads 中
+type txnRecordJSON struct {
+	Reads       map[string]uint64 `json:"reads"`
+	BinaryReads map[string]uint64 `json:"binary_reads,omitempty"`
+	Ops         []BatchOp         `json:"ops"`
+	Time        int64             `json:"time,omitempty"`
+}
+
+func (record txnRecord) MarshalJSON() ([]byte, error) {
+	encoded := txnRecordJSON{Reads: make(map[string]uint64, len(record.Reads)), Ops: record.Ops, Time: record.Time}
+	for key, seq := range record.Reads {
+		if _, binary := kv.SplitBinary(key); binary != nil {
+			if encoded.BinaryReads == nil {
+				encoded.BinaryReads = make(map[string]uint64)
+			}
+			encoded.BinaryReads[base64.StdEncoding.EncodeToString(binary)] = seq
+		} else {
+			encoded.Reads[key] = seq
+		}
+	}
+	return json.Marshal(encoded)
+}
+
+func (record *txnRecord) UnmarshalJSON(data []byte) error {
+	var encoded txnRecordJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	record.Reads = encoded.Reads
+	if record.Reads == nil {
+		record.Reads = make(map[string]uint64)
+	}
+	record.Ops = encoded.Ops
+	record.Time = encoded.Time
+	for key, seq := range encoded.BinaryReads {
+		binary, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return err
+		}
+		record.Reads[string(binary)] = seq
+	}
+	return nil
+}
+
+// BeginTxn 开始一个事务，使用完需要调用 Commit 或 Discard
+func BeginTxn() *Txn {
+	db, err := current()
+	if err != nil {
+		return &Txn{batch: NewWriteBatch(), writes: make(map[string]BatchOp), done: true}
+	}
+	return db.BeginTxn()
+}
+
+// BeginTxn 在数据库上开始一个事务，使用完需要调用 Commit 或 Discard
+func (d *DB) BeginTxn() *Txn {
+	return &Txn{
+		db:       d,
+		snapshot: d.GetSnapshot(),
+		reads:    make(map[string]uint64),
+		batch:    NewWriteBatch(),
+		writes:   make(map[string]BatchOp),
+	}
+}
+
+// Get 获取 key 的值，优先返回事务中自己的写入，否则返回事务开始时的值并记录到读集合
+func (txn *Txn) Get(key string) (interface{}, bool) {
+	var nilV interface{}
+	if txn.done {
+		return nilV, false
+	}
+	if op, ok := txn.writes[key]; ok {
+		if op.Op == BatchDelete {
+			return nilV, false
+		}
+		return getInstance(op.Value)
+	}
+
+	if txn.db.isClosed() {
+		return nilV, false
+	}
+	txn.db.ValueLog.Acquire()
+	defer txn.db.ValueLog.Release()
+	value, result, err := txn.db.lookup(key, txn.snapshot.seq)
+	if err != nil {
+		log.Println(err)
+		return nilV, false
+	}
+	if result != kv.Success {
+		txn.reads[key] = 0
+		return nilV, false
+	}
+	txn.reads[key] = versionOf(value)
+	data, err := txn.db.resolveValue(value)
+	if err != nil {
+		log.Println(err)
+		return nilV, false
+	}
+	return getInstance(data)
+}
+
+// Put 在事务中写入 key
+func (txn *Txn) Put(key string, value interface{}) {
+	n := txn.batch.Len()
+	txn.batch.Put(key, value)
+	// 值编码失败时没有追加操作，错误在提交时返回
+	if txn.batch.Len() > n {
+		txn.writes[key] = txn.batch.ops[n]
+	}
+}
+
+// Delete 在事务中删除 key
+func (txn *Txn) Delete(key string) {
+	txn.batch.Delete(key)
+	txn.writes[key] = txn.batch.ops[txn.batch.Len()-1]
+}
+
+// Commit 提交事务，读过的 key 被修改时返回 ErrTxnConflict，事务中的写入都不会生效。
+// 无论成功与否，提交后事务都不能再使用
+func (txn *Txn) Commit() error {
+	return txn.CommitContext(context.Background())
+}
+
+// CommitContext 和 Commit 相同，ctx 被取消或超时时返回 ctx.Err()，
+// 集群模式下 raft 提交的超时时间取 ctx 的截止时间，返回 ctx.Err() 时事务仍然可能已经提交
+func (txn *Txn) CommitContext(ctx context.Context) error {
+	if txn.db == nil {
+		// 开始事务时数据库没有打开
+		return ErrClosed
+	}
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.Discard()
+	if txn.batch.err != nil {
+		return txn.batch.err
+	}
+	if txn.batch.Len() == 0 {
+		return nil
+	}
+
+	batch := txn.db.withDefaultTTL(txn.batch)
+	if txn.db.raft != nil {
+		data, err := json.Marshal(txnRecord{Reads: txn.reads, Ops: batch.ops, Time: time.Now().UnixNano()})
+		if err != nil {
+			return err
+		}
+		response, err := txn.db.propose(ctx, append([]byte("txn,"), data...))
+		if err != nil {
+			return err
+		}
+		if err, ok := response.(error); ok && err != nil {
+			return err
+		}
+		return nil
+	}
+	return txn.db.commitTxn(ctx, txn.reads, batch, 0, time.Now())
+}
+
+// Discard 放弃事务，释放事务持有的快照，重复调用没有影响
+func (txn *Txn) Discard() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	ReleaseSnapshot(txn.snapshot)
+}
+
+// versionOf 返回记录的版本，通过 raft 写入的记录是写入它的 raft 日志编号，否则是本地的序列号
+func versionOf(value kv.Value) uint64 {
+	if value.Version != 0 {
+		return value.Version
+	}
+	return value.Seq
+}
+
+// commitTxn 检查读集合中的 key 的当前版本和读到的相同，再写入事务，raftIndex 为对应的 raft 日志编号，
+// now 为提交事务的时间，按它判断 key 是否过期
+func (d *DB) commitTxn(ctx context.Context, reads map[string]uint64, batch *WriteBatch, raftIndex uint64, now time.Time) error {
+	return d.writeBatchIf(ctx, batch, raftIndex, func() error {
+		// 持有 writeLock，此时可见的就是每个 key 最新的版本。
+		// 不存在、已经删除或过期的 key 版本为 0，压缩清理删除标记后结果不变；
+		// 合并操作数的版本就是合并后的值的版本，不需要合并操作数或读取 value log
+		seq := d.getVisibleSeq()
+		for key, readVersion := range reads {
+			value, result, err := d.search(key, seq)
+			if err != nil {
+				return err
+			}
+			var version uint64
+			if result == kv.Success && (value.Merge || !value.Expired(now)) {
+				version = versionOf(value)
+			}
+			if version != readVersion {
+				log.Println("Transaction conflict on", key)
+				return ErrTxnConflict
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.Set("a", 1)
+	txn := db.BeginTxn()
+	value, ok := txn.Get("a")
+	if !ok || value != float64(1) {
+		t.Fatalf("a = %v, %v", value, ok)
+	}
+	txn.Put("a", 2)
+	txn.Put("b", 3)
+	// 读到自己的写入
+	if value, ok = txn.Get("a"); !ok || value != float64(2) {
+		t.Fatalf("a in txn = %v, %v", value, ok)
+	}
+	// 提交前其他读取看不到事务中的写入
+	if _, ok = db.GetJSON("b"); ok {
+		t.Fatal("uncommitted write is visible")
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok = db.GetJSON("a"); !ok || value != float64(2) {
+		t.Fatalf("a = %v, %v", value, ok)
+	}
+	if err := txn.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("second commit: got %v, want ErrTxnDone", err)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(db *DB)
+		write func(db *DB)
+	}{
+		{"overwritten", func(db *DB) { db.Set("a", 1) }, func(db *DB) { db.Set("a", 2) }},
+		{"deleted", func(db *DB) { db.Set("a", 1) }, func(db *DB) { db.Delete("a") }},
+		{"created", func(db *DB) {}, func(db *DB) { db.Set("a", 1) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t, nil)
+			test.setup(db)
+			txn := db.BeginTxn()
+			txn.Get("a")
+			txn.Put("b", 1)
+			test.write(db)
+			if err := txn.Commit(); !errors.Is(err, ErrTxnConflict) {
+				t.Fatalf("got %v, want ErrTxnConflict", err)
+			}
+			if _, ok := db.GetJSON("b"); ok {
+				t.Fatal("write of a conflicting transaction is visible")
+			}
+		})
+	}
+}
+
+func TestTxnUnrelatedWriteDoesNotConflict(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.Set("a", 1)
+	txn := db.BeginTxn()
+	txn.Get("a")
+	txn.Get("missing")
+	txn.Put("a", 2)
+	db.Set("b", 1)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxnRecordRoundTrip(t *testing.T) {
+	record := txnRecord{
+		Reads: map[string]uint64{"a": 3, string([]byte{0xff}): 5},
+		Ops:   []BatchOp{{Op: BatchPut, Key: "a", Value: []byte("1")}},
+		Time:  42,
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded txnRecord
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Time != 42 || len(decoded.Ops) != 1 || len(decoded.Reads) != 2 ||
+		decoded.Reads["a"] != 3 || decoded.Reads[string([]byte{0xff})] != 5 {
+		t.Fatalf("got %+v", decoded)
+	}
+}
+
+func TestRaftTxnSameOnReplicas(t *testing.T) {
+	nodes := newTestCluster(t, 3, nil)
+	leader := nodes[0].db
+	// 只在一个 follower 上写入，让它的本地序列号比其他节点大
+	local := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		local.Put(fmt.Sprint("local", i), i)
+	}
+	if err := nodes[1].db.writeBatch(context.Background(), local, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, nodes)
+
+	txn := leader.BeginTxn()
+	txn.Get("a")
+	txn.Put("a", 2)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, nodes)
+	for i, node := range nodes {
+		if value, ok := node.db.GetJSON("a"); !ok || value != float64(2) {
+			t.Errorf("node %d: a = %v, %v", i, value, ok)
+		}
+	}
+	// 读过的 key 被修改，所有节点都放弃这个事务
+	conflicting := leader.BeginTxn()
+	conflicting.Get("a")
+	conflicting.Put("b", 1)
+	if err := leader.Set("a", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := conflicting.Commit(); !errors.Is(err, ErrTxnConflict) {
+		t.Fatalf("got %v, want ErrTxnConflict", err)
+	}
+	waitApplied(t, nodes)
+	for i, node := range nodes {
+		if value, ok := node.db.GetJSON("a"); !ok || value != float64(3) {
+			t.Errorf("node %d: a = %v, %v", i, value, ok)
+		}
+		if _, ok := node.db.GetJSON("b"); ok {
+			t.Errorf("node %d: write of a conflicting transaction is visible", i)
+		}
+	}
+}
+
+func TestRaftWriteOnFollower(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+	if err := nodes[1].db.Set("a", 1); !notLeader(err) {
+		t.Fatalf("got %v, want a not-leader error", err)
+	}
+	if err := nodes[0].db.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, nodes)
+	if value, ok := nodes[1].db.GetJSON("a"); !ok || value != float64(1) {
+		t.Fatalf("a = %v, %v", value, ok)
+	}
+}
+
+func TestSnapshotRestoreKeepsVersion(t *testing.T) {
+	source := openTestDB(t, nil)
+	batch := NewWriteBatch()
+	batch.Put("a", 1)
+	if err := source.writeBatch(context.Background(), batch, 7); err != nil {
+		t.Fatal(err)
+	}
+	batch = NewWriteBatch()
+	batch.Put("b", 1)
+	if err := source.writeBatch(context.Background(), batch, 9); err != nil {
+		t.Fatal(err)
+	}
+	data := persistSnapshot(t, source)
+
+	target := openTestDB(t, nil)
+	if err := (raftEngine{db: target}).Restore(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]uint64{"a": 7, "b": 9} {
+		value, _, err := target.search(key, target.getVisibleSeq())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.Version != want {
+			t.Errorf("%s: version %d, want %d", key, value.Version, want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"log"
+	"mylsmtree/pkg/kv"
+	"mylsmtree/pkg/wal"
+	"time"
+)
+
+// resolveValue 获取记录的值，值被分离到 value log 时从 value log 中读取，
+// 调用方需要在查找记录前 Acquire value log
+func (cf *ColumnFamily) resolveValue(value kv.Value) ([]byte, error) {
+	if value.Pointer == nil {
+		return value.Value, nil
+	}
+	return cf.ValueLog.Read(*value.Pointer)
+}
+
+// liveVersion 判断 value log 中的记录是否仍然被读取用到：在最新的序列号或者任意一个快照的序列号上，
+// 记录是 key 可见的版本，或者是可见的值合并时用到的操作数或旧值。最新的值用到它时返回 key 当前的值，
+// 合并得到的值没有指针。movable 表示记录可以搬迁，快照用到的和最新的值是同一个版本；
+// 只有快照用到的旧版本不能搬迁，沿用旧的序列号写入内存表后会遮盖 SSTable 中更新的版本。
+// 查找失败时返回错误，不能把记录当作已经失效
+func (cf *ColumnFamily) liveVersion(key string, ptr kv.ValuePointer) (current kv.Value, live, movable bool, err error) {
+	now := time.Now()
+	current, live, err = cf.liveVersionAt(key, ptr, cf.db.getVisibleSeq(), now)
+	if err != nil {
+		return kv.Value{}, false, false, err
+	}
+	movable = live
+	for _, seq := range cf.db.getSnapshots() {
+		value, used, err := cf.liveVersionAt(key, ptr, seq, now)
+		if err != nil {
+			return kv.Value{}, false, false, err
+		}
+		if used {
+			movable = movable && value.Seq == current.Seq
+			live = true
+		}
+	}
+	return current, live, movable, nil
+}
+
+// liveVersionAt 判断记录在序列号 seq 上是否被读取用到，是的话返回 key 在 seq 时的值
+func (cf *ColumnFamily) liveVersionAt(key string, ptr kv.ValuePointer, seq uint64, now time.Time) (kv.Value, bool, error) {
+	value, result, err := cf.search(key, seq)
+	for ; err == nil && result == kv.Success; value, result, err = cf.search(key, value.Seq-1) {
+		if value.Pointer != nil && *value.Pointer == ptr && (value.Merge || !value.Expired(now)) {
+			current, result, err := cf.lookupAt(key, seq, now)
+			return current, result == kv.Success, err
+		}
+		if !value.Merge || value.Seq == 0 {
+			break
+		}
+	}
+	return kv.Value{}, false, err
+}
+
+// valueLogGC 依次回收每个列族的 value log，返回第一个失败的回收的错误
+func (d *DB) valueLogGC() error {
+	ratio := d.con.ValueLogGCRatio
+	if ratio <= 0 {
+		return nil
+	}
+	for _, cf := range d.getFamilies() {
+		cf.bgLock.Lock()
+		var err error
+		if !cf.isDropped() {
+			err = cf.valueLogGC(ratio)
+		}
+		cf.bgLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueLogGC 回收列族的 value log，失效数据占比超过 ratio 的文件，
+// 将其中仍然有效的值搬到当前写入的文件中，重新写入指针后删除旧文件
+func (cf *ColumnFamily) valueLogGC(ratio float64) error {
+	for _, fid := range cf.ValueLog.Files() {
+		type liveValue struct {
+			key   string
+			ptr   kv.ValuePointer
+			value []byte
+		}
+		var total, garbage int64
+		var searchErr error
+		// 文件中有只被快照用到的旧版本，等快照释放后再回收
+		pinned := false
+		lives := make([]liveValue, 0)
+		err := cf.ValueLog.Iterate(fid, func(key string, ptr kv.ValuePointer, value []byte) {
+			if searchErr != nil {
+				return
+			}
+			total += ptr.Len
+			_, live, movable, err := cf.liveVersion(key, ptr)
+			if err != nil {
+				searchErr = err
+			} else if live && !movable {
+				pinned = true
+			} else if live {
+				lives = append(lives, liveValue{key: key, ptr: ptr, value: value})
+			} else {
+				garbage += ptr.Len
+			}
+		})
+		if searchErr != nil {
+			return searchErr
+		}
+		if err != nil {
+			// 文件中的记录读不出来，说明 value log 已经损坏，不能继续回收
+			log.Println("failure to read the value log", fid, err)
+			return err
+		}
+		if total == 0 || float64(garbage)/float64(total) < ratio {
+			continue
+		}
+		if pinned {
+			log.Println("Value log", fid, "is still used by snapshots")
+			continue
+		}
+		log.Printf("Value log %d garbage ratio %.2f, relocating %d values\r\n", fid, float64(garbage)/float64(total), len(lives))
+
+		// 先把有效的值写入新文件并落盘，再写入指向新位置的记录
+		newPtrs := make([]kv.ValuePointer, len(lives))
+		for i, live := range lives {
+			if newPtrs[i], err = cf.ValueLog.Write(live.key, live.value); err != nil {
+				return err
+			}
+		}
+		if err = cf.ValueLog.Sync(); err != nil {
+			return err
+		}
+
+		cf.db.writeLock.Lock()
+		if err = cf.db.writeError(); err != nil {
+			cf.db.writeLock.Unlock()
+			return err
+		}
+		// 新的记录沿用当前版本的序列号和版本，内容相同，只是换了位置，
+		// 快照、事务的冲突检查看到的和搬迁前一样。序列号相同时新写入的记录覆盖旧的记录
+		values := make([]kv.Value, 0, len(lives))
+		for i, live := range lives {
+			// 搬迁期间 key 可能被重新写入、删除或过期，这时新位置上的值直接作废
+			current, ok, movable, err := cf.liveVersion(live.key, live.ptr)
+			if err != nil {
+				cf.db.writeLock.Unlock()
+				return err
+			}
+			if ok && !movable {
+				// 搬迁期间创建的快照用到了旧版本，放弃回收这个文件，新位置上的值作废
+				pinned = true
+				break
+			}
+			if !ok {
+				continue
+			}
+			value := kv.Value{
+				Key:       live.key,
+				Pointer:   &newPtrs[i],
+				Seq:       current.Seq,
+				ExpiresAt: current.ExpiresAt,
+				Version:   current.Version,
+			}
+			if current.Pointer == nil {
+				// 记录是合并时用到的操作数或旧值，直接写入合并后的值，新位置上的值作废
+				value.Pointer = nil
+				value.Value = current.Value
+			}
+			values = append(values, value)
+		}
+		if pinned {
+			cf.db.writeLock.Unlock()
+			log.Println("Value log", fid, "is still used by snapshots")
+			continue
+		}
+		if len(values) > 0 {
+			if err = cf.db.Wal.WriteBatch(0, map[string]*wal.FamilyBatch{cf.name: {Values: values}}); err != nil {
+				cf.db.writeLock.Unlock()
+				return err
+			}
+			for _, value := range values {
+				cf.MemoryTree.SetValue(value)
+			}
+		}
+		cf.db.maybeSwitchMemoryTree()
+		cf.db.writeLock.Unlock()
+
+		// 指向新位置的记录落盘后才能删除旧文件，否则崩溃后从 wal 回放的还是指向旧文件的指针。
+		// wal 切换时会同步归档的文件，记录不在当前的 wal 中时也已经落盘
+		if len(values) > 0 {
+			if err = cf.db.Wal.SyncLog(); err != nil {
+				return err
+			}
+		}
+		if err = cf.ValueLog.Remove(fid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
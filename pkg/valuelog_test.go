@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// valueLogOptions 值大于 10 字节时分离到 value log，文件很小，方便产生多个文件
+func valueLogOptions() *Options {
+	opts := DefaultOptions()
+	opts.ValueThreshold = 10
+	opts.ValueLogFileSize = 1024
+	opts.ValueLogGCRatio = 0.5
+	return opts
+}
+
+// flushTestDB 切换内存表并把所有只读内存表落盘
+func flushTestDB(t *testing.T, db *DB) {
+	t.Helper()
+	db.writeLock.Lock()
+	err := db.rotateMemoryTree(true)
+	db.writeLock.Unlock()
+	if err == nil {
+		err = db.flushImmutables()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bigValue 会被分离到 value log 的值
+func bigValue(i int) string {
+	return fmt.Sprint(i, strings.Repeat("x", 200))
+}
+
+func TestValueLogGC(t *testing.T) {
+	dir := t.TempDir()
+	opts := valueLogOptions()
+	// 关闭时不落盘，重启后从 wal 回放搬迁的记录
+	opts.SkipFlushOnClose = true
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Set(fmt.Sprint("key", i), bigValue(i))
+	}
+	flushTestDB(t, db)
+	oldFiles := db.ValueLog.Files()
+	if len(oldFiles) == 0 {
+		t.Fatal("no value log file to collect")
+	}
+	// 覆盖大部分 key，旧文件中大部分值失效
+	for i := 0; i < 8; i++ {
+		db.Set(fmt.Sprint("key", i), i)
+	}
+	flushTestDB(t, db)
+	before := make(map[string]uint64)
+	for i := 8; i < 10; i++ {
+		key := fmt.Sprint("key", i)
+		value, _, err := db.search(key, db.getVisibleSeq())
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[key] = value.Seq
+	}
+
+	if err = db.valueLogGC(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fid := range db.ValueLog.Files() {
+		if fid == oldFiles[0] {
+			t.Fatalf("value log file %d was not collected", fid)
+		}
+	}
+	for key, seq := range before {
+		value, _, err := db.search(key, db.getVisibleSeq())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.Seq != seq {
+			t.Errorf("%s: seq %d after relocation, want %d", key, value.Seq, seq)
+		}
+	}
+
+	// 重启后从 wal 回放的是指向新位置的记录
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		want := interface{}(float64(i))
+		if i >= 8 {
+			want = bigValue(i)
+		}
+		if value, ok := db.GetJSON(fmt.Sprint("key", i)); !ok || value != want {
+			t.Errorf("key%d = %v, %v", i, value, ok)
+		}
+	}
+}
+
+// hasValueLogFile 列族的 value log 中是否还有编号为 fid 的文件
+func hasValueLogFile(db *DB, fid uint32) bool {
+	for _, f := range db.ValueLog.Files() {
+		if f == fid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValueLogGCKeepsSnapshotVersions(t *testing.T) {
+	db := openTestDB(t, valueLogOptions())
+	for i := 0; i < 10; i++ {
+		db.Set(fmt.Sprint("key", i), bigValue(i))
+	}
+	flushTestDB(t, db)
+	fid := db.ValueLog.Files()[0]
+	snapshot := db.GetSnapshot()
+	for i := 0; i < 10; i++ {
+		db.Set(fmt.Sprint("key", i), i)
+	}
+	flushTestDB(t, db)
+
+	// 快照还会读取旧版本，文件不能回收
+	if err := db.valueLogGC(); err != nil {
+		t.Fatal(err)
+	}
+	if !hasValueLogFile(db, fid) {
+		t.Fatal("value log file used by a snapshot was collected")
+	}
+	if value, ok := snapshot.GetJSON("key0"); !ok || value != bigValue(0) {
+		t.Fatalf("snapshot read key0 = %v, %v", value, ok)
+	}
+
+	db.ReleaseSnapshot(snapshot)
+	if err := db.valueLogGC(); err != nil {
+		t.Fatal(err)
+	}
+	if hasValueLogFile(db, fid) {
+		t.Fatal("value log file was not collected after the snapshot was released")
+	}
+}
+
+func TestValueLogGCWithNewerSnapshot(t *testing.T) {
+	db := openTestDB(t, valueLogOptions())
+	for i := 0; i < 10; i++ {
+		db.Set(fmt.Sprint("key", i), bigValue(i))
+	}
+	flushTestDB(t, db)
+	fid := db.ValueLog.Files()[0]
+	for i := 0; i < 8; i++ {
+		db.Set(fmt.Sprint("key", i), i)
+	}
+	flushTestDB(t, db)
+
+	// 快照只看到最新的值，不妨碍回收，搬迁后快照仍然读到原来的值
+	snapshot := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+	if err := db.valueLogGC(); err != nil {
+		t.Fatal(err)
+	}
+	if hasValueLogFile(db, fid) {
+		t.Fatal("value log file was not collected while a snapshot exists")
+	}
+	for i := 0; i < 10; i++ {
+		want := interface{}(float64(i))
+		if i >= 8 {
+			want = bigValue(i)
+		}
+		if value, ok := snapshot.GetJSON(fmt.Sprint("key", i)); !ok || value != want {
+			t.Errorf("snapshot read key%d = %v, %v", i, value, ok)
+		}
+	}
+}
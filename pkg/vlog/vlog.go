@@ -0,0 +1,264 @@
+package vlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mylsmtree/pkg/kv"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ValueLog 只追加写入的 value log，较大的值在内存表落盘时写入这里，
+// SSTable 中只保存 kv.ValuePointer，压缩时不需要再搬动这些值。
+// 每条记录和 wal 一样，由 8 字节长度和 json 编码的 kv.Value 组成
+type ValueLog struct {
+	dir string
+	// 单个文件的最大字节数，超过后切换到新文件
+	maxFileSize int64
+	files       map[uint32]*os.File
+	activeFid   uint32
+	activeSize  int64
+	// 正在读取的调用方数量，大于 0 时回收的文件延迟到全部读取结束后再删除
+	readers int
+	pending []uint32
+	lock    sync.Locker
+}
+
+func (vl *ValueLog) Init(dir string, maxFileSize int64) error {
+	log.Println("loading value log")
+	vl.dir = dir
+	vl.maxFileSize = maxFileSize
+	vl.files = make(map[uint32]*os.File)
+	vl.lock = &sync.Mutex{}
+
+	matches, err := filepath.Glob(path.Join(dir, "*.vlog"))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		var fid uint32
+		if _, err := fmt.Sscanf(filepath.Base(match), "%d.vlog", &fid); err != nil {
+			continue
+		}
+		f, err := os.OpenFile(match, os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			return kv.IOError("open", match, err)
+		}
+		vl.files[fid] = f
+		if fid >= vl.activeFid {
+			vl.activeFid = fid
+		}
+	}
+	if f, ok := vl.files[vl.activeFid]; ok {
+		info, err := f.Stat()
+		if err != nil {
+			return kv.IOError("stat", f.Name(), err)
+		}
+		vl.activeSize = info.Size()
+		return nil
+	}
+	return vl.openActive(vl.activeFid)
+}
+
+func (vl *ValueLog) filePath(fid uint32) string {
+	return path.Join(vl.dir, fmt.Sprintf("%d.vlog", fid))
+}
+
+func (vl *ValueLog) openActive(fid uint32) error {
+	f, err := os.OpenFile(vl.filePath(fid), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return kv.IOError("open", vl.filePath(fid), err)
+	}
+	vl.files[fid] = f
+	vl.activeFid = fid
+	vl.activeSize = 0
+	return nil
+}
+
+// Write 追加一条记录，返回记录的位置
+func (vl *ValueLog) Write(key string, value []byte) (kv.ValuePointer, error) {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+
+	if vl.maxFileSize > 0 && vl.activeSize >= vl.maxFileSize {
+		log.Println("rotate value log file", vl.activeFid)
+		if err := vl.openActive(vl.activeFid + 1); err != nil {
+			return kv.ValuePointer{}, err
+		}
+	}
+
+	data, _ := json.Marshal(kv.Value{
+		Key:   key,
+		Value: value,
+	})
+	f := vl.files[vl.activeFid]
+	buf := make([]byte, 8+len(data))
+	binary.LittleEndian.PutUint64(buf, uint64(len(data)))
+	copy(buf[8:], data)
+	n, err := f.Write(buf)
+	if err != nil {
+		// 不完整的记录不会被引用，但要计入文件大小，后续记录的位置才正确
+		vl.activeSize += int64(n)
+		return kv.ValuePointer{}, kv.IOError("write", f.Name(), err)
+	}
+	ptr := kv.ValuePointer{
+		Fid:    vl.activeFid,
+		Offset: vl.activeSize + 8,
+		Len:    int64(len(data)),
+	}
+	vl.activeSize += 8 + int64(len(data))
+	return ptr, nil
+}
+
+// Sync 将当前文件刷到磁盘，引用这些记录的 SSTable 或 wal 写入前需要调用
+func (vl *ValueLog) Sync() error {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+
+	f := vl.files[vl.activeFid]
+	return kv.IOError("sync", f.Name(), f.Sync())
+}
+
+// Read 读取指针指向的值
+func (vl *ValueLog) Read(ptr kv.ValuePointer) ([]byte, error) {
+	vl.lock.Lock()
+	f, ok := vl.files[ptr.Fid]
+	vl.lock.Unlock()
+	if !ok {
+		return nil, kv.CorruptionError("read", vl.filePath(ptr.Fid), errors.New("value log file does not exist"))
+	}
+
+	data := make([]byte, ptr.Len)
+	if _, err := f.ReadAt(data, ptr.Offset); err != nil {
+		return nil, kv.IOError("read", f.Name(), err)
+	}
+	value, err := kv.Decode(data)
+	if err != nil {
+		return nil, kv.CorruptionError("decode", f.Name(), err)
+	}
+	return value.Value, nil
+}
+
+// Acquire 和 Release 包住一次完整的查找和读取，保证期间查到的指针不会被回收删除
+func (vl *ValueLog) Acquire() {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+	vl.readers++
+}
+
+func (vl *ValueLog) Release() {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+	vl.readers--
+	if vl.readers == 0 {
+		// 延迟删除失败只留下一个多余的文件，不影响读写
+		for _, fid := range vl.pending {
+			if err := vl.removeFile(fid); err != nil {
+				log.Println("failed to remove value log file:", err)
+			}
+		}
+		vl.pending = nil
+	}
+}
+
+// Close 关闭所有文件，返回遇到的第一个错误
+func (vl *ValueLog) Close() error {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+
+	var firstErr error
+	for fid, f := range vl.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = kv.IOError("close", f.Name(), err)
+		}
+		delete(vl.files, fid)
+	}
+	return firstErr
+}
+
+// Files 获取除当前写入文件外的所有文件，按从旧到新排列
+func (vl *ValueLog) Files() []uint32 {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+
+	fids := make([]uint32, 0, len(vl.files))
+	for fid := range vl.files {
+		if fid != vl.activeFid && !vl.isPending(fid) {
+			fids = append(fids, fid)
+		}
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	return fids
+}
+
+func (vl *ValueLog) isPending(fid uint32) bool {
+	for _, pending := range vl.pending {
+		if pending == fid {
+			return true
+		}
+	}
+	return false
+}
+
+// Iterate 按顺序遍历文件中的所有记录
+func (vl *ValueLog) Iterate(fid uint32, fn func(key string, ptr kv.ValuePointer, value []byte)) error {
+	data, err := ioutil.ReadFile(vl.filePath(fid))
+	if err != nil {
+		return kv.IOError("read", vl.filePath(fid), err)
+	}
+	size := int64(len(data))
+	dataLen := int64(0)
+	index := int64(0)
+	for index+8 <= size {
+		err := binary.Read(bytes.NewBuffer(data[index:(index+8)]), binary.LittleEndian, &dataLen)
+		if err != nil {
+			return err
+		}
+		index += 8
+		if index+dataLen > size {
+			return kv.CorruptionError("iterate", vl.filePath(fid), errors.New("value log record is truncated"))
+		}
+		value, err := kv.Decode(data[index:(index + dataLen)])
+		if err != nil {
+			return kv.CorruptionError("iterate", vl.filePath(fid), err)
+		}
+		fn(value.Key, kv.ValuePointer{Fid: fid, Offset: index, Len: dataLen}, value.Value)
+		index += dataLen
+	}
+	return nil
+}
+
+// Remove 删除已经回收的文件，有正在进行的读取时延迟删除
+func (vl *ValueLog) Remove(fid uint32) error {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+
+	if vl.readers > 0 {
+		vl.pending = append(vl.pending, fid)
+		return nil
+	}
+	return vl.removeFile(fid)
+}
+
+func (vl *ValueLog) removeFile(fid uint32) error {
+	log.Println("remove value log file", fid)
+	f, ok := vl.files[fid]
+	if !ok {
+		return nil
+	}
+	delete(vl.files, fid)
+	if err := f.Close(); err != nil {
+		return kv.IOError("close", f.Name(), err)
+	}
+	return kv.IOError("remove", f.Name(), os.Remove(vl.filePath(fid)))
+}
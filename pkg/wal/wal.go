@@ -4,22 +4,67 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"mylsmtree/pkg/kv"
 	"mylsmtree/pkg/sort_tree"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
 
 type Wal struct {
+	// 每次写入后调用 fsync，为 false 时只写入操作系统的缓存，进程崩溃不会丢数据，机器掉电可能丢失最近的写入
+	Sync bool
 	f *os.File
 	path string
+	// 下一个归档文件的编号
+	archiveIndex int
+	// 加载 wal.log 时读到的最大 raft 日志编号
+	raftIndex uint64
 	lock sync.Locker
 }
 
-func (w *Wal) Init(dir string) *sort_tree.Tree {
+// DefaultFamily 默认列族的名字，单条写入和批量写入中没有指定列族的记录都属于默认列族
+const DefaultFamily = "default"
+
+// FamilyBatch 批量写入中属于同一个列族的记录
+type FamilyBatch struct {
+	Values []kv.Value
+	// 批量写入中的范围删除标记
+	RangeTombstones []kv.RangeTombstone `json:",omitempty"`
+}
+
+// batchRecord wal 中的一条批量写入记录
+type batchRecord struct {
+	// 批量写入对应的 raft 日志编号，不经过 raft 的写入为 0
+	Index uint64 `json:",omitempty"`
+	// 默认列族的记录，回放时一起写入内存表
+	FamilyBatch
+	// 其它列族的记录，列族名到记录
+	Families map[string]*FamilyBatch `json:",omitempty"`
+}
+
+// Trees 回放 wal 得到的每个列族的内存表，列族名到内存表
+type Trees map[string]*sort_tree.Tree
+
+// Get 获取列族的内存表，没有时创建一个空的
+func (trees Trees) Get(family string) *sort_tree.Tree {
+	tree, ok := trees[family]
+	if !ok {
+		tree = &sort_tree.Tree{}
+		tree.Init()
+		trees[family] = tree
+	}
+	return tree
+}
+
+// Init 打开 dir 中的 wal.log，返回回放得到的每个列族的内存表
+func (w *Wal) Init(dir string) (Trees, error) {
 	log.Println("loading wal log")
 	start := time.Now()
 	defer func() {
@@ -28,81 +73,112 @@ func (w *Wal) Init(dir string) *sort_tree.Tree {
 	}()
 
 	walPath := path.Join(dir, "wal.log")
+	w.path = walPath
+	w.lock = &sync.Mutex{}
 	f, err := os.OpenFile(walPath, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
 	if err != nil {
-		log.Println("the wal log file cannot create")
-		return nil
+		return nil, kv.IOError("open", walPath, err)
 	}
 	w.f = f
-	w.path = walPath
-	w.lock = &sync.Mutex{}
+	for _, archive := range w.Archives() {
+		index, err := getArchiveIndex(archive)
+		if err == nil && index >= w.archiveIndex {
+			w.archiveIndex = index + 1
+		}
+	}
 	return w.loadToMemory()
 }
 
-func (w *Wal) loadToMemory() *sort_tree.Tree {
+func (w *Wal) loadToMemory() (Trees, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	info, _ := os.Stat(w.path)
-	size := info.Size()
-	tree := &sort_tree.Tree{}
-	tree.Init()
-
-	if size == 0 {
-		return tree
-	}
-
-	_, err := w.f.Seek(0, 0)
+	trees := make(Trees)
+	data, err := ioutil.ReadFile(w.path)
 	if err != nil {
-		log.Println("failure to open the wal log")
-		return nil
+		return nil, kv.IOError("read", w.path, err)
 	}
-
-	defer func(f *os.File, offset int64, whence int) {
-		_, err := f.Seek(offset, whence)
-		if err != nil {
-			log.Println("failure to open wal to send")
-			panic(err)
-		}
-	}(w.f, size-1, 0)
-
-	data := make([]byte, size)
-	_, err = w.f.Read(data)
+	raftIndex, err := loadToTree(data, trees)
 	if err != nil {
-		log.Println("fail to open file to read")
-		return nil
+		return nil, kv.CorruptionError("load", w.path, err)
 	}
+	w.raftIndex = raftIndex
+	return trees, nil
+}
 
+// GetRaftIndex 获取 wal.log 中最大的 raft 日志编号
+func (w *Wal) GetRaftIndex() uint64 {
+	return w.raftIndex
+}
 
+// loadToTree 将 wal 文件内容回放到每个列族的内存表中，返回其中最大的 raft 日志编号。
+// 写入时崩溃可能留下不完整的最后一条记录，这条记录没有返回写入成功，直接忽略；
+// 中间的记录无法解析时返回错误
+func loadToTree(data []byte, trees Trees) (uint64, error) {
+	var raftIndex uint64
+	size := int64(len(data))
 	dataLen := int64(0)
 	index := int64(0)
 	for index < size {
-		indexData := data[index:(index+8)]
-		buf := bytes.NewBuffer(indexData)
-		err := binary.Read(buf, binary.LittleEndian, &dataLen)
-		if err != nil {
-			panic(err)
+		if index+8 > size {
+			log.Println("ignore torn wal record at offset", index)
+			break
 		}
-		index += 8
-		dataArea := data[index:(index+dataLen)]
-		var value kv.Value
-		err = json.Unmarshal(dataArea, &value)
+		err := binary.Read(bytes.NewBuffer(data[index:(index+8)]), binary.LittleEndian, &dataLen)
 		if err != nil {
-			panic(err)
+			return raftIndex, err
+		}
+		if dataLen < 0 {
+			return raftIndex, fmt.Errorf("invalid record length %d at offset %d", dataLen, index)
+		}
+		if index+8+dataLen > size {
+			log.Println("ignore torn wal record at offset", index)
+			break
+		}
+		last := index+8+dataLen == size
+		dataArea := data[(index+8):(index+8+dataLen)]
+		// 记录可以是单条写入，也可以是一个批量写入，先按批量写入解析
+		var r batchRecord
+		if err = json.Unmarshal(dataArea, &r); err != nil {
+			if last {
+				log.Println("ignore torn wal record at offset", index)
+				break
+			}
+			return raftIndex, fmt.Errorf("record at offset %d: %w", index, err)
 		}
 
-		if value.Deleted {
-			tree.Delete(value.Key)
-		}else {
-			tree.Set(value.Key, value.Value)
+		// 删除标记也作为一个版本写入内存表
+		if r.Values != nil || r.RangeTombstones != nil || r.Families != nil {
+			loadBatch(&r.FamilyBatch, trees.Get(DefaultFamily))
+			for family, batch := range r.Families {
+				loadBatch(batch, trees.Get(family))
+			}
+		} else {
+			var value kv.Value
+			if err = json.Unmarshal(dataArea, &value); err != nil {
+				return raftIndex, fmt.Errorf("record at offset %d: %w", index, err)
+			}
+			trees.Get(DefaultFamily).SetValue(value)
+		}
+		if r.Index > raftIndex {
+			raftIndex = r.Index
 		}
-		index = index + dataLen
+		index = index + 8 + dataLen
+	}
+	return raftIndex, nil
+}
 
+// loadBatch 将批量写入中一个列族的记录写入内存表
+func loadBatch(batch *FamilyBatch, tree *sort_tree.Tree) {
+	for _, value := range batch.Values {
+		tree.SetValue(value)
+	}
+	for _, tombstone := range batch.RangeTombstones {
+		tree.AddRangeTombstone(tombstone)
 	}
-	return tree
 }
 
-func (w *Wal) Write(value kv.Value) {
+func (w *Wal) Write(value kv.Value) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
@@ -113,48 +189,174 @@ func (w *Wal) Write(value kv.Value) {
 	}
 
 	data, _ := json.Marshal(value)
-	err := binary.Write(w.f, binary.LittleEndian, int64(len(data)))
-	if err != nil {
-		panic(err)
+	return w.write(data)
+}
+
+// WriteBatch 将批量写入作为一条记录写入 wal，回放时要么全部写入内存表，要么都不写入，
+// raftIndex 为批量写入对应的 raft 日志编号，不经过 raft 时为 0，batches 为列族名到列族中的记录
+func (w *Wal) WriteBatch(raftIndex uint64, batches map[string]*FamilyBatch) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	record := batchRecord{Index: raftIndex}
+	for family, batch := range batches {
+		log.Println("wal log batch", family, len(batch.Values), len(batch.RangeTombstones))
+		if family == DefaultFamily {
+			record.FamilyBatch = *batch
+			continue
+		}
+		if record.Families == nil {
+			record.Families = make(map[string]*FamilyBatch)
+		}
+		record.Families[family] = batch
+	}
+	if record.Values == nil {
+		// 默认列族没有记录时，空数组让回放时能识别为批量写入
+		record.Values = make([]kv.Value, 0)
 	}
+	data, _ := json.Marshal(record)
+	return w.write(data)
+}
 
-	err = binary.Write(w.f, binary.LittleEndian, data)
-	if err != nil {
-		panic(err)
+// write 长度和内容一次写入，写入失败时文件末尾可能留下不完整的记录，回放时会被忽略
+func (w *Wal) write(data []byte) error {
+	if w.f == nil {
+		return kv.IOError("write", w.path, os.ErrClosed)
+	}
+	buf := make([]byte, 8+len(data))
+	binary.LittleEndian.PutUint64(buf, uint64(len(data)))
+	copy(buf[8:], data)
+	if _, err := w.f.Write(buf); err != nil {
+		return kv.IOError("write", w.path, err)
 	}
+	if w.Sync {
+		return kv.IOError("sync", w.path, w.f.Sync())
+	}
+	return nil
 }
 
-func (w *Wal) Reset() {
+func (w *Wal) Reset() error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
 	log.Println("reset wal long file")
-	err := w.f.Close()
-	if err != nil {
-		panic(err)
+	if w.f != nil {
+		err := w.f.Close()
+		w.f = nil
+		if err != nil {
+			return kv.IOError("close", w.path, err)
+		}
 	}
-	w.f = nil
-	err = os.Remove(w.path)
+	err := os.Remove(w.path)
 	if err != nil {
-		panic(err)
+		return kv.IOError("remove", w.path, err)
 	}
 	f, err := os.OpenFile(w.path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0600)
 	if err != nil {
-		panic(err)
+		return kv.IOError("open", w.path, err)
 	}
 	w.f = f
+	return nil
 }
 
+// Rotate 将当前的 wal.log 归档，并重新创建一个空的 wal.log，
+// 返回归档文件的路径，归档文件对应的内存表落盘后再通过 Remove 删除
+func (w *Wal) Rotate() (string, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
+	if w.f != nil {
+		// 归档文件中的记录要等到落盘后才能删除，先同步到磁盘
+		err := w.f.Sync()
+		if closeErr := w.f.Close(); err == nil {
+			err = closeErr
+		}
+		w.f = nil
+		if err != nil {
+			return "", kv.IOError("close", w.path, err)
+		}
+	}
+	archivePath := path.Join(path.Dir(w.path), fmt.Sprintf("wal.%d.log", w.archiveIndex))
+	if _, err := os.Stat(w.path); err == nil {
+		log.Println("rotate wal log file to", archivePath)
+		if err = os.Rename(w.path, archivePath); err != nil {
+			return "", kv.IOError("rename", w.path, err)
+		}
+		w.archiveIndex++
+	} else {
+		// 上一次轮转重命名成功但没能创建新文件，没有需要归档的内容
+		archivePath = ""
+	}
+	f, err := os.OpenFile(w.path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0600)
+	if err != nil {
+		return archivePath, kv.IOError("open", w.path, err)
+	}
+	w.f = f
+	return archivePath, nil
+}
 
+// SyncLog 将 wal.log 同步到磁盘
+func (w *Wal) SyncLog() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
+	if w.f == nil {
+		return kv.IOError("sync", w.path, os.ErrClosed)
+	}
+	return kv.IOError("sync", w.path, w.f.Sync())
+}
 
+// Close 关闭 wal.log
+func (w *Wal) Close() error {
+	if w.lock == nil {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return kv.IOError("close", w.path, err)
+}
 
+// Archives 获取所有尚未删除的归档文件，按从旧到新排列
+func (w *Wal) Archives() []string {
+	matches, err := filepath.Glob(path.Join(path.Dir(w.path), "wal.*.log"))
+	if err != nil {
+		return nil
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, _ := getArchiveIndex(matches[i])
+		b, _ := getArchiveIndex(matches[j])
+		return a < b
+	})
+	return matches
+}
 
+// Load 将归档文件还原为每个列族的内存表，同时返回其中最大的 raft 日志编号
+func (w *Wal) Load(archivePath string) (Trees, uint64, error) {
+	trees := make(Trees)
+	data, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		return nil, 0, kv.IOError("read", archivePath, err)
+	}
+	raftIndex, err := loadToTree(data, trees)
+	if err != nil {
+		return nil, 0, kv.CorruptionError("load", archivePath, err)
+	}
+	return trees, raftIndex, nil
+}
 
+// Remove 删除已经落盘的归档文件
+func (w *Wal) Remove(archivePath string) error {
+	log.Println("remove wal archive", archivePath)
+	return kv.IOError("remove", archivePath, os.Remove(archivePath))
+}
 
-
-
-
-
+func getArchiveIndex(archivePath string) (index int, err error) {
+	_, err = fmt.Sscanf(filepath.Base(archivePath), "wal.%d.log", &index)
+	return index, err
+}
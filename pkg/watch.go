@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrWatchOverflow 订阅者处理事件太慢，缓冲区满后订阅被关闭
+var ErrWatchOverflow = errors.New("watcher fell behind")
+
+// watchBuffer 每个订阅者缓冲的事件数
+const watchBuffer = 256
+
+// WatchEvent 一次写入产生的变更事件，Type 为 BatchPut、BatchDelete、BatchMerge 或 BatchDeleteRange，
+// Merge 的 Value 是合并操作数，DeleteRange 删除 [Start, End) 范围内的 key。过期的 key 不产生事件
+type WatchEvent struct {
+	Type   string
+	Family string
+	Key    string
+	Value  []byte
+	Start  string
+	End    string
+	// 写入分配的序列号，同一个订阅收到的事件序列号递增
+	Seq uint64
+}
+
+// WatchOptions 订阅列族 Family 中以 Prefix 开头的 key 的变更，Family 为空表示默认列族，Prefix 为空表示所有 key
+type WatchOptions struct {
+	Family string
+	Prefix string
+}
+
+// Watcher 一个变更订阅，Events 关闭后 Err 返回关闭的原因
+type Watcher struct {
+	options WatchOptions
+	events  chan WatchEvent
+	db      *DB
+	once    sync.Once
+	err     error
+	// 订阅结束时关闭，结束等待 ctx 的 goroutine
+	done chan struct{}
+}
+
+// Watch 订阅变更，在节点上应用写入后按写入顺序收到事件，集群中每个节点都可以订阅。
+// ctx 被取消、调用 Close、数据库关闭或处理事件太慢时订阅结束
+func Watch(ctx context.Context, options WatchOptions) (*Watcher, error) {
+	db, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return db.Watch(ctx, options)
+}
+
+// Watch 订阅数据库的变更
+func (d *DB) Watch(ctx context.Context, options WatchOptions) (*Watcher, error) {
+	if d.isClosed() {
+		return nil, ErrClosed
+	}
+	options.Family = familyName(options.Family)
+	if _, ok := d.getFamily(options.Family); !ok {
+		return nil, ErrFamilyNotFound
+	}
+	w := &Watcher{
+		options: options,
+		events:  make(chan WatchEvent, watchBuffer),
+		db:      d,
+		done:    make(chan struct{}),
+	}
+	d.watchLock.Lock()
+	d.watchers[w] = struct{}{}
+	d.watchLock.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.stop(ctx.Err())
+		case <-d.closeCh:
+			w.stop(ErrClosed)
+		case <-w.done:
+		}
+	}()
+	return w, nil
+}
+
+// Events 变更事件，订阅结束时关闭
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Err 订阅结束的原因，Events 关闭之前返回 nil
+func (w *Watcher) Err() error {
+	w.db.watchLock.Lock()
+	defer w.db.watchLock.Unlock()
+	return w.err
+}
+
+// Close 结束订阅
+func (w *Watcher) Close() {
+	w.stop(context.Canceled)
+}
+
+func (w *Watcher) stop(err error) {
+	w.once.Do(func() {
+		w.db.watchLock.Lock()
+		defer w.db.watchLock.Unlock()
+		delete(w.db.watchers, w)
+		w.err = err
+		close(w.events)
+		close(w.done)
+	})
+}
+
+// matches 事件是否在订阅的范围内，DeleteRange 和前缀范围有交集时发送
+func (w *Watcher) matches(event WatchEvent) bool {
+	if event.Family != w.options.Family {
+		return false
+	}
+	prefix := w.options.Prefix
+	if prefix == "" {
+		return true
+	}
+	if event.Type != BatchDeleteRange {
+		return strings.HasPrefix(event.Key, prefix)
+	}
+	if event.End != "" && event.End <= prefix {
+		return false
+	}
+	return event.Start <= prefix || strings.HasPrefix(event.Start, prefix)
+}
+
+// watching 是否有订阅者，没有订阅者时写入不生成事件
+func (d *DB) watching() bool {
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+	return len(d.watchers) > 0
+}
+
+// notifyWatchers 把一次写入的变更发给订阅者，调用方持有 writeLock，保证事件按写入顺序发送。
+// 不等待订阅者，缓冲区满的订阅者被关闭
+func (d *DB) notifyWatchers(events []WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+	d.watchLock.Lock()
+	var slow []*Watcher
+	for w := range d.watchers {
+		for _, event := range events {
+			if !w.matches(event) {
+				continue
+			}
+			if !w.send(event) {
+				slow = append(slow, w)
+				break
+			}
+		}
+	}
+	d.watchLock.Unlock()
+	for _, w := range slow {
+		w.stop(ErrWatchOverflow)
+	}
+}
+
+// send 不阻塞地发送事件，缓冲区满时返回 false，调用方持有 watchLock
+func (w *Watcher) send(event WatchEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mylsmtree/pkg/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextEvent 等待下一个事件，订阅结束或超时时失败
+func nextEvent(t *testing.T, w *Watcher) WatchEvent {
+	t.Helper()
+	select {
+	case event, ok := <-w.Events():
+		if !ok {
+			t.Fatalf("watch ended: %v", w.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return WatchEvent{}
+}
+
+// waitClosed 等待订阅结束，返回结束的原因
+func waitClosed(t *testing.T, w *Watcher) error {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-w.Events():
+			if !ok {
+				return w.Err()
+			}
+		case <-timeout:
+			t.Fatal("watch did not end")
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	db := openTestDB(t, nil)
+	w, err := db.Watch(context.Background(), WatchOptions{Prefix: "u/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = db.Put([]byte("x"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("u/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("u/a"); err != nil {
+		t.Fatal(err)
+	}
+	// 和前缀范围没有交集的 DeleteRange 不发送
+	if err = db.DeleteRange("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteRange("t", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var seq uint64
+	for i := 0; i < 3; i++ {
+		event := nextEvent(t, w)
+		if event.Seq <= seq || event.Family != familyName("") {
+			t.Fatalf("event %+v after seq %d", event, seq)
+		}
+		seq = event.Seq
+		got = append(got, fmt.Sprintf("%s %s%s%s %s", event.Type, event.Key, event.Start, event.End, event.Value))
+	}
+	want := "put u/a 1,delete u/a ,delete_range tv "
+	if strings.Join(got, ",") != want {
+		t.Fatalf("events = %q, want %q", strings.Join(got, ","), want)
+	}
+	select {
+	case event := <-w.Events():
+		t.Fatalf("unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestWatchFamily(t *testing.T) {
+	db := openTestDB(t, nil)
+	if _, err := db.Watch(context.Background(), WatchOptions{Family: "missing"}); !errors.Is(err, ErrFamilyNotFound) {
+		t.Fatalf("missing family: got %v, want ErrFamilyNotFound", err)
+	}
+	users, err := db.CreateColumnFamily("users", config.FamilyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := db.Watch(context.Background(), WatchOptions{Family: "users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = db.Put([]byte("k"), []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	if err = users.Put([]byte("k"), []byte("users")); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, w); event.Family != "users" || string(event.Value) != "users" {
+		t.Fatalf("event = %+v", event)
+	}
+}
+
+func TestWatchEnds(t *testing.T) {
+	db := openTestDB(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled, err := db.Watch(ctx, WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := db.Watch(context.Background(), WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := db.Watch(context.Background(), WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err = waitClosed(t, canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled ctx: got %v", err)
+	}
+	closed.Close()
+	closed.Close()
+	if err = waitClosed(t, closed); !errors.Is(err, context.Canceled) {
+		t.Fatalf("closed: got %v", err)
+	}
+
+	// 不读取事件的订阅在缓冲区满后被关闭，不会阻塞写入
+	for i := 0; i <= watchBuffer; i++ {
+		if err = db.Put([]byte(fmt.Sprint("k", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = waitClosed(t, slow); !errors.Is(err, ErrWatchOverflow) {
+		t.Fatalf("slow watcher: got %v, want ErrWatchOverflow", err)
+	}
+	if db.watching() {
+		t.Fatal("watchers are still registered")
+	}
+}
+
+func TestWatchEndsOnClose(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := db.Watch(context.Background(), WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = waitClosed(t, w); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if _, err = db.Watch(context.Background(), WatchOptions{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("watch a closed database: got %v, want ErrClosed", err)
+	}
+}